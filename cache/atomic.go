@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Objects and chroots are written under a temporary name beginning with
+// tmpPrefix in the directory they will be published to. The writer holds
+// an exclusive flock on the temporary file or directory, so temporaries
+// which are not locked were orphaned by a crashed process.
+const tmpPrefix = "."
+
+// lockTemporaries locks the file which orders the creation of temporaries
+// against the removal of orphans. Writers hold a shared lock from creating
+// a temporary until it is locked, and removeOrphans holds an exclusive
+// lock, so a temporary is never mistaken for an orphan before its writer
+// has locked it.
+func (c *Cache) lockTemporaries(how int) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(c.dir, "tmp.lock"), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// PendingObject is an object being written to the cache. Writes go to a
+// temporary file, which is published atomically by Commit. Closing a
+// PendingObject which has not been committed discards it.
+type PendingObject struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// Commit publishes the object at its path in the cache. The object may
+// continue to be read after it is committed.
+func (p *PendingObject) Commit() error {
+	if err := p.File.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.File.Name(), p.path); err != nil {
+		return err
+	}
+	p.committed = true
+	return nil
+}
+
+// Close closes the object, discarding it if it was not committed.
+func (p *PendingObject) Close() error {
+	err := p.File.Close()
+	if !p.committed {
+		os.Remove(p.File.Name())
+	}
+	return err
+}
+
+// PendingChroot is a chroot being populated. The chroot is published
+// atomically by Commit. Closing a PendingChroot which has not been committed
+// discards it.
+type PendingChroot struct {
+	// Path is the directory which should be populated with the contents
+	// of the chroot.
+	Path string
+
+	dest      string
+	lock      *os.File
+	committed bool
+}
+
+// Commit publishes the chroot, replacing any existing chroot with the
+// same hash. If the existing chroot is pinned, Commit waits for it to be
+// unpinned before replacing it.
+func (p *PendingChroot) Commit() error {
+	old, err := lockExisting(p.dest)
+	if err != nil {
+		return err
+	}
+	if old != nil {
+		defer old.Close()
+	}
+
+	trash := p.Path + ".old"
+	if err := os.Rename(p.dest, trash); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	defer os.RemoveAll(trash)
+
+	if err := os.Rename(p.Path, p.dest); err != nil {
+		return err
+	}
+	p.committed = true
+	return nil
+}
+
+// Close releases the chroot, discarding it if it was not committed.
+func (p *PendingChroot) Close() error {
+	err := p.lock.Close()
+	if !p.committed {
+		os.RemoveAll(p.Path)
+	}
+	return err
+}
+
+// NewChroot returns a pending chroot for the given hash, which can be
+// populated and then published by calling Commit.
+func (c *Cache) NewChroot(h []byte) (*PendingChroot, error) {
+	hash := c.hashString(h)
+	dir := filepath.Join(c.dir, "chroots")
+	creating, err := c.lockTemporaries(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer creating.Close()
+
+	p, err := ioutil.TempDir(dir, tmpPrefix+hash+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(p, 0755); err != nil {
+		os.RemoveAll(p)
+		return nil, err
+	}
+	lock, err := lockPath(p, unix.LOCK_EX)
+	if err != nil {
+		os.RemoveAll(p)
+		return nil, err
+	}
+	return &PendingChroot{Path: p, dest: filepath.Join(dir, hash), lock: lock}, nil
+}
+
+// lockExisting acquires an exclusive lock on the directory at p, returning
+// a nil file if it does not exist.
+func lockExisting(p string) (*os.File, error) {
+	for {
+		f, err := lockPath(p, unix.LOCK_EX)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		// The directory may have been replaced while we waited for the lock.
+		s, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if s2, err := os.Stat(p); err == nil && os.SameFile(s, s2) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+func lockPath(p string, how int) (*os.File, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// LockHash acquires an exclusive lock for the given hash, waiting for any
+// other process or goroutine holding it to release it. Builders should hold
+// the lock while producing the object for a hash, so concurrent builders of
+// the same hash can use the output of the first rather than duplicating
+// work.
+func (c *Cache) LockHash(h []byte) (unlock func(), err error) {
+	p := filepath.Join(c.dir, "locks", c.hashString(h))
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// The lock file may have been removed by GC while we waited for
+		// the lock, in which case another caller may hold a new one.
+		s, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if s2, err := os.Stat(p); err == nil && os.SameFile(s, s2) {
+			return func() { f.Close() }, nil
+		}
+		f.Close()
+	}
+}
+
+// removeUnusedLocks removes the lock files of hashes which are not locked.
+func (c *Cache) removeUnusedLocks() error {
+	dir := filepath.Join(c.dir, "locks")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		lock, err := lockPath(p, unix.LOCK_EX|unix.LOCK_NB)
+		if err != nil {
+			if err == unix.EWOULDBLOCK || os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		err = os.Remove(p)
+		lock.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeOrphans removes temporary files and directories left behind by
+// processes which crashed while writing to the cache.
+func (c *Cache) removeOrphans() error {
+	creating, err := c.lockTemporaries(unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer creating.Close()
+
+	dirs := []string{filepath.Join(c.dir, "chroots"), filepath.Join(c.dir, "checks")}
+	hashDirs, err := ioutil.ReadDir(filepath.Join(c.dir, "hash"))
+	if err != nil {
+		return err
+	}
+	for _, d := range hashDirs {
+		if d.IsDir() {
+			dirs = append(dirs, filepath.Join(c.dir, "hash", d.Name()))
+		}
+	}
+
+	for _, dir := range dirs {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !strings.HasPrefix(e.Name(), tmpPrefix) {
+				continue
+			}
+			p := filepath.Join(dir, e.Name())
+			lock, err := lockPath(p, unix.LOCK_EX|unix.LOCK_NB)
+			if err != nil {
+				if err == unix.EWOULDBLOCK || os.IsNotExist(err) {
+					continue // Still being written, or already cleaned up.
+				}
+				return err
+			}
+			err = os.RemoveAll(p)
+			lock.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
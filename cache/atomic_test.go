@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPendingObject(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	h := sha256.Sum256([]byte(t.Name()))
+
+	// Objects which are never committed are discarded.
+	w, err := c.HashWriter(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	if cached, _ := c.IsHashCached(h[:]); cached {
+		t.Error("object is visible before commit")
+	}
+	w.Close()
+	if cached, _ := c.IsHashCached(h[:]); cached {
+		t.Error("object is visible after being discarded")
+	}
+	if _, err := os.Stat(w.Name()); !os.IsNotExist(err) {
+		t.Errorf("temporary file remains after discard: %v", err)
+	}
+
+	w, err = c.HashWriter(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("complete"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("Commit() failed: %v", err)
+	}
+	w.Close()
+	f, err := c.ByHash(h[:])
+	if err != nil {
+		t.Fatalf("ByHash() failed: %v", err)
+	}
+	defer f.Close()
+	if b, _ := ioutil.ReadAll(f); string(b) != "complete" {
+		t.Errorf("object content = %q, want %q", b, "complete")
+	}
+}
+
+func TestPendingChroot(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	h := sha256.Sum256([]byte(t.Name()))
+
+	for _, content := range []string{"first", "second"} {
+		pc, err := c.NewChroot(h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(pc.Path, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if content == "first" {
+			if _, err := c.Chroot(h[:], false); err != ErrCacheMiss {
+				t.Errorf("Chroot() returned %v before commit, want %v", err, ErrCacheMiss)
+			}
+		}
+		if err := pc.Commit(); err != nil {
+			t.Fatalf("Commit() failed: %v", err)
+		}
+		pc.Close()
+
+		p, err := c.Chroot(h[:], false)
+		if err != nil {
+			t.Fatalf("Chroot() failed: %v", err)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(p, "file")); string(b) != content {
+			t.Errorf("chroot content = %q, want %q", b, content)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(c.dir, "chroots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d entries in chroots directory, want 1", len(entries))
+	}
+}
+
+func TestPendingChrootPinned(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	h := sha256.Sum256([]byte(t.Name()))
+
+	if _, err := c.Chroot(h[:], true); err != nil {
+		t.Fatal(err)
+	}
+	unpin, err := c.PinChroot(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := c.NewChroot(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := make(chan struct{})
+	go func() {
+		if err := pc.Commit(); err != nil {
+			t.Errorf("Commit() failed: %v", err)
+		}
+		pc.Close()
+		close(committed)
+	}()
+
+	select {
+	case <-committed:
+		t.Fatal("chroot replaced while pinned")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unpin()
+	select {
+	case <-committed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("chroot not replaced after unpin")
+	}
+
+	if _, err := c.Chroot(h[:], false); err != nil {
+		t.Errorf("Chroot() failed after commit: %v", err)
+	}
+}
+
+func TestLockHash(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	h := sha256.Sum256([]byte(t.Name()))
+
+	unlock, err := c.LockHash(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		unlock, err := c.LockHash(h[:])
+		if err != nil {
+			t.Error(err)
+		} else {
+			unlock()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held elsewhere")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+}
+
+func TestRemoveOrphans(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	h := sha256.Sum256([]byte(t.Name()))
+
+	// A writer which is still running.
+	w, err := c.HashWriter(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// A writer which crashed.
+	orphan := filepath.Join(filepath.Dir(w.Name()), ".orphan.tmp-1")
+	if err := ioutil.WriteFile(orphan, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphanChroot := filepath.Join(c.dir, "chroots", ".orphan.tmp-1")
+	if err := os.Mkdir(orphanChroot, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewCache(c.dir); err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+	for _, p := range []string{orphan, orphanChroot} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("orphan %s was not removed: %v", p, err)
+		}
+	}
+	if _, err := os.Stat(w.Name()); err != nil {
+		t.Errorf("in-progress write was removed: %v", err)
+	}
+}
+
+func TestRemoveOrphansWaitsForCreation(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	// A writer which has created its temporary, but not yet locked it.
+	creating, err := c.lockTemporaries(unix.LOCK_SH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(c.dir, "chroots", ".creating.tmp-1")
+	if err := os.Mkdir(p, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- c.removeOrphans() }()
+	select {
+	case err := <-done:
+		t.Fatalf("removeOrphans() returned %v while a temporary was being created", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock, err := lockPath(p, unix.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	creating.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("removeOrphans() failed: %v", err)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("temporary was removed while being created: %v", err)
+	}
+}
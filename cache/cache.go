@@ -26,6 +26,12 @@ var ErrCacheMiss = errors.New("cache miss")
 type Cache struct {
 	dir      string
 	objCache *lru.TwoQueueCache
+
+	remote     Remote
+	remoteMode RemoteMode
+	// warnings receives messages about problems which do not prevent
+	// the cache from being used, such as an unreachable remote.
+	warnings io.Writer
 }
 
 type ReadSeekCloser interface {
@@ -54,6 +60,10 @@ func (c *Cache) ByName(name string) (io.ReadCloser, error) {
 	return f, err
 }
 
+func (c *Cache) warnf(format string, args ...interface{}) {
+	fmt.Fprintf(c.warnings, "Warning: "+format+"\n", args...)
+}
+
 func (c *Cache) hashString(h []byte) string {
 	s := base64.RawURLEncoding.EncodeToString(h)
 	if len(s) > 36 {
@@ -67,12 +77,21 @@ func (c *Cache) hashPath(h []byte) string {
 	return filepath.Join(c.dir, "hash", hash[:1], hash[1:])
 }
 
+// IsHashCached returns true if the object with the given hash is present
+// in the local cache. If a remote cache is configured, objects missing from
+// the local cache are fetched from it. Failures to use the remote are
+// reported as warnings and treated as a miss, so the caller produces the
+// object itself. Chroots are never fetched from the remote, so callers which
+// need the chroot of a build must check for it separately.
 func (c *Cache) IsHashCached(h []byte) (bool, error) {
 	_, err := os.Stat(c.hashPath(h))
 	switch {
 	case err == nil:
 		return true, nil
 	case os.IsNotExist(err):
+		if c.remote != nil {
+			return c.tryRemote(h), nil
+		}
 		return false, nil
 	default:
 		return false, err
@@ -83,60 +102,127 @@ func (c *Cache) DeleteHash(h []byte) error {
 	return os.Remove(c.hashPath(h))
 }
 
-func (c *Cache) HashWriter(h []byte) (*os.File, error) {
+// HashWriter returns a pending object which can be written and then
+// committed to the cache as the object with the given hash. Readers
+// never observe a partially-written object.
+func (c *Cache) HashWriter(h []byte) (*PendingObject, error) {
 	hash := c.hashString(h)
 	dir := filepath.Join(c.dir, "hash", hash[:1])
 
 	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
-		if err := os.Mkdir(dir, 0755); err != nil {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
 			return nil, err
 		}
 	}
-	return os.OpenFile(filepath.Join(dir, hash[1:]), os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0644)
+	return c.newPendingObject(dir, hash[1:])
+}
+
+// newPendingObject returns a pending object which is published as the
+// file with the given name in dir.
+func (c *Cache) newPendingObject(dir, name string) (*PendingObject, error) {
+	creating, err := c.lockTemporaries(unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	defer creating.Close()
+
+	f, err := ioutil.TempFile(dir, tmpPrefix+name+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &PendingObject{File: f, path: filepath.Join(dir, name)}, nil
+}
+
+// CheckResult returns the cached result of the check with the given key.
+// Check results are kept apart from hashed objects, and are never fetched
+// from or uploaded to a remote cache.
+func (c *Cache) CheckResult(key []byte) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(c.dir, "checks", c.hashString(key)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	if err := touchIfStale(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// CheckResultWriter returns a pending object which can be written and then
+// committed as the result of the check with the given key.
+func (c *Cache) CheckResultWriter(key []byte) (*PendingObject, error) {
+	return c.newPendingObject(filepath.Join(c.dir, "checks"), c.hashString(key))
 }
 
 // ByHash returns a ReadSeekCloser for the given hash if cached.
 // Regardless of whether the hash is cached or not, any directory tree
-// for storing the object is created if it does not exist.
+// for storing the object is created if it does not exist. Objects missing
+// from the local cache are fetched from the remote cache, if one is
+// configured.
 func (c *Cache) ByHash(h []byte) (ReadSeekCloser, error) {
 	hash := c.hashString(h)
 
 	dir := filepath.Join(c.dir, "hash", hash[:1])
 	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
-		if err := os.Mkdir(dir, 0755); err != nil {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
 			return nil, err
 		}
 	}
 
 	f, err := os.Open(filepath.Join(dir, hash[1:]))
 	if err != nil {
-		if os.IsNotExist(err) {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if c.remote == nil {
 			return nil, ErrCacheMiss
 		}
+		if err := c.fetchRemote(h); err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.Join(dir, hash[1:]))
+	}
+
+	if err := touchIfStale(f); err != nil {
+		f.Close()
 		return nil, err
 	}
+	return f, nil
+}
 
+// touchIfStale updates the mod time of f if it is more than 3 hours old.
+// Doing this allows us to use the mod time as a signal for recent use of
+// this cache entry, but avoid unnecessary disk writes that would happen
+// if we unconditionally updated the modtime.
+func touchIfStale(f *os.File) error {
 	s, err := f.Stat()
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
-	// If the mod time is more than 3 hours, we boop it. Doing this
-	// allows us to use the mod time as a signal for recent use of this
-	// cache entry, but avoid unnecessary disk writes that would happen
-	// if we unconditionally updated the modtime.
 	if n := time.Now(); s.ModTime().Add(3 * time.Hour).Before(n) {
 		nt := unix.NsecToTimeval(n.UnixNano())
 		if err := unix.Futimes(int(f.Fd()), []unix.Timeval{nt, nt}); err != nil {
-			f.Close()
-			return nil, fmt.Errorf("failed to update mtime: %v", err)
+			return fmt.Errorf("failed to update mtime: %v", err)
 		}
 	}
-
-	return f, nil
+	return nil
 }
 
-// Clean purges old objects from the cache.
+// Clean purges old objects from the cache, regardless of its size. GC
+// should be preferred where the size of the cache is a concern.
 func (c *Cache) Clean() error {
 	dirs, err := ioutil.ReadDir(filepath.Join(c.dir, "hash"))
 	if err != nil {
@@ -174,30 +260,30 @@ func (c *Cache) Clean() error {
 }
 
 // Chroot returns the path to the base filesystem of the rootFS with that hash.
-// If create is set, the directory will be created if it doesnt exist, and
-// cleared of contents if it does.
+// If create is set, the directory will be replaced with an empty directory.
+// Callers populating a chroot should use NewChroot instead, so the chroot
+// is not observed until it is complete.
 func (c *Cache) Chroot(h []byte, create bool) (string, error) {
 	hash := c.hashString(h)
 	p := filepath.Join(c.dir, "chroots", hash)
 
+	if create {
+		pc, err := c.NewChroot(h)
+		if err != nil {
+			return "", err
+		}
+		defer pc.Close()
+		return p, pc.Commit()
+	}
+
 	s, err := os.Stat(p)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if create {
-				return p, os.Mkdir(p, 0755)
-			}
 			return "", ErrCacheMiss
 		}
 		return "", err
 	}
 
-	if create {
-		if err := os.RemoveAll(p); err != nil {
-			return "", err
-		}
-		return p, os.Mkdir(p, 0755)
-	}
-
 	// If the mod time is more than an hour, we boop it. Doing this
 	// allows us to use the mod time as a signal for recent use of this
 	// cache entry, but avoid unnecessary disk writes that would happen
@@ -245,11 +331,21 @@ func NewCache(dir string) (*Cache, error) {
 	if err := os.MkdirAll(filepath.Join(dir, "chroots"), 0755); err != nil {
 		return nil, err
 	}
+	if err := os.MkdirAll(filepath.Join(dir, "locks"), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "checks"), 0755); err != nil {
+		return nil, err
+	}
 
-	c, err := lru.New2Q(numCachedObjects)
+	oc, err := lru.New2Q(numCachedObjects)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Cache{dir: dir, objCache: c}, nil
+	c := &Cache{dir: dir, objCache: oc, warnings: os.Stderr}
+	if err := c.removeOrphans(); err != nil {
+		return nil, fmt.Errorf("removing orphaned files: %v", err)
+	}
+	return c, nil
 }
@@ -92,6 +92,9 @@ func TestCacheUpdatesModtime(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
 	f.Close()
 
 	if err := os.Chtimes(c.hashPath(ne[:]), time.Now().Add(-24*time.Hour), time.Now().Add(-24*time.Hour)); err != nil {
@@ -3,30 +3,46 @@ package cache
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/crfs/stargz"
+	"golang.org/x/sys/unix"
 )
 
 // PendingFileset implements writing a set of files into the cache
 // as a specific cache hash.
 type PendingFileset struct {
+	c       *Cache
+	hash    []byte
 	tmpFile *os.File
-	f       *os.File
+	f       *PendingObject
 	gzip    *stargz.Writer
 	tar     *tar.Writer
+
+	rootOwned bool
+	rootUID   int
+	rootGID   int
+	// clampTime is the latest modification time recorded for an entry.
+	clampTime time.Time
+	// manifest describes the files written so far.
+	manifest Manifest
 }
 
+// Close finishes writing the fileset and commits it to the cache.
 func (pfs *PendingFileset) Close() error {
 	var err error
-	if err2 := pfs.tar.Close(); err != nil {
+	if err2 := pfs.tar.Close(); err2 != nil {
 		err = err2
 	}
-	if err2 := pfs.tmpFile.Sync(); err != nil {
+	if err2 := pfs.tmpFile.Sync(); err2 != nil {
 		err = err2
 	}
 	if _, err2 := pfs.tmpFile.Seek(0, 0); err2 != nil {
@@ -36,51 +52,149 @@ func (pfs *PendingFileset) Close() error {
 	if err2 := pfs.gzip.AppendTar(pfs.tmpFile); err2 != nil {
 		err = err2
 	}
-	if err2 := pfs.gzip.Close(); err != nil {
+	if err2 := pfs.gzip.Close(); err2 != nil {
 		err = err2
 	}
-	if err2 := pfs.f.Close(); err != nil {
+	if err == nil {
+		err = pfs.f.Commit()
+	}
+	if err2 := pfs.f.Close(); err == nil && err2 != nil {
 		err = err2
 	}
 	pfs.tmpFile.Close()
 	os.Remove(pfs.tmpFile.Name())
-	return err
+	if err != nil {
+		return err
+	}
+	if err := pfs.c.writeManifest(pfs.hash, &pfs.manifest); err != nil {
+		return fmt.Errorf("writing manifest: %v", err)
+	}
+	// The fileset is usable from the local cache regardless of whether
+	// the upload succeeds.
+	if err := pfs.c.uploadRemote(pfs.hash); err != nil {
+		pfs.c.warnf("%v", err)
+	}
+	return nil
 }
 
-func (pfs *PendingFileset) AddSymlink(path string, info os.FileInfo, target string) error {
-	if err := pfs.tar.WriteHeader(&tar.Header{
-		Typeflag: tar.TypeSymlink,
-		Linkname: target,
+// Abort discards the fileset without committing it to the cache.
+func (pfs *PendingFileset) Abort() {
+	pfs.f.Close()
+	pfs.tmpFile.Close()
+	os.Remove(pfs.tmpFile.Name())
+}
+
+// MapOwnerToRoot indicates files owned by the given uid and gid should be
+// recorded as owned by root, such as when they were created by root within
+// a user namespace.
+func (pfs *PendingFileset) MapOwnerToRoot(uid, gid int) {
+	pfs.rootOwned, pfs.rootUID, pfs.rootGID = true, uid, gid
+}
+
+// owner returns the uid and gid of the file described by info.
+func (pfs *PendingFileset) owner(info os.FileInfo) (int, int) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	uid, gid := int(st.Uid), int(st.Gid)
+	if pfs.rootOwned && uid == pfs.rootUID {
+		uid = 0
+	}
+	if pfs.rootOwned && gid == pfs.rootGID {
+		gid = 0
+	}
+	return uid, gid
+}
+
+// ClampModTime indicates entries modified after t should be recorded as
+// modified at t, in the manner of SOURCE_DATE_EPOCH.
+func (pfs *PendingFileset) ClampModTime(t time.Time) {
+	pfs.clampTime = t
+}
+
+// header returns a tar header describing the file, omitting properties of
+// the file which depend on the host or time of the build: only type and
+// permission bits of the mode are kept, the modification time is clamped,
+// and the names of the owner and group are not recorded.
+func (pfs *PendingFileset) header(typ byte, path string, info os.FileInfo) *tar.Header {
+	uid, gid := pfs.owner(info)
+	mt := info.ModTime()
+	if !pfs.clampTime.IsZero() && mt.After(pfs.clampTime) {
+		mt = pfs.clampTime
+	}
+	return &tar.Header{
+		Typeflag: typ,
 		Name:     path,
-		Size:     info.Size(),
-		Mode:     int64(info.Mode()),
-		ModTime:  info.ModTime(),
-	}); err != nil {
-		return fmt.Errorf("writing header: %v", err)
+		Mode:     int64(info.Mode() & (os.ModeType | os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)),
+		Uid:      uid,
+		Gid:      gid,
+		ModTime:  mt.Truncate(time.Second),
 	}
-	return nil
+}
+
+func (pfs *PendingFileset) AddSymlink(path string, info os.FileInfo, target string) error {
+	h := pfs.header(tar.TypeSymlink, path, info)
+	h.Linkname = target
+	return pfs.writeHeader(h)
+}
+
+// AddHardlink adds a hardlink to the file at target, which must have
+// already been added to the fileset.
+func (pfs *PendingFileset) AddHardlink(path string, info os.FileInfo, target string) error {
+	h := pfs.header(tar.TypeLink, path, info)
+	h.Linkname = target
+	return pfs.writeHeader(h)
+}
+
+// AddSpecial adds a device node or FIFO.
+func (pfs *PendingFileset) AddSpecial(path string, info os.FileInfo) error {
+	h := pfs.header(0, path, info)
+	switch m := info.Mode(); {
+	case m&os.ModeNamedPipe != 0:
+		h.Typeflag = tar.TypeFifo
+	case m&os.ModeCharDevice != 0:
+		h.Typeflag = tar.TypeChar
+	case m&os.ModeDevice != 0:
+		h.Typeflag = tar.TypeBlock
+	default:
+		return fmt.Errorf("%s is not a device node or fifo", path)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && h.Typeflag != tar.TypeFifo {
+		h.Devmajor, h.Devminor = int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+	}
+	return pfs.writeHeader(h)
 }
 
 func (pfs *PendingFileset) AddFile(path string, info os.FileInfo, content io.ReadCloser) error {
-	err := pfs.addFile(&tar.Header{
-		Name:    path,
-		Size:    info.Size(),
-		Mode:    int64(info.Mode()),
-		ModTime: info.ModTime(),
-	}, content)
+	h := pfs.header(tar.TypeReg, path, info)
+	h.Size = info.Size()
+	err := pfs.addFile(h, content)
 	if err2 := content.Close(); err == nil && err2 != nil {
 		err = fmt.Errorf("close: %v", err2)
 	}
 	return err
 }
 
+// writeHeader writes the header of an entry without contents, recording it
+// in the manifest.
+func (pfs *PendingFileset) writeHeader(h *tar.Header) error {
+	if err := pfs.tar.WriteHeader(h); err != nil {
+		return fmt.Errorf("writing header: %v", err)
+	}
+	pfs.manifest.Entries = append(pfs.manifest.Entries, manifestEntry(h, nil))
+	return nil
+}
+
 func (pfs *PendingFileset) addFile(h *tar.Header, content io.Reader) error {
 	if err := pfs.tar.WriteHeader(h); err != nil {
 		return fmt.Errorf("writing header: %v", err)
 	}
-	if _, err := io.Copy(pfs.tar, content); err != nil {
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(pfs.tar, digest), content); err != nil {
 		return fmt.Errorf("copy: %v", err)
 	}
+	pfs.manifest.Entries = append(pfs.manifest.Entries, manifestEntry(h, digest.Sum(nil)))
 	return nil
 }
 
@@ -91,49 +205,88 @@ func (c *Cache) CommitFileset(hash []byte) (*PendingFileset, error) {
 	}
 	t, err := ioutil.TempFile("", "")
 	if err != nil {
+		f.Close()
 		return nil, err
 	}
-	return &PendingFileset{f: f, tmpFile: t, gzip: stargz.NewWriter(f), tar: tar.NewWriter(t)}, nil
+	return &PendingFileset{c: c, hash: hash, f: f, tmpFile: t, gzip: stargz.NewWriter(f), tar: tar.NewWriter(t)}, nil
 }
 
 func (c *Cache) FileInFileset(fsHash []byte, fsPath string) (io.Reader, io.Closer, os.FileMode, error) {
-	f, err := c.ByHash(fsHash)
+	f, err := c.OpenInFileset(fsHash, fsPath)
 	if err != nil {
 		return nil, nil, 0, err
 	}
+	return f.SectionReader, f, f.Mode, nil
+}
+
+// FilesetFile is a file opened from a fileset in the cache.
+type FilesetFile struct {
+	*io.SectionReader
+	Mode os.FileMode
+
+	f io.Closer
+}
+
+// Close closes the fileset the file was opened from.
+func (f *FilesetFile) Close() error {
+	return f.f.Close()
+}
+
+// OpenInFileset opens the file at fsPath in the fileset. Unlike the reader
+// returned by FileInFileset, the file supports random access.
+func (c *Cache) OpenInFileset(fsHash []byte, fsPath string) (*FilesetFile, error) {
+	f, err := c.ByHash(fsHash)
+	if err != nil {
+		return nil, err
+	}
 
 	osF, ok := f.(*os.File)
 	if !ok {
-		return nil, nil, 0, fmt.Errorf("expected reader to be *os.File, got %T", f)
+		f.Close()
+		return nil, fmt.Errorf("expected reader to be *os.File, got %T", f)
 	}
 	s, err := osF.Stat()
 	if err != nil {
-		return nil, nil, 0, err
+		f.Close()
+		return nil, err
 	}
 
 	sgz, err := stargz.Open(io.NewSectionReader(f, 0, s.Size()))
 	if err != nil {
-		return nil, nil, 0, fmt.Errorf("reading gzip: %v", err)
+		f.Close()
+		return nil, fmt.Errorf("reading gzip: %v", err)
 	}
 
 	e, ok := sgz.Lookup(fsPath)
 	if !ok {
 		f.Close()
-		return nil, nil, 0, os.ErrNotExist
+		return nil, os.ErrNotExist
 	}
 
 	r, err := sgz.OpenFile(fsPath)
 	if err != nil {
 		f.Close()
-		return nil, nil, 0, fmt.Errorf("reading file: %v", err)
+		return nil, fmt.Errorf("reading file: %v", err)
 	}
 
-	return r, f, os.FileMode(e.Mode), nil
+	return &FilesetFile{SectionReader: r, Mode: os.FileMode(e.Mode), f: f}, nil
+}
+
+// reopen returns a function which opens the file at fsPath in the
+// fileset, for reading after the fileset currently being read is closed.
+func (c *Cache) reopen(fsHash []byte, fsPath string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return c.OpenInFileset(fsHash, fsPath)
+	}
 }
 
 type FilesetReader struct {
 	f    io.Closer
 	tape *tar.Reader
+
+	c       *Cache
+	hash    []byte
+	current *tar.Header
 }
 
 func (fsr *FilesetReader) Close() error {
@@ -148,6 +301,7 @@ func (fsr *FilesetReader) Next() (path string, header *tar.Header, err error) {
 	if h.Name == "stargz.index.json" {
 		return fsr.Next()
 	}
+	fsr.current = h
 	return h.Name, h, nil
 }
 
@@ -155,6 +309,15 @@ func (fsr *FilesetReader) Read(b []byte) (int, error) {
 	return fsr.tape.Read(b)
 }
 
+// Reopen returns a function which opens the content of the current file
+// independently of the reader.
+func (fsr *FilesetReader) Reopen() func() (io.ReadCloser, error) {
+	if fsr.current == nil || fsr.current.Typeflag != tar.TypeReg {
+		return nil
+	}
+	return fsr.c.reopen(fsr.hash, strings.TrimPrefix(fsr.current.Name, "./"))
+}
+
 func (c *Cache) FilesetReader(fsHash []byte) (*FilesetReader, error) {
 	f, err := c.ByHash(fsHash)
 	if err != nil {
@@ -168,6 +331,8 @@ func (c *Cache) FilesetReader(fsHash []byte) (*FilesetReader, error) {
 	return &FilesetReader{
 		f:    f,
 		tape: tar.NewReader(tape),
+		c:    c,
+		hash: fsHash,
 	}, nil
 }
 
@@ -175,12 +340,22 @@ type FilesetDirReader struct {
 	f         io.Closer
 	sgz       *stargz.Reader
 	baseEntry *stargz.TOCEntry
+	c         *Cache
+	hash      []byte
 
 	current *stargz.TOCEntry
 	r       *io.SectionReader
 
 	closing chan struct{}
-	next    chan *stargz.TOCEntry
+	next    chan dirEntry
+	// names records the name each entry was first read as, so further
+	// references to the entry can be read as hardlinks.
+	names map[*stargz.TOCEntry]string
+}
+
+type dirEntry struct {
+	name string
+	ent  *stargz.TOCEntry
 }
 
 func (fsdr *FilesetDirReader) Close() error {
@@ -190,15 +365,16 @@ func (fsdr *FilesetDirReader) Close() error {
 
 func (fsdr *FilesetDirReader) Next() (path string, header *tar.Header, err error) {
 	select {
-	case ent, ok := <-fsdr.next:
+	case de, ok := <-fsdr.next:
 		if !ok {
 			return "", nil, io.EOF
 		}
+		ent := de.ent
 		fsdr.current = ent
 		fsdr.r = nil
 
 		h := tar.Header{
-			Name:     ent.Name,
+			Name:     de.name,
 			Mode:     ent.Mode,
 			Uid:      ent.Uid,
 			Gid:      ent.Gid,
@@ -217,9 +393,25 @@ func (fsdr *FilesetDirReader) Next() (path string, header *tar.Header, err error
 			h.Typeflag = tar.TypeReg
 		case "symlink":
 			h.Typeflag = tar.TypeSymlink
+		case "char":
+			h.Typeflag = tar.TypeChar
+		case "block":
+			h.Typeflag = tar.TypeBlock
+		case "fifo":
+			h.Typeflag = tar.TypeFifo
 		default:
 			return "", nil, fmt.Errorf("unknown entry type: %v", ent.Type)
 		}
+
+		// Entries with multiple names are read in full under the first name
+		// encountered, and as hardlinks to that name thereafter.
+		if ent.Type != "dir" && ent.NumLink > 1 {
+			if first, seen := fsdr.names[ent]; seen {
+				h.Typeflag, h.Linkname, h.Size = tar.TypeLink, first, 0
+			} else {
+				fsdr.names[ent] = de.name
+			}
+		}
 		return h.Name, &h, nil
 	}
 }
@@ -238,16 +430,34 @@ func (fsdr *FilesetDirReader) Read(b []byte) (int, error) {
 	return n, err
 }
 
-func (fsdr *FilesetDirReader) forEachEnt(baseName string, ent *stargz.TOCEntry) bool {
-	if ent.Type == "dir" {
-		ent.ForeachChild(fsdr.forEachEnt)
-	}
-	select {
-	case <-fsdr.closing:
-		return false
-	case fsdr.next <- ent:
+// Reopen returns a function which opens the content of the current file
+// independently of the reader.
+func (fsdr *FilesetDirReader) Reopen() func() (io.ReadCloser, error) {
+	if fsdr.current == nil || fsdr.current.Type != "reg" {
+		return nil
 	}
-	return true
+	return fsdr.c.reopen(fsdr.hash, fsdr.current.Name)
+}
+
+// walk sends each entry below the directory with the given name, returning
+// false if the reader was closed.
+func (fsdr *FilesetDirReader) walk(dirName string, dir *stargz.TOCEntry) bool {
+	open := true
+	dir.ForeachChild(func(baseName string, ent *stargz.TOCEntry) bool {
+		name := path.Join(dirName, baseName)
+		if ent.Type == "dir" && !fsdr.walk(name, ent) {
+			open = false
+			return false
+		}
+		select {
+		case <-fsdr.closing:
+			open = false
+			return false
+		case fsdr.next <- dirEntry{name: name, ent: ent}:
+		}
+		return true
+	})
+	return open
 }
 
 func (c *Cache) FilesetSubdir(fsHash []byte, dirPath string) (*FilesetDirReader, error) {
@@ -278,11 +488,14 @@ func (c *Cache) FilesetSubdir(fsHash []byte, dirPath string) (*FilesetDirReader,
 		f:         f,
 		sgz:       sgz,
 		baseEntry: b,
+		c:         c,
+		hash:      fsHash,
 		closing:   make(chan struct{}),
-		next:      make(chan *stargz.TOCEntry),
+		next:      make(chan dirEntry),
+		names:     make(map[*stargz.TOCEntry]string),
 	}
 	go func() {
-		b.ForeachChild(fsdr.forEachEnt)
+		fsdr.walk(dirPath, b)
 		close(fsdr.next)
 	}()
 	return fsdr, nil
@@ -229,3 +229,37 @@ func TestSubdirFileset(t *testing.T) {
 		t.Errorf("Next() = %v, expected %v", err, io.EOF)
 	}
 }
+
+func TestFilesetAbort(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	pfs, err := c.CommitFileset(createHash[:])
+	if err != nil {
+		t.Fatalf("CommitFileset(%X) failed: %v", createHash, err)
+	}
+	content, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(content.Name())
+	s, err := content.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pfs.AddFile("something.txt", s, content); err != nil {
+		t.Fatalf("AddFile() failed: %v", err)
+	}
+	pfs.Abort()
+
+	if cached, err := c.IsHashCached(createHash[:]); err != nil || cached {
+		t.Errorf("IsHashCached() = %v, %v after Abort(), want false", cached, err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Dir(c.hashPath(createHash[:])))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d entries left behind after Abort(), want 0", len(entries))
+	}
+}
@@ -0,0 +1,299 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// gcStampFile is touched whenever a garbage collection completes, so
+// automatic collections can be rate-limited.
+const gcStampFile = "gc.stamp"
+
+// GCPolicy describes which entries in the cache may be evicted.
+type GCPolicy struct {
+	// MaxBytes is the total size hashed objects, chroots and check results
+	// may occupy before the least-recently-used entries are evicted. If
+	// zero, no entries are evicted.
+	MaxBytes int64
+	// MinAge is the minimum time since an entry was last used before it
+	// may be evicted, regardless of the size of the cache.
+	MinAge time.Duration
+}
+
+// DefaultGCPolicy is a reasonable policy for a developer workstation.
+var DefaultGCPolicy = GCPolicy{
+	MaxBytes: 20 << 30,
+	MinAge:   24 * time.Hour,
+}
+
+// GCStats describes the outcome of a garbage collection.
+type GCStats struct {
+	// Evicted is the number of entries removed from the cache.
+	Evicted int
+	// Pinned is the number of entries which would have been evicted, but
+	// were in use by a running build.
+	Pinned int
+	// BytesReclaimed is the total size of all evicted entries.
+	BytesReclaimed int64
+	// BytesRemaining is the total size of all entries left in the cache.
+	BytesRemaining int64
+}
+
+type gcEntry struct {
+	path    string
+	isDir   bool
+	size    int64
+	lastUse time.Time
+	// chroot is the path of the chroot produced alongside a hashed object,
+	// which is evicted together with the object.
+	chroot string
+}
+
+func dirSize(p string) (int64, error) {
+	var total int64
+	err := filepath.Walk(p, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
+
+func (c *Cache) gcEntries() ([]gcEntry, error) {
+	var out []gcEntry
+	// Objects are indexed by their hash string, so the chroots of root_fs
+	// builds can be grouped with their fileset.
+	byHash := make(map[string]int, 512)
+	dirs, err := ioutil.ReadDir(filepath.Join(c.dir, "hash"))
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		files, err := ioutil.ReadDir(filepath.Join(c.dir, "hash", d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), tmpPrefix) {
+				continue
+			}
+			byHash[d.Name()+f.Name()] = len(out)
+			out = append(out, gcEntry{
+				path:    filepath.Join(c.dir, "hash", d.Name(), f.Name()),
+				size:    f.Size(),
+				lastUse: f.ModTime(),
+			})
+		}
+	}
+
+	checks, err := ioutil.ReadDir(filepath.Join(c.dir, "checks"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range checks {
+		if strings.HasPrefix(f.Name(), tmpPrefix) {
+			continue
+		}
+		out = append(out, gcEntry{
+			path:    filepath.Join(c.dir, "checks", f.Name()),
+			size:    f.Size(),
+			lastUse: f.ModTime(),
+		})
+	}
+
+	roots, err := ioutil.ReadDir(filepath.Join(c.dir, "chroots"))
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if strings.HasPrefix(root.Name(), tmpPrefix) {
+			continue
+		}
+		p := filepath.Join(c.dir, "chroots", root.Name())
+		size, err := dirSize(p)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := byHash[root.Name()]; ok {
+			// A chroot is only useful alongside the fileset of the build
+			// which produced it, so they are used and evicted as one.
+			e := &out[i]
+			e.chroot, e.size = p, e.size+size
+			if root.ModTime().After(e.lastUse) {
+				e.lastUse = root.ModTime()
+			}
+			continue
+		}
+		out = append(out, gcEntry{path: p, isDir: true, size: size, lastUse: root.ModTime()})
+	}
+	return out, nil
+}
+
+// lockForEviction takes an exclusive lock on the file or directory at p,
+// returning a nil file if it no longer exists, and false if it is pinned by
+// a running build.
+func lockForEviction(p string) (*os.File, bool, error) {
+	f, err := lockPath(p, unix.LOCK_EX|unix.LOCK_NB)
+	switch {
+	case err == nil:
+		return f, true, nil
+	case os.IsNotExist(err):
+		return nil, true, nil
+	case err == unix.EWOULDBLOCK:
+		return nil, false, nil
+	}
+	return nil, false, err
+}
+
+// evict removes an entry from the cache, returning false if the entry is
+// pinned by a running build.
+func (c *Cache) evict(e gcEntry) (bool, error) {
+	f, unpinned, err := lockForEviction(e.path)
+	if err != nil || !unpinned {
+		return false, err
+	}
+	if f != nil {
+		defer f.Close()
+	}
+	if e.chroot != "" {
+		root, unpinned, err := lockForEviction(e.chroot)
+		if err != nil || !unpinned {
+			return false, err
+		}
+		if root != nil {
+			defer root.Close()
+		}
+		if err := os.RemoveAll(e.chroot); err != nil {
+			return false, err
+		}
+	}
+	if f == nil {
+		return true, nil
+	}
+
+	if e.isDir {
+		return true, os.RemoveAll(e.path)
+	}
+	return true, os.Remove(e.path)
+}
+
+// GC evicts the least-recently-used hashed objects, chroots and check
+// results from the cache until it fits within the policy. The chroot of a
+// root_fs build is evicted together with its fileset. Entries used more
+// recently than the policy's MinAge, or pinned by a running build, are never
+// evicted. Lock files which are not held are removed regardless.
+func (c *Cache) GC(p GCPolicy) (GCStats, error) {
+	var stats GCStats
+	entries, err := c.gcEntries()
+	if err != nil {
+		return stats, err
+	}
+	for _, e := range entries {
+		stats.BytesRemaining += e.size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+
+	floor := time.Now().Add(-p.MinAge)
+	for _, e := range entries {
+		if p.MaxBytes <= 0 || stats.BytesRemaining <= p.MaxBytes || !e.lastUse.Before(floor) {
+			break
+		}
+		evicted, err := c.evict(e)
+		if err != nil {
+			return stats, err
+		}
+		if !evicted {
+			stats.Pinned++
+			continue
+		}
+		stats.Evicted++
+		stats.BytesReclaimed += e.size
+		stats.BytesRemaining -= e.size
+	}
+
+	if err := c.removeUnusedLocks(); err != nil {
+		return stats, err
+	}
+
+	now := time.Now()
+	stamp := filepath.Join(c.dir, gcStampFile)
+	if err := os.Chtimes(stamp, now, now); err != nil {
+		if !os.IsNotExist(err) {
+			return stats, err
+		}
+		if err := ioutil.WriteFile(stamp, nil, 0644); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// MaybeGC performs a garbage collection if none has completed within the
+// given interval. The returned stats are nil if no collection was needed.
+func (c *Cache) MaybeGC(p GCPolicy, interval time.Duration) (*GCStats, error) {
+	s, err := os.Stat(filepath.Join(c.dir, gcStampFile))
+	switch {
+	case err == nil && s.ModTime().Add(interval).After(time.Now()):
+		return nil, nil
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	}
+
+	stats, err := c.GC(p)
+	if err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *Cache) pin(p string) (func(), error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrCacheMiss
+		}
+		return nil, err
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// The entry may have been evicted while we waited for the lock.
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if s2, err := os.Stat(p); err != nil || !os.SameFile(s, s2) {
+		f.Close()
+		return nil, ErrCacheMiss
+	}
+	return func() { f.Close() }, nil
+}
+
+// Pin marks the cached object with the given hash as in use, so it will not
+// be evicted by a garbage collection in this or any other process until the
+// returned function is called. ErrCacheMiss is returned if the object is not
+// cached.
+func (c *Cache) Pin(h []byte) (unpin func(), err error) {
+	return c.pin(c.hashPath(h))
+}
+
+// PinChroot marks the chroot with the given hash as in use, so it will not
+// be evicted by a garbage collection in this or any other process until the
+// returned function is called. ErrCacheMiss is returned if the chroot does
+// not exist.
+func (c *Cache) PinChroot(h []byte) (unpin func(), err error) {
+	return c.pin(filepath.Join(c.dir, "chroots", c.hashString(h)))
+}
@@ -0,0 +1,224 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	c, err := NewCache(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create entries of 100 bytes each, the oldest first.
+	var hashes [][]byte
+	for i, name := range []string{"oldest", "old", "pinned", "new", "newest"} {
+		h := sha256.Sum256([]byte(name))
+		f, err := c.HashWriter(h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(make([]byte, 100))
+		if err := f.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		mt := time.Now().Add(-time.Duration(10-i) * time.Hour)
+		if name == "newest" {
+			mt = time.Now()
+		}
+		if err := os.Chtimes(c.hashPath(h[:]), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h[:])
+	}
+	chrootHash := sha256.Sum256([]byte("chroot"))
+	p, err := c.Chroot(chrootHash[:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(p, "file"), make([]byte, 50), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mt := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(p, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+
+	unpin, err := c.Pin(hashes[2])
+	if err != nil {
+		t.Fatalf("Pin() failed: %v", err)
+	}
+	defer unpin()
+
+	stats, err := c.GC(GCPolicy{MaxBytes: 1, MinAge: time.Hour})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if stats.Evicted != 4 || stats.Pinned != 1 {
+		t.Errorf("GC() evicted %d entries and skipped %d pinned, want 4 and 1", stats.Evicted, stats.Pinned)
+	}
+	if stats.BytesReclaimed < 350 {
+		t.Errorf("GC() reclaimed %d bytes, want at least 350", stats.BytesReclaimed)
+	}
+	if stats.BytesRemaining != 200 {
+		t.Errorf("GC() left %d bytes, want 200", stats.BytesRemaining)
+	}
+
+	for i, want := range []bool{false, false, true, false, true} {
+		if cached, _ := c.IsHashCached(hashes[i]); cached != want {
+			t.Errorf("IsHashCached(%d) = %v, want %v", i, cached, want)
+		}
+	}
+	if _, err := c.Chroot(chrootHash[:], false); err != ErrCacheMiss {
+		t.Errorf("Chroot() returned %v after GC, want %v", err, ErrCacheMiss)
+	}
+
+	// A collection should not run again so soon.
+	if s, err := c.MaybeGC(GCPolicy{MaxBytes: 1}, time.Hour); s != nil || err != nil {
+		t.Errorf("MaybeGC() = (%v, %v), want (nil, nil)", s, err)
+	}
+}
+
+func TestGCUnderLimit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	c, err := NewCache(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte(t.Name()))
+	f, err := c.HashWriter(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 100))
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	mt := time.Now().Add(-30 * 24 * time.Hour)
+	if err := os.Chtimes(c.hashPath(h[:]), mt, mt); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := c.GC(GCPolicy{MaxBytes: 1000})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if stats.Evicted != 0 || stats.BytesRemaining != 100 {
+		t.Errorf("GC() = %+v, want nothing evicted and 100 bytes remaining", stats)
+	}
+}
+
+func TestGCRootFS(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	old := time.Now().Add(-48 * time.Hour)
+	var hashes [][]byte
+	for _, name := range []string{"evicted", "pinned"} {
+		h := sha256.Sum256([]byte(name))
+		writeTestObject(t, c, h[:], "fileset")
+		if err := os.Chtimes(c.hashPath(h[:]), old, old); err != nil {
+			t.Fatal(err)
+		}
+		p, err := c.Chroot(h[:], true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h[:])
+	}
+
+	// A pinned chroot keeps its fileset, too.
+	unpin, err := c.PinChroot(hashes[1])
+	if err != nil {
+		t.Fatalf("PinChroot() failed: %v", err)
+	}
+	defer unpin()
+
+	stats, err := c.GC(GCPolicy{MaxBytes: 1, MinAge: time.Hour})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if stats.Evicted != 1 || stats.Pinned != 1 {
+		t.Errorf("GC() evicted %d entries and skipped %d pinned, want 1 and 1", stats.Evicted, stats.Pinned)
+	}
+	for i, want := range []bool{false, true} {
+		if cached, _ := c.IsHashCached(hashes[i]); cached != want {
+			t.Errorf("IsHashCached(%d) = %v, want %v", i, cached, want)
+		}
+		_, err := c.Chroot(hashes[i], false)
+		if hasChroot := err == nil; hasChroot != want {
+			t.Errorf("Chroot(%d) returned %v, want present = %v", i, err, want)
+		}
+	}
+}
+
+func TestGCChecksAndLocks(t *testing.T) {
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+
+	key := sha256.Sum256([]byte("check"))
+	w, err := c.CheckResultWriter(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 100))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	p := filepath.Join(c.dir, "checks", c.hashString(key[:]))
+	mt := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(p, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+
+	held, unused := sha256.Sum256([]byte("held")), sha256.Sum256([]byte("unused"))
+	unlock, err := c.LockHash(unused[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if unlock, err = c.LockHash(held[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	stats, err := c.GC(GCPolicy{MaxBytes: 1, MinAge: time.Hour})
+	if err != nil {
+		t.Fatalf("GC() failed: %v", err)
+	}
+	if stats.Evicted != 1 || stats.BytesReclaimed != 100 {
+		t.Errorf("GC() = %+v, want the check result evicted", stats)
+	}
+	if _, err := c.CheckResult(key[:]); err != ErrCacheMiss {
+		t.Errorf("CheckResult() returned %v after GC, want %v", err, ErrCacheMiss)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "locks", c.hashString(unused[:]))); !os.IsNotExist(err) {
+		t.Errorf("unused lock file was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, "locks", c.hashString(held[:]))); err != nil {
+		t.Errorf("held lock file was removed: %v", err)
+	}
+}
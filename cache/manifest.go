@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Types of file described by a manifest entry.
+const (
+	EntryReg      = "reg"
+	EntryDir      = "dir"
+	EntrySymlink  = "symlink"
+	EntryHardlink = "hardlink"
+	EntryChar     = "char"
+	EntryBlock    = "block"
+	EntryFifo     = "fifo"
+)
+
+// ManifestEntry describes a file in a fileset.
+type ManifestEntry struct {
+	Path string      `json:"path"`
+	Type string      `json:"type"`
+	Mode os.FileMode `json:"mode"`
+	Size int64       `json:"size,omitempty"`
+	// SHA256 is the hex-encoded digest of the contents of a regular file.
+	SHA256 string `json:"sha256,omitempty"`
+	// Link is the target of a symlink or hardlink.
+	Link string `json:"link,omitempty"`
+}
+
+// Manifest describes every file in a fileset, ordered by path.
+type Manifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// manifestHash returns the hash the manifest of a fileset is stored as.
+func manifestHash(fsHash []byte) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "fileset manifest\n%x", fsHash)
+	return h.Sum(nil)
+}
+
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return EntryReg
+	case tar.TypeDir:
+		return EntryDir
+	case tar.TypeSymlink:
+		return EntrySymlink
+	case tar.TypeLink:
+		return EntryHardlink
+	case tar.TypeChar:
+		return EntryChar
+	case tar.TypeBlock:
+		return EntryBlock
+	case tar.TypeFifo:
+		return EntryFifo
+	}
+	return fmt.Sprintf("unknown(%q)", typeflag)
+}
+
+// manifestEntry returns the manifest entry for the file described by the
+// tar header. The digest is only recorded for regular files.
+func manifestEntry(h *tar.Header, digest []byte) ManifestEntry {
+	e := ManifestEntry{
+		Path: h.Name,
+		Type: entryType(h.Typeflag),
+		Mode: os.FileMode(h.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+		Link: h.Linkname,
+	}
+	if e.Type == EntryReg {
+		e.Size, e.SHA256 = h.Size, hex.EncodeToString(digest)
+	}
+	return e
+}
+
+// writeManifest commits the manifest of the fileset with the given hash to
+// the cache.
+func (c *Cache) writeManifest(fsHash []byte, m *Manifest) error {
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].Path < m.Entries[j].Path })
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	mh := manifestHash(fsHash)
+	f, err := c.HashWriter(mh)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(d); err != nil {
+		return err
+	}
+	if err := f.Commit(); err != nil {
+		return err
+	}
+	return c.uploadRemote(mh)
+}
+
+// FilesetManifest returns the manifest of the fileset with the given hash.
+// Manifests are written when a fileset is committed, and recomputed from
+// the fileset if missing, such as when the manifest was evicted from the
+// cache.
+func (c *Cache) FilesetManifest(fsHash []byte) (*Manifest, error) {
+	f, err := c.ByHash(manifestHash(fsHash))
+	switch {
+	case err == nil:
+		defer f.Close()
+		var m Manifest
+		if err := json.NewDecoder(f).Decode(&m); err != nil {
+			return nil, fmt.Errorf("decoding manifest: %v", err)
+		}
+		return &m, nil
+	case err != ErrCacheMiss:
+		return nil, err
+	}
+
+	fr, err := c.FilesetReader(fsHash)
+	if err != nil {
+		return nil, err
+	}
+	defer fr.Close()
+	m := &Manifest{}
+	for {
+		_, h, err := fr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		digest := sha256.New()
+		if _, err := io.Copy(digest, fr); err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, manifestEntry(h, digest.Sum(nil)))
+	}
+	return m, c.writeManifest(fsHash, m)
+}
+
+// Types of change between two manifests.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+)
+
+// ManifestChange describes a file which differs between two manifests.
+type ManifestChange struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// Old and New describe the file in each manifest, and are nil if the
+	// file was added or removed respectively.
+	Old *ManifestEntry `json:"old,omitempty"`
+	New *ManifestEntry `json:"new,omitempty"`
+}
+
+// SizeDelta returns the change in size of the file.
+func (c ManifestChange) SizeDelta() int64 {
+	var d int64
+	if c.Old != nil {
+		d -= c.Old.Size
+	}
+	if c.New != nil {
+		d += c.New.Size
+	}
+	return d
+}
+
+// DiffManifests returns the files which were added, removed or changed
+// between the old and new manifests, ordered by path.
+func DiffManifests(old, new *Manifest) []ManifestChange {
+	byPath := make(map[string]*ManifestEntry, len(old.Entries))
+	for i := range old.Entries {
+		byPath[old.Entries[i].Path] = &old.Entries[i]
+	}
+
+	var out []ManifestChange
+	seen := make(map[string]bool, len(new.Entries))
+	for i := range new.Entries {
+		e := &new.Entries[i]
+		seen[e.Path] = true
+		switch o, ok := byPath[e.Path]; {
+		case !ok:
+			out = append(out, ManifestChange{Path: e.Path, Kind: ChangeAdded, New: e})
+		case *o != *e:
+			out = append(out, ManifestChange{Path: e.Path, Kind: ChangeChanged, Old: o, New: e})
+		}
+	}
+	for i := range old.Entries {
+		if e := &old.Entries[i]; !seen[e.Path] {
+			out = append(out, ManifestChange{Path: e.Path, Kind: ChangeRemoved, Old: e})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestManifestEntry(t *testing.T) {
+	tcs := []struct {
+		name   string
+		h      tar.Header
+		digest []byte
+		want   ManifestEntry
+	}{
+		{
+			name:   "file",
+			h:      tar.Header{Typeflag: tar.TypeReg, Name: "bin/ls", Mode: int64(0755 | os.ModeSetuid), Size: 4},
+			digest: []byte{0xca, 0xfe},
+			want:   ManifestEntry{Path: "bin/ls", Type: EntryReg, Mode: 0755 | os.ModeSetuid, Size: 4, SHA256: "cafe"},
+		},
+		{
+			name: "symlink",
+			h:    tar.Header{Typeflag: tar.TypeSymlink, Name: "bin/sh", Mode: int64(0777 | os.ModeSymlink), Linkname: "bash"},
+			want: ManifestEntry{Path: "bin/sh", Type: EntrySymlink, Mode: 0777, Link: "bash"},
+		},
+		{
+			name: "hardlink",
+			h:    tar.Header{Typeflag: tar.TypeLink, Name: "bin/gunzip", Mode: 0755, Linkname: "bin/gzip"},
+			want: ManifestEntry{Path: "bin/gunzip", Type: EntryHardlink, Mode: 0755, Link: "bin/gzip"},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, manifestEntry(&tc.h, tc.digest)); diff != "" {
+				t.Errorf("manifestEntry() differs (+got, -want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFilesetManifestStored(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewCache(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := []byte("fake fileset hash")
+	want := &Manifest{Entries: []ManifestEntry{
+		{Path: "b", Type: EntryReg, Mode: 0644, Size: 2, SHA256: "abcd"},
+		{Path: "a", Type: EntryDir, Mode: 0755},
+	}}
+	if err := c.writeManifest(h, want); err != nil {
+		t.Fatalf("writeManifest() failed: %v", err)
+	}
+	got, err := c.FilesetManifest(h)
+	if err != nil {
+		t.Fatalf("FilesetManifest() failed: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("FilesetManifest() differs (+got, -want):\n%s", diff)
+	}
+	if got.Entries[0].Path != "a" {
+		t.Errorf("manifest is not ordered by path: %+v", got.Entries)
+	}
+	if _, err := c.FilesetManifest([]byte("missing")); err != ErrCacheMiss {
+		t.Errorf("FilesetManifest() of missing fileset returned %v, want %v", err, ErrCacheMiss)
+	}
+}
+
+func TestDiffManifests(t *testing.T) {
+	old := &Manifest{Entries: []ManifestEntry{
+		{Path: "bin/tool", Type: EntryReg, Mode: 0755, Size: 100, SHA256: "01"},
+		{Path: "lib/libold.so", Type: EntryReg, Mode: 0644, Size: 50, SHA256: "02"},
+		{Path: "lib/libsame.so", Type: EntryReg, Mode: 0644, Size: 10, SHA256: "03"},
+		{Path: "lib/libtool.so", Type: EntrySymlink, Mode: 0777, Link: "libtool.so.1"},
+	}}
+	new := &Manifest{Entries: []ManifestEntry{
+		{Path: "bin/tool", Type: EntryReg, Mode: 0755, Size: 120, SHA256: "04"},
+		{Path: "lib/libnew.so", Type: EntryReg, Mode: 0644, Size: 30, SHA256: "05"},
+		{Path: "lib/libsame.so", Type: EntryReg, Mode: 0644, Size: 10, SHA256: "03"},
+		{Path: "lib/libtool.so", Type: EntrySymlink, Mode: 0777, Link: "libtool.so.2"},
+	}}
+
+	changes := DiffManifests(old, new)
+	type change struct {
+		Path, Kind string
+		Delta      int64
+	}
+	var got []change
+	for _, c := range changes {
+		got = append(got, change{c.Path, c.Kind, c.SizeDelta()})
+	}
+	want := []change{
+		{"bin/tool", ChangeChanged, 20},
+		{"lib/libnew.so", ChangeAdded, 30},
+		{"lib/libold.so", ChangeRemoved, -50},
+		{"lib/libtool.so", ChangeChanged, 0},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DiffManifests() differs (+got, -want):\n%s", diff)
+	}
+}
@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RemoteMode describes how a remote cache is used.
+type RemoteMode uint8
+
+// Valid RemoteMode values.
+const (
+	// RemoteReadOnly fetches objects missing from the local cache from the
+	// remote, but never uploads to it.
+	RemoteReadOnly RemoteMode = iota
+	// RemoteReadWrite additionally uploads filesets committed to the local
+	// cache to the remote.
+	RemoteReadWrite
+)
+
+// Remote describes a content-addressed store which can be shared between
+// caches. Objects are keyed by the same string used to name them in the
+// local cache, and are accompanied by the SHA-256 of their contents so they
+// can be verified on download.
+type Remote interface {
+	// Has returns true if the remote has the object with the given key.
+	Has(key string) (bool, error)
+	// Get returns the contents of the object with the given key, and the
+	// SHA-256 the remote claims of those contents. ErrCacheMiss is returned
+	// if the remote does not have the object.
+	Get(key string) (io.ReadCloser, []byte, error)
+	// Put uploads the contents of an object, which have the given SHA-256.
+	Put(key string, content io.Reader, sha256 []byte) error
+}
+
+// UseRemote configures the cache to fall back to the given remote when
+// objects are missing from the local cache.
+func (c *Cache) UseRemote(r Remote, mode RemoteMode) {
+	c.remote = r
+	c.remoteMode = mode
+}
+
+// tryRemote fetches an object from the remote into the local cache,
+// returning false if the remote does not have the object or could not
+// be used.
+func (c *Cache) tryRemote(h []byte) bool {
+	has, err := c.remote.Has(c.hashString(h))
+	if err == nil && has {
+		err = c.fetchRemote(h)
+	}
+	switch {
+	case err == ErrCacheMiss:
+		return false
+	case err != nil:
+		c.warnf("remote cache failed, treating %s as a miss: %v", c.hashString(h), err)
+		return false
+	}
+	return has
+}
+
+// fetchRemote downloads an object from the remote into the local cache,
+// verifying the contents match the digest provided by the remote.
+func (c *Cache) fetchRemote(h []byte) error {
+	hash := c.hashString(h)
+	content, want, err := c.remote.Get(hash)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	w, err := c.HashWriter(h)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, digest), content); err != nil {
+		return fmt.Errorf("downloading %s: %v", hash, err)
+	}
+	if got := digest.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("downloading %s: sha256 mismatch: got %x but remote claimed %x", hash, got, want)
+	}
+	return w.Commit()
+}
+
+// uploadRemote uploads an object in the local cache to the remote, if the
+// remote is writable.
+func (c *Cache) uploadRemote(h []byte) error {
+	if c.remote == nil || c.remoteMode != RemoteReadWrite {
+		return nil
+	}
+	f, err := os.Open(c.hashPath(h))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := c.remote.Put(c.hashString(h), f, digest.Sum(nil)); err != nil {
+		return fmt.Errorf("uploading to remote cache: %v", err)
+	}
+	return nil
+}
+
+// digestHeader is the header used to convey the SHA-256 of an object, in the
+// form described by RFC 3230.
+const digestHeader = "Digest"
+
+func formatDigest(sha256 []byte) string {
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sha256)
+}
+
+func parseDigest(v string) ([]byte, error) {
+	for _, d := range strings.Split(v, ",") {
+		spl := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(spl) == 2 && strings.EqualFold(spl[0], "SHA-256") {
+			return base64.StdEncoding.DecodeString(spl[1])
+		}
+	}
+	return nil, errors.New("no SHA-256 digest present")
+}
+
+// defaultRemoteClient is used by an HTTPRemote without a client, so an
+// unresponsive remote cannot stall a build indefinitely.
+var defaultRemoteClient = &http.Client{
+	Timeout: 10 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// HTTPRemote is a Remote backed by an HTTP server, such as the one
+// implemented by Server. Objects are addressed as <URL>/hash/<key>.
+type HTTPRemote struct {
+	URL string
+	// Client is used to make requests to the server. If nil, a client
+	// with timeouts suitable for transferring filesets is used.
+	Client *http.Client
+}
+
+func (r *HTTPRemote) client() *http.Client {
+	if r.Client != nil {
+		return r.Client
+	}
+	return defaultRemoteClient
+}
+
+func (r *HTTPRemote) objectURL(key string) string {
+	return strings.TrimSuffix(r.URL, "/") + "/hash/" + key
+}
+
+// Has implements Remote.
+func (r *HTTPRemote) Has(key string) (bool, error) {
+	resp, err := r.client().Head(r.objectURL(key))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("remote cache returned %s", resp.Status)
+}
+
+// Get implements Remote.
+func (r *HTTPRemote) Get(key string) (io.ReadCloser, []byte, error) {
+	resp, err := r.client().Get(r.objectURL(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, nil, ErrCacheMiss
+	default:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("remote cache returned %s", resp.Status)
+	}
+
+	digest, err := parseDigest(resp.Header.Get(digestHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("remote cache returned invalid digest: %v", err)
+	}
+	return resp.Body, digest, nil
+}
+
+// Put implements Remote.
+func (r *HTTPRemote) Put(key string, content io.Reader, sha256 []byte) error {
+	req, err := http.NewRequest(http.MethodPut, r.objectURL(key), content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(digestHeader, formatDigest(sha256))
+
+	resp, err := r.client().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("remote cache returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestCache(t *testing.T) (*Cache, func()) {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCache(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatal(err)
+	}
+	return c, func() { os.RemoveAll(tmp) }
+}
+
+func writeTestObject(t *testing.T, c *Cache, h []byte, content string) {
+	t.Helper()
+	f, err := c.HashWriter(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteCache(t *testing.T) {
+	srvDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srvDir)
+	srv, err := NewServer(srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	writer, cleanup := newTestCache(t)
+	defer cleanup()
+	writer.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadWrite)
+	reader, cleanup := newTestCache(t)
+	defer cleanup()
+	reader.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadOnly)
+
+	h := sha256.Sum256([]byte(t.Name()))
+	if cached, err := reader.IsHashCached(h[:]); cached || err != nil {
+		t.Errorf("IsHashCached() = (%v, %v) before upload, want (false, nil)", cached, err)
+	}
+	if _, err := reader.ByHash(h[:]); err != ErrCacheMiss {
+		t.Errorf("ByHash() returned %v before upload, want %v", err, ErrCacheMiss)
+	}
+
+	writeTestObject(t, writer, h[:], "swiggity swooty")
+	if err := writer.uploadRemote(h[:]); err != nil {
+		t.Fatalf("uploadRemote() failed: %v", err)
+	}
+	if cached, err := reader.IsHashCached(h[:]); !cached || err != nil {
+		t.Errorf("IsHashCached() = (%v, %v) after upload, want (true, nil)", cached, err)
+	}
+
+	f, err := reader.ByHash(h[:])
+	if err != nil {
+		t.Fatalf("ByHash() failed: %v", err)
+	}
+	defer f.Close()
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "swiggity swooty" {
+		t.Errorf("object content = (%q, %v), want %q", b, err, "swiggity swooty")
+	}
+	// The object should now be present in the local cache.
+	if _, err := os.Stat(reader.hashPath(h[:])); err != nil {
+		t.Errorf("object was not stored locally: %v", err)
+	}
+
+	// Read-only caches must not upload.
+	other := sha256.Sum256([]byte("read-only"))
+	writeTestObject(t, reader, other[:], "nope")
+	if err := reader.uploadRemote(other[:]); err != nil {
+		t.Fatalf("uploadRemote() failed: %v", err)
+	}
+	if cached, _ := (&HTTPRemote{URL: ts.URL}).Has(reader.hashString(other[:])); cached {
+		t.Error("read-only cache uploaded a fileset")
+	}
+}
+
+func TestRemoteCacheIntegrity(t *testing.T) {
+	h := sha256.Sum256([]byte(t.Name()))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(digestHeader, formatDigest(h[:]))
+		io.WriteString(w, "tampered")
+	}))
+	defer ts.Close()
+
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	c.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadOnly)
+
+	if _, err := c.ByHash(h[:]); err == nil || !strings.Contains(err.Error(), "sha256 mismatch") {
+		t.Errorf("ByHash() returned %v, want sha256 mismatch", err)
+	}
+	if _, err := os.Stat(c.hashPath(h[:])); !os.IsNotExist(err) {
+		t.Errorf("corrupt object was stored locally: %v", err)
+	}
+}
+
+func TestServerRejectsBadDigest(t *testing.T) {
+	srvDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srvDir)
+	srv, err := NewServer(srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	r := &HTTPRemote{URL: ts.URL}
+	wrong := sha256.Sum256([]byte("something else"))
+	if err := r.Put("abcdef", strings.NewReader("content"), wrong[:]); err == nil {
+		t.Error("Put() with incorrect digest succeeded, want error")
+	}
+	if has, err := r.Has("abcdef"); has || err != nil {
+		t.Errorf("Has() = (%v, %v), want (false, nil)", has, err)
+	}
+}
+
+func TestCheckResultsNotRemote(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("check result caused remote request: %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	c.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadWrite)
+
+	key := sha256.Sum256([]byte(t.Name()))
+	if _, err := c.CheckResult(key[:]); err != ErrCacheMiss {
+		t.Errorf("CheckResult() returned %v before write, want %v", err, ErrCacheMiss)
+	}
+	w, err := c.CheckResultWriter(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "passed")
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := c.CheckResult(key[:])
+	if err != nil {
+		t.Fatalf("CheckResult() failed: %v", err)
+	}
+	defer f.Close()
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "passed" {
+		t.Errorf("check result = (%q, %v), want %q", b, err, "passed")
+	}
+	// Check results are kept apart from hashed objects.
+	if _, err := os.Stat(c.hashPath(key[:])); !os.IsNotExist(err) {
+		t.Errorf("check result was stored as a hashed object: %v", err)
+	}
+}
+
+func TestRemoteCacheFailure(t *testing.T) {
+	tcs := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			name: "has",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "broken", http.StatusInternalServerError)
+			},
+		},
+		{
+			name: "get",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					return
+				}
+				http.Error(w, "broken", http.StatusInternalServerError)
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(tc.handler)
+			defer ts.Close()
+			c, cleanup := newTestCache(t)
+			defer cleanup()
+			c.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadOnly)
+			var warnings strings.Builder
+			c.warnings = &warnings
+
+			h := sha256.Sum256([]byte(t.Name()))
+			if cached, err := c.IsHashCached(h[:]); cached || err != nil {
+				t.Errorf("IsHashCached() = (%v, %v), want (false, nil)", cached, err)
+			}
+			if !strings.Contains(warnings.String(), "500") {
+				t.Errorf("warnings = %q, want remote failure", warnings.String())
+			}
+		})
+	}
+}
+
+func TestRemoteUploadFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	c, cleanup := newTestCache(t)
+	defer cleanup()
+	c.UseRemote(&HTTPRemote{URL: ts.URL}, RemoteReadWrite)
+	var warnings strings.Builder
+	c.warnings = &warnings
+
+	h := sha256.Sum256([]byte(t.Name()))
+	pfs, err := c.CommitFileset(h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pfs.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+	if _, err := os.Stat(c.hashPath(h[:])); err != nil {
+		t.Errorf("fileset was not committed locally: %v", err)
+	}
+	if !strings.Contains(warnings.String(), "uploading to remote cache") {
+		t.Errorf("warnings = %q, want upload failure", warnings.String())
+	}
+}
+
+func TestServerStoresDigest(t *testing.T) {
+	srvDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srvDir)
+	srv, err := NewServer(srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	r := &HTTPRemote{URL: ts.URL}
+	want := sha256.Sum256([]byte("content"))
+	if err := r.Put("abcdef", strings.NewReader("content"), want[:]); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	// The digest is served as recorded when the object was stored, rather
+	// than being computed from the stored contents.
+	if err := ioutil.WriteFile(srv.objectPath("abcdef"), []byte("CONTENT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rc, got, err := r.Get("abcdef")
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	rc.Close()
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("Get() digest = %x, want %x", got, want)
+	}
+}
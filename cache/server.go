@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var validKey = regexp.MustCompile("^[A-Za-z0-9_-]{2,64}$")
+
+// Server is a minimal HTTP store of cache objects, suitable for use as an
+// HTTPRemote. Objects are stored as files under a directory.
+type Server struct {
+	dir string
+}
+
+// NewServer returns a server which stores objects under dir.
+func NewServer(dir string) (*Server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Server{dir: dir}, nil
+}
+
+func (s *Server) objectPath(key string) string {
+	return filepath.Join(s.dir, key[:1], key[1:])
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/hash/")
+	if key == r.URL.Path || !validKey.MatchString(key) {
+		http.Error(w, "invalid object path", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		s.serveObject(w, r, key)
+	case http.MethodPut:
+		s.storeObject(w, r, key)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveObject(w http.ResponseWriter, r *http.Request, key string) {
+	f, err := os.Open(s.objectPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	digest, err := s.objectDigest(key, f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(digestHeader, formatDigest(digest))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(st.Size()))
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
+
+// digestPath returns the path of the file storing the SHA-256 of the object
+// with the given key. Keys never contain a '.', so this cannot collide with
+// the path of another object.
+func (s *Server) digestPath(key string) string {
+	return s.objectPath(key) + ".sha256"
+}
+
+// objectDigest returns the SHA-256 of an object, as recorded when it was
+// stored. Objects stored without a digest are hashed, leaving f positioned
+// at the start of the object.
+func (s *Server) objectDigest(key string, f *os.File) ([]byte, error) {
+	if d, err := ioutil.ReadFile(s.digestPath(key)); err == nil && len(d) == sha256.Size {
+		return d, nil
+	}
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+func (s *Server) storeObject(w http.ResponseWriter, r *http.Request, key string) {
+	want, err := parseDigest(r.Header.Get(digestHeader))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid digest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	p := s.objectPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+key[1:]+".")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	digest := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, digest), r.Body); err != nil {
+		tmp.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if got := digest.Sum(nil); !bytes.Equal(got, want) {
+		http.Error(w, fmt.Sprintf("sha256 mismatch: got %x but expected %x", got, want), http.StatusBadRequest)
+		return
+	}
+	// The digest is written first, so it is present for any object
+	// which can be served.
+	if err := writeFileAtomic(s.digestPath(key), want); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// writeFileAtomic replaces the file at p with the given contents, such that
+// readers observe either the old or new contents in full.
+func writeFileAtomic(p string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -7,9 +7,13 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"time"
+	"strings"
 
+	"github.com/twitchylinux/ccr"
 	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/gen"
+	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/common"
 )
 
 var (
@@ -17,8 +21,64 @@ var (
 	dir      = flag.String("contracts-dir", "", "Use the provided directory when reading contracts instead of the working directory.")
 	baseDir  = flag.String("base-dir", "", "Use the provided directory as the base directory instead of the working directory.")
 	resCache *cache.Cache
+	defines  = defineFlags{}
+
+	strictOutputs  = flag.Bool("strict-outputs", false, "Fail any build with an output rule which matches no files, as if every build set strict_outputs.")
+	failUncaptured = flag.Bool("fail-uncaptured", false, "Fail builds which produce files not captured by any output rule, rather than warning about them.")
 )
 
+func init() {
+	flag.Var(defines, "define", "Set a configuration value visible to contracts, in the form key=value. May be repeated.")
+}
+
+// defineFlags collects configuration values set with --define.
+type defineFlags map[string]string
+
+func (d defineFlags) String() string {
+	out := make([]string, 0, len(d))
+	for k, v := range d {
+		out = append(out, k+"="+v)
+	}
+	return strings.Join(out, ",")
+}
+
+func (d defineFlags) Set(v string) error {
+	spl := strings.SplitN(v, "=", 2)
+	if len(spl) != 2 || spl[0] == "" {
+		return fmt.Errorf("invalid define %q: want key=value", v)
+	}
+	d[spl[0]] = spl[1]
+	return nil
+}
+
+// generateConfig returns the configuration specified on the command line.
+func generateConfig() ccr.GenerateConfig {
+	return ccr.GenerateConfig{
+		Defines: defines,
+		OutputChecks: gen.OutputChecks{
+			Strict:         *strictOutputs,
+			FailUncaptured: *failUncaptured,
+		},
+	}
+}
+
+// buildUniverse returns a universe built from the given targets, resolved
+// from the contracts directory.
+func buildUniverse(targets []vts.TargetRef) (*ccr.Universe, error) {
+	uv := ccr.NewUniverse(nil, nil)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
+	findOpts := ccr.FindOptions{
+		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]ccr.CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build(targets, &findOpts, *baseDir); err != nil {
+		return nil, err
+	}
+	return uv, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -32,6 +92,10 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error initializing cache: %v\n", err)
 		os.Exit(1)
 	}
+	if err := configureRemoteCache(resCache); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 
 	if *inline && flag.Arg(0) != "fmt" {
 		fmt.Fprintf(os.Stderr, "Error: %s\n", "--inline may only be specified with the fmt sub-command.")
@@ -43,11 +107,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	if time.Now().Unix()%8 == 0 {
-		if err := resCache.Clean(); err != nil {
+	if flag.Arg(0) != "cache" {
+		stats, err := resCache.MaybeGC(gcPolicy(), autoGCInterval)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error cleaning cache: %v\n", err)
 			os.Exit(1)
 		}
+		if stats != nil && stats.Evicted > 0 {
+			printGCStats(os.Stderr, *stats)
+		}
 	}
 }
 
@@ -63,6 +131,12 @@ func run() error {
 		return doCheckCmd()
 	case "generate":
 		return doGenerateCmd()
+	case "export":
+		return doExportCmd(flag.Arg(1))
+	case "repro-check":
+		return doReproCheckCmd(flag.Arg(1))
+	case "diff":
+		return doDiffCmd(flag.Arg(1), flag.Arg(2))
 	case "debgen":
 		return goDebGenCmd(flag.Arg(1), flag.Arg(2))
 	case "query", "query-by-name", "query-by-class":
@@ -71,6 +145,14 @@ func run() error {
 		return doBuildgenCmd(flag.Arg(1))
 	case "parallel-build", "para-build", "parabuild":
 		return doParabuildCmd(flag.Arg(1))
+	case "graph":
+		return doGraphCmd(flag.Arg(1))
+	case "why":
+		return doWhyCmd(flag.Arg(1), flag.Arg(2))
+	case "rdeps":
+		return doRdepsCmd(flag.Args()[1:])
+	case "cache":
+		return doCacheCmd(flag.Args()[1:])
 	case "":
 		fmt.Fprintf(os.Stderr, "Error: Expected command \"fmt\", \"lint\", \"check\", or \"generate\".\n")
 		os.Exit(1)
@@ -45,7 +45,7 @@ func dumpFilesetContents(h []byte) error {
 func doBuildgenCmd(target string) error {
 	uv := ccr.NewUniverse(nil, resCache)
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
@@ -62,7 +62,7 @@ func doBuildgenCmd(target string) error {
 		return err
 	}
 	fmt.Printf("[%x] %s\n", h, t)
-	if err := uv.Generate(ccr.GenerateConfig{}, vts.TargetRef{Path: target}, *baseDir); err != nil {
+	if err := uv.Generate(generateConfig(), vts.TargetRef{Path: target}, *baseDir); err != nil {
 		return err
 	}
 
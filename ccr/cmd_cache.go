@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/twitchylinux/ccr/cache"
+)
+
+var (
+	cacheMaxBytes = flag.Int64("cache-max-bytes", cache.DefaultGCPolicy.MaxBytes, "Size in bytes the cache may grow to before least-recently-used entries are evicted.")
+	cacheMinAge   = flag.Duration("cache-min-age", cache.DefaultGCPolicy.MinAge, "Cache entries used more recently than this are never evicted.")
+	remoteCache   = flag.String("remote-cache", "", "URL of a remote cache to fetch build outputs from when they are missing from the local cache.")
+	remoteUpload  = flag.Bool("remote-cache-upload", false, "Upload build outputs to the remote cache, as well as fetching them.")
+	cacheListen   = flag.String("listen", "localhost:8080", "Address to listen on. Only valid for the cache serve command.")
+)
+
+// autoGCInterval is how frequently the cache is garbage collected
+// automatically.
+const autoGCInterval = time.Hour
+
+func gcPolicy() cache.GCPolicy {
+	return cache.GCPolicy{
+		MaxBytes: *cacheMaxBytes,
+		MinAge:   *cacheMinAge,
+	}
+}
+
+// configureRemoteCache sets up the remote cache, if one was specified.
+func configureRemoteCache(c *cache.Cache) error {
+	if *remoteCache == "" {
+		if *remoteUpload {
+			return errors.New("--remote-cache-upload requires --remote-cache")
+		}
+		return nil
+	}
+	mode := cache.RemoteReadOnly
+	if *remoteUpload {
+		mode = cache.RemoteReadWrite
+	}
+	c.UseRemote(&cache.HTTPRemote{URL: *remoteCache}, mode)
+	return nil
+}
+
+func printGCStats(w io.Writer, stats cache.GCStats) {
+	fmt.Fprintf(w, "Evicted %d entries, reclaiming %d bytes. %d bytes remain in the cache.\n", stats.Evicted, stats.BytesReclaimed, stats.BytesRemaining)
+	if stats.Pinned > 0 {
+		fmt.Fprintf(w, "Skipped %d entries in use by running builds.\n", stats.Pinned)
+	}
+}
+
+func doCacheCmd(args []string) error {
+	switch {
+	case len(args) == 1 && args[0] == "gc":
+		stats, err := resCache.GC(gcPolicy())
+		if err != nil {
+			return err
+		}
+		printGCStats(os.Stdout, stats)
+		return nil
+	case len(args) == 2 && args[0] == "serve":
+		srv, err := cache.NewServer(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Serving cache objects from %s on %s\n", args[1], *cacheListen)
+		return http.ListenAndServe(*cacheListen, srv)
+	case len(args) == 0:
+		return fmt.Errorf("expected cache sub-command \"gc\" or \"serve\"")
+	}
+	return fmt.Errorf("unknown cache sub-command %q", args[0])
+}
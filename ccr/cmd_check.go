@@ -2,16 +2,30 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/twitchylinux/ccr"
+	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/common"
 )
 
+var noCheckCache = flag.Bool("no-check-cache", false, "For the check command, run every check even if a passing result is cached.")
+
 func doCheckCmd() error {
-	uv := ccr.NewUniverse(nil, nil)
+	var uv *ccr.Universe
+	switch *outputFormat {
+	case "":
+		uv = ccr.NewUniverse(nil, resCache)
+	case "json", "junit":
+		// Failures are only reported in the requested format.
+		uv = ccr.NewUniverse(&log.Silent{}, resCache)
+	default:
+		return fmt.Errorf("unknown check format %q", *outputFormat)
+	}
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
@@ -26,9 +40,30 @@ func doCheckCmd() error {
 	if err := uv.Build(targets, &findOpts, *baseDir); err != nil {
 		return err
 	}
-	if err := uv.Check(targets, *baseDir); err != nil {
+	report, err := uv.CheckWithOptions(targets, *baseDir, ccr.CheckOptions{
+		KeepGoing:   *keepGoing,
+		Workers:     *numWorkers,
+		IgnoreCache: *noCheckCache,
+	})
+	if err != nil {
 		return err
 	}
 
-	return nil
+	switch *outputFormat {
+	case "json":
+		err = report.WriteJSON(os.Stdout)
+	case "junit":
+		err = report.WriteJUnit(os.Stdout)
+	}
+	if err != nil {
+		return err
+	}
+	switch n := len(report.Failures); {
+	case n == 0:
+		return nil
+	case n == 1 && !*keepGoing:
+		return report.Failures[0]
+	default:
+		return fmt.Errorf("%d checks failed", n)
+	}
 }
@@ -12,7 +12,7 @@ import (
 func doCoverageCmd() error {
 	uv := ccr.NewUniverse(nil, nil)
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// isTargetPath returns true if the argument names a target, rather than
+// being a rollup hash.
+func isTargetPath(arg string) bool {
+	return strings.HasPrefix(arg, "//") || strings.Contains(arg, ":")
+}
+
+// parseRollupHash decodes a rollup hash, given in hex or in the base64
+// encoding used to name cache entries.
+func parseRollupHash(s string) ([]byte, error) {
+	if h, err := hex.DecodeString(s); err == nil && len(h) > 0 {
+		return h, nil
+	}
+	if h, err := base64.RawURLEncoding.DecodeString(s); err == nil && len(h) > 0 {
+		return h, nil
+	}
+	return nil, fmt.Errorf("%q is neither a target nor a rollup hash", s)
+}
+
+// describeChange summarizes how a changed file differs.
+func describeChange(c cache.ManifestChange) string {
+	var out []string
+	o, n := c.Old, c.New
+	if o.Type != n.Type {
+		out = append(out, fmt.Sprintf("type %s -> %s", o.Type, n.Type))
+	}
+	if o.Mode != n.Mode {
+		out = append(out, fmt.Sprintf("mode %v -> %v", o.Mode, n.Mode))
+	}
+	if o.Link != n.Link {
+		out = append(out, fmt.Sprintf("link %q -> %q", o.Link, n.Link))
+	}
+	if o.SHA256 != n.SHA256 {
+		out = append(out, "content")
+	}
+	return strings.Join(out, ", ")
+}
+
+func doDiffCmd(a, b string) error {
+	if a == "" || b == "" {
+		return errors.New("expected two builds or rollup hashes to compare")
+	}
+
+	var targets []vts.TargetRef
+	for _, arg := range []string{a, b} {
+		if isTargetPath(arg) {
+			targets = append(targets, vts.TargetRef{Path: arg})
+		}
+	}
+	hashOf := parseRollupHash
+	if len(targets) > 0 {
+		uv, err := buildUniverse(targets)
+		if err != nil {
+			return err
+		}
+		hashOf = func(arg string) ([]byte, error) {
+			if isTargetPath(arg) {
+				return uv.TargetRollupHash(arg)
+			}
+			return parseRollupHash(arg)
+		}
+	}
+
+	var manifests [2]*cache.Manifest
+	for i, arg := range []string{a, b} {
+		h, err := hashOf(arg)
+		if err != nil {
+			return err
+		}
+		if manifests[i], err = resCache.FilesetManifest(h); err != nil {
+			if err == cache.ErrCacheMiss {
+				return fmt.Errorf("%s has not been built", arg)
+			}
+			return fmt.Errorf("%s: %v", arg, err)
+		}
+	}
+	changes := cache.DiffManifests(manifests[0], manifests[1])
+
+	switch *outputFormat {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	case "":
+	default:
+		return fmt.Errorf("unknown diff format %q", *outputFormat)
+	}
+
+	var added, removed, changed int
+	var delta int64
+	for _, c := range changes {
+		delta += c.SizeDelta()
+		switch c.Kind {
+		case cache.ChangeAdded:
+			added++
+			fmt.Printf("\033[1;32m+\033[0m %s (%d bytes)\n", c.Path, c.New.Size)
+		case cache.ChangeRemoved:
+			removed++
+			fmt.Printf("\033[1;31m-\033[0m %s (%d bytes)\n", c.Path, c.Old.Size)
+		case cache.ChangeChanged:
+			changed++
+			fmt.Printf("\033[1;33m~\033[0m %s (%+d bytes): %s\n", c.Path, c.SizeDelta(), describeChange(c))
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d changed, %+d bytes\n", added, removed, changed, delta)
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/twitchylinux/ccr"
+	"github.com/twitchylinux/ccr/export"
+	"github.com/twitchylinux/ccr/log"
+	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/common"
+)
+
+var (
+	exportOutput = flag.String("output", "", "For the export command, the file to write the archive to. Defaults to standard output.")
+)
+
+// exportModTime returns the timestamp of files in exported archives, which
+// is taken from SOURCE_DATE_EPOCH if set, or the unix epoch otherwise.
+func exportModTime() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		return time.Unix(0, 0), nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func doExportCmd(target string) error {
+	if target == "" {
+		return errors.New("expected target to export")
+	}
+	format, err := export.ParseFormat(*outputFormat)
+	if err != nil {
+		return err
+	}
+	modTime, err := exportModTime()
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *exportOutput != "" {
+		if out, err = os.Create(*exportOutput); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	// Progress is reported on stderr, as stdout may hold the archive.
+	uv := ccr.NewUniverse(log.NewConsole(os.Stderr, os.Stderr), resCache)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
+	findOpts := ccr.FindOptions{
+		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]ccr.CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: target}}, &findOpts, *baseDir); err != nil {
+		return err
+	}
+	if err := uv.Export(generateConfig(), vts.TargetRef{Path: target}, out, export.Options{
+		Format:  format,
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	if *exportOutput != "" {
+		return out.Close()
+	}
+	return nil
+}
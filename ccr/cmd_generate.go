@@ -11,7 +11,7 @@ import (
 func doGenerateCmd() error {
 	uv := ccr.NewUniverse(nil, resCache)
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
@@ -22,7 +22,7 @@ func doGenerateCmd() error {
 	if err := uv.Build([]vts.TargetRef{{Path: flag.Arg(1)}}, &findOpts, *baseDir); err != nil {
 		return err
 	}
-	if err := uv.Generate(ccr.GenerateConfig{}, vts.TargetRef{Path: flag.Arg(1)}, *baseDir); err != nil {
+	if err := uv.Generate(generateConfig(), vts.TargetRef{Path: flag.Arg(1)}, *baseDir); err != nil {
 		return err
 	}
 
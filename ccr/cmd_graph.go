@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/twitchylinux/ccr"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+var (
+	outputFormat    = flag.String("format", "", "Output format. For the graph command, one of dot (the default), json or graphml. For the query command, json or a list of targets (the default). For the check command, json or junit. For the export command, one of tar (the default), cpio-newc or oci. For the diff command, json or a list of changes (the default).")
+	graphTypes      = flag.String("types", "", "Comma-separated list of target types to include in the graph. Defaults to all types.")
+	collapseClasses = flag.Bool("collapse-classes", false, "Omit instances of class targets from the graph.")
+	graphDepth      = flag.Int("depth", 0, "Maximum number of edges from the root target to include in the graph. Zero means unlimited.")
+)
+
+func graphOptions() (ccr.GraphOptions, error) {
+	opts := ccr.GraphOptions{
+		CollapseClasses: *collapseClasses,
+		MaxDepth:        *graphDepth,
+	}
+	if *graphTypes != "" {
+		for _, name := range strings.Split(*graphTypes, ",") {
+			tt, err := vts.ParseTargetType(strings.TrimSpace(name))
+			if err != nil {
+				return opts, err
+			}
+			opts.Types = append(opts.Types, tt)
+		}
+	}
+	return opts, nil
+}
+
+func doGraphCmd(target string) error {
+	if target == "" {
+		return errors.New("no target specified")
+	}
+	opts, err := graphOptions()
+	if err != nil {
+		return err
+	}
+
+	uv, err := buildUniverse([]vts.TargetRef{{Path: target}})
+	if err != nil {
+		return err
+	}
+
+	g, err := uv.Graph(vts.TargetRef{Path: target}, opts)
+	if err != nil {
+		return err
+	}
+	return g.Write(os.Stdout, *outputFormat)
+}
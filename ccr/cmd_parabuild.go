@@ -4,7 +4,6 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
-	"sync"
 
 	"github.com/twitchylinux/ccr"
 	"github.com/twitchylinux/ccr/gen"
@@ -14,15 +13,16 @@ import (
 )
 
 var (
-	planOnly            = flag.Bool("plan", false, "Print the build plan then exit. Only valid for the para-build command.")
-	numParabuildWorkers = flag.Int("workers", 3, "Number of workers. Only valid fro the para-build command.")
+	planOnly   = flag.Bool("plan", false, "Print the build plan then exit. Only valid for the para-build command.")
+	numWorkers = flag.Int("workers", 3, "Number of workers. For the para-build command, the number of concurrent builds. For the check command, the number of concurrent checks.")
+	keepGoing  = flag.Bool("keep-going", false, "Continue after a failure. For the para-build command, targets which do not depend on a failed build are still built. For the check command, every failing check is reported.")
 )
 
 func doParabuildCmd(target string) error {
 	console := &log.Console{}
 	uv := ccr.NewUniverse(console, resCache)
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
@@ -34,7 +34,11 @@ func doParabuildCmd(target string) error {
 		return err
 	}
 
-	out, err := uv.TargetsDependencyOrder(ccr.GenerateConfig{}, vts.TargetRef{Path: target}, *baseDir, vts.TargetBuild)
+	graph, err := uv.DependencyGraph(generateConfig(), vts.TargetRef{Path: target}, *baseDir, vts.TargetBuild)
+	if err != nil {
+		return err
+	}
+	out, err := graph.Phases()
 	if err != nil {
 		return err
 	}
@@ -46,49 +50,44 @@ func doParabuildCmd(target string) error {
 		return nil
 	}
 
-	for i := range out {
-		fmt.Printf("\033[1;31mCommencing phase %d\033[0m\n", i+1)
-
-		var (
-			wg   sync.WaitGroup
-			work = make(chan *vts.Build)
-			errC = make(chan error, 200)
-		)
-		wg.Add(*numParabuildWorkers)
-		for n := 0; n < *numParabuildWorkers; n++ {
-			go buildWorker(&wg, uv, target, work, errC, console)
+	res := graph.Execute(ccr.ScheduleOptions{
+		Workers:   *numWorkers,
+		KeepGoing: *keepGoing,
+		OnStart: func(t vts.Target) {
+			fmt.Printf("\033[1;31mCommencing build\033[0m %s\n", t.(*vts.Build).GlobalPath())
+		},
+	}, func(t vts.Target) error {
+		gc := gen.GenerationContext{
+			Cache:        resCache,
+			RunnerEnv:    uv.MakeEnv(*baseDir),
+			Console:      console,
+			OutputChecks: generateConfig().OutputChecks,
 		}
-
-		for _, t := range out[i] {
-			select {
-			case err := <-errC:
-				close(work)
-				return err
-			case work <- t.(*vts.Build):
-			}
+		if err := gen.Generate(gc, t.(*vts.Build)); err != nil {
+			return fmt.Errorf("generate failed: %v", err)
 		}
-		close(work)
-		wg.Wait()
-	}
+		return nil
+	})
 
-	return nil
+	if len(res.Failed) > 0 {
+		printBuildSummary(res)
+	}
+	return res.Err()
 }
 
-func buildWorker(wg *sync.WaitGroup, uv *ccr.Universe, target string, work chan *vts.Build, errC chan error, console *log.Console) {
-	defer wg.Done()
-	env := uv.MakeEnv(*baseDir)
-
-	for target := range work {
-		gc := gen.GenerationContext{
-			Cache:     resCache,
-			RunnerEnv: env,
-			Console:   console,
-		}
-		if err := gen.Generate(gc, target); err != nil {
-			errC <- fmt.Errorf("generate failed: %v", err)
-			return
+func printBuildSummary(res *ccr.ScheduleResult) {
+	fmt.Printf("\n\033[1;31m%d builds failed\033[0m, %d skipped, %d succeeded:\n", len(res.Failed), len(res.Skipped), len(res.Completed))
+	for _, t := range res.FailedTargets() {
+		fmt.Printf("  \033[1;31m✖\033[0m \033[1;33m%s\033[0m: %v\n", t.(*vts.Build).GlobalPath(), res.Failed[t])
+	}
+	for _, t := range res.SkippedTargets() {
+		if cause := res.Skipped[t]; cause != nil {
+			fmt.Printf("  \033[1;34m-\033[0m \033[1;33m%s\033[0m: skipped, depends on %s\n", t.(*vts.Build).GlobalPath(), cause.(*vts.Build).GlobalPath())
+		} else {
+			fmt.Printf("  \033[1;34m-\033[0m \033[1;33m%s\033[0m: skipped\n", t.(*vts.Build).GlobalPath())
 		}
 	}
+	fmt.Println()
 }
 
 func printBuildPlan(uv *ccr.Universe, out [][]vts.Target) error {
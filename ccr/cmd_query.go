@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/twitchylinux/ccr"
@@ -12,10 +13,49 @@ import (
 	"go.starlark.net/starlark"
 )
 
+// isAttrQuery returns true if the argument to the query command is of the
+// form target%attr, rather than a query expression.
+func isAttrQuery(arg string) bool {
+	return strings.Contains(arg, "%") && !strings.Contains(arg, "(")
+}
+
+func doQueryExprCmd(expr string, roots []string) error {
+	q, err := ccr.ParseQuery(expr)
+	if err != nil {
+		return err
+	}
+	var targets []vts.TargetRef
+	for _, p := range append(q.TargetPaths(), roots...) {
+		targets = append(targets, vts.TargetRef{Path: p})
+	}
+	uv, err := buildUniverse(targets)
+	if err != nil {
+		return err
+	}
+
+	matches, err := uv.Query(*baseDir, q)
+	if err != nil {
+		return err
+	}
+	switch *outputFormat {
+	case "json":
+		return uv.WriteQueryJSON(os.Stdout, *baseDir, matches)
+	case "":
+		for _, t := range matches {
+			fmt.Println(t.GlobalPath())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown query format %q", *outputFormat)
+}
+
 func doQueryCmd(targetAttr string) error {
+	if flag.Arg(0) == "query" && targetAttr != "" && !isAttrQuery(targetAttr) {
+		return doQueryExprCmd(targetAttr, flag.Args()[2:])
+	}
 	uv := ccr.NewUniverse(nil, nil)
 
-	dr := ccr.NewDirResolver(*dir)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
 	findOpts := ccr.FindOptions{
 		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
 		PrefixResolvers: map[string]ccr.CCRResolver{
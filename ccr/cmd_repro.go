@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twitchylinux/ccr"
+	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/common"
+)
+
+func doReproCheckCmd(target string) error {
+	if target == "" {
+		return errors.New("expected a build target to check")
+	}
+	uv := ccr.NewUniverse(nil, resCache)
+	dr := ccr.NewDirResolverWithConfig(*dir, generateConfig())
+	findOpts := ccr.FindOptions{
+		FallbackResolvers: []ccr.CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]ccr.CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: target}}, &findOpts, *baseDir); err != nil {
+		return err
+	}
+
+	diffs, err := uv.ReproCheck(generateConfig(), vts.TargetRef{Path: target}, *baseDir)
+	if err != nil {
+		return err
+	}
+	if len(diffs) == 0 {
+		fmt.Printf("%s is reproducible.\n", target)
+		return nil
+	}
+	for _, d := range diffs {
+		fmt.Printf("\033[1;31m%s\033[0m\n  %s\n", d.Path, strings.ReplaceAll(d.Summary, "\n", "\n  "))
+	}
+	return fmt.Errorf("%d file(s) differ between builds of %s", len(diffs), target)
+}
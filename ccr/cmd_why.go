@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/twitchylinux/ccr/vts"
+)
+
+var whyAll = flag.Bool("all", false, "For the why command, print every dependency chain rather than only the shortest.")
+
+func doWhyCmd(from, to string) error {
+	if from == "" || to == "" {
+		return errors.New("expected a target to start from and a target to explain")
+	}
+	fromRef, toRef := vts.TargetRef{Path: from}, vts.TargetRef{Path: to}
+	uv, err := buildUniverse([]vts.TargetRef{fromRef, toRef})
+	if err != nil {
+		return err
+	}
+
+	paths, err := uv.Why(fromRef, toRef, *whyAll)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("%s does not depend on %s", from, to)
+	}
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+	return nil
+}
+
+func doRdepsCmd(args []string) error {
+	if len(args) == 0 {
+		return errors.New("no target specified")
+	}
+	// The universe is enumerated from the target and any further targets
+	// provided, so dependents outside of those are not reported.
+	targets := make([]vts.TargetRef, len(args))
+	for i, arg := range args {
+		targets[i] = vts.TargetRef{Path: arg}
+	}
+	uv, err := buildUniverse(targets)
+	if err != nil {
+		return err
+	}
+
+	paths, err := uv.ReverseDeps(targets[0])
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		fmt.Println(p.StringWithKinds())
+	}
+	return nil
+}
@@ -83,6 +83,10 @@ func PkgReader(c *cache.Cache, sha256 []byte, url string) (cache.ReadSeekCloser,
 		w.Close()
 		return nil, err
 	}
+	if err := w.Commit(); err != nil {
+		w.Close()
+		return nil, err
+	}
 	w.Seek(0, os.SEEK_SET)
 	return w, nil
 }
@@ -0,0 +1,368 @@
+package ccr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// checkCacheVersion is mixed into the key of every cached check result, and
+// should be incremented when the meaning of a cached result changes.
+const checkCacheVersion = 1
+
+// fsAccess describes how a checker accessed a path.
+type fsAccess uint8
+
+// Valid fsAccess bits.
+const (
+	accessStat fsAccess = 1 << iota
+	accessRead
+	accessList
+)
+
+// recordingFS is a filesystem which records the paths accessed through it.
+type recordingFS struct {
+	billy.Filesystem
+
+	mu    sync.Mutex
+	paths map[string]fsAccess
+	// deps holds the recordings of other targets whose runtime information
+	// was used, as the paths read to populate it were accessed through them.
+	deps []*recordingFS
+}
+
+func newRecordingFS(fs billy.Filesystem) *recordingFS {
+	return &recordingFS{Filesystem: fs, paths: make(map[string]fsAccess, 8)}
+}
+
+func (fs *recordingFS) record(path string, access fsAccess) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.paths[filepath.Clean(path)] |= access
+}
+
+// addDep indicates the paths accessed through dep should be considered
+// accessed through fs as well.
+func (fs *recordingFS) addDep(dep *recordingFS) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if dep == fs {
+		return
+	}
+	for _, d := range fs.deps {
+		if d == dep {
+			return
+		}
+	}
+	fs.deps = append(fs.deps, dep)
+}
+
+// accessed returns a snapshot of the paths accessed so far, including those
+// accessed through dependencies.
+func (fs *recordingFS) accessed() map[string]fsAccess {
+	out := make(map[string]fsAccess, 8)
+	fs.collect(out, make(map[*recordingFS]bool, 2))
+	return out
+}
+
+func (fs *recordingFS) collect(out map[string]fsAccess, seen map[*recordingFS]bool) {
+	if seen[fs] {
+		return
+	}
+	seen[fs] = true
+
+	fs.mu.Lock()
+	for p, a := range fs.paths {
+		out[p] |= a
+	}
+	deps := append([]*recordingFS(nil), fs.deps...)
+	fs.mu.Unlock()
+	for _, d := range deps {
+		d.collect(out, seen)
+	}
+}
+
+func (fs *recordingFS) Open(filename string) (billy.File, error) {
+	fs.record(filename, accessRead)
+	return fs.Filesystem.Open(filename)
+}
+
+func (fs *recordingFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	fs.record(filename, accessRead)
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (fs *recordingFS) Stat(filename string) (os.FileInfo, error) {
+	fs.record(filename, accessStat)
+	return fs.Filesystem.Stat(filename)
+}
+
+func (fs *recordingFS) Lstat(filename string) (os.FileInfo, error) {
+	fs.record(filename, accessStat)
+	return fs.Filesystem.Lstat(filename)
+}
+
+func (fs *recordingFS) Readlink(link string) (string, error) {
+	fs.record(link, accessStat)
+	return fs.Filesystem.Readlink(link)
+}
+
+func (fs *recordingFS) ReadDir(path string) ([]os.FileInfo, error) {
+	fs.record(path, accessList)
+	return fs.Filesystem.ReadDir(path)
+}
+
+// fingerprintPath summarizes the state of a path, such that the
+// fingerprint changes if anything observed by the given access changes.
+func fingerprintPath(fs billy.Filesystem, path string, access fsAccess) (string, error) {
+	hash := sha256.New()
+	describe := func(st os.FileInfo) {
+		fmt.Fprintf(hash, "%v %d %d", st.Mode(), st.Size(), st.ModTime().UnixNano())
+		if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+			fmt.Fprintf(hash, " %d:%d %d", sys.Uid, sys.Gid, sys.Rdev)
+		}
+		fmt.Fprintln(hash)
+	}
+
+	st, err := fs.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		fmt.Fprintln(hash, "absent")
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	case err != nil:
+		return "", err
+	}
+	describe(st)
+
+	if st.Mode()&os.ModeSymlink != 0 {
+		link, err := fs.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "link: %q\n", link)
+		if st, err = fs.Stat(path); err != nil {
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+			fmt.Fprintln(hash, "dangling")
+			return hex.EncodeToString(hash.Sum(nil)), nil
+		}
+		describe(st)
+	}
+
+	switch {
+	case st.IsDir() && access&accessList != 0:
+		entries, err := fs.ReadDir(path)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range entries {
+			fmt.Fprintf(hash, "%q ", e.Name())
+			describe(e)
+		}
+	case st.Mode().IsRegular() && access&accessRead != 0:
+		f, err := fs.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if _, err := io.Copy(hash, f); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type checkCacheFile struct {
+	Path        string   `json:"path"`
+	Access      fsAccess `json:"access"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+// checkCacheEntry records a passing check, and the state of the files the
+// check read.
+type checkCacheEntry struct {
+	Files []checkCacheFile `json:"files"`
+}
+
+// checkResults persists the outcome of passing checks in the cache, so they
+// need not be run again while the checked target and the files it reads
+// are unchanged. Results are only stored locally.
+type checkResults struct {
+	cache *cache.Cache
+	// fs is the filesystem of the checked system, without recording.
+	fs billy.Filesystem
+	// ignore is true if checks should run even if their result is cached.
+	ignore bool
+
+	mu sync.Mutex
+	// envs holds the environment for checks against each target. Checks
+	// against the same target share runtime information, so they share a
+	// recording of the paths read as well.
+	envs      map[vts.Target]*vts.RunnerEnv
+	defHashes map[string][]byte
+}
+
+func newCheckResults(c *cache.Cache, env *vts.RunnerEnv, ignore bool) *checkResults {
+	return &checkResults{
+		cache:     c,
+		fs:        env.FS,
+		ignore:    ignore,
+		envs:      make(map[vts.Target]*vts.RunnerEnv, 128),
+		defHashes: make(map[string][]byte, 16),
+	}
+}
+
+// envFor returns the environment which checks against t should use.
+//
+// Runtime information about a target is populated once, by whichever check
+// needs it first. Populators therefore run in the environment of the target
+// they populate, so the paths they read are recorded against that target
+// regardless of which check triggered them. Checks which use the runtime
+// information of another target depend on the paths recorded for it.
+func (r *checkResults) envFor(t vts.Target, base *vts.RunnerEnv) *vts.RunnerEnv {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if env, ok := r.envs[t]; ok {
+		return env
+	}
+	fs := newRecordingFS(base.FS)
+	env := &vts.RunnerEnv{
+		Dir:      base.Dir,
+		FS:       fs,
+		Universe: base.Universe,
+	}
+	env.PopulateEnv = func(pt vts.Target) *vts.RunnerEnv {
+		if pt == t {
+			return env
+		}
+		penv := r.envFor(pt, base)
+		fs.addDep(penv.FS.(*recordingFS))
+		return penv
+	}
+	r.envs[t] = env
+	return env
+}
+
+// definitionHash returns the hash of the file at path, or nil if it
+// cannot be read, such as for contracts built into ccr.
+func (r *checkResults) definitionHash(path string) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if h, ok := r.defHashes[path]; ok {
+		return h
+	}
+	var out []byte
+	if f, err := os.Open(path); err == nil {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err == nil {
+			out = hash.Sum(nil)
+		}
+		f.Close()
+	}
+	r.defHashes[path] = out
+	return out
+}
+
+// key computes the cache key for running the given checkers against t.
+// Targets which are not reproducible cannot have their checks cached.
+func (r *checkResults) key(t vts.Target, env *vts.RunnerEnv, checkers ...*vts.Checker) ([]byte, error) {
+	rt, ok := t.(vts.ReproducibleTarget)
+	if !ok {
+		return nil, fmt.Errorf("cannot cache checks of non-reproducible target of type %T", t)
+	}
+	rh, err := rt.RollupHash(env, proc.EvalComputedAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "check result v%d\n%x\n", checkCacheVersion, rh)
+	for _, c := range checkers {
+		fmt.Fprintf(hash, "%q %q %v\n", c.Path, c.Kind, c.Runner)
+		if c.Pos != nil {
+			fmt.Fprintf(hash, "%q:%d %x\n", c.Pos.Path, c.Pos.Frame.Pos.Line, r.definitionHash(c.Pos.Path))
+		}
+	}
+	return hash.Sum(nil), nil
+}
+
+// passed returns true if a passing result is cached for the key, and the
+// files read by the check are unchanged.
+func (r *checkResults) passed(key []byte) bool {
+	f, err := r.cache.CheckResult(key)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var entry checkCacheEntry
+	if err := json.NewDecoder(f).Decode(&entry); err != nil {
+		return false
+	}
+	for _, file := range entry.Files {
+		fp, err := fingerprintPath(r.fs, file.Path, file.Access)
+		if err != nil || fp != file.Fingerprint {
+			return false
+		}
+	}
+	return true
+}
+
+// record caches a passing result for the key, along with the state of the
+// files read through env.
+func (r *checkResults) record(key []byte, env *vts.RunnerEnv) error {
+	accessed := env.FS.(*recordingFS).accessed()
+	entry := checkCacheEntry{Files: make([]checkCacheFile, 0, len(accessed))}
+	for p, a := range accessed {
+		fp, err := fingerprintPath(r.fs, p, a)
+		if err != nil {
+			return err
+		}
+		entry.Files = append(entry.Files, checkCacheFile{Path: p, Access: a, Fingerprint: fp})
+	}
+	sort.Slice(entry.Files, func(i, j int) bool {
+		return entry.Files[i].Path < entry.Files[j].Path
+	})
+
+	w, err := r.cache.CheckResultWriter(key)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// run runs a cacheable check, unless a passing result is cached. It returns
+// true if the check was skipped.
+func (r *checkResults) run(j checkJob) (bool, error) {
+	key, err := j.key()
+	if err != nil {
+		// The check cannot be cached, but can still be run.
+		return false, j.run()
+	}
+	if !r.ignore && r.passed(key) {
+		return true, nil
+	}
+	if err := j.run(); err != nil {
+		return false, err
+	}
+	// Failing to record a result only means the check runs next time.
+	r.record(key, j.env)
+	return false, nil
+}
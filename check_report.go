@@ -0,0 +1,206 @@
+package ccr
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// ConstraintRecord describes a constraint which was not met.
+type ConstraintRecord struct {
+	Kind string `json:"kind"`
+	Lhs  string `json:"lhs"`
+	Op   string `json:"op"`
+	Rhs  string `json:"rhs"`
+}
+
+// CheckRecord describes a failing check in a machine-readable form.
+type CheckRecord struct {
+	// Target is the path of the target which failed the check.
+	Target string `json:"target,omitempty"`
+	// Checker is the path of the checker which failed.
+	Checker string `json:"checker,omitempty"`
+	// Position is the file:line at which the failing target was defined.
+	Position string `json:"position,omitempty"`
+	// Path is the file on the checked system the failure relates to.
+	Path string `json:"path,omitempty"`
+	// Chain lists the paths of the targets which depend on the failing
+	// target, nearest first.
+	Chain      []string          `json:"chain,omitempty"`
+	Message    string            `json:"message"`
+	Constraint *ConstraintRecord `json:"constraint,omitempty"`
+	HostCheck  bool              `json:"host_check,omitempty"`
+}
+
+func globalPath(t vts.Target) string {
+	if gt, ok := t.(vts.GlobalTarget); ok {
+		return gt.GlobalPath()
+	}
+	return ""
+}
+
+// NewCheckRecord describes the error from a failing check.
+func NewCheckRecord(err error) CheckRecord {
+	we, ok := err.(vts.WrappedErr)
+	if !ok {
+		return CheckRecord{Message: err.Error()}
+	}
+
+	out := CheckRecord{
+		Message:   we.Error(),
+		Path:      we.Path,
+		HostCheck: we.IsHostCheck,
+	}
+	if we.Target != nil {
+		out.Target = globalPath(we.Target)
+	}
+	switch {
+	case we.ActionTarget != nil:
+		out.Checker = globalPath(we.ActionTarget)
+	case we.Target != nil && we.Target.TargetType() == vts.TargetChecker:
+		// Global checkers are the target of their own failures.
+		out.Checker = out.Target
+	}
+
+	pos := we.Pos
+	if pos == nil && we.Target != nil {
+		pos = we.Target.DefinedAt()
+	}
+	if pos != nil {
+		out.Position = fmt.Sprintf("%s:%d", pos.Path, pos.Frame.Pos.Line)
+	}
+	for _, t := range we.TargetChain {
+		if p := globalPath(t); p != "" {
+			out.Chain = append(out.Chain, p)
+		}
+	}
+	// Failures of anonymous targets, such as attributes, are reported
+	// against the nearest target with a path.
+	if out.Target == "" && len(out.Chain) > 0 {
+		out.Target, out.Chain = out.Chain[0], out.Chain[1:]
+	}
+	if c, ok := we.Err.(vts.FailingConstraintInfo); ok {
+		out.Constraint = &ConstraintRecord{Kind: c.Kind, Lhs: c.Lhs, Op: c.Op, Rhs: c.Rhs}
+	}
+	return out
+}
+
+// Records returns a description of each failing check.
+func (r *CheckReport) Records() []CheckRecord {
+	out := make([]CheckRecord, len(r.Failures))
+	for i, err := range r.Failures {
+		out[i] = NewCheckRecord(err)
+	}
+	return out
+}
+
+type jsonCheckReport struct {
+	Checked  int           `json:"checked"`
+	Failures []CheckRecord `json:"failures"`
+}
+
+// WriteJSON writes the report as a JSON object.
+func (r *CheckReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonCheckReport{Checked: len(r.Checked), Failures: r.Records()})
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	File      string         `xml:"file,attr,omitempty"`
+	Failures  []junitFailure `xml:"failure"`
+}
+
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+func (r CheckRecord) junitBody() string {
+	out := r.Message + "\n"
+	if r.Constraint != nil {
+		out += fmt.Sprintf("failing constraint: %s %s %s\n", r.Constraint.Lhs, r.Constraint.Op, r.Constraint.Rhs)
+	}
+	if r.Path != "" {
+		out += "affected path: " + r.Path + "\n"
+	}
+	if r.Position != "" {
+		out += "defined at: " + r.Position + "\n"
+	}
+	for _, p := range r.Chain {
+		out += "required by: " + p + "\n"
+	}
+	return out
+}
+
+// WriteJUnit writes the report as a JUnit XML test suite, with a test case
+// for each checked target. Failures which do not relate to a checked target
+// are reported against a test case named after their checker.
+func (r *CheckReport) WriteJUnit(w io.Writer) error {
+	var (
+		suite   = junitTestSuite{Name: "ccr check"}
+		indexes = make(map[string]int, len(r.Checked))
+	)
+	for _, t := range r.Checked {
+		p := globalPath(t)
+		if p == "" {
+			continue
+		}
+		indexes[p] = len(suite.Cases)
+		suite.Cases = append(suite.Cases, junitTestCase{Name: p, ClassName: t.TargetType().String()})
+	}
+
+	for _, rec := range r.Records() {
+		name := rec.Target
+		if name == "" {
+			name = rec.Checker
+		}
+		idx, ok := indexes[name]
+		if !ok {
+			idx = len(suite.Cases)
+			indexes[name] = idx
+			suite.Cases = append(suite.Cases, junitTestCase{Name: name, ClassName: "check"})
+		}
+		tc := &suite.Cases[idx]
+		if tc.File == "" {
+			tc.File = rec.Position
+		}
+		tc.Failures = append(tc.Failures, junitFailure{
+			Message: rec.Message,
+			Type:    rec.Checker,
+			Body:    rec.junitBody(),
+		})
+	}
+
+	suite.Tests = len(suite.Cases)
+	for _, tc := range suite.Cases {
+		if len(tc.Failures) > 0 {
+			suite.Failures++
+		}
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
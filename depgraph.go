@@ -0,0 +1,243 @@
+package ccr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// DepGraph describes the dependency relationships between a set of targets.
+type DepGraph struct {
+	// Deps maps each target to the targets it transitively depends on.
+	Deps map[vts.Target][]vts.Target
+	// Dependents maps each target to the targets which transitively
+	// depend on it.
+	Dependents map[vts.Target][]vts.Target
+}
+
+// Phases returns the targets in the graph as a sequence of sets, where
+// the order represents dependency order, and targets in the same set may
+// be generated simultaneously.
+func (g *DepGraph) Phases() ([][]vts.Target, error) {
+	pending, emitted := make(map[vts.Target]struct{}, len(g.Deps)), make(map[vts.Target]struct{}, len(g.Deps))
+	for k := range g.Deps {
+		pending[k] = struct{}{}
+	}
+
+	var out [][]vts.Target
+	for len(pending) > 0 {
+		curSet := make([]vts.Target, 0, 6)
+		for k := range pending {
+			if numPending(g.Deps[k], emitted) == 0 {
+				curSet = append(curSet, k)
+			}
+		}
+		if len(curSet) == 0 {
+			return nil, errors.New("dependency graph contains a cycle")
+		}
+
+		sortTargets(curSet)
+		for _, s := range curSet {
+			delete(pending, s)
+			emitted[s] = struct{}{}
+		}
+		out = append(out, curSet)
+	}
+	return out, nil
+}
+
+func numPending(deps []vts.Target, done map[vts.Target]struct{}) int {
+	out := 0
+	for _, d := range deps {
+		if _, done := done[d]; !done {
+			out++
+		}
+	}
+	return out
+}
+
+// ScheduleOptions configures how a DepGraph is executed.
+type ScheduleOptions struct {
+	// Workers is the maximum number of targets processed concurrently.
+	Workers int
+	// KeepGoing continues processing targets which do not depend on a
+	// failed target, rather than stopping at the first failure.
+	KeepGoing bool
+	// OnStart, if non-nil, is called before each target is dispatched
+	// to a worker.
+	OnStart func(t vts.Target)
+}
+
+// ScheduleResult describes the outcome of executing a DepGraph.
+type ScheduleResult struct {
+	// Completed lists targets which were processed successfully, in
+	// the order they completed.
+	Completed []vts.Target
+	// Failed maps targets which failed to the error they returned.
+	Failed map[vts.Target]error
+	// Skipped maps targets which were never started to the failed target
+	// which blocked them. The value is nil if the target was skipped
+	// because execution stopped early.
+	Skipped map[vts.Target]vts.Target
+}
+
+// Err returns an error summarizing any failures, or nil if all targets
+// were processed successfully.
+func (r *ScheduleResult) Err() error {
+	switch len(r.Failed) {
+	case 0:
+		return nil
+	case 1:
+		for _, err := range r.Failed {
+			return err
+		}
+	}
+	return fmt.Errorf("%d targets failed", len(r.Failed))
+}
+
+// FailedTargets returns the targets which failed, in a stable order.
+func (r *ScheduleResult) FailedTargets() []vts.Target {
+	out := make([]vts.Target, 0, len(r.Failed))
+	for t := range r.Failed {
+		out = append(out, t)
+	}
+	sortTargets(out)
+	return out
+}
+
+// SkippedTargets returns the targets which were skipped, in a stable order.
+func (r *ScheduleResult) SkippedTargets() []vts.Target {
+	out := make([]vts.Target, 0, len(r.Skipped))
+	for t := range r.Skipped {
+		out = append(out, t)
+	}
+	sortTargets(out)
+	return out
+}
+
+type scheduleOutcome struct {
+	target vts.Target
+	err    error
+}
+
+// Execute invokes fn on every target in the graph, using a pool of
+// workers. Each target is started as soon as all of its dependencies have
+// completed successfully.
+func (g *DepGraph) Execute(opts ScheduleOptions, fn func(t vts.Target) error) *ScheduleResult {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	res := &ScheduleResult{
+		Completed: make([]vts.Target, 0, len(g.Deps)),
+		Failed:    make(map[vts.Target]error, 4),
+		Skipped:   make(map[vts.Target]vts.Target, 4),
+	}
+
+	var (
+		work     = make(chan vts.Target)
+		outcomes = make(chan scheduleOutcome)
+	)
+	for n := 0; n < workers; n++ {
+		go func() {
+			for t := range work {
+				outcomes <- scheduleOutcome{target: t, err: fn(t)}
+			}
+		}()
+	}
+	defer close(work)
+
+	remaining := make(map[vts.Target]int, len(g.Deps))
+	ready := make([]vts.Target, 0, len(g.Deps))
+	for t, deps := range g.Deps {
+		if remaining[t] = len(deps); len(deps) == 0 {
+			ready = append(ready, t)
+		}
+	}
+	sortTargets(ready)
+
+	var (
+		inFlight int
+		stopping bool
+	)
+	for inFlight > 0 || (len(ready) > 0 && !stopping) {
+		// A nil channel is never selected, so dispatch is disabled when
+		// nothing is ready or execution is stopping.
+		var (
+			dispatch chan vts.Target
+			next     vts.Target
+		)
+		if len(ready) > 0 && !stopping {
+			dispatch, next = work, ready[0]
+		}
+
+		select {
+		case dispatch <- next:
+			if opts.OnStart != nil {
+				opts.OnStart(next)
+			}
+			ready = ready[1:]
+			inFlight++
+
+		case o := <-outcomes:
+			inFlight--
+			if o.err != nil {
+				res.Failed[o.target] = o.err
+				for _, d := range g.Dependents[o.target] {
+					if _, skipped := res.Skipped[d]; !skipped {
+						res.Skipped[d] = o.target
+					}
+				}
+				stopping = stopping || !opts.KeepGoing
+				continue
+			}
+
+			res.Completed = append(res.Completed, o.target)
+			var unblocked []vts.Target
+			for _, d := range g.Dependents[o.target] {
+				if remaining[d]--; remaining[d] == 0 {
+					if _, skipped := res.Skipped[d]; !skipped {
+						unblocked = append(unblocked, d)
+					}
+				}
+			}
+			if len(unblocked) > 0 {
+				ready = append(ready, unblocked...)
+				sortTargets(ready)
+			}
+		}
+	}
+
+	// Anything not otherwise accounted for was never started, because
+	// execution stopped early.
+	completed := make(map[vts.Target]struct{}, len(res.Completed))
+	for _, t := range res.Completed {
+		completed[t] = struct{}{}
+	}
+	for t := range g.Deps {
+		_, done := completed[t]
+		_, failed := res.Failed[t]
+		_, skipped := res.Skipped[t]
+		if !done && !failed && !skipped {
+			res.Skipped[t] = nil
+		}
+	}
+	return res
+}
+
+// sortTargets orders targets by their string representation.
+func sortTargets(targets []vts.Target) {
+	sort.Slice(targets, func(i int, j int) bool {
+		oi, ok := targets[i].(fmt.Stringer)
+		if !ok {
+			return false
+		}
+		oj, ok := targets[j].(fmt.Stringer)
+		if !ok {
+			return false
+		}
+		return oi.String() < oj.String()
+	})
+}
@@ -0,0 +1,178 @@
+package ccr
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// makeTestGraph builds a DepGraph of builds, given a map of build names to
+// the names of builds they (transitively) depend on.
+func makeTestGraph(deps map[string][]string) (*DepGraph, map[string]vts.Target) {
+	targets := make(map[string]vts.Target, len(deps))
+	for n := range deps {
+		targets[n] = &vts.Build{Name: n, Path: "//test:" + n}
+	}
+	g := &DepGraph{
+		Deps:       make(map[vts.Target][]vts.Target, len(deps)),
+		Dependents: make(map[vts.Target][]vts.Target, len(deps)),
+	}
+	for n, ds := range deps {
+		t := targets[n]
+		g.Deps[t] = []vts.Target{}
+		for _, d := range ds {
+			g.Deps[t] = append(g.Deps[t], targets[d])
+			g.Dependents[targets[d]] = append(g.Dependents[targets[d]], t)
+		}
+	}
+	return g, targets
+}
+
+func targetNames(targets []vts.Target) []string {
+	out := make([]string, len(targets))
+	for i, t := range targets {
+		out[i] = t.(*vts.Build).Name
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestDepGraphExecute(t *testing.T) {
+	graph := map[string][]string{
+		"a":    {},
+		"b":    {"a"},
+		"c":    {"a", "b"},
+		"slow": {},
+		"d":    {"slow"},
+		"e":    {},
+	}
+
+	tcs := []struct {
+		name          string
+		keepGoing     bool
+		fail          string
+		wantCompleted []string
+		wantFailed    []string
+		wantSkipped   map[string]string
+	}{
+		{
+			name:          "success",
+			wantCompleted: []string{"a", "b", "c", "d", "e", "slow"},
+			wantFailed:    []string{},
+			wantSkipped:   map[string]string{},
+		},
+		{
+			name:          "keep going",
+			keepGoing:     true,
+			fail:          "a",
+			wantCompleted: []string{"d", "e", "slow"},
+			wantFailed:    []string{"a"},
+			wantSkipped:   map[string]string{"b": "a", "c": "a"},
+		},
+		{
+			name:          "keep going leaf",
+			keepGoing:     true,
+			fail:          "c",
+			wantCompleted: []string{"a", "b", "d", "e", "slow"},
+			wantFailed:    []string{"c"},
+			wantSkipped:   map[string]string{},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			g, _ := makeTestGraph(graph)
+
+			var (
+				lock sync.Mutex
+				done = map[string]bool{}
+			)
+			res := g.Execute(ScheduleOptions{Workers: 3, KeepGoing: tc.keepGoing}, func(target vts.Target) error {
+				b := target.(*vts.Build)
+				lock.Lock()
+				defer lock.Unlock()
+				for _, d := range graph[b.Name] {
+					if !done[d] {
+						t.Errorf("%s started before dependency %s completed", b.Name, d)
+					}
+				}
+				if b.Name == tc.fail {
+					return errors.New("failed")
+				}
+				done[b.Name] = true
+				return nil
+			})
+
+			if diff := cmp.Diff(tc.wantCompleted, targetNames(res.Completed)); diff != "" {
+				t.Errorf("completed differs (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantFailed, targetNames(res.FailedTargets())); diff != "" {
+				t.Errorf("failed differs (-want,+got):\n%s", diff)
+			}
+			skipped := map[string]string{}
+			for s, cause := range res.Skipped {
+				skipped[s.(*vts.Build).Name] = cause.(*vts.Build).Name
+			}
+			if diff := cmp.Diff(tc.wantSkipped, skipped); diff != "" {
+				t.Errorf("skipped differs (-want,+got):\n%s", diff)
+			}
+			if (len(tc.wantFailed) > 0) != (res.Err() != nil) {
+				t.Errorf("Err() = %v, want error = %v", res.Err(), len(tc.wantFailed) > 0)
+			}
+		})
+	}
+}
+
+func TestDepGraphExecuteNoBarrier(t *testing.T) {
+	// d depends only on slow, so should start once slow finishes, even if
+	// a (which is in the same phase as slow) is still running.
+	g, _ := makeTestGraph(map[string][]string{
+		"a":    {},
+		"slow": {},
+		"d":    {"slow"},
+	})
+
+	var (
+		releaseA = make(chan struct{})
+		dStarted = make(chan struct{})
+	)
+	res := g.Execute(ScheduleOptions{Workers: 2}, func(target vts.Target) error {
+		switch target.(*vts.Build).Name {
+		case "a":
+			<-releaseA
+		case "d":
+			close(dStarted)
+			close(releaseA)
+		}
+		return nil
+	})
+	<-dStarted
+	if err := res.Err(); err != nil {
+		t.Errorf("Execute() failed: %v", err)
+	}
+}
+
+func TestDepGraphExecuteStopsOnFailure(t *testing.T) {
+	g, _ := makeTestGraph(map[string][]string{
+		"a": {},
+		"b": {"a"},
+		"c": {"b"},
+	})
+
+	res := g.Execute(ScheduleOptions{Workers: 1}, func(target vts.Target) error {
+		if target.(*vts.Build).Name == "a" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err := res.Err(); err == nil || err.Error() != "failed" {
+		t.Errorf("Err() = %v, want %q", err, "failed")
+	}
+	if diff := cmp.Diff([]string{"b", "c"}, targetNames(res.SkippedTargets())); diff != "" {
+		t.Errorf("skipped differs (-want,+got):\n%s", diff)
+	}
+}
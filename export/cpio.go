@@ -0,0 +1,107 @@
+package export
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/twitchylinux/ccr/fsmeta"
+)
+
+const (
+	cpioMagic   = "070701"
+	cpioTrailer = "TRAILER!!!"
+)
+
+// cpioWriter writes archives in the 'new ascii' (newc) cpio format, as
+// consumed by the linux kernel when unpacking an initramfs.
+type cpioWriter struct {
+	w       io.Writer
+	modTime time.Time
+	offset  int64
+	ino     uint32
+	inodes  map[string]cpioInode
+}
+
+type cpioInode struct {
+	ino, nlink uint32
+}
+
+func newCPIOWriter(w io.Writer, modTime time.Time) *cpioWriter {
+	return &cpioWriter{w: w, modTime: modTime, inodes: map[string]cpioInode{}}
+}
+
+func (w *cpioWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return n, err
+}
+
+// pad writes zeros until the archive is aligned to a 4-byte boundary.
+func (w *cpioWriter) pad() error {
+	if rem := w.offset % 4; rem != 0 {
+		_, err := w.Write(make([]byte, 4-rem))
+		return err
+	}
+	return nil
+}
+
+func (w *cpioWriter) writeHeader(name string, ino, mode uint32, uid, gid int, nlink uint32, size int64, major, minor uint32) error {
+	hdr := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioMagic, ino, mode, uid, gid, nlink, w.modTime.Unix(), size,
+		0, 0, major, minor, len(name)+1, 0)
+	if _, err := io.WriteString(w, hdr+name+"\x00"); err != nil {
+		return err
+	}
+	return w.pad()
+}
+
+func (w *cpioWriter) WriteEntry(e *entry, content io.Reader) error {
+	mode, err := unixMode(e)
+	if err != nil {
+		return err
+	}
+
+	var (
+		nlink uint32 = 1
+		size  int64
+	)
+	switch e.Type {
+	case fsmeta.TypeHardlink:
+		// Hardlinks share the inode of their target, which has already been
+		// written along with its contents.
+		target, ok := w.inodes[e.Link]
+		if !ok {
+			return fmt.Errorf("hardlink target %q has not been written", e.Link)
+		}
+		return w.writeHeader(e.Name, target.ino, mode, e.UID, e.GID, target.nlink, 0, 0, 0)
+	case fsmeta.TypeReg:
+		size, nlink = e.Size, uint32(1+e.Links)
+	case fsmeta.TypeSymlink:
+		size, content = int64(len(e.Target)), strings.NewReader(e.Target)
+	case fsmeta.TypeDir:
+		nlink = 2
+	}
+	w.ino++
+	w.inodes[e.Path] = cpioInode{ino: w.ino, nlink: nlink}
+
+	if err := w.writeHeader(e.Name, w.ino, mode, e.UID, e.GID, nlink, size, e.Major, e.Minor); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	n, err := io.Copy(w, content)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("size changed while writing: got %d bytes, want %d", n, size)
+	}
+	return w.pad()
+}
+
+func (w *cpioWriter) Close() error {
+	return w.writeHeader(cpioTrailer, 0, 0, 0, 0, 1, 0, 0, 0)
+}
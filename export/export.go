@@ -0,0 +1,250 @@
+// Package export writes a generated filesystem as a single archive, such
+// as a tarball, a cpio initramfs or an OCI image layout.
+package export
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/twitchylinux/ccr/fsmeta"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// Format describes the format of an exported archive.
+type Format string
+
+// Supported archive formats.
+const (
+	FormatTar  Format = "tar"
+	FormatCPIO Format = "cpio-newc"
+	FormatOCI  Format = "oci"
+)
+
+// ParseFormat returns the format with the given name. The empty string
+// refers to the tar format.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case "":
+		return FormatTar, nil
+	case FormatTar, FormatCPIO, FormatOCI:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %q: want one of %s, %s or %s", name, FormatTar, FormatCPIO, FormatOCI)
+}
+
+// Options describes how an archive should be written.
+type Options struct {
+	Format Format
+	// ModTime is the modification time of every file in the archive. The
+	// zero value means the unix epoch.
+	ModTime time.Time
+	// Arch is the architecture recorded in OCI image configuration.
+	Arch string
+}
+
+func (o Options) modTime() time.Time {
+	if o.ModTime.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return o.ModTime
+}
+
+// entry describes a file to be written to an archive.
+type entry struct {
+	fsmeta.Entry
+	// Name is the path of the file relative to the root of the archive.
+	Name string
+	// Size is the size of a regular file.
+	Size int64
+	// Target is the target of a symlink.
+	Target string
+	// Links is the number of hardlinks to a regular file.
+	Links int
+}
+
+// collect returns every file in the filesystem, combined with the metadata
+// in the manifest of the filesystem. Entries are ordered by path, except
+// hardlinks, which follow every other entry so their targets have always
+// been written.
+func collect(fs billy.Filesystem) ([]*entry, error) {
+	m, err := fsmeta.Load(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out   []*entry
+		links []*entry
+		paths = map[string]*entry{}
+	)
+	add := func(e *entry) {
+		e.Name = strings.TrimPrefix(e.Path, "/")
+		paths[e.Path] = e
+		if e.Type == fsmeta.TypeHardlink {
+			links = append(links, e)
+		} else {
+			out = append(out, e)
+		}
+	}
+
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		files, err := fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			p := path.Join(dir, f.Name())
+			if p == fsmeta.ManifestPath {
+				continue
+			}
+			meta, err := fsmeta.Lookup(fs, p)
+			if err != nil {
+				return err
+			}
+			e := &entry{Entry: meta}
+			switch meta.Type {
+			case fsmeta.TypeReg:
+				st, err := fs.Lstat(p)
+				if err != nil {
+					return err
+				}
+				e.Size = st.Size()
+			case fsmeta.TypeSymlink:
+				if e.Target, err = fs.Readlink(p); err != nil {
+					return err
+				}
+			}
+			add(e)
+			if meta.Type == fsmeta.TypeDir {
+				if err := walk(p); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return nil, err
+	}
+
+	// Special files which could not be created are only present in the
+	// manifest, and may be missing their parent directories.
+	for _, me := range m.Entries {
+		if _, exists := paths[me.Path]; exists || me.Type == fsmeta.TypeReg {
+			continue
+		}
+		for dir := path.Dir(me.Path); dir != "/"; dir = path.Dir(dir) {
+			if _, exists := paths[dir]; !exists {
+				add(&entry{Entry: fsmeta.Entry{Path: dir, Type: fsmeta.TypeDir, Mode: 0755}})
+			}
+		}
+		add(&entry{Entry: me})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	for _, l := range links {
+		target, err := linkTarget(l, paths)
+		if err != nil {
+			return nil, err
+		}
+		// A hardlink shares the metadata of its target.
+		l.Link, l.Mode, l.UID, l.GID = target.Path, target.Mode, target.UID, target.GID
+		target.Links++
+	}
+	return append(out, links...), nil
+}
+
+// linkTarget returns the regular file a hardlink ultimately refers to.
+func linkTarget(l *entry, paths map[string]*entry) (*entry, error) {
+	seen := map[*entry]bool{}
+	for t := l; ; {
+		if seen[t] {
+			return nil, fmt.Errorf("%s: hardlinks form a cycle", l.Path)
+		}
+		seen[t] = true
+		next, ok := paths[t.Link]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("%s: hardlink target %q does not exist", l.Path, t.Link)
+		case next.Type == fsmeta.TypeHardlink:
+			t = next
+		case next.Type != fsmeta.TypeReg:
+			return nil, fmt.Errorf("%s: hardlink target %q is not a regular file", l.Path, t.Link)
+		default:
+			return next, nil
+		}
+	}
+}
+
+// archiveWriter is implemented by writers of each archive format.
+type archiveWriter interface {
+	WriteEntry(e *entry, content io.Reader) error
+	Close() error
+}
+
+// writeEntries writes every file in the filesystem to the archive.
+func writeEntries(aw archiveWriter, fs billy.Filesystem) error {
+	entries, err := collect(fs)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Type != fsmeta.TypeReg {
+			if err := aw.WriteEntry(e, nil); err != nil {
+				return fmt.Errorf("%s: %v", e.Path, err)
+			}
+			continue
+		}
+		f, err := fs.Open(e.Path)
+		if err != nil {
+			return err
+		}
+		err = aw.WriteEntry(e, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Path, err)
+		}
+	}
+	return aw.Close()
+}
+
+// Write writes every file in the filesystem to w as an archive of the
+// given format. Ownership, device nodes, FIFOs and hardlinks recorded in
+// the metadata manifest of the filesystem are reproduced in the archive.
+func Write(w io.Writer, fs billy.Filesystem, opts Options) error {
+	switch opts.Format {
+	case FormatTar, "":
+		return writeEntries(newTarWriter(w, opts.modTime()), fs)
+	case FormatCPIO:
+		return writeEntries(newCPIOWriter(w, opts.modTime()), fs)
+	case FormatOCI:
+		return writeOCI(w, fs, opts)
+	}
+	return fmt.Errorf("unknown export format %q", opts.Format)
+}
+
+// unixMode returns the unix mode of an entry, including the file type.
+func unixMode(e *entry) (uint32, error) {
+	mode := fsmeta.UnixMode(e.Mode)
+	switch e.Type {
+	case fsmeta.TypeReg, fsmeta.TypeHardlink:
+		return mode | 0100000, nil
+	case fsmeta.TypeDir:
+		return mode | 0040000, nil
+	case fsmeta.TypeSymlink:
+		return 0777 | 0120000, nil
+	case fsmeta.TypeChar:
+		return mode | 0020000, nil
+	case fsmeta.TypeBlock:
+		return mode | 0060000, nil
+	case fsmeta.TypeFifo:
+		return mode | 0010000, nil
+	}
+	return 0, fmt.Errorf("unsupported file type %q", e.Type)
+}
@@ -0,0 +1,267 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/twitchylinux/ccr/fsmeta"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+func testFS(t *testing.T) billy.Filesystem {
+	t.Helper()
+	fs := NewFS()
+	f, err := fs.OpenFile("/etc/shadow", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("root:*:::::::\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsmeta.Chown(fs, "/etc/shadow", 0, 42); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("/proc/self/mounts", "/etc/mtab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsmeta.Link(fs, "/etc/shadow-", "/etc/shadow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsmeta.Mknod(fs, fsmeta.Entry{Path: "/dev/console", Type: fsmeta.TypeChar, Mode: 0600, Major: 5, Minor: 1}); err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestParseFormat(t *testing.T) {
+	tcs := []struct {
+		name string
+		want Format
+		err  bool
+	}{
+		{"", FormatTar, false},
+		{"tar", FormatTar, false},
+		{"cpio-newc", FormatCPIO, false},
+		{"oci", FormatOCI, false},
+		{"zip", "", true},
+	}
+	for _, tc := range tcs {
+		got, err := ParseFormat(tc.name)
+		if (err != nil) != tc.err {
+			t.Errorf("ParseFormat(%q) returned err = %v, want error = %v", tc.name, err, tc.err)
+		}
+		if got != tc.want {
+			t.Errorf("ParseFormat(%q) = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWriteDeterministic(t *testing.T) {
+	for _, f := range []Format{FormatTar, FormatCPIO, FormatOCI} {
+		var a, b bytes.Buffer
+		if err := Write(&a, testFS(t), Options{Format: f}); err != nil {
+			t.Fatalf("Write(%s) failed: %v", f, err)
+		}
+		if err := Write(&b, testFS(t), Options{Format: f}); err != nil {
+			t.Fatalf("Write(%s) failed: %v", f, err)
+		}
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			t.Errorf("Write(%s) is not deterministic", f)
+		}
+	}
+}
+
+type cpioFile struct {
+	Ino, Mode, UID, GID, NLink int64
+	Major, Minor               int64
+	Content                    string
+}
+
+func readCPIO(t *testing.T, d []byte) ([]string, map[string]cpioFile) {
+	t.Helper()
+	var (
+		names []string
+		files = map[string]cpioFile{}
+		off   int
+	)
+	align := func() { off = (off + 3) &^ 3 }
+	for {
+		if string(d[off:off+6]) != cpioMagic {
+			t.Fatalf("bad magic at offset %d: %q", off, d[off:off+6])
+		}
+		var fields [13]int64
+		for i := range fields {
+			v, err := strconv.ParseInt(string(d[off+6+i*8:off+14+i*8]), 16, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields[i] = v
+		}
+		off += 110
+		name := string(d[off : off+int(fields[11])-1])
+		off += int(fields[11])
+		align()
+		if name == cpioTrailer {
+			break
+		}
+		content := string(d[off : off+int(fields[6])])
+		off += int(fields[6])
+		align()
+
+		names = append(names, name)
+		files[name] = cpioFile{fields[0], fields[1], fields[2], fields[3], fields[4], fields[9], fields[10], content}
+	}
+	if off != len(d) {
+		t.Errorf("archive has %d trailing bytes", len(d)-off)
+	}
+	return names, files
+}
+
+func TestWriteCPIO(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, testFS(t), Options{Format: FormatCPIO}); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	names, files := readCPIO(t, out.Bytes())
+
+	if diff := cmp.Diff([]string{"dev", "dev/console", "etc", "etc/mtab", "etc/shadow", "etc/shadow-"}, names); diff != "" {
+		t.Errorf("archive order differs (+got, -want):\n%s", diff)
+	}
+	want := map[string]cpioFile{
+		"dev":         {Ino: 1, Mode: 040755, NLink: 2},
+		"dev/console": {Ino: 2, Mode: 020600, NLink: 1, Major: 5, Minor: 1},
+		"etc":         {Ino: 3, Mode: 040755, NLink: 2},
+		"etc/mtab":    {Ino: 4, Mode: 0120777, NLink: 1, Content: "/proc/self/mounts"},
+		"etc/shadow":  {Ino: 5, Mode: 0100640, GID: 42, NLink: 2, Content: "root:*:::::::\n"},
+		"etc/shadow-": {Ino: 5, Mode: 0100640, GID: 42, NLink: 2},
+	}
+	if diff := cmp.Diff(want, files); diff != "" {
+		t.Errorf("archive differs (+got, -want):\n%s", diff)
+	}
+}
+
+func TestWriteOCI(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, testFS(t), Options{Format: FormatOCI, Arch: "arm64"}); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(&out)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[h.Name], err = ioutil.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := string(files["oci-layout"]), `{"imageLayoutVersion":"1.0.0"}`; got != want {
+		t.Errorf("oci-layout = %q, want %q", got, want)
+	}
+	// Every blob must be stored under its digest.
+	for name, d := range files {
+		if len(name) > len("blobs/sha256/") && name[:len("blobs/sha256/")] == "blobs/sha256/" {
+			if got := blobPath(digest(d)); got != name {
+				t.Errorf("blob %s has digest path %s", name, got)
+			}
+		}
+	}
+	if !bytes.Contains(files["index.json"], []byte(ociManifestType)) {
+		t.Errorf("index.json does not reference a manifest: %s", files["index.json"])
+	}
+}
+
+func TestReferencedContent(t *testing.T) {
+	const content = "#!/bin/sh\necho hello\n"
+	opened := 0
+	open := func() (io.ReadCloser, error) {
+		opened++
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+
+	fs := NewFS()
+	if err := fs.(*memFS).Reference("/usr/bin/hello", 0755, int64(len(content)), open); err != nil {
+		t.Fatalf("Reference() failed: %v", err)
+	}
+	if err := fs.Symlink("hello", "/usr/bin/hi"); err != nil {
+		t.Fatal(err)
+	}
+	if opened != 0 {
+		t.Errorf("content was opened %d times before being read", opened)
+	}
+	for _, p := range []string{"/usr/bin/hello", "/usr/bin/hi"} {
+		st, err := fs.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() != int64(len(content)) {
+			t.Errorf("Stat(%q).Size() = %d, want %d", p, st.Size(), len(content))
+		}
+	}
+
+	var out bytes.Buffer
+	if err := Write(&out, fs, Options{Format: FormatTar}); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	tr := tar.NewReader(&out)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("usr/bin/hello was not written")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != "usr/bin/hello" {
+			continue
+		}
+		d, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d) != content {
+			t.Errorf("usr/bin/hello = %q, want %q", d, content)
+		}
+		break
+	}
+
+	// Appending to the file replaces the reference with a copy.
+	f, err := fs.OpenFile("/usr/bin/hi", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("exit 0\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = fs.Open("/usr/bin/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := content + "exit 0\n"; string(d) != want {
+		t.Errorf("usr/bin/hello = %q, want %q", d, want)
+	}
+}
@@ -0,0 +1,302 @@
+package export
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+)
+
+// maxSymlinks is the number of symlinks which may be followed when
+// resolving a path.
+const maxSymlinks = 40
+
+// memFS is an in-memory filesystem. Unlike memfs, missing parent directories
+// are created with mode 0755, matching the behaviour of osfs.
+//
+// Regular files may reference their content rather than hold a copy of it,
+// so that the content of large files is only read as they are exported.
+type memFS struct {
+	billy.Filesystem
+
+	mu   sync.Mutex
+	refs map[string]*reference
+}
+
+// reference describes the content of a file which is held elsewhere.
+type reference struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+// NewFS returns an in-memory filesystem which a system can be generated
+// into, before being exported. As the filesystem is not backed by the host,
+// all ownership and special files are recorded in its metadata manifest.
+func NewFS() billy.Filesystem {
+	return &memFS{Filesystem: memfs.New(), refs: map[string]*reference{}}
+}
+
+func (fs *memFS) mkParent(path string) error {
+	return fs.Filesystem.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// resolve returns the path of the file path refers to. Like memfs, only
+// symlinks in the final component of the path are followed.
+func (fs *memFS) resolve(path string) string {
+	path = filepath.Join("/", path)
+	for i := 0; i < maxSymlinks; i++ {
+		target, err := fs.Filesystem.Readlink(path)
+		if err != nil {
+			break
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = filepath.Clean(target)
+	}
+	return path
+}
+
+// Reference creates a regular file at path, the content of which is read
+// by calling open.
+func (fs *memFS) Reference(path string, mode os.FileMode, size int64, open func() (io.ReadCloser, error)) error {
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.refs[fs.resolve(path)] = &reference{size: size, open: open}
+	return nil
+}
+
+func (fs *memFS) lookupRef(path string, lstat bool) (string, *reference) {
+	p := filepath.Join("/", path)
+	if !lstat {
+		p = fs.resolve(path)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return p, fs.refs[p]
+}
+
+// materialize replaces the reference at path with a copy of its content.
+func (fs *memFS) materialize(path string, ref *reference) error {
+	r, err := ref.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := fs.Filesystem.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func (fs *memFS) Create(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *memFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *memFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	if p, ref := fs.lookupRef(filename, false); ref != nil {
+		if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			return &refFile{name: filename, ref: ref}, nil
+		}
+		if flag&os.O_TRUNC == 0 {
+			if err := fs.materialize(p, ref); err != nil {
+				return nil, err
+			}
+		}
+		fs.mu.Lock()
+		delete(fs.refs, p)
+		fs.mu.Unlock()
+	}
+
+	if flag&os.O_CREATE != 0 {
+		if err := fs.mkParent(filename); err != nil {
+			return nil, err
+		}
+	}
+	return fs.Filesystem.OpenFile(filename, flag, perm)
+}
+
+func (fs *memFS) Stat(filename string) (os.FileInfo, error) {
+	st, err := fs.Filesystem.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, ref := fs.lookupRef(filename, false); ref != nil {
+		return &refInfo{st, ref.size}, nil
+	}
+	return st, nil
+}
+
+func (fs *memFS) Lstat(filename string) (os.FileInfo, error) {
+	st, err := fs.Filesystem.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, ref := fs.lookupRef(filename, true); ref != nil {
+		return &refInfo{st, ref.size}, nil
+	}
+	return st, nil
+}
+
+func (fs *memFS) ReadDir(path string) ([]os.FileInfo, error) {
+	files, err := fs.Filesystem.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := fs.resolve(path)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for i, f := range files {
+		if ref, ok := fs.refs[filepath.Join(dir, f.Name())]; ok {
+			files[i] = &refInfo{f, ref.size}
+		}
+	}
+	return files, nil
+}
+
+func (fs *memFS) Rename(from, to string) error {
+	if err := fs.Filesystem.Rename(from, to); err != nil {
+		return err
+	}
+	from, to = filepath.Join("/", from), filepath.Join("/", to)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for p, ref := range fs.refs {
+		if p == from || strings.HasPrefix(p, from+"/") {
+			delete(fs.refs, p)
+			fs.refs[to+strings.TrimPrefix(p, from)] = ref
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Remove(filename string) error {
+	p := filepath.Join("/", filename)
+	if err := fs.Filesystem.Remove(filename); err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.refs, p)
+	return nil
+}
+
+func (fs *memFS) Symlink(target, link string) error {
+	if err := fs.mkParent(link); err != nil {
+		return err
+	}
+	return fs.Filesystem.Symlink(target, link)
+}
+
+// refInfo describes a file which references its content.
+type refInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *refInfo) Size() int64 {
+	return i.size
+}
+
+// refFile is a file opened for reading, the content of which is
+// referenced. The content is opened when it is first read.
+type refFile struct {
+	name string
+	ref  *reference
+	r    io.ReadCloser
+}
+
+var errReadOnly = errors.New("file is opened read-only")
+
+func (f *refFile) content() (io.ReadCloser, error) {
+	if f.r == nil {
+		r, err := f.ref.open()
+		if err != nil {
+			return nil, err
+		}
+		f.r = r
+	}
+	return f.r, nil
+}
+
+func (f *refFile) Name() string {
+	return f.name
+}
+
+func (f *refFile) Read(b []byte) (int, error) {
+	r, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (f *refFile) ReadAt(b []byte, off int64) (int, error) {
+	r, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errors.New("random access is not supported")}
+	}
+	return ra.ReadAt(b, off)
+}
+
+func (f *refFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.content()
+	if err != nil {
+		return 0, err
+	}
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("random access is not supported")}
+	}
+	return s.Seek(offset, whence)
+}
+
+func (f *refFile) Write(b []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: errReadOnly}
+}
+
+func (f *refFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: errReadOnly}
+}
+
+func (f *refFile) Lock() error {
+	return nil
+}
+
+func (f *refFile) Unlock() error {
+	return nil
+}
+
+func (f *refFile) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	err := f.r.Close()
+	f.r = nil
+	return err
+}
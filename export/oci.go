@@ -0,0 +1,179 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+// Media types of OCI image content.
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociLayout is the content of the oci-layout file.
+const ociLayout = `{"imageLayoutVersion":"1.0.0"}`
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Config       struct{}  `json:"config"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+func digest(b []byte) string {
+	h := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(h[:])
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+// writeLayer writes the filesystem as a compressed layer to f, returning
+// the digests of the layer before and after compression, and its size.
+func writeLayer(f io.Writer, fs billy.Filesystem, opts Options) (diffID, layerDigest string, size int64, err error) {
+	var (
+		diffHash, layerHash = sha256.New(), sha256.New()
+		count               countingWriter
+	)
+	// The gzip header is left without a name or timestamp so the layer
+	// digest is deterministic.
+	zw := gzip.NewWriter(io.MultiWriter(f, layerHash, &count))
+	if err := writeEntries(newTarWriter(io.MultiWriter(zw, diffHash), opts.modTime()), fs); err != nil {
+		return "", "", 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return "", "", 0, err
+	}
+	return "sha256:" + hex.EncodeToString(diffHash.Sum(nil)), "sha256:" + hex.EncodeToString(layerHash.Sum(nil)), count.n, nil
+}
+
+// writeOCI writes the filesystem as a single-layer image in the OCI image
+// layout, itself packaged as a tarball. The layer is staged in a temporary
+// file, as its digest must be known before it is written.
+func writeOCI(w io.Writer, fs billy.Filesystem, opts Options) error {
+	layer, err := ioutil.TempFile("", "ccr-layer-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	diffID, layerDigest, layerSize, err := writeLayer(layer, fs, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	conf := ociConfig{
+		Created:      opts.modTime().UTC(),
+		Architecture: opts.Arch,
+		OS:           "linux",
+	}
+	if conf.Architecture == "" {
+		conf.Architecture = runtime.GOARCH
+	}
+	conf.RootFS.Type = "layers"
+	conf.RootFS.DiffIDs = []string{diffID}
+	confJSON, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+
+	manifestJSON, err := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociManifestType,
+		Config:        ociDescriptor{MediaType: ociConfigType, Digest: digest(confJSON), Size: int64(len(confJSON))},
+		Layers: []ociDescriptor{
+			{MediaType: ociLayerType, Digest: layerDigest, Size: layerSize},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	indexJSON, err := json.Marshal(ociIndex{
+		SchemaVersion: 2,
+		Manifests: []ociDescriptor{
+			{MediaType: ociManifestType, Digest: digest(manifestJSON), Size: int64(len(manifestJSON))},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755, ModTime: opts.modTime()}); err != nil {
+			return err
+		}
+	}
+	files := []struct {
+		name string
+		size int64
+		data io.Reader
+	}{
+		{"oci-layout", int64(len(ociLayout)), strings.NewReader(ociLayout)},
+		{"index.json", int64(len(indexJSON)), bytes.NewReader(indexJSON)},
+		{blobPath(digest(manifestJSON)), int64(len(manifestJSON)), bytes.NewReader(manifestJSON)},
+		{blobPath(digest(confJSON)), int64(len(confJSON)), bytes.NewReader(confJSON)},
+		{blobPath(layerDigest), layerSize, layer},
+	}
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Mode: 0644, Size: f.size, ModTime: opts.modTime()}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// blobPath returns the path of the blob with the given digest.
+func blobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
@@ -0,0 +1,61 @@
+package export
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/twitchylinux/ccr/fsmeta"
+)
+
+type tarWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+}
+
+func newTarWriter(w io.Writer, modTime time.Time) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), modTime: modTime}
+}
+
+func (w *tarWriter) WriteEntry(e *entry, content io.Reader) error {
+	h := &tar.Header{
+		Name:    e.Name,
+		Mode:    int64(fsmeta.UnixMode(e.Mode)),
+		Uid:     e.UID,
+		Gid:     e.GID,
+		ModTime: w.modTime,
+	}
+	switch e.Type {
+	case fsmeta.TypeReg:
+		h.Typeflag, h.Size = tar.TypeReg, e.Size
+	case fsmeta.TypeDir:
+		h.Typeflag, h.Name = tar.TypeDir, e.Name+"/"
+	case fsmeta.TypeSymlink:
+		h.Typeflag, h.Linkname, h.Mode = tar.TypeSymlink, e.Target, 0777
+	case fsmeta.TypeHardlink:
+		h.Typeflag, h.Linkname = tar.TypeLink, e.Link[1:]
+	case fsmeta.TypeChar:
+		h.Typeflag, h.Devmajor, h.Devminor = tar.TypeChar, int64(e.Major), int64(e.Minor)
+	case fsmeta.TypeBlock:
+		h.Typeflag, h.Devmajor, h.Devminor = tar.TypeBlock, int64(e.Major), int64(e.Minor)
+	case fsmeta.TypeFifo:
+		h.Typeflag = tar.TypeFifo
+	default:
+		return fmt.Errorf("unsupported file type %q", e.Type)
+	}
+
+	if err := w.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if content != nil {
+		if _, err := io.Copy(w.tw, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() error {
+	return w.tw.Close()
+}
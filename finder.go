@@ -20,8 +20,16 @@ type CCRResolver func(fqPath string) (vts.Target, error)
 // NewDirResolver constructs a resolver that reads targets from the directory
 // tree under the path provided.
 func NewDirResolver(dir string) *DirResolver {
+	return NewDirResolverWithConfig(dir, GenerateConfig{})
+}
+
+// NewDirResolverWithConfig constructs a resolver that reads targets from the
+// directory tree under the path provided, evaluating contracts against the
+// given configuration.
+func NewDirResolverWithConfig(dir string, conf GenerateConfig) *DirResolver {
 	return &DirResolver{
 		dir:     dir,
+		config:  conf.Defines,
 		targets: make(map[string]vts.GlobalTarget, 32),
 	}
 }
@@ -38,6 +46,8 @@ func (e buildErr) Error() string {
 // DirResolver resolves targets laid out as children of a directory.
 type DirResolver struct {
 	dir     string
+	config  map[string]string
+	modules *ccbuild.ModuleLoader
 	targets map[string]vts.GlobalTarget
 }
 
@@ -65,7 +75,11 @@ func (r *DirResolver) Resolve(fqPath string) (vts.Target, error) {
 		return nil, err
 	}
 
-	s, err := ccbuild.NewScript(d, fqPath[:cIdx], fPath, nil, nil)
+	// Modules are shared between all contracts read by the resolver.
+	if r.modules == nil {
+		r.modules = ccbuild.NewModuleLoader(r.dir, r.config)
+	}
+	s, err := ccbuild.NewScriptWithConfig(d, fqPath[:cIdx], fPath, r.modules, r.config)
 	if err != nil {
 		return nil, buildErr{path: fPath, err: err}
 	}
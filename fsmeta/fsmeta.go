@@ -0,0 +1,479 @@
+// Package fsmeta applies file metadata which cannot be expressed through a
+// billy filesystem: ownership, device nodes, FIFOs and hardlinks.
+//
+// Metadata is applied to the host directory backing the filesystem. Where
+// that is not possible, such as when generating onto a host directory as
+// an unprivileged user, the metadata is instead recorded in a manifest at
+// the root of the filesystem, to be applied when the filesystem is exported.
+package fsmeta
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/helper/chroot"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+// ManifestPath is the path, relative to the root of a filesystem, of the
+// manifest of metadata which could not be applied.
+const ManifestPath = "/.ccr-metadata.json"
+
+// Types of file described by an entry.
+const (
+	TypeReg      = ""
+	TypeDir      = "dir"
+	TypeSymlink  = "symlink"
+	TypeHardlink = "hardlink"
+	TypeChar     = "char"
+	TypeBlock    = "block"
+	TypeFifo     = "fifo"
+)
+
+// Entry describes the metadata of a file.
+type Entry struct {
+	Path string      `json:"path"`
+	Type string      `json:"type,omitempty"`
+	Mode os.FileMode `json:"mode,omitempty"`
+	UID  int         `json:"uid,omitempty"`
+	GID  int         `json:"gid,omitempty"`
+
+	// Link is the path of the file a hardlink refers to.
+	Link string `json:"link,omitempty"`
+	// Major and Minor are the device numbers of a device node.
+	Major uint32 `json:"major,omitempty"`
+	Minor uint32 `json:"minor,omitempty"`
+}
+
+// Manifest describes metadata which could not be applied to a filesystem.
+type Manifest struct {
+	// Generator is set when the filesystem was generated onto a host
+	// directory by an unprivileged user. Files owned by that user were
+	// created on behalf of root, and are reported as owned by root unless
+	// their ownership was recorded.
+	Generator *Owner  `json:"generator,omitempty"`
+	Entries   []Entry `json:"entries"`
+}
+
+// Owner describes the owner and group of a file.
+type Owner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// Lookup returns the entry recorded for the given path.
+func (m *Manifest) Lookup(path string) (Entry, bool) {
+	path = cleanPath(path)
+	for _, e := range m.Entries {
+		if e.Path == path {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// generation is the manifest of a filesystem which is being generated.
+type generation struct {
+	m     *Manifest
+	index map[string]int
+}
+
+func (g *generation) lookup(path string) (Entry, bool) {
+	i, ok := g.index[cleanPath(path)]
+	if !ok {
+		return Entry{}, false
+	}
+	return g.m.Entries[i], true
+}
+
+var (
+	// manifestLock serializes updates to manifests.
+	manifestLock sync.Mutex
+	// generating holds the manifests of filesystems between calls to Begin
+	// and End, which are kept in memory rather than rewritten on every
+	// update.
+	generating = map[billy.Filesystem]*generation{}
+
+	// geteuid and getegid are replaced by tests.
+	geteuid, getegid = os.Geteuid, os.Getegid
+)
+
+// Begin keeps the manifest of the filesystem in memory until End is called,
+// so metadata recorded while generating the filesystem is written once.
+func Begin(fs billy.Filesystem) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	m, err := readManifest(fs)
+	if err != nil {
+		return err
+	}
+	if _, onHost := hostPath(fs, "/"); onHost && geteuid() != 0 && m.Generator == nil {
+		m.Generator = &Owner{UID: geteuid(), GID: getegid()}
+	}
+	g := &generation{m: m, index: make(map[string]int, len(m.Entries))}
+	for i, e := range m.Entries {
+		g.index[e.Path] = i
+	}
+	generating[fs] = g
+	return nil
+}
+
+// End writes the manifest kept in memory since Begin was called.
+func End(fs billy.Filesystem) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	g, ok := generating[fs]
+	if !ok {
+		return nil
+	}
+	delete(generating, fs)
+	if len(g.m.Entries) == 0 && g.m.Generator == nil {
+		return nil
+	}
+	return writeManifest(fs, g.m)
+}
+
+// Load reads the manifest of the filesystem. An empty manifest is returned
+// if none exists.
+func Load(fs billy.Filesystem) (*Manifest, error) {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	if g, ok := generating[fs]; ok {
+		entries := append([]Entry(nil), g.m.Entries...)
+		sortEntries(entries)
+		return &Manifest{Generator: g.m.Generator, Entries: entries}, nil
+	}
+	return readManifest(fs)
+}
+
+func readManifest(fs billy.Filesystem) (*Manifest, error) {
+	f, err := fs.Open(ManifestPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Manifest{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", ManifestPath, err)
+	}
+	return &m, nil
+}
+
+func writeManifest(fs billy.Filesystem, m *Manifest) error {
+	sortEntries(m.Entries)
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := fs.OpenFile(ManifestPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+}
+
+// lookupRecorded returns the entry recorded for the given path, along with the
+// generator of the filesystem.
+func lookupRecorded(fs billy.Filesystem, path string) (Entry, bool, *Owner, error) {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	if g, ok := generating[fs]; ok {
+		e, ok := g.lookup(path)
+		return e, ok, g.m.Generator, nil
+	}
+	m, err := readManifest(fs)
+	if err != nil {
+		return Entry{}, false, nil, err
+	}
+	e, ok := m.Lookup(path)
+	return e, ok, m.Generator, nil
+}
+
+// merge returns the entry to record in place of existing. Ownership
+// recorded for a path is kept when the path is later recorded as a special
+// file, and vice-versa.
+func merge(existing, e Entry) Entry {
+	if e.Type == TypeReg && existing.Type != TypeReg {
+		existing.UID, existing.GID = e.UID, e.GID
+		return existing
+	}
+	if e.Type != TypeReg && existing.Type == TypeReg {
+		e.UID, e.GID = existing.UID, existing.GID
+	}
+	return e
+}
+
+// record merges the given entry into the manifest of the filesystem.
+func record(fs billy.Filesystem, e Entry) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	e.Path = cleanPath(e.Path)
+
+	if g, ok := generating[fs]; ok {
+		if i, exists := g.index[e.Path]; exists {
+			g.m.Entries[i] = merge(g.m.Entries[i], e)
+		} else {
+			g.index[e.Path] = len(g.m.Entries)
+			g.m.Entries = append(g.m.Entries, e)
+		}
+		return nil
+	}
+
+	m, err := readManifest(fs)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, existing := range m.Entries {
+		if existing.Path == e.Path {
+			m.Entries[i], found = merge(existing, e), true
+		}
+	}
+	if !found {
+		m.Entries = append(m.Entries, e)
+	}
+	return writeManifest(fs, m)
+}
+
+func cleanPath(path string) string {
+	return filepath.Join("/", path)
+}
+
+// hostPath returns the path on the host to the given file, or false if
+// the filesystem is not backed by a host directory.
+func hostPath(fs billy.Filesystem, path string) (string, bool) {
+	ch, ok := fs.(*chroot.ChrootHelper)
+	if !ok {
+		return "", false
+	}
+	var underlying billy.Basic = ch
+	for {
+		u, ok := underlying.(interface{ Underlying() billy.Basic })
+		if !ok {
+			break
+		}
+		underlying = u.Underlying()
+	}
+	if _, isOS := underlying.(*osfs.OS); !isOS {
+		return "", false
+	}
+	return filepath.Join(ch.Root(), path), true
+}
+
+// unapplicable returns true if the error indicates metadata cannot be
+// applied by the current user, and should be recorded instead.
+func unapplicable(err error) bool {
+	return os.IsPermission(err) || err == syscall.EPERM
+}
+
+// FileMode converts unix permission bits, such as those parsed from an
+// octal mode string, into a os.FileMode.
+func FileMode(mode uint32) os.FileMode {
+	out := os.FileMode(mode) & os.ModePerm
+	if mode&unix.S_ISUID != 0 {
+		out |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		out |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		out |= os.ModeSticky
+	}
+	return out
+}
+
+// UnixMode converts the permission bits of a os.FileMode into unix
+// permission bits.
+func UnixMode(mode os.FileMode) uint32 {
+	out := uint32(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		out |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		out |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		out |= unix.S_ISVTX
+	}
+	return out
+}
+
+// Chown sets the owner and group of the file at path. Setuid and setgid
+// bits, which the kernel clears on a change of ownership, are preserved.
+// Ownership is always recorded when running as an unprivileged user, as
+// files it creates are otherwise taken to be owned by root.
+func Chown(fs billy.Filesystem, path string, uid, gid int) error {
+	hp, ok := hostPath(fs, path)
+	if !ok || geteuid() != 0 {
+		return record(fs, Entry{Path: path, UID: uid, GID: gid})
+	}
+	st, err := os.Lstat(hp)
+	if err != nil {
+		return err
+	}
+	if err := os.Lchown(hp, uid, gid); err != nil {
+		if unapplicable(err) {
+			return record(fs, Entry{Path: path, UID: uid, GID: gid})
+		}
+		return err
+	}
+	if st.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 && st.Mode()&os.ModeSymlink == 0 {
+		return os.Chmod(hp, st.Mode())
+	}
+	return nil
+}
+
+// Mknod creates the device node or FIFO described by the entry.
+func Mknod(fs billy.Filesystem, e Entry) error {
+	var mode uint32
+	switch e.Type {
+	case TypeChar:
+		mode = unix.S_IFCHR
+	case TypeBlock:
+		mode = unix.S_IFBLK
+	case TypeFifo:
+		mode = unix.S_IFIFO
+	default:
+		return fmt.Errorf("cannot create special file of type %q", e.Type)
+	}
+
+	hp, ok := hostPath(fs, e.Path)
+	if !ok {
+		return record(fs, e)
+	}
+	if err := unix.Mknod(hp, mode|UnixMode(e.Mode), int(unix.Mkdev(e.Major, e.Minor))); err != nil {
+		switch {
+		case unapplicable(err):
+			return record(fs, e)
+		case err == unix.EEXIST:
+			existing, err := Lookup(fs, e.Path)
+			if err != nil {
+				return err
+			}
+			if existing.Type != e.Type || existing.Major != e.Major || existing.Minor != e.Minor {
+				return fmt.Errorf("file exists but is not a matching %s", e.Type)
+			}
+			return nil
+		}
+		return &os.PathError{Op: "mknod", Path: hp, Err: err}
+	}
+	// The mode given to mknod is subject to the umask.
+	return os.Chmod(hp, e.Mode)
+}
+
+// Link creates a hardlink at path to the file at target.
+func Link(fs billy.Filesystem, path, target string) error {
+	hp, ok := hostPath(fs, path)
+	if !ok {
+		return record(fs, Entry{Path: path, Type: TypeHardlink, Link: cleanPath(target)})
+	}
+	ht, _ := hostPath(fs, target)
+	if err := os.Link(ht, hp); err != nil {
+		switch {
+		case unapplicable(err):
+			return record(fs, Entry{Path: path, Type: TypeHardlink, Link: cleanPath(target)})
+		case os.IsExist(err):
+			linked, err := Linked(fs, path, target)
+			if err != nil {
+				return err
+			}
+			if !linked {
+				return fmt.Errorf("file exists but is not a hardlink to %q", target)
+			}
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Linked returns true if path is a hardlink to target.
+func Linked(fs billy.Filesystem, path, target string) (bool, error) {
+	e, ok, _, err := lookupRecorded(fs, path)
+	if err != nil {
+		return false, err
+	}
+	if ok && e.Type == TypeHardlink {
+		return e.Link == cleanPath(target), nil
+	}
+	st, err := fs.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	tst, err := fs.Lstat(target)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(st, tst), nil
+}
+
+// Lookup returns the metadata of the file at path, combining the file on
+// the filesystem with any metadata recorded in the manifest. Files owned by
+// the unprivileged user which generated the filesystem are reported as
+// owned by root, as they were created on behalf of root.
+func Lookup(fs billy.Filesystem, path string) (Entry, error) {
+	recorded, isRecorded, generator, err := lookupRecorded(fs, path)
+	if err != nil {
+		return Entry{}, err
+	}
+	if isRecorded && recorded.Type != TypeReg {
+		return recorded, nil
+	}
+
+	st, err := fs.Lstat(path)
+	if err != nil {
+		return Entry{}, err
+	}
+	e := Entry{Path: cleanPath(path), Mode: st.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)}
+	switch m := st.Mode(); {
+	case m.IsDir():
+		e.Type = TypeDir
+	case m&os.ModeSymlink != 0:
+		e.Type = TypeSymlink
+	case m&os.ModeNamedPipe != 0:
+		e.Type = TypeFifo
+	case m&os.ModeCharDevice != 0:
+		e.Type = TypeChar
+	case m&os.ModeDevice != 0:
+		e.Type = TypeBlock
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		e.UID, e.GID = int(sys.Uid), int(sys.Gid)
+		if generator != nil && e.UID == generator.UID {
+			e.UID = 0
+		}
+		if generator != nil && e.GID == generator.GID {
+			e.GID = 0
+		}
+		if e.Type == TypeChar || e.Type == TypeBlock {
+			e.Major, e.Minor = unix.Major(uint64(sys.Rdev)), unix.Minor(uint64(sys.Rdev))
+		}
+	}
+	if isRecorded {
+		e.UID, e.GID = recorded.UID, recorded.GID
+	}
+	return e, nil
+}
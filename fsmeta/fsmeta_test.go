@@ -0,0 +1,206 @@
+package fsmeta
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+)
+
+func writeFile(t *testing.T, fs billy.Filesystem, path string) {
+	t.Helper()
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordedWhenNotOnHost(t *testing.T) {
+	fs := memfs.New()
+	writeFile(t, fs, "/etc/shadow")
+
+	if err := Chown(fs, "/etc/shadow", 0, 42); err != nil {
+		t.Fatalf("Chown() failed: %v", err)
+	}
+	if err := Mknod(fs, Entry{Path: "/dev/sda", Type: TypeBlock, Mode: 0660, Major: 8}); err != nil {
+		t.Fatalf("Mknod() failed: %v", err)
+	}
+	if err := Chown(fs, "/dev/sda", 0, 6); err != nil {
+		t.Fatalf("Chown() failed: %v", err)
+	}
+	if err := Link(fs, "/etc/shadow-", "etc/shadow"); err != nil {
+		t.Fatalf("Link() failed: %v", err)
+	}
+
+	m, err := Load(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Manifest{Entries: []Entry{
+		{Path: "/dev/sda", Type: TypeBlock, Mode: 0660, GID: 6, Major: 8},
+		{Path: "/etc/shadow", GID: 42},
+		{Path: "/etc/shadow-", Type: TypeHardlink, Link: "/etc/shadow"},
+	}}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("manifest differs (+got, -want):\n%s", diff)
+	}
+
+	got, err := Lookup(fs, "etc/shadow")
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if diff := cmp.Diff(Entry{Path: "/etc/shadow", Mode: 0644, GID: 42}, got); diff != "" {
+		t.Errorf("Lookup() differs (+got, -want):\n%s", diff)
+	}
+	if linked, err := Linked(fs, "/etc/shadow-", "/etc/shadow"); err != nil || !linked {
+		t.Errorf("Linked() = %v, %v, want true", linked, err)
+	}
+}
+
+func TestAppliedOnHost(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	fs := osfs.New(d)
+	writeFile(t, fs, "/a")
+
+	if err := Mknod(fs, Entry{Path: "/fifo", Type: TypeFifo, Mode: 0600}); err != nil {
+		t.Fatalf("Mknod() failed: %v", err)
+	}
+	if err := Link(fs, "/b", "/a"); err != nil {
+		t.Fatalf("Link() failed: %v", err)
+	}
+
+	got, err := Lookup(fs, "/fifo")
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if diff := cmp.Diff(Entry{Path: "/fifo", Type: TypeFifo, Mode: 0600}, got); diff != "" {
+		t.Errorf("Lookup() differs (+got, -want):\n%s", diff)
+	}
+	if linked, err := Linked(fs, "/b", "/a"); err != nil || !linked {
+		t.Errorf("Linked() = %v, %v, want true", linked, err)
+	}
+	if _, err := fs.Stat(ManifestPath); !os.IsNotExist(err) {
+		t.Errorf("metadata was recorded in a manifest, but should have been applied")
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	tcs := []struct {
+		mode uint32
+		want os.FileMode
+	}{
+		{0644, 0644},
+		{04755, 0755 | os.ModeSetuid},
+		{02755, 0755 | os.ModeSetgid},
+		{01777, 0777 | os.ModeSticky},
+	}
+	for _, tc := range tcs {
+		if got := FileMode(tc.mode); got != tc.want {
+			t.Errorf("FileMode(%#o) = %v, want %v", tc.mode, got, tc.want)
+		}
+		if got := UnixMode(tc.want); got != tc.mode {
+			t.Errorf("UnixMode(%v) = %#o, want %#o", tc.want, got, tc.mode)
+		}
+	}
+}
+
+func TestRecordedUntilEnd(t *testing.T) {
+	fs := memfs.New()
+	writeFile(t, fs, "/etc/shadow")
+
+	if err := Begin(fs); err != nil {
+		t.Fatalf("Begin() failed: %v", err)
+	}
+	if err := Chown(fs, "/etc/shadow", 0, 42); err != nil {
+		t.Fatalf("Chown() failed: %v", err)
+	}
+	if err := Mknod(fs, Entry{Path: "/dev/null", Type: TypeChar, Mode: 0666, Major: 1, Minor: 3}); err != nil {
+		t.Fatalf("Mknod() failed: %v", err)
+	}
+	if _, err := fs.Stat(ManifestPath); !os.IsNotExist(err) {
+		t.Errorf("manifest was written before End()")
+	}
+	got, err := Lookup(fs, "/etc/shadow")
+	if err != nil {
+		t.Fatalf("Lookup() failed: %v", err)
+	}
+	if diff := cmp.Diff(Entry{Path: "/etc/shadow", Mode: 0644, GID: 42}, got); diff != "" {
+		t.Errorf("Lookup() differs (+got, -want):\n%s", diff)
+	}
+
+	if err := End(fs); err != nil {
+		t.Fatalf("End() failed: %v", err)
+	}
+	m, err := Load(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Manifest{Entries: []Entry{
+		{Path: "/dev/null", Type: TypeChar, Mode: 0666, Major: 1, Minor: 3},
+		{Path: "/etc/shadow", GID: 42},
+	}}
+	if diff := cmp.Diff(want, m); diff != "" {
+		t.Errorf("manifest differs (+got, -want):\n%s", diff)
+	}
+}
+
+func TestUnprivilegedOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("files owned by another user can only be created as root")
+	}
+	defer func(u, g func() int) { geteuid, getegid = u, g }(geteuid, getegid)
+	geteuid = func() int { return 1000 }
+	getegid = func() int { return 1000 }
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	fs := osfs.New(d)
+
+	if err := Begin(fs); err != nil {
+		t.Fatalf("Begin() failed: %v", err)
+	}
+	// Files created by the generating user, one of which is declared to
+	// be owned by that user.
+	for _, p := range []string{"/home", "/etc"} {
+		if err := os.Mkdir(filepath.Join(d, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Lchown(filepath.Join(d, p), 1000, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Chown(fs, "/home", 1000, 1000); err != nil {
+		t.Fatalf("Chown() failed: %v", err)
+	}
+	if err := End(fs); err != nil {
+		t.Fatalf("End() failed: %v", err)
+	}
+
+	for p, want := range map[string]Entry{
+		"/home": {Path: "/home", Type: TypeDir, Mode: 0755, UID: 1000, GID: 1000},
+		"/etc":  {Path: "/etc", Type: TypeDir, Mode: 0755},
+	} {
+		got, err := Lookup(fs, p)
+		if err != nil {
+			t.Fatalf("Lookup(%q) failed: %v", p, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Lookup(%q) differs (+got, -want):\n%s", p, diff)
+		}
+	}
+}
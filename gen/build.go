@@ -10,15 +10,22 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/gen/buildstep"
 	"github.com/twitchylinux/ccr/proc"
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/common"
+	"github.com/twitchylinux/ccr/vts/match"
 	"go.starlark.net/starlark"
 	"gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/osfs"
@@ -32,6 +39,10 @@ type RunningBuild struct {
 	fs          billy.Filesystem
 	envVars     map[string]string
 	steps       []*vts.BuildStep
+
+	checks OutputChecks
+	// warnings receives warnings about the outputs of the build.
+	warnings io.Writer
 }
 
 func (rb *RunningBuild) OverlayMountPath() string {
@@ -98,6 +109,13 @@ func (rb *RunningBuild) patch(gc GenerationContext, path string, patch vts.Targe
 			}
 		}
 		return nil
+	case *vts.Virtual:
+		for _, dep := range t.Dependencies() {
+			if err := rb.patch(gc, path, dep); err != nil {
+				return err
+			}
+		}
+		return nil
 	case *vts.Resource:
 		return rb.injectResourceToPath(gc, t, filepath.Join(rb.OverlayUpperPath(), path))
 	}
@@ -155,7 +173,9 @@ func (rb *RunningBuild) Inject(gc GenerationContext, injections []vts.TargetRef)
 }
 
 func (rb *RunningBuild) inject(gc GenerationContext, pt vts.Target, doneTargets map[vts.Target]struct{}) error {
-	if _, isComponent := pt.(*vts.Component); !isComponent {
+	_, isComponent := pt.(*vts.Component)
+	_, isVirtual := pt.(*vts.Virtual)
+	if !isComponent && !isVirtual {
 		if _, done := doneTargets[pt]; done {
 			return nil
 		}
@@ -171,8 +191,8 @@ func (rb *RunningBuild) inject(gc GenerationContext, pt vts.Target, doneTargets
 		defer fsr.Close()
 		return writeMultiFiles(gc.Cache, rb.fs, rb.OverlayPatchPath(), fsr)
 
-	case *vts.Component:
-		for _, d := range t.Dependencies() {
+	case *vts.Component, *vts.Virtual:
+		for _, d := range t.(vts.DepTarget).Dependencies() {
 			if err := rb.inject(gc, d.Target, doneTargets); err != nil {
 				return vts.WrapWithActionTarget(err, t)
 			}
@@ -192,6 +212,12 @@ var permittedInjectGenerators = map[*vts.Generator]struct{}{
 	common.SysLibUnionLinkerscript: struct{}{},
 }
 
+// scopedRunner is implemented by generator runners which only write to the
+// output path of the resource being generated, and so can be injected.
+type scopedRunner interface {
+	OutputScoped() bool
+}
+
 func (rb *RunningBuild) injectResourceToPath(gc GenerationContext, t *vts.Resource, path string) error {
 	if t.Source == nil {
 		return vts.WrapWithTarget(errors.New("cannot inject using virtual resource"), t)
@@ -200,12 +226,41 @@ func (rb *RunningBuild) injectResourceToPath(gc GenerationContext, t *vts.Resour
 	gc.Inputs = &vts.InputSet{Resource: t}
 	if gen, isGen := t.Source.Target.(*vts.Generator); isGen {
 		if _, permitted := permittedInjectGenerators[gen]; !permitted {
-			return vts.WrapWithTarget(errors.New("cannot inject generator targets"), t)
+			sr, isScoped := gen.Runner.(scopedRunner)
+			if !isScoped || !sr.OutputScoped() {
+				return vts.WrapWithTarget(errors.New("cannot inject generator targets"), t)
+			}
+			inputs, err := injectInputSet(t, gen)
+			if err != nil {
+				return vts.WrapWithTarget(err, t)
+			}
+			gc.Inputs = inputs
 		}
 	}
 	return PopulateResource(gc, t, t.Source.Target)
 }
 
+// injectInputSet computes the inputs to a generator used to inject a
+// resource into a build.
+func injectInputSet(t *vts.Resource, gen *vts.Generator) (*vts.InputSet, error) {
+	out := &vts.InputSet{
+		Resource: t,
+		Directs:  make([]vts.Target, 0, len(t.Deps)+len(gen.Inputs)),
+	}
+	for _, d := range t.Deps {
+		out.Directs = append(out.Directs, d.Target)
+	}
+	for i, inp := range gen.Inputs {
+		switch input := inp.Target.(type) {
+		case *vts.Resource, *vts.Component:
+			out.Directs = append(out.Directs, input)
+		default:
+			return nil, fmt.Errorf("cannot inject generator with input[%d] of type %T", i, inp.Target)
+		}
+	}
+	return out, nil
+}
+
 func (rb *RunningBuild) Generate(c *cache.Cache, o, e io.Writer) error {
 	// cmd := exec.Command("find", rb.OverlayUpperPath())
 	// cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
@@ -243,14 +298,56 @@ func (rb *RunningBuild) Generate(c *cache.Cache, o, e io.Writer) error {
 	return nil
 }
 
+// buildOutput describes a file in the overlay of a build which is part of
+// the output of the build.
+type buildOutput struct {
+	path, relPath, outPath string
+	info                   os.FileInfo
+	// target is the target of a symlink.
+	target string
+}
+
+// maxUncapturedListed is the number of uncaptured files listed when
+// reporting the files a build produced but did not output.
+const maxUncapturedListed = 10
+
+// sourceDateEpoch returns the time the outputs of a build are clamped to,
+// which is the SOURCE_DATE_EPOCH of the build environment.
+func sourceDateEpoch(envVars map[string]string) (time.Time, error) {
+	secs, err := strconv.ParseInt(envVars["SOURCE_DATE_EPOCH"], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH: %v", err)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// isPatchedIn returns true if the build-relative path was patched into the
+// build from one of its inputs, rather than produced by the build.
+func isPatchedIn(b *vts.Build, relPath string) bool {
+	for p := range b.PatchIns {
+		p = strings.Trim(p, "/")
+		if relPath == p || strings.HasPrefix(relPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 func (rb *RunningBuild) WriteToCache(c *cache.Cache, b *vts.Build, hash []byte) error {
-	fs, err := c.CommitFileset(hash)
+	epoch, err := sourceDateEpoch(rb.envVars)
 	if err != nil {
 		return err
 	}
-	defer fs.Close()
 
 	buildDir, outPathMatcher := rb.env.OverlayUpperPath(), b.OutputMappings()
+	if outPathMatcher == nil {
+		outPathMatcher = &match.FilenameRules{}
+	}
+	var (
+		outputs    []buildOutput
+		uncaptured []string
+		ruleHits   = make([]int, len(outPathMatcher.Rules))
+	)
 	err = filepath.Walk(buildDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -267,31 +364,139 @@ func (rb *RunningBuild) WriteToCache(c *cache.Cache, b *vts.Build, hash []byte)
 		if err != nil {
 			return err
 		}
-		if outPath := outPathMatcher.Match(relPath); outPath != "" {
-			if info.Mode()&os.ModeSymlink != 0 {
-				target, err := os.Readlink(path)
-				if err != nil {
-					return err
-				}
-				if !strings.Contains(target, "..") {
-					// Only do ones we can be sure are safe.
-					if err := fs.AddSymlink(outPath, info, target); err != nil {
-						return err
-					}
-				}
-				return nil
+		outPath, rule := outPathMatcher.Matching(relPath)
+		if outPath == "" {
+			if !isPatchedIn(b, relPath) {
+				uncaptured = append(uncaptured, relPath)
 			}
-			src, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			if err := fs.AddFile(outPath, info, src); err != nil {
+			return nil
+		}
+		ruleHits[rule]++
+		o := buildOutput{path: path, relPath: relPath, outPath: outPath, info: info}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if o.target, err = os.Readlink(path); err != nil {
 				return err
 			}
 		}
+		outputs = append(outputs, o)
 		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+
+	if b.StrictOutputs || rb.checks.Strict {
+		var unmatched []string
+		for i, n := range ruleHits {
+			if n == 0 {
+				unmatched = append(unmatched, outPathMatcher.Rules[i].String())
+			}
+		}
+		if len(unmatched) > 0 {
+			return fmt.Errorf("output rules matched no files: %s", strings.Join(unmatched, ", "))
+		}
+	}
+	outputs, escaping := containedOutputs(outputs)
+	for _, o := range escaping {
+		uncaptured = append(uncaptured, fmt.Sprintf("%s (symlink to %s, outside the outputs)", o.relPath, o.target))
+	}
+	if err := rb.checkUncaptured(uncaptured); err != nil {
+		return err
+	}
+
+	fs, err := c.CommitFileset(hash)
+	if err != nil {
+		return err
+	}
+	// Builds run as root within a user namespace, which maps to the
+	// current user outside of it.
+	fs.MapOwnerToRoot(os.Getuid(), os.Getgid())
+	fs.ClampModTime(epoch)
+
+	// Outputs are written in order of their output path, so the fileset
+	// does not depend on the layout of the build directory.
+	sort.SliceStable(outputs, func(i, j int) bool { return outputs[i].outPath < outputs[j].outPath })
+	// Files with multiple links are written in full once, and as hardlinks
+	// to that output path thereafter.
+	linkedPaths := make(map[uint64]string, 8)
+	for _, o := range outputs {
+		if err := writeBuildOutput(fs, o, linkedPaths); err != nil {
+			fs.Abort()
+			return err
+		}
+	}
+	return fs.Close()
+}
+
+// containedOutputs splits the outputs of a build into those which can be
+// safely written, and symlinks which refer to files outside the outputs.
+// Symlinks with '..' in their target are only kept if they are relative and
+// resolve to an output, or a directory containing an output.
+func containedOutputs(outputs []buildOutput) (kept, escaping []buildOutput) {
+	captured := make(map[string]bool, len(outputs))
+	for _, o := range outputs {
+		for p := o.outPath; p != "." && p != "/"; p = path.Dir(p) {
+			captured[p] = true
+		}
+	}
+
+	kept = outputs[:0]
+	for _, o := range outputs {
+		if o.info.Mode()&os.ModeSymlink != 0 && strings.Contains(o.target, "..") {
+			if path.IsAbs(o.target) || !captured[path.Join(path.Dir(o.outPath), o.target)] {
+				escaping = append(escaping, o)
+				continue
+			}
+		}
+		kept = append(kept, o)
+	}
+	return kept, escaping
+}
+
+// checkUncaptured reports files the build produced which were not written
+// as outputs, failing the build if configured to do so.
+func (rb *RunningBuild) checkUncaptured(uncaptured []string) error {
+	if len(uncaptured) == 0 {
+		return nil
+	}
+	sort.Strings(uncaptured)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "%d file(s) were produced but not captured as outputs:", len(uncaptured))
+	for i, p := range uncaptured {
+		if i == maxUncapturedListed {
+			fmt.Fprintf(&msg, "\n  ... and %d more", len(uncaptured)-i)
+			break
+		}
+		fmt.Fprintf(&msg, "\n  %s", p)
+	}
+
+	if rb.checks.FailUncaptured {
+		return errors.New(msg.String())
+	}
+	if rb.warnings != nil {
+		fmt.Fprintf(rb.warnings, "-\033[1;33mWarning\033[0m: %s\n", msg.String())
+	}
+	return nil
+}
+
+func writeBuildOutput(fs *cache.PendingFileset, o buildOutput, linkedPaths map[uint64]string) error {
+	if o.info.Mode()&os.ModeSymlink != 0 {
+		return fs.AddSymlink(o.outPath, o.info, o.target)
+	}
+	if o.info.Mode()&(os.ModeNamedPipe|os.ModeDevice) != 0 {
+		return fs.AddSpecial(o.outPath, o.info)
+	}
+	if st, ok := o.info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		if target, seen := linkedPaths[st.Ino]; seen {
+			return fs.AddHardlink(o.outPath, o.info, target)
+		}
+		linkedPaths[st.Ino] = o.outPath
+	}
+	src, err := os.Open(o.path)
+	if err != nil {
+		return err
+	}
+	return fs.AddFile(o.outPath, o.info, src)
 }
 
 func writeMultiFiles(c *cache.Cache, fs billy.Filesystem, p string, fr fileset) error {
@@ -316,21 +521,61 @@ func writeMultiFiles(c *cache.Cache, fs billy.Filesystem, p string, fr fileset)
 			}
 
 		case tar.TypeReg:
-			outFile, err := fs.OpenFile(filepath.Join(p, path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, h.FileInfo().Mode())
-			if err != nil {
-				return vts.WrapWithPath(fmt.Errorf("open from fileset: %v", err), path)
+			if err := writeFile(fs, fr, filepath.Join(p, path), headerMode(h), h.Size); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("writing from fileset: %v", err), path)
+			}
+
+		case tar.TypeLink:
+			if err := fs.MkdirAll(filepath.Dir(filepath.Join(p, path)), 0755); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("mkdir from fileset: %v", err), path)
 			}
-			if _, err := io.Copy(outFile, fr); err != nil {
-				outFile.Close()
-				return vts.WrapWithPath(fmt.Errorf("copying from fileset: %v", err), path)
+			if err := fsmeta.Link(fs, filepath.Join(p, path), filepath.Join(p, h.Linkname)); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("hardlink from fileset: %v", err), path)
+			}
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := fs.MkdirAll(filepath.Dir(filepath.Join(p, path)), 0755); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("mkdir from fileset: %v", err), path)
+			}
+			e := fsmeta.Entry{
+				Path:  filepath.Join(p, path),
+				Type:  fsmeta.TypeFifo,
+				Mode:  headerMode(h),
+				Major: uint32(h.Devmajor),
+				Minor: uint32(h.Devminor),
+			}
+			switch h.Typeflag {
+			case tar.TypeChar:
+				e.Type = fsmeta.TypeChar
+			case tar.TypeBlock:
+				e.Type = fsmeta.TypeBlock
+			}
+			if err := fsmeta.Mknod(fs, e); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("mknod from fileset: %v", err), path)
+			}
+
+		default:
+			continue
+		}
+
+		if h.Uid != 0 || h.Gid != 0 {
+			if err := fsmeta.Chown(fs, filepath.Join(p, path), h.Uid, h.Gid); err != nil {
+				return vts.WrapWithPath(fmt.Errorf("chown from fileset: %v", err), path)
 			}
-			outFile.Close()
 		}
 	}
 
 	return nil
 }
 
+// headerMode returns the permissions of the file described by a fileset
+// header. Filesets written by ccr encode os.FileMode bits, which tar does
+// not interpret for setuid, setgid and sticky bits.
+func headerMode(h *tar.Header) os.FileMode {
+	special := os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	return h.FileInfo().Mode()&(os.ModePerm|special) | os.FileMode(h.Mode)&special
+}
+
 func determinePrefix(prefix string) string {
 	if i := strings.LastIndex(prefix, ":"); i > 0 && !strings.HasSuffix(prefix, ":build") {
 		prefix = prefix[i+1:]
@@ -343,6 +588,73 @@ func determinePrefix(prefix string) string {
 	return prefix
 }
 
+// isBuildCached returns true if the output of the build is cached. Builds
+// which produce a root filesystem are only cached if their chroot is also
+// present, as the chroot is not part of the fileset and so cannot be
+// recovered from it.
+func isBuildCached(c *cache.Cache, b *vts.Build, bh []byte) (bool, error) {
+	if b.ProducesRootFS {
+		if _, err := c.Chroot(bh, false); err != nil {
+			if err == cache.ErrCacheMiss {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return c.IsHashCached(bh)
+}
+
+// inputBuilds adds the builds whose output is read to provide t as the input
+// of another build.
+func inputBuilds(t vts.Target, out map[*vts.Build]struct{}) {
+	switch t := t.(type) {
+	case *vts.Build:
+		out[t] = struct{}{}
+	case *vts.Sieve:
+		for _, inp := range t.Inputs {
+			inputBuilds(inp.Target, out)
+		}
+	case *vts.Component, *vts.Virtual:
+		for _, d := range t.(vts.DepTarget).Dependencies() {
+			inputBuilds(d.Target, out)
+		}
+	case *vts.Resource:
+		if t.Source != nil {
+			inputBuilds(t.Source.Target, out)
+		}
+	}
+}
+
+// pinInputs pins the outputs of the builds read by b, so they cannot be
+// garbage collected while b is running. The returned function unpins them.
+func pinInputs(gc GenerationContext, b *vts.Build) (unpin func(), err error) {
+	builds := make(map[*vts.Build]struct{}, 8)
+	for _, inp := range b.NeedInputs() {
+		inputBuilds(inp.Target, builds)
+	}
+
+	unpins := make([]func(), 0, len(builds))
+	unpin = func() {
+		for _, u := range unpins {
+			u()
+		}
+	}
+	for ib := range builds {
+		h, err := ib.RollupHash(gc.RunnerEnv, proc.EvalComputedAttribute)
+		if err != nil {
+			unpin()
+			return nil, vts.WrapWithTarget(err, ib)
+		}
+		u, err := gc.Cache.Pin(h)
+		if err != nil {
+			unpin()
+			return nil, vts.WrapWithTarget(fmt.Errorf("pinning output: %v", err), ib)
+		}
+		unpins = append(unpins, u)
+	}
+	return unpin, nil
+}
+
 // generateBuild executes a build if the result is not already cached.
 func generateBuild(gc GenerationContext, b *vts.Build) error {
 	bh, err := b.RollupHash(gc.RunnerEnv, proc.EvalComputedAttribute)
@@ -350,15 +662,30 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 		return vts.WrapWithTarget(err, b)
 	}
 	// See if its already cached.
-	isCached, err := gc.Cache.IsHashCached(bh)
+	isCached, err := isBuildCached(gc.Cache, b, bh)
 	if err != nil {
 		return err
 	}
 	if isCached {
 		return nil
 	}
+	// Wait for anyone else building the same hash, and use their output
+	// if they succeeded.
+	unlock, err := gc.Cache.LockHash(bh)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if isCached, err = isBuildCached(gc.Cache, b, bh); err != nil || isCached {
+		return err
+	}
+	return runBuild(gc, b, bh, gc.Cache)
+}
 
-	envVars := make(map[string]string, len(b.Env))
+// runBuild performs a build, writing its output to the cache out. Sources
+// and the outputs of other builds are read from the cache of gc.
+func runBuild(gc GenerationContext, b *vts.Build, bh []byte, out *cache.Cache) error {
+	envVars := make(map[string]string, len(b.Env)+1)
 	for k, v := range b.Env {
 		if ss, ok := v.(starlark.String); ok {
 			envVars[k] = string(ss)
@@ -366,6 +693,11 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 			envVars[k] = v.String()
 		}
 	}
+	// Tools which embed timestamps should use a fixed time, unless the
+	// build specifies one.
+	if _, ok := envVars["SOURCE_DATE_EPOCH"]; !ok {
+		envVars["SOURCE_DATE_EPOCH"] = "0"
+	}
 
 	prefix := determinePrefix(b.GlobalPath())
 	msg := fmt.Sprintf("Starting \033[1;36m%s\033[0m of \033[1;33m%s\033[0m\n", "build", b.GlobalPath())
@@ -382,9 +714,23 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 		if rootDir, err = gc.Cache.Chroot(rootHash, false); err != nil {
 			return err
 		}
+		// Prevent the chroot being garbage collected while we are using it.
+		unpin, err := gc.Cache.PinChroot(rootHash)
+		if err != nil {
+			return err
+		}
+		defer unpin()
+	}
+	// Likewise for the outputs of builds which are patched in or injected.
+	unpinInputs, err := pinInputs(gc, b)
+	if err != nil {
+		return err
 	}
+	defer unpinInputs()
 
-	env, err := proc.NewEnv(false, rootDir)
+	// Builds run without access to the network or the host environment,
+	// so they behave the same on any host.
+	env, err := proc.NewEnvWithOptions(rootDir, proc.EnvOptions{Hermetic: true, Network: b.AllowNetwork})
 	if err != nil {
 		return vts.WrapWithTarget(fmt.Errorf("creating build environment: %v", err), b)
 	}
@@ -394,6 +740,8 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 		fs:          osfs.New(rootDir),
 		envVars:     envVars,
 		contractDir: b.ContractDir,
+		checks:      gc.OutputChecks,
+		warnings:    gc.Console.Stderr(),
 	}
 	if err := rb.Inject(gc, b.Injections); err != nil {
 		rb.Close()
@@ -412,14 +760,16 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 	var (
 		wg          sync.WaitGroup
 		makeRootErr error
+		chroot      *cache.PendingChroot
 	)
 	if b.ProducesRootFS {
 		// Our artifacts are a chroot base for someone else. Lets write everything to
 		// a chroot directory in parallel.
-		cachePath, err := gc.Cache.Chroot(bh, true)
-		if err != nil {
+		if chroot, err = out.NewChroot(bh); err != nil {
 			return err
 		}
+		defer chroot.Close()
+		cachePath := chroot.Path
 
 		wg.Add(1)
 		go func(upperPath, cachePath string) {
@@ -440,7 +790,8 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 		}(rb.env.OverlayUpperPath(), cachePath)
 	}
 
-	if err := rb.WriteToCache(gc.Cache, b, bh); err != nil {
+	if err := rb.WriteToCache(out, b, bh); err != nil {
+		wg.Wait()
 		rb.Close()
 		return vts.WrapWithTarget(fmt.Errorf("gathering output: %v", err), b)
 	}
@@ -450,5 +801,11 @@ func generateBuild(gc GenerationContext, b *vts.Build) error {
 		rb.Close()
 		return vts.WrapWithTarget(fmt.Errorf("finalizing root FS: %v", err), b)
 	}
+	if chroot != nil {
+		if err := chroot.Commit(); err != nil {
+			rb.Close()
+			return vts.WrapWithTarget(fmt.Errorf("finalizing root FS: %v", err), b)
+		}
+	}
 	return rb.Close()
 }
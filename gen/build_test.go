@@ -3,11 +3,17 @@ package gen
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -120,6 +126,207 @@ func TestBuildWriteToCache(t *testing.T) {
 	}
 }
 
+func TestContainedOutputs(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../file", filepath.Join(d, "link")); err != nil {
+		t.Fatal(err)
+	}
+	fileInfo, err := os.Lstat(filepath.Join(d, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	linkInfo, err := os.Lstat(filepath.Join(d, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := []buildOutput{
+		{outPath: "usr/lib/libfoo.so.1", info: fileInfo},
+		{outPath: "usr/lib/libfoo.so", info: linkInfo, target: "libfoo.so.1"},
+		{outPath: "usr/bin/foo", info: linkInfo, target: "../lib/libfoo.so.1"},
+		{outPath: "usr/share/lib", info: linkInfo, target: "../lib"},
+		{outPath: "usr/bin/missing", info: linkInfo, target: "../lib/libbar.so"},
+		{outPath: "usr/bin/escape", info: linkInfo, target: "../../../etc/passwd"},
+		{outPath: "usr/bin/abs", info: linkInfo, target: "/usr/lib/../lib/libfoo.so.1"},
+	}
+	kept, escaping := containedOutputs(outputs)
+
+	var got []string
+	for _, o := range kept {
+		got = append(got, o.outPath)
+	}
+	if want := []string{"usr/lib/libfoo.so.1", "usr/lib/libfoo.so", "usr/bin/foo", "usr/share/lib"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept = %v, want %v", got, want)
+	}
+	got = nil
+	for _, o := range escaping {
+		got = append(got, o.outPath)
+	}
+	if want := []string{"usr/bin/missing", "usr/bin/escape", "usr/bin/abs"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("escaping = %v, want %v", got, want)
+	}
+}
+
+func TestCheckUncaptured(t *testing.T) {
+	var uncaptured []string
+	for i := 0; i < maxUncapturedListed+2; i++ {
+		uncaptured = append(uncaptured, fmt.Sprintf("src/file%02d.o", i))
+	}
+
+	var warnings bytes.Buffer
+	rb := &RunningBuild{warnings: &warnings}
+	if err := rb.checkUncaptured(uncaptured); err != nil {
+		t.Errorf("checkUncaptured() failed: %v", err)
+	}
+	if !strings.Contains(warnings.String(), "src/file00.o") || !strings.Contains(warnings.String(), "and 2 more") {
+		t.Errorf("warning did not list uncaptured files: %q", warnings.String())
+	}
+
+	rb = &RunningBuild{checks: OutputChecks{FailUncaptured: true}}
+	if err := rb.checkUncaptured(uncaptured); err == nil {
+		t.Error("checkUncaptured() did not fail")
+	}
+	if err := rb.checkUncaptured(nil); err != nil {
+		t.Errorf("checkUncaptured(nil) failed: %v", err)
+	}
+}
+
+func TestIsBuildCached(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	c, err := cache.NewCache(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh := bytes.Repeat([]byte{1}, 32)
+	w, err := c.HashWriter(bh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if cached, err := isBuildCached(c, &vts.Build{}, bh); !cached || err != nil {
+		t.Errorf("isBuildCached() = (%v, %v), want (true, nil)", cached, err)
+	}
+	// Without its chroot, a root_fs build must be performed again.
+	rootFS := &vts.Build{ProducesRootFS: true}
+	if cached, err := isBuildCached(c, rootFS, bh); cached || err != nil {
+		t.Errorf("isBuildCached() = (%v, %v) without chroot, want (false, nil)", cached, err)
+	}
+	if _, err := c.Chroot(bh, true); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := isBuildCached(c, rootFS, bh); !cached || err != nil {
+		t.Errorf("isBuildCached() = (%v, %v) with chroot, want (true, nil)", cached, err)
+	}
+}
+
+func TestIsBuildCachedRemote(t *testing.T) {
+	srvDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srvDir)
+	srv, err := cache.NewServer(srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	c, err := cache.NewCache(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &cache.HTTPRemote{URL: ts.URL}
+	c.UseRemote(remote, cache.RemoteReadOnly)
+
+	// Upload the fileset of a build to the remote only.
+	bh, content := bytes.Repeat([]byte{2}, 32), []byte("fileset")
+	digest := sha256.Sum256(content)
+	if err := remote.Put(base64.RawURLEncoding.EncodeToString(bh)[:36], bytes.NewReader(content), digest[:]); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+
+	if cached, err := isBuildCached(c, &vts.Build{}, bh); !cached || err != nil {
+		t.Errorf("isBuildCached() = (%v, %v), want (true, nil)", cached, err)
+	}
+	// The chroot of a root_fs build is never fetched from the remote, so
+	// the build must be performed locally.
+	if cached, err := isBuildCached(c, &vts.Build{ProducesRootFS: true}, bh); cached || err != nil {
+		t.Errorf("isBuildCached() = (%v, %v) for root_fs build, want (false, nil)", cached, err)
+	}
+}
+
+func TestPinInputs(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	c, err := cache.NewCache(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := &vts.Build{Path: "//pin:input"}
+	ih, err := input.RollupHash(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.HashWriter(ih)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 100))
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	b := &vts.Build{
+		Injections: []vts.TargetRef{{Target: &vts.Sieve{Inputs: []vts.TargetRef{{Target: input}}}}},
+	}
+	unpin, err := pinInputs(GenerationContext{Cache: c}, b)
+	if err != nil {
+		t.Fatalf("pinInputs() failed: %v", err)
+	}
+	stats, err := c.GC(cache.GCPolicy{MaxBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evicted != 0 || stats.Pinned != 1 {
+		t.Errorf("GC() evicted %d entries and skipped %d pinned, want 0 and 1", stats.Evicted, stats.Pinned)
+	}
+
+	unpin()
+	if stats, err = c.GC(cache.GCPolicy{MaxBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evicted != 1 {
+		t.Errorf("GC() evicted %d entries after unpin, want 1", stats.Evicted)
+	}
+}
+
 func TestStepUnpackGz(t *testing.T) {
 	rb, c, d := makeEnv(t, "testdata/cool.tar.gz")
 	defer os.RemoveAll(d)
@@ -481,6 +688,9 @@ func TestPatchingBuildEnv(t *testing.T) {
 				if _, err := io.Copy(w, r); err != nil {
 					t.Fatal(err)
 				}
+				if err := w.Commit(); err != nil {
+					t.Fatal(err)
+				}
 				w.Close()
 			}
 
@@ -649,6 +859,9 @@ func TestPopulateResourceFromBuild(t *testing.T) {
 				if err := sgz.Close(); err != nil {
 					t.Fatal(err)
 				}
+				if err := w.Commit(); err != nil {
+					t.Fatal(err)
+				}
 				w.Close()
 			}
 			if err := PopulateResource(GenerationContext{
@@ -1181,6 +1394,9 @@ func TestBuildInjections(t *testing.T) {
 				if err := sgz.Close(); err != nil {
 					t.Fatal(err)
 				}
+				if err := w.Commit(); err != nil {
+					t.Fatal(err)
+				}
 				w.Close()
 			}
 
@@ -39,6 +39,22 @@ func downloadWithClient(client httpClient, c *cache.Cache, s256 []byte, url stri
 		return nil, err
 	}
 
+	// Wait for anyone else downloading the same file, and use their
+	// download if it succeeded.
+	unlock, err := c.LockHash(s256)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	f, err = c.ByHash(s256)
+	switch {
+	case err == cache.ErrCacheMiss:
+	case err == nil:
+		return f, nil
+	default:
+		return nil, err
+	}
+
 	// Download.
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
@@ -76,9 +92,12 @@ func downloadWithClient(client httpClient, c *cache.Cache, s256 []byte, url stri
 	}
 	if !bytes.Equal(h.Sum(nil), s256) {
 		w.Close()
-		c.DeleteHash(s256)
 		return nil, fmt.Errorf("incorrect hash: %x != %x", s256, h.Sum(nil))
 	}
+	if err := w.Commit(); err != nil {
+		w.Close()
+		return nil, err
+	}
 
 	if _, err := w.Seek(0, os.SEEK_SET); err != nil {
 		w.Close()
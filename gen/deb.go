@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/twitchylinux/ccr/cache"
@@ -38,7 +37,7 @@ func unpackedDeb(c *cache.Cache, src *vts.Puesdo) (*dpkg.Deb, error) {
 			return nil, err
 		}
 	} else {
-		if dr, err = os.Open(filepath.Join(filepath.Dir(src.ContractPath), src.Path)); err != nil {
+		if dr, err = os.Open(src.LocalPath()); err != nil {
 			return nil, err
 		}
 	}
@@ -83,6 +82,9 @@ func (fs *debFileset) Next() (path string, header *tar.Header, err error) {
 
 	fs.r = bytes.NewReader(file.Data)
 	file.Hdr.Name = strings.TrimPrefix(file.Hdr.Name, ".")
+	if file.Hdr.Typeflag == tar.TypeLink {
+		file.Hdr.Linkname = strings.TrimPrefix(file.Hdr.Linkname, ".")
+	}
 	return file.Hdr.Name, &file.Hdr, nil
 }
 
@@ -4,13 +4,12 @@ import (
 	"archive/tar"
 	"errors"
 	"os"
-	"path/filepath"
 
 	"github.com/twitchylinux/ccr/vts"
 )
 
 func filesetForFileSource(src *vts.Puesdo) (*unaryFileset, error) {
-	p := filepath.Join(filepath.Dir(src.ContractPath), src.Path)
+	p := src.LocalPath()
 	s, err := os.Stat(p)
 	if err != nil {
 		return nil, err
@@ -21,6 +21,47 @@ type fileset interface {
 	Read(b []byte) (int, error)
 }
 
+// reopener is implemented by filesets which can open the content of their
+// current file again, independently of the fileset. Reopen returns nil if
+// the current file cannot be reopened.
+type reopener interface {
+	Reopen() func() (io.ReadCloser, error)
+}
+
+func reopenCurrent(fs fileset) func() (io.ReadCloser, error) {
+	if r, ok := fs.(reopener); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// referencingFS is implemented by filesystems which can hold a reference
+// to the content of a file in place of a copy, such as the in-memory
+// filesystems systems are exported from.
+type referencingFS interface {
+	Reference(path string, mode os.FileMode, size int64, open func() (io.ReadCloser, error)) error
+}
+
+// writeFile writes the current file of the fileset to path. A reference to
+// the file is written instead if both the filesystem and fileset allow it.
+func writeFile(fs billy.Filesystem, src fileset, path string, mode os.FileMode, size int64) error {
+	if rfs, ok := fs.(referencingFS); ok {
+		if open := reopenCurrent(src); open != nil {
+			return rfs.Reference(path, mode, size, open)
+		}
+	}
+
+	w, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
 // unaryFileset implements the fileset interface for a single file.
 type unaryFileset struct {
 	f io.ReadCloser
@@ -117,14 +158,10 @@ func populateFileToPath(fs billy.Filesystem, src fileset, outPath string, mode o
 			}
 		}
 
-		w, err := fs.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
-		if err != nil {
-			return vts.WrapWithPath(err, outPath)
-		}
-		if _, err := io.Copy(w, src); err != nil {
+		if err := writeFile(fs, src, outPath, mode, h.Size); err != nil {
 			return vts.WrapWithPath(err, outPath)
 		}
-		return w.Close()
+		return nil
 	}
 
 	return os.ErrNotExist
@@ -16,6 +16,19 @@ type GenerationContext struct {
 	Cache     *cache.Cache
 	Inputs    *vts.InputSet
 	Console   vts.Console
+	// OutputChecks configures how the outputs of builds are checked.
+	OutputChecks OutputChecks
+}
+
+// OutputChecks configures how strictly the outputs of builds are checked
+// against the output rules of the build.
+type OutputChecks struct {
+	// Strict fails every build which has an output rule matching no
+	// files, as if each build set strict_outputs.
+	Strict bool
+	// FailUncaptured fails builds which produce files not captured as
+	// outputs, rather than warning about them.
+	FailUncaptured bool
 }
 
 // Generate is called to generate a target, typically writing the output
@@ -23,7 +36,7 @@ type GenerationContext struct {
 func Generate(gc GenerationContext, t vts.Target) error {
 	switch t := t.(type) {
 	case *vts.Resource, *vts.ResourceClass, *vts.Attr, *vts.AttrClass,
-		*vts.Checker, *vts.Component, *vts.Toolchain, *vts.Sieve:
+		*vts.Checker, *vts.Component, *vts.Toolchain, *vts.Sieve, *vts.Virtual:
 		return nil // Targets dont require direct generation.
 	case *vts.Generator:
 		return nil // Generators are always fulfilled with their source.
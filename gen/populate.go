@@ -9,8 +9,10 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/proc"
 	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners/accounts"
 )
 
 func populationStrategy(gc GenerationContext, resource *vts.Resource, source vts.Target) (vts.PopulateStrategy, error) {
@@ -42,24 +44,32 @@ func populateFileFromCache(gc GenerationContext, outPath string, mode os.FileMod
 	if err != nil {
 		return vts.WrapWithTarget(err, b)
 	}
-	r, c, fMode, err := gc.Cache.FileInFileset(h, outPath)
+	f, err := gc.Cache.OpenInFileset(h, outPath)
 	if err != nil {
 		if err == os.ErrNotExist {
 			err = errors.New("file missing from build output")
 		}
 		return vts.WrapWithTarget(err, b)
 	}
-	defer c.Close()
+	defer f.Close()
 
 	if mode == 0 {
-		mode = fMode
+		mode = f.Mode
 	}
 
+	if rfs, ok := gc.RunnerEnv.FS.(referencingFS); ok {
+		open := func() (io.ReadCloser, error) { return gc.Cache.OpenInFileset(h, outPath) }
+		if err := rfs.Reference(outPath, mode, f.Size(), open); err != nil {
+			return vts.WrapWithPath(err, outPath)
+		}
+		return nil
+	}
 	w, err := gc.RunnerEnv.FS.OpenFile(outPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return vts.WrapWithPath(err, outPath)
 	}
-	if _, err := io.Copy(w, r); err != nil {
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
 		return vts.WrapWithPath(err, outPath)
 	}
 	return w.Close()
@@ -71,7 +81,10 @@ func populateFileFromCache(gc GenerationContext, outPath string, mode os.FileMod
 func PopulateResource(gc GenerationContext, resource *vts.Resource, source vts.Target) error {
 	// Special case: Generators do their own generation.
 	if gen, isGen := source.(*vts.Generator); isGen {
-		return gen.Run(resource, gc.Inputs, gc.RunnerEnv)
+		if err := gen.Run(resource, gc.Inputs, gc.RunnerEnv); err != nil {
+			return err
+		}
+		return applyOwnership(gc, resource)
 	}
 	ps, err := populationStrategy(gc, resource, source)
 	if err != nil {
@@ -90,7 +103,7 @@ func PopulateResource(gc GenerationContext, resource *vts.Resource, source vts.T
 		if err := populateFileFromCache(gc, strings.TrimPrefix(outPath, "/"), mode, b); err != nil {
 			return vts.WrapWithPath(vts.WrapWithTarget(err, resource), outPath)
 		}
-		return nil
+		return applyOwnership(gc, resource)
 	}
 
 	fsr, err := filesetForSource(gc, source)
@@ -121,7 +134,28 @@ func PopulateResource(gc GenerationContext, resource *vts.Resource, source vts.T
 		err = errors.New("file missing from build output")
 	}
 	if err != nil {
-		err = vts.WrapWithPath(vts.WrapWithTarget(err, resource), outPath)
+		return vts.WrapWithPath(vts.WrapWithTarget(err, resource), outPath)
+	}
+	return applyOwnership(gc, resource)
+}
+
+// applyOwnership sets the owner and group of the file at the path of the
+// resource, if either were specified. Files are otherwise owned by root,
+// which is recorded explicitly when generating as an unprivileged user.
+func applyOwnership(gc GenerationContext, resource *vts.Resource) error {
+	uid, gid, err := accounts.Ownership(resource, gc.RunnerEnv)
+	if err != nil {
+		return vts.WrapWithTarget(err, resource)
+	}
+	if uid == 0 && gid == 0 && os.Geteuid() == 0 {
+		return nil
+	}
+	p, err := determinePath(resource, gc.RunnerEnv)
+	if err != nil {
+		return vts.WrapWithTarget(err, resource)
+	}
+	if err := fsmeta.Chown(gc.RunnerEnv.FS, p, uid, gid); err != nil {
+		return vts.WrapWithPath(vts.WrapWithTarget(err, resource), p)
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,262 @@
+package gen
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// maxTextDiff is the size beyond which differing files are summarized with
+// a hexdump rather than a line diff.
+const maxTextDiff = 64 * 1024
+
+// ReproDiff describes a file which differs between two runs of a build.
+type ReproDiff struct {
+	Path string
+	// Summary describes how the file differs, and may span multiple lines.
+	Summary string
+}
+
+// reproEntry describes a file in the output of a build.
+type reproEntry struct {
+	header *tar.Header
+	digest [sha256.Size]byte
+}
+
+// readReproEntries returns every file in the fileset, keyed by path.
+func readReproEntries(fs fileset) (map[string]reproEntry, error) {
+	out := make(map[string]reproEntry, 128)
+	for {
+		path, h, err := fs.Next()
+		if err != nil {
+			if err == io.EOF {
+				return out, nil
+			}
+			return nil, err
+		}
+		hash := sha256.New()
+		if h.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(hash, fs); err != nil {
+				return nil, fmt.Errorf("reading %s: %v", path, err)
+			}
+		}
+		e := reproEntry{header: h}
+		copy(e.digest[:], hash.Sum(nil))
+		out[path] = e
+	}
+}
+
+// ReproCheck performs a build twice, each in a fresh environment and
+// writing to a temporary cache, and reports the files which differ between
+// the two outputs. The build's inputs must already be present in the cache.
+func ReproCheck(gc GenerationContext, b *vts.Build) ([]ReproDiff, error) {
+	bh, err := b.RollupHash(gc.RunnerEnv, proc.EvalComputedAttribute)
+	if err != nil {
+		return nil, vts.WrapWithTarget(err, b)
+	}
+
+	var runs [2]*cache.Cache
+	for i := range runs {
+		dir, err := ioutil.TempDir("", "ccr-repro-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		if runs[i], err = cache.NewCache(dir); err != nil {
+			return nil, err
+		}
+		if err := runBuild(gc, b, bh, runs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	var entries [2]map[string]reproEntry
+	for i, c := range runs {
+		fsr, err := c.FilesetReader(bh)
+		if err != nil {
+			return nil, err
+		}
+		entries[i], err = readReproEntries(fsr)
+		fsr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diffReproEntries(entries[0], entries[1], func(path string) (string, error) {
+		var contents [2]io.Reader
+		for i, c := range runs {
+			r, closer, _, err := c.FileInFileset(bh, path)
+			if err != nil {
+				return "", err
+			}
+			defer closer.Close()
+			contents[i] = r
+		}
+		return contentDiff(contents[0], contents[1])
+	})
+}
+
+// diffReproEntries compares the outputs of two runs of a build. The
+// contents function summarizes how the contents of a file differ.
+func diffReproEntries(a, b map[string]reproEntry, contents func(path string) (string, error)) ([]ReproDiff, error) {
+	paths := make([]string, 0, len(a))
+	for p := range a {
+		paths = append(paths, p)
+	}
+	for p := range b {
+		if _, inA := a[p]; !inA {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var out []ReproDiff
+	for _, p := range paths {
+		ea, inA := a[p]
+		eb, inB := b[p]
+		switch {
+		case !inA:
+			out = append(out, ReproDiff{Path: p, Summary: "only present in the second build"})
+			continue
+		case !inB:
+			out = append(out, ReproDiff{Path: p, Summary: "only present in the first build"})
+			continue
+		}
+
+		var summary []string
+		ha, hb := ea.header, eb.header
+		if ha.Typeflag != hb.Typeflag {
+			summary = append(summary, fmt.Sprintf("type %q != %q", ha.Typeflag, hb.Typeflag))
+		}
+		if ha.Mode != hb.Mode {
+			summary = append(summary, fmt.Sprintf("mode %v != %v", os.FileMode(ha.Mode), os.FileMode(hb.Mode)))
+		}
+		if ha.Uid != hb.Uid || ha.Gid != hb.Gid {
+			summary = append(summary, fmt.Sprintf("owner %d:%d != %d:%d", ha.Uid, ha.Gid, hb.Uid, hb.Gid))
+		}
+		if !ha.ModTime.Equal(hb.ModTime) {
+			summary = append(summary, fmt.Sprintf("modification time %v != %v", ha.ModTime.UTC(), hb.ModTime.UTC()))
+		}
+		if ha.Linkname != hb.Linkname {
+			summary = append(summary, fmt.Sprintf("link target %q != %q", ha.Linkname, hb.Linkname))
+		}
+		if ha.Devmajor != hb.Devmajor || ha.Devminor != hb.Devminor {
+			summary = append(summary, fmt.Sprintf("device %d:%d != %d:%d", ha.Devmajor, ha.Devminor, hb.Devmajor, hb.Devminor))
+		}
+		if ha.Typeflag == tar.TypeReg && hb.Typeflag == tar.TypeReg && ea.digest != eb.digest {
+			d, err := contents(p)
+			if err != nil {
+				return nil, fmt.Errorf("comparing %s: %v", p, err)
+			}
+			summary = append(summary, d)
+		}
+		if len(summary) > 0 {
+			out = append(out, ReproDiff{Path: p, Summary: strings.Join(summary, "\n")})
+		}
+	}
+	return out, nil
+}
+
+func isText(b []byte) bool {
+	return utf8.Valid(b) && bytes.IndexByte(b, 0) < 0
+}
+
+// contentDiff summarizes how two files differ: text files are summarized by
+// the first differing line, and other files by a hexdump of the first
+// differing bytes.
+func contentDiff(a, b io.Reader) (string, error) {
+	var bufs [2][]byte
+	for i, r := range []io.Reader{a, b} {
+		var err error
+		if bufs[i], err = ioutil.ReadAll(io.LimitReader(r, maxTextDiff+1)); err != nil {
+			return "", err
+		}
+	}
+	if len(bufs[0]) <= maxTextDiff && len(bufs[1]) <= maxTextDiff && isText(bufs[0]) && isText(bufs[1]) {
+		return lineDiff(string(bufs[0]), string(bufs[1])), nil
+	}
+	return hexDiff(io.MultiReader(bytes.NewReader(bufs[0]), a), io.MultiReader(bytes.NewReader(bufs[1]), b))
+}
+
+func lineDiff(a, b string) string {
+	la, lb := strings.Split(a, "\n"), strings.Split(b, "\n")
+	n, first := 0, -1
+	for i := 0; i < len(la) || i < len(lb); i++ {
+		if i < len(la) && i < len(lb) && la[i] == lb[i] {
+			continue
+		}
+		if n++; first < 0 {
+			first = i
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "content differs on %d line(s), first at line %d:", n, first+1)
+	if first < len(la) {
+		fmt.Fprintf(&out, "\n- %s", la[first])
+	}
+	if first < len(lb) {
+		fmt.Fprintf(&out, "\n+ %s", lb[first])
+	}
+	return out.String()
+}
+
+// hexDiff returns a hexdump of both files from the first 16-byte row which
+// differs.
+func hexDiff(a, b io.Reader) (string, error) {
+	const chunkSize = 4096
+	bufA, bufB := make([]byte, chunkSize), make([]byte, chunkSize)
+	for off := 0; ; off += chunkSize {
+		na, err := io.ReadFull(a, bufA)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+		nb, err := io.ReadFull(b, bufB)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+
+		i := 0
+		for i < na && i < nb && bufA[i] == bufB[i] {
+			i++
+		}
+		if i == na && i == nb {
+			if na < chunkSize {
+				return "content is identical", nil
+			}
+			continue
+		}
+
+		row := i &^ 15
+		var out strings.Builder
+		fmt.Fprintf(&out, "content differs from offset %#x:", off+i)
+		for _, side := range []struct {
+			prefix string
+			b      []byte
+		}{{"-", bufA[:na]}, {"+", bufB[:nb]}} {
+			for r := row; r < row+32 && r < len(side.b); r += 16 {
+				end := r + 16
+				if end > len(side.b) {
+					end = len(side.b)
+				}
+				fmt.Fprintf(&out, "\n%s %08x  % x", side.prefix, off+r, side.b[r:end])
+			}
+			if row >= len(side.b) {
+				fmt.Fprintf(&out, "\n%s %08x  (end of file)", side.prefix, off+row)
+			}
+		}
+		return out.String(), nil
+	}
+}
@@ -0,0 +1,104 @@
+package gen
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffReproEntries(t *testing.T) {
+	reg := func(mode int64, mt int64, content string) reproEntry {
+		return reproEntry{
+			header: &tar.Header{Typeflag: tar.TypeReg, Mode: mode, ModTime: time.Unix(mt, 0)},
+			digest: sha256.Sum256([]byte(content)),
+		}
+	}
+	a := map[string]reproEntry{
+		"bin/same":    reg(0755, 0, "same"),
+		"bin/mode":    reg(0755, 0, "same"),
+		"bin/mtime":   reg(0644, 0, "same"),
+		"bin/content": reg(0644, 0, "a"),
+		"only/a":      reg(0644, 0, ""),
+	}
+	b := map[string]reproEntry{
+		"bin/same":    reg(0755, 0, "same"),
+		"bin/mode":    reg(0700, 0, "same"),
+		"bin/mtime":   reg(0644, 60, "same"),
+		"bin/content": reg(0644, 0, "b"),
+		"only/b":      reg(0644, 0, ""),
+	}
+
+	got, err := diffReproEntries(a, b, func(path string) (string, error) {
+		return "contents of " + path, nil
+	})
+	if err != nil {
+		t.Fatalf("diffReproEntries() failed: %v", err)
+	}
+	want := []ReproDiff{
+		{Path: "bin/content", Summary: "contents of bin/content"},
+		{Path: "bin/mode", Summary: "mode -rwxr-xr-x != -rwx------"},
+		{Path: "bin/mtime", Summary: "modification time 1970-01-01 00:00:00 +0000 UTC != 1970-01-01 00:01:00 +0000 UTC"},
+		{Path: "only/a", Summary: "only present in the first build"},
+		{Path: "only/b", Summary: "only present in the second build"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("diffReproEntries() differs (+got, -want):\n%s", diff)
+	}
+}
+
+func TestContentDiff(t *testing.T) {
+	tcs := []struct {
+		name string
+		a, b []byte
+		want string
+	}{
+		{
+			name: "text",
+			a:    []byte("one\ntwo\nthree\n"),
+			b:    []byte("one\n2\nthree\n"),
+			want: "content differs on 1 line(s), first at line 2:\n- two\n+ 2",
+		},
+		{
+			name: "text_appended",
+			a:    []byte("one\n"),
+			b:    []byte("one\ntwo\n"),
+			want: "content differs on 2 line(s), first at line 2:\n- \n+ two",
+		},
+		{
+			name: "binary",
+			a:    append(bytes.Repeat([]byte{0}, 20), 1, 2, 3),
+			b:    append(bytes.Repeat([]byte{0}, 20), 1, 5, 3),
+			want: strings.Join([]string{
+				"content differs from offset 0x15:",
+				"- 00000010  00 00 00 00 01 02 03",
+				"+ 00000010  00 00 00 00 01 05 03",
+			}, "\n"),
+		},
+		{
+			name: "binary_truncated",
+			a:    append(bytes.Repeat([]byte{0}, 5000), 1),
+			b:    bytes.Repeat([]byte{0}, 5000),
+			want: strings.Join([]string{
+				"content differs from offset 0x1388:",
+				"- 00001380  00 00 00 00 00 00 00 00 01",
+				"+ 00001380  00 00 00 00 00 00 00 00",
+			}, "\n"),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := contentDiff(bytes.NewReader(tc.a), bytes.NewReader(tc.b))
+			if err != nil {
+				t.Fatalf("contentDiff() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("contentDiff() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -53,44 +53,137 @@ func (fs *unionFileset) Read(b []byte) (int, error) {
 	return fs.remaining[0].Read(b)
 }
 
+func (fs *unionFileset) Reopen() func() (io.ReadCloser, error) {
+	if len(fs.remaining) == 0 {
+		return nil
+	}
+	return reopenCurrent(fs.remaining[0])
+}
+
 // filterFileset exposes a fileset that filters files based on path.
+//
+// Hardlinks whose target was filtered out are instead exposed as a regular
+// file, the contents of which are read from a fresh copy of the base fileset
+// obtained by calling reopen. Later hardlinks to the same target are
+// rewritten to point at that file.
 type filterFileset struct {
 	base     fileset
 	patterns []glob.Glob
 	invert   bool
+	reopen   func() (fileset, error)
+
+	dropped  map[string]bool
+	relinked map[string]string
+	content  fileset
 }
 
 func (fs *filterFileset) Close() error {
+	if err := fs.closeContent(); err != nil {
+		return err
+	}
 	return fs.base.Close()
 }
 
+func (fs *filterFileset) closeContent() error {
+	if fs.content == nil {
+		return nil
+	}
+	err := fs.content.Close()
+	fs.content = nil
+	return err
+}
+
+func (fs *filterFileset) keep(path string) bool {
+	for _, p := range fs.patterns {
+		if p.Match(path) {
+			return fs.invert
+		}
+	}
+	return !fs.invert
+}
+
 func (fs *filterFileset) Next() (path string, header *tar.Header, err error) {
-outer:
+	if err := fs.closeContent(); err != nil {
+		return "", nil, err
+	}
+
 	for {
 		path, h, err := fs.base.Next()
 		if err != nil {
 			return "", nil, err
 		}
 
-		for _, p := range fs.patterns {
-			if p.Match(path) {
-				if fs.invert {
-					return path, h, nil
+		if !fs.keep(path) {
+			if h.Typeflag == tar.TypeReg {
+				if fs.dropped == nil {
+					fs.dropped = make(map[string]bool)
 				}
-				continue outer
+				fs.dropped[path] = true
 			}
-		}
-		if fs.invert {
 			continue
 		}
+		if h.Typeflag == tar.TypeLink && fs.dropped[h.Linkname] {
+			return fs.unlink(path, h)
+		}
 		return path, h, nil
 	}
 }
 
+// unlink returns the header for a hardlink whose target was filtered out,
+// either as a regular file with the contents of the target, or as a hardlink
+// to a previous such file.
+func (fs *filterFileset) unlink(path string, h *tar.Header) (string, *tar.Header, error) {
+	if to, ok := fs.relinked[h.Linkname]; ok {
+		hdr := *h
+		hdr.Linkname = to
+		return path, &hdr, nil
+	}
+	if fs.reopen == nil {
+		return "", nil, vts.WrapWithPath(fmt.Errorf("hardlink target %q was filtered out", h.Linkname), path)
+	}
+
+	content, err := fs.reopen()
+	if err != nil {
+		return "", nil, err
+	}
+	for {
+		p, th, err := content.Next()
+		if err != nil {
+			content.Close()
+			if err == io.EOF {
+				err = fmt.Errorf("hardlink target %q not found", h.Linkname)
+			}
+			return "", nil, vts.WrapWithPath(err, path)
+		}
+		if p != h.Linkname {
+			continue
+		}
+
+		fs.content = content
+		if fs.relinked == nil {
+			fs.relinked = make(map[string]string)
+		}
+		fs.relinked[h.Linkname] = path
+		hdr := *th
+		hdr.Name = h.Name
+		return path, &hdr, nil
+	}
+}
+
 func (fs *filterFileset) Read(b []byte) (int, error) {
+	if fs.content != nil {
+		return fs.content.Read(b)
+	}
 	return fs.base.Read(b)
 }
 
+func (fs *filterFileset) Reopen() func() (io.ReadCloser, error) {
+	if fs.content != nil {
+		return reopenCurrent(fs.content)
+	}
+	return reopenCurrent(fs.base)
+}
+
 // prefixFileset exposes a fileset that adds a prefix onto all files.
 type prefixFileset struct {
 	base   fileset
@@ -106,6 +199,11 @@ func (fs *prefixFileset) Next() (path string, header *tar.Header, err error) {
 	if err != nil {
 		return "", nil, err
 	}
+	if h.Typeflag == tar.TypeLink {
+		hdr := *h
+		hdr.Linkname = filepath.Join(fs.prefix, h.Linkname)
+		h = &hdr
+	}
 	return filepath.Join(fs.prefix, path), h, nil
 }
 
@@ -113,6 +211,10 @@ func (fs *prefixFileset) Read(b []byte) (int, error) {
 	return fs.base.Read(b)
 }
 
+func (fs *prefixFileset) Reopen() func() (io.ReadCloser, error) {
+	return reopenCurrent(fs.base)
+}
+
 // renameFileset exposes a fileset that renames files based on match rules.
 type renameFileset struct {
 	base  fileset
@@ -129,6 +231,13 @@ func (fs *renameFileset) Next() (path string, header *tar.Header, err error) {
 		return "", nil, err
 	}
 
+	if h.Typeflag == tar.TypeLink {
+		if newPath := fs.rules.Match(h.Linkname); newPath != "" {
+			hdr := *h
+			hdr.Linkname = newPath
+			h = &hdr
+		}
+	}
 	if newPath := fs.rules.Match(path); newPath != "" {
 		return newPath, h, nil
 	}
@@ -139,6 +248,10 @@ func (fs *renameFileset) Read(b []byte) (int, error) {
 	return fs.base.Read(b)
 }
 
+func (fs *renameFileset) Reopen() func() (io.ReadCloser, error) {
+	return reopenCurrent(fs.base)
+}
+
 func filesetForSieve(gc GenerationContext, s *vts.Sieve) (fileset, error) {
 	// Fast path: Sieve's that only select a subpath + remove a prefix from a
 	// path, from build output.
@@ -158,36 +271,41 @@ func filesetForSieve(gc GenerationContext, s *vts.Sieve) (fileset, error) {
 		}
 	}
 
-	inputs := make([]fileset, 0, len(s.Inputs))
-	for i, inp := range s.Inputs {
-		fs, err := filesetForSource(gc, inp.Target)
-		if err != nil {
-			return nil, fmt.Errorf("input[%d] loading fileset: %v", i, err)
+	// open returns a fresh copy of the fileset built so far, which filters
+	// use to read the contents of filtered-out hardlink targets.
+	open := func() (fileset, error) {
+		inputs := make([]fileset, 0, len(s.Inputs))
+		for i, inp := range s.Inputs {
+			fs, err := filesetForSource(gc, inp.Target)
+			if err != nil {
+				for _, f := range inputs {
+					f.Close()
+				}
+				return nil, fmt.Errorf("input[%d] loading fileset: %v", i, err)
+			}
+			inputs = append(inputs, fs)
 		}
-		inputs = append(inputs, fs)
+		return &unionFileset{all: inputs, remaining: inputs}, nil
 	}
 
-	var out fileset = &unionFileset{all: inputs, remaining: inputs}
-
 	if len(s.ExcludeGlobs) > 0 {
-		ff := filterFileset{base: out, patterns: make([]glob.Glob, len(s.ExcludeGlobs))}
-		for i, p := range s.ExcludeGlobs {
-			var err error
-			if ff.patterns[i], err = glob.Compile(p); err != nil {
-				return nil, err
-			}
+		patterns, err := compileGlobs(s.ExcludeGlobs)
+		if err != nil {
+			return nil, err
 		}
-		out = &ff
+		open = filterOpener(open, patterns, false)
 	}
 	if len(s.IncludeGlobs) > 0 {
-		ff := filterFileset{base: out, patterns: make([]glob.Glob, len(s.IncludeGlobs)), invert: true}
-		for i, p := range s.IncludeGlobs {
-			var err error
-			if ff.patterns[i], err = glob.Compile(p); err != nil {
-				return nil, err
-			}
+		patterns, err := compileGlobs(s.IncludeGlobs)
+		if err != nil {
+			return nil, err
 		}
-		out = &ff
+		open = filterOpener(open, patterns, true)
+	}
+
+	out, err := open()
+	if err != nil {
+		return nil, err
 	}
 
 	if s.AddPrefix != "" {
@@ -199,3 +317,26 @@ func filesetForSieve(gc GenerationContext, s *vts.Sieve) (fileset, error) {
 
 	return out, nil
 }
+
+func compileGlobs(globs []string) ([]glob.Glob, error) {
+	out := make([]glob.Glob, len(globs))
+	for i, p := range globs {
+		var err error
+		if out[i], err = glob.Compile(p); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// filterOpener returns a function which opens the fileset returned by base,
+// filtered by the given patterns.
+func filterOpener(base func() (fileset, error), patterns []glob.Glob, invert bool) func() (fileset, error) {
+	return func() (fileset, error) {
+		fs, err := base()
+		if err != nil {
+			return nil, err
+		}
+		return &filterFileset{base: fs, patterns: patterns, invert: invert, reopen: base}, nil
+	}
+}
@@ -1,14 +1,20 @@
 package gen
 
 import (
+	"archive/tar"
 	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/gobwas/glob"
+	"github.com/google/go-cmp/cmp"
+	"github.com/twitchylinux/ccr/export"
 	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/match"
+	"github.com/twitchyliquid64/debdep/dpkg"
 )
 
 func TestSievePrefixFastpath(t *testing.T) {
@@ -151,3 +157,155 @@ func TestSieveFilesets(t *testing.T) {
 		t.Errorf("expected file %q", path)
 	}
 }
+
+func hardlinkFileset() *debFileset {
+	return &debFileset{files: []dpkg.DataFile{
+		{Hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./a/x", Mode: 0644, Size: 5}, Data: []byte("hello")},
+		{Hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./a/y", Mode: 0644, Linkname: "./a/x"}},
+		{Hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./a/z", Mode: 0644, Linkname: "./a/x"}},
+	}}
+}
+
+type sieveEntry struct {
+	typ      byte
+	linkname string
+	data     string
+}
+
+func readSieveEntries(t *testing.T, fs fileset) map[string]sieveEntry {
+	t.Helper()
+	defer fs.Close()
+
+	out := make(map[string]sieveEntry)
+	for {
+		path, h, err := fs.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			t.Fatalf("iterating fileset: %v", err)
+		}
+		e := sieveEntry{typ: h.Typeflag, linkname: h.Linkname}
+		if h.Typeflag == tar.TypeReg {
+			d, err := ioutil.ReadAll(fs)
+			if err != nil {
+				t.Fatalf("reading %q: %v", path, err)
+			}
+			e.data = string(d)
+		}
+		out[path] = e
+	}
+	return out
+}
+
+func TestSieveHardlinks(t *testing.T) {
+	tcs := []struct {
+		name string
+		fs   fileset
+		want map[string]sieveEntry
+	}{
+		{
+			name: "prefix",
+			fs:   &prefixFileset{base: hardlinkFileset(), prefix: "/usr"},
+			want: map[string]sieveEntry{
+				"/usr/a/x": {typ: tar.TypeReg, data: "hello"},
+				"/usr/a/y": {typ: tar.TypeLink, linkname: "/usr/a/x"},
+				"/usr/a/z": {typ: tar.TypeLink, linkname: "/usr/a/x"},
+			},
+		},
+		{
+			name: "rename",
+			fs: &renameFileset{base: hardlinkFileset(), rules: &match.FilenameRules{Rules: []match.MatchRule{
+				{P: glob.MustCompile("/a/**"), Out: &match.StripPrefixOutputMapper{Prefix: "/a/"}},
+			}}},
+			want: map[string]sieveEntry{
+				"x": {typ: tar.TypeReg, data: "hello"},
+				"y": {typ: tar.TypeLink, linkname: "x"},
+				"z": {typ: tar.TypeLink, linkname: "x"},
+			},
+		},
+		{
+			name: "filter target",
+			fs: &filterFileset{
+				base:     hardlinkFileset(),
+				patterns: []glob.Glob{glob.MustCompile("/a/x")},
+				reopen:   func() (fileset, error) { return hardlinkFileset(), nil },
+			},
+			want: map[string]sieveEntry{
+				"/a/y": {typ: tar.TypeReg, data: "hello"},
+				"/a/z": {typ: tar.TypeLink, linkname: "/a/y"},
+			},
+		},
+		{
+			name: "filter link",
+			fs: &filterFileset{
+				base:     hardlinkFileset(),
+				patterns: []glob.Glob{glob.MustCompile("/a/y")},
+			},
+			want: map[string]sieveEntry{
+				"/a/x": {typ: tar.TypeReg, data: "hello"},
+				"/a/z": {typ: tar.TypeLink, linkname: "/a/x"},
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, readSieveEntries(t, tc.fs), cmp.AllowUnexported(sieveEntry{})); diff != "" {
+				t.Errorf("unexpected entries (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// reopenableFileset is a fileset which can reopen its current file.
+type reopenableFileset struct {
+	*debFileset
+	current  string
+	reopened int
+}
+
+func (fs *reopenableFileset) Next() (string, *tar.Header, error) {
+	p, h, err := fs.debFileset.Next()
+	fs.current = p
+	return p, h, err
+}
+
+func (fs *reopenableFileset) Reopen() func() (io.ReadCloser, error) {
+	p := fs.current
+	return func() (io.ReadCloser, error) {
+		fs.reopened++
+		return ioutil.NopCloser(strings.NewReader("content of " + p)), nil
+	}
+}
+
+func TestWriteMultiFilesReferences(t *testing.T) {
+	src := &reopenableFileset{debFileset: hardlinkFileset()}
+	fs := export.NewFS()
+	if err := writeMultiFiles(nil, fs, "/", &prefixFileset{base: src, prefix: "/usr"}); err != nil {
+		t.Fatalf("writeMultiFiles() failed: %v", err)
+	}
+	if src.reopened != 0 {
+		t.Errorf("content was read %d times before the file was opened", src.reopened)
+	}
+
+	st, err := fs.Stat("/usr/a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != 5 {
+		t.Errorf("size of /usr/a/x = %d, want 5", st.Size())
+	}
+	f, err := fs.Open("/usr/a/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(d), "content of /a/x"; got != want {
+		t.Errorf("content of /usr/a/x = %q, want %q", got, want)
+	}
+}
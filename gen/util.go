@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/proc"
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/common"
@@ -53,8 +54,8 @@ func determineMode(t vts.Target, env *vts.RunnerEnv) (os.FileMode, error) {
 		return 0, fmt.Errorf("mode: %w", err)
 	}
 	if s, ok := v.(starlark.String); ok {
-		mode, err := strconv.ParseInt(string(s), 8, 64)
-		return os.FileMode(mode), err
+		mode, err := strconv.ParseUint(string(s), 8, 32)
+		return fsmeta.FileMode(uint32(mode)), err
 	}
 	return 0, vts.WrapWithTarget(fmt.Errorf("bad type for mode: want string, got %T", v), t)
 }
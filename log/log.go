@@ -50,6 +50,15 @@ type Console struct {
 	err *lockingWriter
 }
 
+// NewConsole returns a console which writes to the given writers, such as
+// when stdout is reserved for the output of a command.
+func NewConsole(stdout, stderr io.Writer) *Console {
+	return &Console{
+		out: &lockingWriter{Writer: stdout},
+		err: &lockingWriter{Writer: stderr},
+	}
+}
+
 func (t *Console) Error(category MsgCategory, err error) error {
 	printErr(category, err)
 	return err
@@ -17,6 +17,14 @@ func printComputedValueErr(cv *vts.ComputedValue) {
 	fmt.Println()
 }
 
+// printVia prints the frames in loaded modules through which a target
+// was defined.
+func printVia(pos *vts.DefPosition) {
+	for _, f := range pos.Via {
+		fmt.Printf("    via %s() at \033[1;33m%s\033[0m\n", f.Name, f.Pos)
+	}
+}
+
 func printErrSource(kind MsgCategory, we vts.WrappedErr) {
 	msg, thing := "Failing", "target"
 	switch kind {
@@ -32,9 +40,11 @@ func printErrSource(kind MsgCategory, we vts.WrappedErr) {
 	case we.Pos != nil:
 		pos := we.Pos
 		fmt.Printf("  %s %s at:  \033[1;33m%s:%d:%d\033[0m\n", msg, thing, pos.Path, pos.Frame.Pos.Line, pos.Frame.Pos.Col)
+		printVia(pos)
 	case we.Target != nil:
 		if pos := we.Target.DefinedAt(); pos != nil {
 			fmt.Printf("  %s %s at:  \033[1;33m%s:%d:%d\033[0m\n", msg, thing, pos.Path, pos.Frame.Pos.Line, pos.Frame.Pos.Col)
+			printVia(pos)
 		}
 	}
 	if we.ActionTarget != nil {
@@ -141,7 +141,31 @@ func dependenciesInstalled() (bool, error) {
 	return true, nil
 }
 
+// EnvOptions describes how an environment is isolated from the host.
+type EnvOptions struct {
+	ReadOnly bool
+	// Hermetic runs processes with a fixed environment and hostname, and
+	// in a network namespace with only a loopback interface.
+	Hermetic bool
+	// Network permits processes in a hermetic environment to access the
+	// network of the host.
+	Network bool
+}
+
+// isolateNetwork returns true if processes should run in their own network
+// namespace.
+func (o EnvOptions) isolateNetwork() bool {
+	return o.Hermetic && !o.Network
+}
+
+// NewEnv creates an environment which is isolated from the host filesystem.
 func NewEnv(readOnly bool, rootDir string) (*Env, error) {
+	return NewEnvWithOptions(rootDir, EnvOptions{ReadOnly: readOnly})
+}
+
+// NewEnvWithOptions creates an environment, isolated from the host as
+// described by opts.
+func NewEnvWithOptions(rootDir string, opts EnvOptions) (*Env, error) {
 	good, err := dependenciesInstalled()
 	if err != nil {
 		return nil, err
@@ -176,13 +200,18 @@ func NewEnv(readOnly bool, rootDir string) (*Env, error) {
 		return nil, err
 	}
 
-	out.p = reexec.Command("reexecEntry", "env", strconv.FormatBool(readOnly), rootDir)
+	out.p = reexec.Command("reexecEntry", "env", strconv.FormatBool(opts.ReadOnly), rootDir,
+		strconv.FormatBool(opts.Hermetic), strconv.FormatBool(opts.isolateNetwork()))
 	out.p.Stderr = os.Stderr
 	out.p.Stdout = os.Stdout
 	out.p.Stdin = os.Stdin
 	out.p.Dir = out.dir
+	cloneFlags := syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWUSER
+	if opts.isolateNetwork() {
+		cloneFlags |= syscall.CLONE_NEWNET
+	}
 	out.p.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWUSER,
+		Cloneflags: uintptr(cloneFlags),
 		UidMappings: []syscall.SysProcIDMap{
 			{
 				HostID: os.Getuid(),
@@ -293,3 +293,36 @@ func TestEnsurePatched(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestHermeticEnv(t *testing.T) {
+	t.Parallel()
+	e, err := NewEnvWithOptions("/", EnvOptions{ReadOnly: true, Hermetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	o, s, _, err := e.RunBlocking("/tmp", map[string]string{"EXTRA": "1"}, "sh", "-c", "hostname; echo $HOME $LANG $TZ $EXTRA")
+	if err != nil {
+		t.Errorf("RunBlocking(%q) failed: %v", "sh", err)
+		t.Logf("stdout = %q\nstderr = %q", string(o), string(s))
+	}
+	if want := hermeticHostname + "\n/tmp C UTC 1\n"; string(o) != want {
+		t.Errorf("output = %q, want %q", string(o), want)
+	}
+
+	// Only the loopback interface should be present.
+	o, s, _, err = e.RunBlocking("/tmp", nil, "cat", "/proc/net/dev")
+	if err != nil {
+		t.Errorf("RunBlocking(%q) failed: %v", "cat", err)
+		t.Logf("stdout = %q\nstderr = %q", string(o), string(s))
+	}
+	for _, line := range strings.Split(string(o), "\n") {
+		if !strings.Contains(line, ":") {
+			continue // header lines
+		}
+		if iface := strings.TrimSpace(strings.Split(line, ":")[0]); iface != "lo" {
+			t.Errorf("interface %q is present in hermetic environment", iface)
+		}
+	}
+}
@@ -39,7 +39,12 @@ func commandChannels() (*gob.Encoder, *gob.Decoder, *gob.Encoder, error) {
 	return gob.NewEncoder(respWriter), gob.NewDecoder(instReader), gob.NewEncoder(streamWriter), nil
 }
 
-func envMainloop(cmdW *gob.Encoder, cmdR *gob.Decoder, respW *gob.Encoder, readOnly bool, rootDir string) error {
+func envMainloop(cmdW *gob.Encoder, cmdR *gob.Decoder, respW *gob.Encoder, readOnly bool, rootDir string, hermetic, isolateNetwork bool) error {
+	if hermetic {
+		if err := setupHermetic(isolateNetwork); err != nil {
+			return err
+		}
+	}
 	wd, err := os.Getwd()
 	if err != nil {
 		return err
@@ -52,7 +57,7 @@ func envMainloop(cmdW *gob.Encoder, cmdR *gob.Decoder, respW *gob.Encoder, readO
 	}
 	defer fs.Close()
 
-	em, err := makeExecManager(respW)
+	em, err := makeExecManager(respW, hermetic)
 	if err != nil {
 		return err
 	}
@@ -68,7 +73,7 @@ func envMainloop(cmdW *gob.Encoder, cmdR *gob.Decoder, respW *gob.Encoder, readO
 		case cmdPing:
 			cmdW.Encode(procResp{Code: cmdPing})
 		case cmdRunBlocking:
-			cmdW.Encode(runBlocking(cmd, fs.Root(), readOnly))
+			cmdW.Encode(runBlocking(cmd, fs.Root(), readOnly, hermetic))
 		case cmdRunStreaming:
 			cmdW.Encode(em.RunStreaming(cmd, fs.Root(), readOnly))
 		case cmdEnsureTLDWired:
@@ -109,13 +114,23 @@ func isolatedMain() {
 		os.Exit(reexecExitCode)
 	}
 
-	if len(os.Args) > 3 && os.Args[1] == "env" {
+	if len(os.Args) > 5 && os.Args[1] == "env" {
 		readOnly, err := strconv.ParseBool(os.Args[2])
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed parsing read-only argument: %v\n", err)
 			os.Exit(reexecExitCode)
 		}
 		rootDir := os.Args[3]
+		hermetic, err := strconv.ParseBool(os.Args[4])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed parsing hermetic argument: %v\n", err)
+			os.Exit(reexecExitCode)
+		}
+		isolateNetwork, err := strconv.ParseBool(os.Args[5])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed parsing network argument: %v\n", err)
+			os.Exit(reexecExitCode)
+		}
 
 		cmdW, cmdR, respW, err := commandChannels()
 		if err != nil {
@@ -123,7 +138,7 @@ func isolatedMain() {
 			os.Exit(reexecExitCode)
 		}
 
-		if err := envMainloop(cmdW, cmdR, respW, readOnly, rootDir); err != nil {
+		if err := envMainloop(cmdW, cmdR, respW, readOnly, rootDir, hermetic, isolateNetwork); err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 			os.Exit(reexecExitCode)
 		}
@@ -23,7 +23,7 @@ type outputData struct {
 	Error    string
 }
 
-func runBlocking(cmd procCommand, pivotDir string, readOnly bool) procResp {
+func runBlocking(cmd procCommand, pivotDir string, readOnly, hermetic bool) procResp {
 	c := reexec.Command(append([]string{"reexecEntry", "run", pivotDir, strconv.FormatBool(readOnly), cmd.Dir}, cmd.Args...)...)
 	var sOut, sErr bytes.Buffer
 	c.Stdout = &sOut
@@ -32,8 +32,12 @@ func runBlocking(cmd procCommand, pivotDir string, readOnly bool) procResp {
 		Cloneflags: syscall.CLONE_NEWNS,
 	}
 
-	if len(cmd.Env) > 0 {
+	if hermetic {
+		c.Env = append([]string(nil), hermeticEnviron...)
+	} else if len(cmd.Env) > 0 {
 		c.Env = os.Environ()
+	}
+	if len(cmd.Env) > 0 {
 		for k, v := range cmd.Env {
 			c.Env = append(c.Env, fmt.Sprintf("%s=%s", k, v))
 		}
@@ -53,6 +57,7 @@ func runBlocking(cmd procCommand, pivotDir string, readOnly bool) procResp {
 
 type execManager struct {
 	out       *gob.Encoder
+	hermetic  bool
 	processes map[string]*exec.Cmd
 	stream    chan outputData
 
@@ -128,6 +133,9 @@ func (m *execManager) RunStreaming(cmd procCommand, pivotDir string, readOnly bo
 	c.Stderr = &streamWriter{m: m, id: cmd.ProcID, isErr: true}
 	c.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
 	c.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin:/sbin:/usr/local/go/bin", "TMPDIR=/tmp", "FORCE_UNSAFE_CONFIGURE=1"}
+	if m.hermetic {
+		c.Env = append([]string(nil), hermeticEnviron...)
+	}
 	if len(cmd.Env) > 0 {
 		for k, v := range cmd.Env {
 			c.Env = append(c.Env, fmt.Sprintf("%s=%s", k, v))
@@ -148,9 +156,10 @@ func (m *execManager) RunStreaming(cmd procCommand, pivotDir string, readOnly bo
 	return resp
 }
 
-func makeExecManager(out *gob.Encoder) (*execManager, error) {
+func makeExecManager(out *gob.Encoder, hermetic bool) (*execManager, error) {
 	m := execManager{
 		out:       out,
+		hermetic:  hermetic,
 		processes: map[string]*exec.Cmd{},
 		stream:    make(chan outputData),
 	}
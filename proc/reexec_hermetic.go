@@ -0,0 +1,61 @@
+package proc
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// hermeticHostname is the hostname of hermetic environments.
+const hermeticHostname = "ccr-build"
+
+// hermeticEnviron is the environment processes in a hermetic environment
+// start with, before any variables requested for the process are applied.
+var hermeticEnviron = []string{
+	"PATH=/usr/local/bin:/usr/bin:/bin:/sbin:/usr/local/go/bin",
+	"TMPDIR=/tmp",
+	"HOME=/tmp",
+	"LANG=C",
+	"TZ=UTC",
+	"FORCE_UNSAFE_CONFIGURE=1",
+}
+
+// setupHermetic sets the hostname of the UTS namespace of the environment,
+// and brings up the loopback interface if the environment has its own
+// network namespace.
+func setupHermetic(isolateNetwork bool) error {
+	if err := syscall.Sethostname([]byte(hermeticHostname)); err != nil {
+		return fmt.Errorf("sethostname: %v", err)
+	}
+	if isolateNetwork {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %v", err)
+		}
+	}
+	return nil
+}
+
+// ifreqFlags is the layout of struct ifreq used to set interface flags.
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// loopbackUp brings up the loopback interface, which is down in a newly
+// created network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req ifreqFlags
+	copy(req.Name[:], "lo")
+	req.Flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return errno
+	}
+	return nil
+}
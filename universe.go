@@ -94,9 +94,30 @@ func (u *Universe) linkTarget(t vts.Target) error {
 				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, t))
 			}
 		}
+		for i := range n.Provides {
+			if n.Provides[i], err = u.makeTargetRef(n.Provides[i]); err != nil {
+				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, t))
+			}
+		}
+		return nil
+
+	case *vts.Virtual:
+		// Providers are linked when they are selected.
 		return nil
 
 	case *vts.ResourceClass:
+		if n.Parent != nil {
+			tmp, err := u.makeTargetRef(*n.Parent)
+			if err != nil {
+				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, t))
+			}
+			n.Parent = &tmp
+		}
+		for i := range n.DefaultDetails {
+			if n.DefaultDetails[i], err = u.makeTargetRef(n.DefaultDetails[i]); err != nil {
+				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, t))
+			}
+		}
 		for i := range n.Deps {
 			if n.Deps[i], err = u.makeTargetRef(n.Deps[i]); err != nil {
 				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, t))
@@ -268,6 +289,30 @@ func (u *Universe) resolveTarget(findOpts *FindOptions, t vts.Target) error {
 			}
 		}
 	}
+	// A resource class depends on the class it extends, and on the
+	// attributes its instances inherit.
+	if rc, isResourceClass := gt.(*vts.ResourceClass); isResourceClass {
+		if rc.Parent != nil {
+			if err := u.resolveRef(findOpts, *rc.Parent); err != nil {
+				return err
+			}
+		}
+		for _, attr := range rc.DefaultDetails {
+			if err := u.resolveRef(findOpts, attr); err != nil {
+				return err
+			}
+		}
+	}
+	// Only the virtual targets a component provides are resolved here.
+	// Providers and conflicting targets are not part of the universe
+	// unless they are selected or required by something else.
+	if c, isComponent := gt.(*vts.Component); isComponent {
+		for _, v := range c.Provides {
+			if err := u.resolveRef(findOpts, v); err != nil {
+				return err
+			}
+		}
+	}
 	if st, isSrcdTarget := gt.(vts.SourcedTarget); isSrcdTarget && st.Src() != nil {
 		if err := u.resolveRef(findOpts, *st.Src()); err != nil {
 			return err
@@ -287,9 +332,16 @@ func (u *Universe) resolveTarget(findOpts *FindOptions, t vts.Target) error {
 	}
 	// After linking, a target which has a parent will reference the parent. We
 	// track all instances of a class to simplify resolving inputs of a class.
+	// Instances of a resource class are also instances of its ancestors.
 	if hasClass {
 		classTarget := class.Class().Target.(vts.Target)
-		u.classedTargets[classTarget] = append(u.classedTargets[classTarget], gt)
+		if rc, isResourceClass := classTarget.(*vts.ResourceClass); isResourceClass {
+			for _, c := range rc.Lineage() {
+				u.classedTargets[c] = append(u.classedTargets[c], gt)
+			}
+		} else {
+			u.classedTargets[classTarget] = append(u.classedTargets[classTarget], gt)
+		}
 	}
 	return nil
 }
@@ -334,6 +386,9 @@ func (u *Universe) Build(targets []vts.TargetRef, findOpts *FindOptions, basePat
 			return err
 		}
 	}
+	if err := u.resolveVirtuals(findOpts, targets); err != nil {
+		return err
+	}
 
 	// Track special targets separately.
 	for _, t := range u.allTargets {
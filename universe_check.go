@@ -3,6 +3,9 @@ package ccr
 import (
 	"errors"
 	"fmt"
+	"runtime"
+	"sort"
+	"sync"
 
 	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
@@ -10,60 +13,291 @@ import (
 
 type targetSet map[vts.Target]struct{}
 
+// checkState tracks the progress of checking a set of targets.
+type checkState struct {
+	env     *vts.RunnerEnv
+	checked targetSet
+	// keepGoing is true if checking should continue after a check fails,
+	// in which case failures are recorded rather than returned.
+	keepGoing bool
+	failures  []error
+	// workers is the number of checks which may run concurrently.
+	workers int
+	// jobs lists the checks which have been collected but not yet run, in
+	// the order they would run serially.
+	jobs []checkJob
+	// order lists the targets which have been checked.
+	order []vts.Target
+	// chain enumerates targets from the root to the current target.
+	chain []vts.Target
+	// results caches passing checks. If nil, every check is run.
+	results *checkResults
+	// cached counts the checks skipped as their result was cached.
+	cached int
+}
+
+// checkJob is a single check against a target.
+type checkJob struct {
+	run func() error
+	// chain enumerates targets from the root to the checked target.
+	chain []vts.Target
+	// logged is true if a failure should be reported to the logger.
+	logged bool
+	// fatal is true if a failure should stop checking, even when
+	// checking would otherwise keep going.
+	fatal bool
+	// key computes the key under which a passing result is cached, and
+	// env is the environment the check runs in. If key is nil, the result
+	// is not cached.
+	key func() ([]byte, error)
+	env *vts.RunnerEnv
+}
+
+func newCheckState(env *vts.RunnerEnv, checked targetSet) *checkState {
+	return &checkState{env: env, checked: checked, workers: runtime.NumCPU()}
+}
+
+// add queues a check against the current target.
+func (s *checkState) add(logged, fatal bool, run func() error) {
+	s.jobs = append(s.jobs, checkJob{
+		run:    run,
+		chain:  append([]vts.Target(nil), s.chain...),
+		logged: logged,
+		fatal:  fatal,
+	})
+}
+
+// envFor returns the environment which checks against t should use.
+func (s *checkState) envFor(t vts.Target) *vts.RunnerEnv {
+	if s.results == nil {
+		return s.env
+	}
+	return s.results.envFor(t, s.env)
+}
+
+// addCacheable queues a check of t by the given checkers, whose result
+// may be cached.
+func (s *checkState) addCacheable(t vts.Target, checkers []*vts.Checker, run func() error) {
+	s.add(true, false, run)
+	if s.results == nil || checkers == nil {
+		return
+	}
+	for _, c := range checkers {
+		if ud, ok := c.Runner.(vts.UniverseDependentRunner); ok && ud.UniverseDependent() {
+			return
+		}
+	}
+	j := &s.jobs[len(s.jobs)-1]
+	j.env = s.envFor(t)
+	j.key = func() ([]byte, error) {
+		return s.results.key(t, s.env, checkers...)
+	}
+}
+
+// runJob runs a queued check, returning true if it was skipped as its
+// result was cached.
+func (s *checkState) runJob(j checkJob) (bool, error) {
+	if s.results == nil || j.key == nil {
+		return false, j.run()
+	}
+	return s.results.run(j)
+}
+
+// runJobs runs the queued checks on a pool of workers. Failures are handled
+// in the order the checks were queued, regardless of the order they
+// complete in, so the outcome is deterministic. The first failure is
+// returned, unless checking should keep going, in which case failures are
+// recorded and nil is returned.
+func (s *checkState) runJobs(logger opTrack) error {
+	jobs := s.jobs
+	s.jobs = nil
+
+	var (
+		errs   = make([]error, len(jobs))
+		cached = make([]bool, len(jobs))
+		done   = make([]chan struct{}, len(jobs))
+		work   = make(chan int)
+		stop   = make(chan struct{})
+		wg     sync.WaitGroup
+	)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	go func() {
+		defer close(work)
+		for i := range jobs {
+			select {
+			case work <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	workers := s.workers
+	if workers < 1 {
+		workers = 1
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				cached[i], errs[i] = s.runJob(jobs[i])
+				close(done[i])
+			}
+		}()
+	}
+	// Wait for running checks to finish before returning, even if
+	// remaining checks are abandoned.
+	defer wg.Wait()
+	defer close(stop)
+
+	for i, j := range jobs {
+		<-done[i]
+		if cached[i] {
+			s.cached++
+		}
+		err := errs[i]
+		if err == nil {
+			continue
+		}
+		if j.logged {
+			logger.Error(log.MsgFailedCheck, err)
+		}
+		// Wrap with the chain of parent targets, as if the error had been
+		// returned to the root.
+		for k := len(j.chain) - 2; k >= 0; k-- {
+			err = vts.WrapWithTarget(err, j.chain[k])
+		}
+		if !s.keepGoing || j.fatal {
+			return err
+		}
+		s.failures = append(s.failures, err)
+	}
+	return nil
+}
+
+// CheckOptions describes how checks should be run.
+type CheckOptions struct {
+	// KeepGoing continues checking after a check fails, so that every
+	// failing check is reported.
+	KeepGoing bool
+	// Workers is the number of checks which may run concurrently. If
+	// zero, the number of CPUs is used.
+	Workers int
+	// IgnoreCache runs every check, even if a passing result is cached.
+	// Results are still recorded in the cache.
+	IgnoreCache bool
+}
+
+// CheckReport describes the outcome of running checks.
+type CheckReport struct {
+	// Checked lists the targets which were checked, in the order they
+	// were checked.
+	Checked []vts.Target
+	// Failures contains the error from each failing check. When checks
+	// are not run in keep-going mode, at most one failure is reported.
+	Failures []error
+	// Cached is the number of checks which were skipped, as a passing
+	// result was cached and the files they read were unchanged.
+	Cached int
+}
+
 // Check runs the checkers for all reachable targets against the system
 // in basePath.
 func (u *Universe) Check(targets []vts.TargetRef, basePath string) error {
+	report, err := u.CheckWithOptions(targets, basePath, CheckOptions{})
+	if err != nil {
+		return err
+	}
+	if len(report.Failures) > 0 {
+		return report.Failures[0]
+	}
+	return nil
+}
+
+// CheckWithOptions runs the checkers for all reachable targets against the
+// system in basePath, returning a report of the failing checks. An error is
+// returned only if the checks could not be run.
+//
+// If the universe has a cache, passing results are recorded in it, keyed
+// by the checkers and the rollup hash of the checked target. Checks whose
+// result is cached are skipped if the files they read are unchanged.
+func (u *Universe) CheckWithOptions(targets []vts.TargetRef, basePath string, opts CheckOptions) (*CheckReport, error) {
 	if !u.resolved {
-		return ErrNotBuilt
+		return nil, ErrNotBuilt
+	}
+
+	s := newCheckState(u.MakeEnv(basePath), make(targetSet, 4096))
+	s.keepGoing = opts.KeepGoing
+	if opts.Workers > 0 {
+		s.workers = opts.Workers
+	}
+	if u.cache != nil {
+		s.results = newCheckResults(u.cache, s.env, opts.IgnoreCache)
+	}
+	report := func() *CheckReport {
+		return &CheckReport{Checked: s.order, Failures: s.failures, Cached: s.cached}
 	}
 
-	var (
-		evaluatedTargets = make(targetSet, 4096)
-		runnerEnv        = u.MakeEnv(basePath)
-	)
 	for _, t := range targets {
 		target := t.Target
 		if target == nil {
 			var ok bool
 			target, ok = u.fqTargets[t.Path]
 			if !ok {
-				return ErrNotExists(t.Path)
+				return nil, ErrNotExists(t.Path)
 			}
 		}
-		if err := u.checkTarget(target, runnerEnv, evaluatedTargets); err != nil {
-			return err
-		}
+		u.collectChecks(target, s)
 	}
-
+	// Global checks run once all other checks have passed.
 	for _, chkr := range u.globalCheckers {
-		if err := chkr.RunCheckedTarget(nil, runnerEnv); err != nil {
-			u.logger.Error(log.MsgFailedCheck, err)
-			return err
-		}
+		chkr := chkr
+		s.add(true, false, func() error {
+			return chkr.RunCheckedTarget(nil, s.env)
+		})
 	}
-	return nil
+
+	// Errors which are returned rather than recorded stop checking, and
+	// are reported as the final failure.
+	if err := s.runJobs(u.logger); err != nil {
+		s.failures = append(s.failures, err)
+	}
+	return report(), nil
+}
+
+// checkTarget runs the checks for t and the targets it depends on.
+func (u *Universe) checkTarget(t vts.Target, s *checkState) error {
+	u.collectChecks(t, s)
+	return s.runJobs(u.logger)
 }
 
-func (u *Universe) checkTarget(t vts.Target, opts *vts.RunnerEnv, checked targetSet) error {
-	if _, checked := checked[t]; checked {
-		return nil
+// collectChecks queues the checks for t and the targets it depends on.
+// Checks are queued in dependency order, so dependencies are reported
+// before their dependents.
+func (u *Universe) collectChecks(t vts.Target, s *checkState) {
+	if _, checked := s.checked[t]; checked {
+		return
 	}
-	checked[t] = struct{}{}
+	s.checked[t] = struct{}{}
+	s.order = append(s.order, t)
+	s.chain = append(s.chain, t)
+	defer func() {
+		s.chain = s.chain[:len(s.chain)-1]
+	}()
+	opts := s.envFor(t)
 
 	// Check dependencies first.
 	if deps, hasDeps := t.(vts.DepTarget); hasDeps {
 		for _, dep := range deps.Dependencies() {
-			if err := u.checkTarget(dep.Target, opts, checked); err != nil {
-				return vts.WrapWithTarget(err, t)
-			}
+			u.collectChecks(dep.Target, s)
 		}
 	}
 	// Validate attributes by recursing.
 	if deets, hasDetails := t.(vts.DetailedTarget); hasDetails {
 		for _, attr := range deets.Attributes() {
-			if err := u.checkTarget(attr.Target, opts, checked); err != nil {
-				return vts.WrapWithTarget(err, t)
-			}
+			u.collectChecks(attr.Target, s)
 		}
 	}
 
@@ -71,15 +305,23 @@ func (u *Universe) checkTarget(t vts.Target, opts *vts.RunnerEnv, checked target
 	if class, hasClass := t.(vts.ClassedTarget); hasClass {
 		switch n := class.Class().Target.(type) {
 		case *vts.ResourceClass:
-			if err := n.RunCheckers(t.(*vts.Resource), opts); err != nil {
-				return u.logger.Error(log.MsgFailedCheck, vts.WrapWithTarget(err, t))
-			}
+			s.addCacheable(t, classCheckers(n), func() error {
+				if err := n.RunCheckers(t.(*vts.Resource), opts); err != nil {
+					return vts.WrapWithTarget(err, t)
+				}
+				return nil
+			})
 		case *vts.AttrClass:
-			if err := n.RunCheckers(t.(*vts.Attr), opts); err != nil {
-				return u.logger.Error(log.MsgFailedCheck, vts.WrapWithTarget(err, t))
-			}
+			s.add(true, false, func() error {
+				if err := n.RunCheckers(t.(*vts.Attr), opts); err != nil {
+					return vts.WrapWithTarget(err, t)
+				}
+				return nil
+			})
 		default:
-			return vts.WrapWithTarget(fmt.Errorf("cannot check against class target %T", class.Class().Target), t)
+			s.add(false, true, func() error {
+				return vts.WrapWithTarget(fmt.Errorf("cannot check against class target %T", class.Class().Target), t)
+			})
 		}
 	}
 
@@ -90,9 +332,12 @@ func (u *Universe) checkTarget(t vts.Target, opts *vts.RunnerEnv, checked target
 				ct := c.Target.(*vts.Checker)
 				// Do not run global checks: they run at the end.
 				if ct.Kind != vts.ChkKindGlobal {
-					if err := ct.RunCheckedTarget(n, opts); err != nil {
-						return u.logger.Error(log.MsgFailedCheck, vts.WrapWithTarget(err, t))
-					}
+					s.addCacheable(t, []*vts.Checker{ct}, func() error {
+						if err := ct.RunCheckedTarget(n, opts); err != nil {
+							return vts.WrapWithTarget(err, t)
+						}
+						return nil
+					})
 				}
 			}
 		}
@@ -100,12 +345,13 @@ func (u *Universe) checkTarget(t vts.Target, opts *vts.RunnerEnv, checked target
 		// Some targets annotate a source, which can have logic for checking.
 		if st, hasSrc := t.(vts.SourcedTarget); hasSrc {
 			if src := st.Src(); src != nil {
-				if err := u.checkAgainstSource(opts, t, src.Target); err != nil {
-					return u.logger.Error(log.MsgFailedCheck, vts.WrapWithTarget(err, t))
-				}
-				if err := u.checkTarget(src.Target, opts, checked); err != nil {
-					return vts.WrapWithTarget(err, src.Target)
-				}
+				s.add(true, true, func() error {
+					if err := u.checkAgainstSource(opts, t, src.Target); err != nil {
+						return vts.WrapWithTarget(err, t)
+					}
+					return nil
+				})
+				u.collectChecks(src.Target, s)
 			}
 		}
 	}
@@ -116,13 +362,36 @@ func (u *Universe) checkTarget(t vts.Target, opts *vts.RunnerEnv, checked target
 	// TODO: Lets make a new interface type 'vts.ExtraSelfChecks' that can
 	// have this logic on the concrete target type itself.
 	if tc, isToolchain := t.(*vts.Toolchain); isToolchain {
-		for n, p := range tc.BinaryMappings {
-			if _, err := opts.FS.Stat(p); err != nil {
-				return vts.WrapWithTarget(vts.WrapWithPath(fmt.Errorf("toolchain component missing: %s", n), p), tc)
-			}
+		names := make([]string, 0, len(tc.BinaryMappings))
+		for n := range tc.BinaryMappings {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			n, p := n, tc.BinaryMappings[n]
+			s.add(false, false, func() error {
+				if _, err := opts.FS.Stat(p); err != nil {
+					return vts.WrapWithTarget(vts.WrapWithPath(fmt.Errorf("toolchain component missing: %s", n), p), tc)
+				}
+				return nil
+			})
 		}
 	}
-	return nil
+}
+
+// classCheckers returns the checkers of a resource class, including those
+// it inherits, or nil if any are not resolved.
+func classCheckers(c *vts.ResourceClass) []*vts.Checker {
+	checks := c.InheritedCheckers()
+	out := make([]*vts.Checker, 0, len(checks))
+	for _, ref := range checks {
+		ct, ok := ref.Target.(*vts.Checker)
+		if !ok {
+			return nil
+		}
+		out = append(out, ct)
+	}
+	return out
 }
 
 func (u *Universe) checkAgainstSource(opts *vts.RunnerEnv, t vts.Target, src vts.Target) error {
@@ -148,7 +417,14 @@ func (u *Universe) checkRefConstraints(ref vts.TargetRef, opts *vts.RunnerEnv) e
 		if c.Meta.Target == nil {
 			return errors.New("constraint target is not resolved")
 		}
-		v1, err := determineAttrValue(ref.Target, c.Meta.Target.(*vts.AttrClass), opts)
+		cls, ok := c.Meta.Target.(*vts.AttrClass)
+		if !ok {
+			return vts.WrapWithTarget(fmt.Errorf("constraint on %T, want attr_class", c.Meta.Target), c.Meta.Target)
+		}
+		v1, err := determineAttrValue(ref.Target, cls, opts)
+		if err == errNoAttr {
+			return vts.WrapWithTarget(fmt.Errorf("constraint on %s: %v", cls.GlobalPath(), err), ref.Target)
+		}
 		if err != nil {
 			return err
 		}
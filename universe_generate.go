@@ -2,7 +2,10 @@ package ccr
 
 import (
 	"fmt"
+	"io"
 
+	"github.com/twitchylinux/ccr/export"
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/gen"
 	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
@@ -22,11 +25,39 @@ func (c CircularDependencyError) Error() string {
 
 // GenerateConfig describes parameters to use when generating against
 // a universe.
-type GenerateConfig struct{}
+type GenerateConfig struct {
+	// Defines holds configuration values, as set by --define key=value.
+	// Contracts observe these values through config and select(), so the
+	// same configuration must be provided when resolving targets with
+	// NewDirResolverWithConfig.
+	Defines map[string]string
+	// OutputChecks configures how the outputs of builds are checked.
+	OutputChecks gen.OutputChecks
+}
 
 // Generate applies the tree of rules in target to basePath, creating a
 // system based on those rules.
 func (u *Universe) Generate(conf GenerateConfig, t vts.TargetRef, basePath string) error {
+	return u.generate(conf, t, u.MakeEnv(basePath))
+}
+
+// Export generates the tree of rules in target into memory, writing the
+// resulting system to w as an archive. Unlike Generate, no output directory
+// is needed, and ownership and special files are reproduced in the archive
+// without requiring root privileges.
+func (u *Universe) Export(conf GenerateConfig, t vts.TargetRef, w io.Writer, opts export.Options) error {
+	env := &vts.RunnerEnv{
+		Dir:      "/",
+		FS:       export.NewFS(),
+		Universe: &runtimeResolver{u, map[string]interface{}{}},
+	}
+	if err := u.generate(conf, t, env); err != nil {
+		return err
+	}
+	return export.Write(w, env.FS, opts)
+}
+
+func (u *Universe) generate(conf GenerateConfig, t vts.TargetRef, runnerEnv *vts.RunnerEnv) error {
 	if !u.resolved {
 		return ErrNotBuilt
 	}
@@ -41,22 +72,28 @@ func (u *Universe) Generate(conf GenerateConfig, t vts.TargetRef, basePath strin
 		}
 	}
 
-	runnerEnv := u.MakeEnv(basePath)
-	if err := u.generateTarget(generationState{
-		basePath:               basePath,
+	if err := fsmeta.Begin(runnerEnv.FS); err != nil {
+		return err
+	}
+	err := u.generateTarget(generationState{
+		basePath:               runnerEnv.Dir,
 		conf:                   &conf,
 		runnerEnv:              runnerEnv,
 		haveGenerated:          make(targetSet, 4096),
 		targetChain:            make([]vts.Target, 0, 64),
 		rootTarget:             target,
 		completedToolchainDeps: make(targetSet, 32),
-	}, target); err != nil {
+	}, target)
+	// Metadata recorded before a failure still describes generated files.
+	if endErr := fsmeta.End(runnerEnv.FS); err == nil {
+		err = endErr
+	}
+	if err != nil {
 		u.logger.Error(log.MsgFailedPrecondition, err)
 		return err
 	}
 
-	checked := make(targetSet, 4096)
-	if err := u.checkTarget(target, runnerEnv, checked); err != nil {
+	if err := u.checkTarget(target, newCheckState(runnerEnv, make(targetSet, 4096))); err != nil {
 		return err
 	}
 	for _, chkr := range u.globalCheckers {
@@ -68,6 +105,47 @@ func (u *Universe) Generate(conf GenerateConfig, t vts.TargetRef, basePath strin
 	return nil
 }
 
+// ReproCheck performs the build twice in fresh environments, reporting
+// any files which differ between the two outputs. Inputs to the build are
+// generated first, if not already cached.
+func (u *Universe) ReproCheck(conf GenerateConfig, t vts.TargetRef, basePath string) ([]gen.ReproDiff, error) {
+	if !u.resolved {
+		return nil, ErrNotBuilt
+	}
+	target, ok := u.fqTargets[t.Path]
+	if !ok {
+		return nil, ErrNotExists(t.Path)
+	}
+	b, isBuild := target.(*vts.Build)
+	if !isBuild {
+		return nil, fmt.Errorf("%s is a %s, not a build", t.Path, target.TargetType())
+	}
+
+	runnerEnv := u.MakeEnv(basePath)
+	s := generationState{
+		isGeneratingInputs:     true,
+		basePath:               basePath,
+		conf:                   &conf,
+		runnerEnv:              runnerEnv,
+		haveGenerated:          make(targetSet, 4096),
+		targetChain:            append(make([]vts.Target, 0, 64), b),
+		rootTarget:             b,
+		completedToolchainDeps: make(targetSet, 32),
+	}
+	for _, inp := range b.NeedInputs() {
+		if err := u.generateTarget(s, inp.Target); err != nil {
+			return nil, vts.WrapWithTarget(err, inp.Target)
+		}
+	}
+
+	return gen.ReproCheck(gen.GenerationContext{
+		Cache:        u.cache,
+		RunnerEnv:    runnerEnv,
+		Console:      u.logger.(vts.Console),
+		OutputChecks: conf.OutputChecks,
+	}, b)
+}
+
 type generationState struct {
 	// basePath refers to the directory generated artifacts should reside.
 	basePath string
@@ -104,22 +182,8 @@ func (s generationState) makeCircularDepErr(t vts.Target) error {
 	}
 
 	depChain := s.targetChain[rootIdx:]
-	msg := "circular dependency: "
-	for _, t := range depChain {
-		if gt, ok := t.(vts.GlobalTarget); ok {
-			msg += gt.GlobalPath() + " -> "
-		} else {
-			msg += fmt.Sprintf("anon<%s> -> ", t.TargetType())
-		}
-	}
-	if gt, ok := t.(vts.GlobalTarget); ok {
-		msg += gt.GlobalPath()
-	} else {
-		msg += fmt.Sprintf("anon<%s>", t.TargetType())
-	}
-
 	return CircularDependencyError{
-		msg:  msg,
+		msg:  "circular dependency: " + formatChain(append(depChain[:len(depChain):len(depChain)], t)),
 		Deps: depChain,
 	}
 }
@@ -182,7 +246,7 @@ func (u *Universe) generateTarget(s generationState, t vts.Target) error {
 			Universe: s.runnerEnv.Universe,
 		}
 		for _, dep := range hdt.HostDependencies() {
-			if err := u.checkTarget(dep.Target, env, s.completedToolchainDeps); err != nil {
+			if err := u.checkTarget(dep.Target, newCheckState(env, s.completedToolchainDeps)); err != nil {
 				return err
 			}
 			if err := u.checkRefConstraints(dep, env); err != nil {
@@ -221,9 +285,10 @@ func (u *Universe) generateTarget(s generationState, t vts.Target) error {
 	// Generate() does nothing if the target type doesnt make
 	// sense for generation.
 	if err := gen.Generate(gen.GenerationContext{
-		Cache:     u.cache,
-		RunnerEnv: s.runnerEnv,
-		Console:   u.logger.(vts.Console),
+		Cache:        u.cache,
+		RunnerEnv:    s.runnerEnv,
+		Console:      u.logger.(vts.Console),
+		OutputChecks: s.conf.OutputChecks,
 	}, t); err != nil {
 		return err
 	}
@@ -0,0 +1,350 @@
+package ccr
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// EdgeKind describes the relationship represented by an edge in a Graph.
+type EdgeKind string
+
+// Valid edge kinds.
+const (
+	EdgeDep           EdgeKind = "dep"
+	EdgeInput         EdgeKind = "input"
+	EdgeSource        EdgeKind = "source"
+	EdgeClassInstance EdgeKind = "class_instance"
+	EdgeHostDep       EdgeKind = "host_dep"
+	EdgeInjection     EdgeKind = "injection"
+	EdgePatchInput    EdgeKind = "patch_input"
+	EdgeChroot        EdgeKind = "chroot"
+)
+
+// GraphEdge describes a relationship from one target to another.
+type GraphEdge struct {
+	From, To vts.Target
+	Kind     EdgeKind
+}
+
+// GraphOptions describes how a Graph should be constructed.
+type GraphOptions struct {
+	// Types restricts the graph to targets of the given types. Edges which
+	// would pass through targets of other types connect the nearest targets
+	// of the given types instead. If empty, targets of all types are included.
+	Types []vts.TargetType
+	// CollapseClasses omits the instances of class targets, unless they are
+	// reachable by some other edge.
+	CollapseClasses bool
+	// MaxDepth limits the number of edges between the root target and any
+	// other target in the graph. If zero, the depth is unlimited.
+	MaxDepth int
+}
+
+// Graph describes the targets reachable from a root target, and the
+// relationships between them.
+type Graph struct {
+	Root  vts.Target
+	Nodes []vts.Target
+	Edges []GraphEdge
+
+	ids map[vts.Target]string
+}
+
+// directEdges returns the edges from t, following the same relationships
+// used when collecting the dependencies of a target.
+func (u *Universe) directEdges(t vts.Target) []GraphEdge {
+	var out []GraphEdge
+	add := func(kind EdgeKind, refs ...vts.TargetRef) {
+		for _, r := range refs {
+			if r.Target != nil {
+				out = append(out, GraphEdge{From: t, To: r.Target, Kind: kind})
+			}
+		}
+	}
+
+	switch target := t.(type) {
+	case *vts.Build:
+		add(EdgeHostDep, target.HostDeps...)
+		add(EdgeInjection, target.Injections...)
+		patchPaths := make([]string, 0, len(target.PatchIns))
+		for p := range target.PatchIns {
+			patchPaths = append(patchPaths, p)
+		}
+		sort.Strings(patchPaths)
+		for _, p := range patchPaths {
+			add(EdgePatchInput, target.PatchIns[p])
+		}
+		if target.UsingRoot != nil {
+			add(EdgeChroot, *target.UsingRoot)
+		}
+	default:
+		if inputs, hasInputs := t.(vts.InputTarget); hasInputs {
+			add(EdgeInput, inputs.NeedInputs()...)
+		}
+	}
+
+	if t.IsClassTarget() {
+		for _, inst := range u.classedTargets[t] {
+			out = append(out, GraphEdge{From: t, To: inst, Kind: EdgeClassInstance})
+		}
+	}
+	if deps, hasDeps := t.(vts.DepTarget); hasDeps {
+		add(EdgeDep, deps.Dependencies()...)
+	}
+	if st, hasSrc := t.(vts.SourcedTarget); hasSrc {
+		if src := st.Src(); src != nil {
+			add(EdgeSource, *src)
+		}
+	}
+	return out
+}
+
+// Graph returns the graph of targets reachable from the given target.
+func (u *Universe) Graph(t vts.TargetRef, opts GraphOptions) (*Graph, error) {
+	if !u.resolved {
+		return nil, ErrNotBuilt
+	}
+	target, err := u.lookupTarget(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the graph breadth-first, so depth is the shortest distance
+	// from the root.
+	var (
+		order = []vts.Target{target}
+		depth = map[vts.Target]int{target: 0}
+		edges = make(map[vts.Target][]GraphEdge, 64)
+	)
+	for i := 0; i < len(order); i++ {
+		n := order[i]
+		if opts.MaxDepth > 0 && depth[n] >= opts.MaxDepth {
+			continue
+		}
+		for _, e := range u.directEdges(n) {
+			if opts.CollapseClasses && e.Kind == EdgeClassInstance {
+				continue
+			}
+			edges[n] = append(edges[n], e)
+			if _, seen := depth[e.To]; !seen {
+				depth[e.To] = depth[n] + 1
+				order = append(order, e.To)
+			}
+		}
+	}
+
+	g := &Graph{Root: target}
+	keep := func(t vts.Target) bool {
+		if len(opts.Types) == 0 || t == target {
+			return true
+		}
+		for _, tt := range opts.Types {
+			if t.TargetType() == tt {
+				return true
+			}
+		}
+		return false
+	}
+
+	type edgeKey struct {
+		from, to vts.Target
+		kind     EdgeKind
+	}
+	seenEdges := make(map[edgeKey]bool, len(edges))
+	for _, n := range order {
+		if !keep(n) {
+			continue
+		}
+		g.Nodes = append(g.Nodes, n)
+
+		// Edges to omitted targets are replaced by edges to the nearest
+		// targets which are kept, retaining the kind of the first edge.
+		for _, e := range edges[n] {
+			visited := map[vts.Target]bool{n: true}
+			stack := []vts.Target{e.To}
+			for len(stack) > 0 {
+				to := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if visited[to] {
+					continue
+				}
+				visited[to] = true
+
+				if keep(to) {
+					if k := (edgeKey{n, to, e.Kind}); !seenEdges[k] {
+						seenEdges[k] = true
+						g.Edges = append(g.Edges, GraphEdge{From: n, To: to, Kind: e.Kind})
+					}
+					continue
+				}
+				for i := len(edges[to]) - 1; i >= 0; i-- {
+					stack = append(stack, edges[to][i].To)
+				}
+			}
+		}
+	}
+	return g, nil
+}
+
+// NodeID returns the name of a target in the graph.
+func (g *Graph) NodeID(t vts.Target) string {
+	if g.ids == nil {
+		g.ids = make(map[vts.Target]string, len(g.Nodes))
+		anon := 0
+		for _, n := range g.Nodes {
+			if gt, ok := n.(vts.GlobalTarget); ok && gt.GlobalPath() != "" {
+				g.ids[n] = gt.GlobalPath()
+				continue
+			}
+			anon++
+			g.ids[n] = fmt.Sprintf("anon<%s>#%d", n.TargetType(), anon)
+		}
+	}
+	return g.ids[t]
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "digraph %q {\n", g.NodeID(g.Root)); err != nil {
+		return err
+	}
+	for _, n := range g.Nodes {
+		id := g.NodeID(n)
+		if _, err := fmt.Fprintf(w, "  %q [label=%q];\n", id, id+"\n"+n.TargetType().String()); err != nil {
+			return err
+		}
+	}
+	for _, e := range g.Edges {
+		if _, err := fmt.Fprintf(w, "  %q -> %q [label=%q];\n", g.NodeID(e.From), g.NodeID(e.To), e.Kind); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+type jsonGraphNode struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type jsonGraphEdge struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Kind EdgeKind `json:"kind"`
+}
+
+type jsonGraph struct {
+	Root  string          `json:"root"`
+	Nodes []jsonGraphNode `json:"nodes"`
+	Edges []jsonGraphEdge `json:"edges"`
+}
+
+// WriteJSON writes the graph as a JSON object.
+func (g *Graph) WriteJSON(w io.Writer) error {
+	out := jsonGraph{
+		Root:  g.NodeID(g.Root),
+		Nodes: make([]jsonGraphNode, len(g.Nodes)),
+		Edges: make([]jsonGraphEdge, len(g.Edges)),
+	}
+	for i, n := range g.Nodes {
+		out.Nodes[i] = jsonGraphNode{ID: g.NodeID(n), Type: n.TargetType().String()}
+	}
+	for i, e := range g.Edges {
+		out.Edges[i] = jsonGraphEdge{From: g.NodeID(e.From), To: g.NodeID(e.To), Kind: e.Kind}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		ID          string        `xml:"id,attr"`
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// WriteGraphML writes the graph as a GraphML document.
+func (g *Graph) WriteGraphML(w io.Writer) error {
+	out := graphML{
+		XMLNS: "http://graphml.graphdrawing.org/xmlns",
+		Keys: []graphMLKey{
+			{ID: "type", For: "node", AttrName: "type", AttrType: "string"},
+			{ID: "kind", For: "edge", AttrName: "kind", AttrType: "string"},
+		},
+	}
+	out.Graph.ID = g.NodeID(g.Root)
+	out.Graph.EdgeDefault = "directed"
+	for _, n := range g.Nodes {
+		out.Graph.Nodes = append(out.Graph.Nodes, graphMLNode{
+			ID:   g.NodeID(n),
+			Data: []graphMLData{{Key: "type", Value: n.TargetType().String()}},
+		})
+	}
+	for _, e := range g.Edges {
+		out.Graph.Edges = append(out.Graph.Edges, graphMLEdge{
+			Source: g.NodeID(e.From),
+			Target: g.NodeID(e.To),
+			Data:   []graphMLData{{Key: "kind", Value: string(e.Kind)}},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Write writes the graph in the named format: one of dot, json or graphml.
+func (g *Graph) Write(w io.Writer, format string) error {
+	switch strings.ToLower(format) {
+	case "dot", "":
+		return g.WriteDOT(w)
+	case "json":
+		return g.WriteJSON(w)
+	case "graphml":
+		return g.WriteGraphML(w)
+	}
+	return fmt.Errorf("unknown graph format %q", format)
+}
@@ -0,0 +1,227 @@
+package ccr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/ccr/log"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// targetName returns the path of a target, or a description of its type if
+// the target is anonymous.
+func targetName(t vts.Target) string {
+	if gt, ok := t.(vts.GlobalTarget); ok && gt.GlobalPath() != "" {
+		return gt.GlobalPath()
+	}
+	return fmt.Sprintf("anon<%s>", t.TargetType())
+}
+
+// formatChain describes a chain of targets, in the form a -> b -> c.
+func formatChain(chain []vts.Target) string {
+	names := make([]string, len(chain))
+	for i, t := range chain {
+		names[i] = targetName(t)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// DepPath describes a chain of relationships from one target to another.
+// Each edge begins at the target the previous edge ended at.
+type DepPath []GraphEdge
+
+// Targets returns the targets along the path, starting with the target
+// the path begins at.
+func (p DepPath) Targets() []vts.Target {
+	if len(p) == 0 {
+		return nil
+	}
+	out := make([]vts.Target, 0, len(p)+1)
+	out = append(out, p[0].From)
+	for _, e := range p {
+		out = append(out, e.To)
+	}
+	return out
+}
+
+// String describes the path in the form a -> b -> c.
+func (p DepPath) String() string {
+	return formatChain(p.Targets())
+}
+
+// StringWithKinds describes the path in the form a -[dep]-> b -[source]-> c,
+// naming the kind of each edge.
+func (p DepPath) StringWithKinds() string {
+	if len(p) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString(targetName(p[0].From))
+	for _, e := range p {
+		fmt.Fprintf(&sb, " -[%s]-> %s", e.Kind, targetName(e.To))
+	}
+	return sb.String()
+}
+
+// lookupTarget returns the target referenced by t.
+func (u *Universe) lookupTarget(t vts.TargetRef) (vts.Target, error) {
+	if t.Target != nil {
+		return t.Target, nil
+	}
+	target, ok := u.fqTargets[t.Path]
+	if !ok {
+		u.logger.Error(log.MsgBadFind, ErrNotExists(t.Path))
+		return nil, ErrNotExists(t.Path)
+	}
+	return target, nil
+}
+
+// incomingEdges indexes the edges into each target reachable from roots.
+// Anonymous targets are not enumerated, so they are discovered by
+// following edges.
+func (u *Universe) incomingEdges(roots []vts.Target) map[vts.Target][]GraphEdge {
+	var (
+		out     = make(map[vts.Target][]GraphEdge, len(roots))
+		indexed = make(map[vts.Target]bool, len(roots))
+		pending = append(make([]vts.Target, 0, len(roots)), roots...)
+	)
+	for len(pending) > 0 {
+		n := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if indexed[n] {
+			continue
+		}
+		indexed[n] = true
+		for _, e := range u.directEdges(n) {
+			out[e.To] = append(out[e.To], e)
+			if !indexed[e.To] {
+				pending = append(pending, e.To)
+			}
+		}
+	}
+	return out
+}
+
+// dependents describes the targets which transitively depend on a target.
+type dependents struct {
+	// order lists the target and its dependents, nearest first.
+	order []vts.Target
+	// via holds the first edge of the shortest path from each dependent
+	// towards the target.
+	via map[vts.Target]GraphEdge
+}
+
+// dependentsOf searches backwards from target along the given incoming
+// edges.
+func dependentsOf(target vts.Target, incoming map[vts.Target][]GraphEdge) dependents {
+	out := dependents{
+		order: []vts.Target{target},
+		via:   map[vts.Target]GraphEdge{target: {}},
+	}
+	for i := 0; i < len(out.order); i++ {
+		for _, e := range incoming[out.order[i]] {
+			if _, seen := out.via[e.From]; seen {
+				continue
+			}
+			out.via[e.From] = e
+			out.order = append(out.order, e.From)
+		}
+	}
+	return out
+}
+
+// Why returns the dependency chains from one target to another, following
+// the same relationships as Graph. If all is false, only the shortest chain
+// is returned. No chains are returned if to is not reachable from from.
+func (u *Universe) Why(from, to vts.TargetRef, all bool) ([]DepPath, error) {
+	if !u.resolved {
+		return nil, ErrNotBuilt
+	}
+	src, err := u.lookupTarget(from)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := u.lookupTarget(to)
+	if err != nil {
+		return nil, err
+	}
+
+	reach := dependentsOf(dst, u.incomingEdges([]vts.Target{src}))
+	if _, ok := reach.via[src]; !ok || src == dst {
+		return nil, nil
+	}
+	if !all {
+		var out DepPath
+		for t := src; t != dst; t = reach.via[t].To {
+			out = append(out, reach.via[t])
+		}
+		return []DepPath{out}, nil
+	}
+
+	// Depth-first search for every path which does not revisit a target,
+	// only descending into targets from which dst is reachable.
+	var (
+		out    []DepPath
+		path   DepPath
+		onPath = map[vts.Target]bool{}
+		visit  func(t vts.Target)
+	)
+	visit = func(t vts.Target) {
+		if t == dst {
+			out = append(out, append(DepPath(nil), path...))
+			return
+		}
+		onPath[t] = true
+		for _, e := range u.directEdges(t) {
+			if _, ok := reach.via[e.To]; !ok || onPath[e.To] {
+				continue
+			}
+			path = append(path, e)
+			visit(e.To)
+			path = path[:len(path)-1]
+		}
+		onPath[t] = false
+	}
+	visit(src)
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return len(out[i]) < len(out[j])
+	})
+	return out, nil
+}
+
+// ReverseDeps returns a dependency chain to the given target from every
+// enumerated target which transitively depends on it. Chains are the
+// shortest possible, and are ordered from the nearest dependent.
+func (u *Universe) ReverseDeps(t vts.TargetRef) ([]DepPath, error) {
+	if !u.resolved {
+		return nil, ErrNotBuilt
+	}
+	target, err := u.lookupTarget(t)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]vts.Target, len(u.allTargets))
+	for i, gt := range u.allTargets {
+		roots[i] = gt
+	}
+	var (
+		out  []DepPath
+		deps = dependentsOf(target, u.incomingEdges(roots))
+	)
+	for _, n := range deps.order {
+		if n == target {
+			continue
+		}
+		if gt, ok := n.(vts.GlobalTarget); ok && gt.GlobalPath() != "" {
+			var p DepPath
+			for t := n; t != target; t = deps.via[t].To {
+				p = append(p, deps.via[t])
+			}
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
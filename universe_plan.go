@@ -1,24 +1,17 @@
 package ccr
 
 import (
-	"errors"
-	"fmt"
-	"sort"
-
 	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
 )
 
-const maxDepOrderIterations = 80
-
 type collectionState struct {
 	allDeps map[vts.Target][]vts.Target
 }
 
-// TargetsDependencyOrder returns a sets of targets of the given type, where
-// the order represents dependency order, and targets in the same set may
-// be generated simultaneously.
-func (u *Universe) TargetsDependencyOrder(conf GenerateConfig, t vts.TargetRef, basePath string, tt vts.TargetType) ([][]vts.Target, error) {
+// DependencyGraph returns the graph of dependencies between all targets of
+// the given type which are needed to generate the given target.
+func (u *Universe) DependencyGraph(conf GenerateConfig, t vts.TargetRef, basePath string, tt vts.TargetType) (*DepGraph, error) {
 	if !u.resolved {
 		return nil, ErrNotBuilt
 	}
@@ -50,61 +43,45 @@ func (u *Universe) TargetsDependencyOrder(conf GenerateConfig, t vts.TargetRef,
 		return nil, err
 	}
 
-	pending, emitted := make(map[vts.Target]struct{}, len(cs.allDeps)/2), make(map[vts.Target]struct{}, len(cs.allDeps))
-	for k, _ := range cs.allDeps {
-		if k.TargetType() == tt {
-			pending[k] = struct{}{}
-		}
+	g := &DepGraph{
+		Deps:       make(map[vts.Target][]vts.Target, len(cs.allDeps)/2),
+		Dependents: make(map[vts.Target][]vts.Target, len(cs.allDeps)/2),
 	}
-
-	var out [][]vts.Target
-
-	for i := 0; len(pending) > 0; i++ {
-		curSet := make([]vts.Target, 0, 6)
-		if i > maxDepOrderIterations {
-			return nil, errors.New("max resolution iterations were reached")
-		}
-
-		for k, _ := range pending {
-			// fmt.Printf("Pending[%02d]: %v\n", i, k)
-			pendingDeps := numDepsOfType(cs.allDeps[k], emitted, tt)
-			// fmt.Printf("  pending = %d (%v)\n", pendingDeps, cs.allDeps[k])
-			if pendingDeps == 0 {
-				curSet = append(curSet, k)
-			}
+	for k, deps := range cs.allDeps {
+		if k.TargetType() != tt {
+			continue
 		}
-
-		sort.Slice(curSet, func(i int, j int) bool {
-			oi, ok := curSet[i].(fmt.Stringer)
-			if !ok {
-				return false
-			}
-			oj, ok := curSet[j].(fmt.Stringer)
-			if !ok {
-				return false
-			}
-			return oi.String() < oj.String()
-		})
-		for _, s := range curSet {
-			delete(pending, s)
-			emitted[s] = struct{}{}
+		g.Deps[k] = depsOfType(k, deps, tt)
+		for _, d := range g.Deps[k] {
+			g.Dependents[d] = append(g.Dependents[d], k)
 		}
-		out = append(out, curSet)
 	}
+	for _, dependents := range g.Dependents {
+		sortTargets(dependents)
+	}
+	return g, nil
+}
 
-	return out, nil
+// TargetsDependencyOrder returns a sets of targets of the given type, where
+// the order represents dependency order, and targets in the same set may
+// be generated simultaneously.
+func (u *Universe) TargetsDependencyOrder(conf GenerateConfig, t vts.TargetRef, basePath string, tt vts.TargetType) ([][]vts.Target, error) {
+	g, err := u.DependencyGraph(conf, t, basePath, tt)
+	if err != nil {
+		return nil, err
+	}
+	return g.Phases()
 }
 
-func numDepsOfType(deps []vts.Target, ignore map[vts.Target]struct{}, tt vts.TargetType) int {
-	out := 0
+// depsOfType returns the members of deps of the given type, excluding t.
+func depsOfType(t vts.Target, deps []vts.Target, tt vts.TargetType) []vts.Target {
+	out := make([]vts.Target, 0, len(deps))
 	for _, d := range deps {
-		if _, ignore := ignore[d]; ignore {
-			continue
-		}
-		if d.TargetType() == tt {
-			out++
+		if d != t && d.TargetType() == tt {
+			out = append(out, d)
 		}
 	}
+	sortTargets(out)
 	return out
 }
 
@@ -0,0 +1,647 @@
+package ccr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gobwas/glob"
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// Query is a parsed expression which selects a set of targets from a
+// universe. Expressions are composed of the following terms:
+//
+//	//some:target             the target with the given path
+//	all()                     all enumerated targets
+//	type(resource)            targets of the given type
+//	class(//some:class)       instances of the given class or its subclasses
+//	attr(//some:attr_class)   targets with an attribute of the given class
+//	attr(//x:class == "v")    ... with the given value (or !=)
+//	path("/usr/lib/**")       targets with a path matching the glob
+//	source(build)             targets whose source is of the given type
+//	deps(expr)                the selected targets, and those they reach
+//	rdeps(expr)               the selected targets, and those reaching them
+//
+// Terms are combined with & (intersection), | (union) and - (difference).
+// Intersection binds more tightly than union and difference, which are
+// evaluated left to right. Parentheses may be used for grouping.
+type Query struct {
+	expr queryNode
+	refs []string
+}
+
+// TargetPaths returns the paths of all targets referenced by the query,
+// so the universe can be built from them.
+func (q *Query) TargetPaths() []string {
+	return q.refs
+}
+
+// ParseQuery parses a query expression.
+func ParseQuery(expr string) (*Query, error) {
+	toks, err := lexQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := queryParser{toks: toks}
+	n, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != qtEOF {
+		return nil, fmt.Errorf("query: unexpected %s at offset %d", tok, tok.pos)
+	}
+	return &Query{expr: n, refs: p.refs}, nil
+}
+
+type queryTokenKind uint8
+
+const (
+	qtEOF queryTokenKind = iota
+	qtWord
+	qtString
+	qtLParen
+	qtRParen
+	qtAnd
+	qtOr
+	qtMinus
+	qtEq
+	qtNotEq
+)
+
+type queryToken struct {
+	kind  queryTokenKind
+	value string
+	pos   int
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case qtEOF:
+		return "end of query"
+	case qtString:
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+func isQueryWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-./:@+", r)
+}
+
+func lexQuery(expr string) ([]queryToken, error) {
+	var (
+		out []queryToken
+		rs  = []rune(expr)
+	)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			out = append(out, queryToken{qtLParen, "(", i})
+			i++
+		case r == ')':
+			out = append(out, queryToken{qtRParen, ")", i})
+			i++
+		case r == '&':
+			out = append(out, queryToken{qtAnd, "&", i})
+			i++
+		case r == '|':
+			out = append(out, queryToken{qtOr, "|", i})
+			i++
+		case r == '-':
+			out = append(out, queryToken{qtMinus, "-", i})
+			i++
+		case r == '=' && i+1 < len(rs) && rs[i+1] == '=':
+			out = append(out, queryToken{qtEq, "==", i})
+			i += 2
+		case r == '!' && i+1 < len(rs) && rs[i+1] == '=':
+			out = append(out, queryToken{qtNotEq, "!=", i})
+			i += 2
+		case r == '"':
+			start := i
+			for i++; i < len(rs) && rs[i] != '"'; i++ {
+				if rs[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(rs) {
+				return nil, fmt.Errorf("query: unterminated string at offset %d", start)
+			}
+			i++
+			s, err := strconv.Unquote(string(rs[start:i]))
+			if err != nil {
+				return nil, fmt.Errorf("query: invalid string at offset %d: %v", start, err)
+			}
+			out = append(out, queryToken{qtString, s, start})
+		case isQueryWordChar(r):
+			// Words may contain '-', as in //base:foo-bar, but may not
+			// begin with it, so a difference is always recognized.
+			start := i
+			for i < len(rs) && isQueryWordChar(rs[i]) {
+				i++
+			}
+			out = append(out, queryToken{qtWord, string(rs[start:i]), start})
+		default:
+			return nil, fmt.Errorf("query: unexpected character %q at offset %d", r, i)
+		}
+	}
+	return append(out, queryToken{kind: qtEOF, pos: len(rs)}), nil
+}
+
+type queryParser struct {
+	toks []queryToken
+	pos  int
+	refs []string
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.toks[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.toks[p.pos]
+	if t.kind != qtEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) expect(kind queryTokenKind, what string) (queryToken, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("query: expected %s at offset %d, got %s", what, t.pos, t)
+	}
+	return t, nil
+}
+
+func (p *queryParser) parseExpr() (queryNode, error) {
+	lhs, err := p.parseIntersection()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op.kind != qtOr && op.kind != qtMinus {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseIntersection()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &setOpNode{op: op.kind, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *queryParser) parseIntersection() (queryNode, error) {
+	lhs, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == qtAnd {
+		p.next()
+		rhs, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		lhs = &setOpNode{op: qtAnd, lhs: lhs, rhs: rhs}
+	}
+	return lhs, nil
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.next()
+	switch t.kind {
+	case qtLParen:
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(qtRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case qtWord:
+		if p.peek().kind != qtLParen {
+			p.refs = append(p.refs, t.value)
+			return &targetNode{path: t.value}, nil
+		}
+		p.next()
+		n, err := p.parseFunc(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(qtRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("query: unexpected %s at offset %d", t, t.pos)
+}
+
+func (p *queryParser) parseFunc(name queryToken) (queryNode, error) {
+	switch name.value {
+	case "all":
+		return &allNode{}, nil
+	case "deps", "rdeps":
+		n, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &depsNode{reverse: name.value == "rdeps", of: n}, nil
+	case "type", "source":
+		arg, err := p.expect(qtWord, "target type")
+		if err != nil {
+			return nil, err
+		}
+		tt, err := vts.ParseTargetType(arg.value)
+		if err != nil {
+			return nil, fmt.Errorf("query: %v", err)
+		}
+		return &typeNode{tt: tt, ofSource: name.value == "source"}, nil
+	case "class":
+		arg, err := p.expect(qtWord, "class path")
+		if err != nil {
+			return nil, err
+		}
+		p.refs = append(p.refs, arg.value)
+		return &classNode{path: arg.value}, nil
+	case "attr":
+		arg, err := p.expect(qtWord, "attribute class path")
+		if err != nil {
+			return nil, err
+		}
+		p.refs = append(p.refs, arg.value)
+		n := &attrNode{class: arg.value}
+		if op := p.peek(); op.kind == qtEq || op.kind == qtNotEq {
+			p.next()
+			v := p.next()
+			if v.kind != qtString && v.kind != qtWord {
+				return nil, fmt.Errorf("query: expected value at offset %d, got %s", v.pos, v)
+			}
+			n.op, n.value = op.kind, v.value
+		}
+		return n, nil
+	case "path":
+		arg, err := p.expect(qtString, "path glob")
+		if err != nil {
+			return nil, err
+		}
+		g, err := glob.Compile(arg.value, '/')
+		if err != nil {
+			return nil, fmt.Errorf("query: invalid path glob %q: %v", arg.value, err)
+		}
+		return &pathNode{glob: g}, nil
+	}
+	return nil, fmt.Errorf("query: unknown function %q at offset %d", name.value, name.pos)
+}
+
+// queryEnv is the state used to evaluate a query.
+type queryEnv struct {
+	u   *Universe
+	env *vts.RunnerEnv
+}
+
+// all returns every enumerated target with a path.
+func (e *queryEnv) all() targetSet {
+	out := make(targetSet, len(e.u.allTargets))
+	for _, t := range e.u.allTargets {
+		if t.GlobalPath() != "" {
+			out[t] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (e *queryEnv) filter(pred func(t vts.Target) (bool, error)) (targetSet, error) {
+	out := make(targetSet, 64)
+	for t := range e.all() {
+		ok, err := pred(t)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out[t] = struct{}{}
+		}
+	}
+	return out, nil
+}
+
+type queryNode interface {
+	eval(e *queryEnv) (targetSet, error)
+}
+
+type setOpNode struct {
+	op       queryTokenKind
+	lhs, rhs queryNode
+}
+
+func (n *setOpNode) eval(e *queryEnv) (targetSet, error) {
+	lhs, err := n.lhs.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := n.rhs.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	out := make(targetSet, len(lhs))
+	switch n.op {
+	case qtAnd:
+		for t := range lhs {
+			if _, ok := rhs[t]; ok {
+				out[t] = struct{}{}
+			}
+		}
+	case qtOr:
+		for t := range lhs {
+			out[t] = struct{}{}
+		}
+		for t := range rhs {
+			out[t] = struct{}{}
+		}
+	case qtMinus:
+		for t := range lhs {
+			if _, ok := rhs[t]; !ok {
+				out[t] = struct{}{}
+			}
+		}
+	}
+	return out, nil
+}
+
+type targetNode struct {
+	path string
+}
+
+func (n *targetNode) eval(e *queryEnv) (targetSet, error) {
+	t, err := e.u.lookupTarget(vts.TargetRef{Path: n.path})
+	if err != nil {
+		return nil, err
+	}
+	return targetSet{t: struct{}{}}, nil
+}
+
+type allNode struct{}
+
+func (n *allNode) eval(e *queryEnv) (targetSet, error) {
+	return e.all(), nil
+}
+
+type typeNode struct {
+	tt       vts.TargetType
+	ofSource bool
+}
+
+func (n *typeNode) eval(e *queryEnv) (targetSet, error) {
+	return e.filter(func(t vts.Target) (bool, error) {
+		if !n.ofSource {
+			return t.TargetType() == n.tt, nil
+		}
+		st, ok := t.(vts.SourcedTarget)
+		if !ok || st.Src() == nil || st.Src().Target == nil {
+			return false, nil
+		}
+		return st.Src().Target.TargetType() == n.tt, nil
+	})
+}
+
+type classNode struct {
+	path string
+}
+
+func (n *classNode) eval(e *queryEnv) (targetSet, error) {
+	class, err := e.u.lookupTarget(vts.TargetRef{Path: n.path})
+	if err != nil {
+		return nil, err
+	}
+	return e.filter(func(t vts.Target) (bool, error) {
+		ct, ok := t.(vts.ClassedTarget)
+		if !ok {
+			return false, nil
+		}
+		// Instances of a resource class are also instances of its ancestors.
+		if rc, ok := ct.Class().Target.(*vts.ResourceClass); ok {
+			for _, c := range rc.Lineage() {
+				if c == class {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+		return ct.Class().Target == class, nil
+	})
+}
+
+type attrNode struct {
+	class string
+	// op is qtEq or qtNotEq, or zero if only the presence of the attribute
+	// is tested.
+	op    queryTokenKind
+	value string
+}
+
+func (n *attrNode) eval(e *queryEnv) (targetSet, error) {
+	return e.filter(func(t vts.Target) (bool, error) {
+		dt, ok := t.(vts.DetailedTarget)
+		if !ok {
+			return false, nil
+		}
+		for _, ref := range dt.Attributes() {
+			a, ok := ref.Target.(*vts.Attr)
+			if !ok || a.Parent.Target == nil || a.Parent.Target.(*vts.AttrClass).GlobalPath() != n.class {
+				continue
+			}
+			if n.op == qtEOF {
+				return true, nil
+			}
+			v, err := a.Value(t, e.env, proc.EvalComputedAttribute)
+			if err != nil {
+				return false, vts.WrapWithTarget(err, t)
+			}
+			s, isStr := starlark.AsString(v)
+			if !isStr {
+				s = v.String()
+			}
+			if (s == n.value) == (n.op == qtEq) {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+}
+
+type pathNode struct {
+	glob glob.Glob
+}
+
+func (n *pathNode) eval(e *queryEnv) (targetSet, error) {
+	return e.filter(func(t vts.Target) (bool, error) {
+		if _, ok := t.(vts.DetailedTarget); !ok {
+			return false, nil
+		}
+		p, err := determinePath(t, e.env)
+		if err != nil {
+			if err == errNoAttr {
+				return false, nil
+			}
+			return false, err
+		}
+		return n.glob.Match(p), nil
+	})
+}
+
+type depsNode struct {
+	reverse bool
+	of      queryNode
+}
+
+func (n *depsNode) eval(e *queryEnv) (targetSet, error) {
+	of, err := n.of.eval(e)
+	if err != nil {
+		return nil, err
+	}
+
+	var incoming map[vts.Target][]GraphEdge
+	if n.reverse {
+		roots := make([]vts.Target, len(e.u.allTargets))
+		for i, gt := range e.u.allTargets {
+			roots[i] = gt
+		}
+		incoming = e.u.incomingEdges(roots)
+	}
+
+	out := make(targetSet, 64)
+	pending := make([]vts.Target, 0, len(of))
+	for t := range of {
+		pending = append(pending, t)
+	}
+	for len(pending) > 0 {
+		t := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, seen := out[t]; seen {
+			continue
+		}
+		out[t] = struct{}{}
+
+		if n.reverse {
+			for _, edge := range incoming[t] {
+				pending = append(pending, edge.From)
+			}
+			continue
+		}
+		for _, edge := range e.u.directEdges(t) {
+			pending = append(pending, edge.To)
+		}
+	}
+	return out, nil
+}
+
+// Query returns the enumerated targets selected by the query, in
+// enumeration order. Anonymous targets are never selected.
+func (u *Universe) Query(basePath string, q *Query) ([]vts.GlobalTarget, error) {
+	if !u.resolved {
+		return nil, ErrNotBuilt
+	}
+	set, err := q.expr.eval(&queryEnv{u: u, env: u.MakeEnv(basePath)})
+	if err != nil {
+		return nil, err
+	}
+
+	var out []vts.GlobalTarget
+	for _, t := range u.allTargets {
+		if _, ok := set[t]; ok && t.GlobalPath() != "" {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+type queryResult struct {
+	Path  string                 `json:"path"`
+	Type  string                 `json:"type"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// WriteQueryJSON writes the given targets as JSON, with the resolved
+// values of their attributes keyed by attribute class.
+func (u *Universe) WriteQueryJSON(w io.Writer, basePath string, targets []vts.GlobalTarget) error {
+	env := u.MakeEnv(basePath)
+	out := make([]queryResult, len(targets))
+	for i, t := range targets {
+		out[i] = queryResult{Path: t.GlobalPath(), Type: t.TargetType().String()}
+		dt, ok := t.(vts.DetailedTarget)
+		if !ok {
+			continue
+		}
+		for _, ref := range dt.Attributes() {
+			a, ok := ref.Target.(*vts.Attr)
+			if !ok || a.Parent.Target == nil {
+				continue
+			}
+			v, err := a.Value(t, env, proc.EvalComputedAttribute)
+			if err != nil {
+				return vts.WrapWithTarget(err, t)
+			}
+			if out[i].Attrs == nil {
+				out[i].Attrs = make(map[string]interface{}, 4)
+			}
+			class := a.Parent.Target.(*vts.AttrClass).GlobalPath()
+			if a.Parent.Target.(*vts.AttrClass).Repeatable {
+				l, _ := out[i].Attrs[class].([]interface{})
+				out[i].Attrs[class] = append(l, starlarkToJSON(v))
+			} else {
+				out[i].Attrs[class] = starlarkToJSON(v)
+			}
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// starlarkToJSON converts a starlark value to a value which can be encoded
+// as JSON.
+func starlarkToJSON(v starlark.Value) interface{} {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.Bool:
+		return bool(v)
+	case starlark.String:
+		return string(v)
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i
+		}
+		return v.String()
+	case starlark.Float:
+		return float64(v)
+	case starlark.Indexable:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = starlarkToJSON(v.Index(i))
+		}
+		return out
+	case *starlark.Dict:
+		out := make(map[string]interface{}, v.Len())
+		for _, kv := range v.Items() {
+			k, ok := starlark.AsString(kv[0])
+			if !ok {
+				k = kv[0].String()
+			}
+			out[k] = starlarkToJSON(kv[1])
+		}
+		return out
+	}
+	return v.String()
+}
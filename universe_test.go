@@ -1,23 +1,34 @@
 package ccr
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/twitchylinux/ccr/cache"
+	"github.com/twitchylinux/ccr/export"
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/log"
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/ccbuild"
 	"github.com/twitchylinux/ccr/vts/common"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-billy.v4/util"
 )
 
 func testResolver(path string) (vts.Target, error) {
@@ -439,6 +450,57 @@ func TestUniverseCheck(t *testing.T) {
 			base:    "testdata/checkers/base",
 			targets: []vts.TargetRef{{Path: "//cheaders:good"}},
 		},
+		{
+			name:    "user_good",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//accounts:good"}},
+		},
+		{
+			name:    "user_missing_shell",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//accounts:missing_shell"}},
+			err:     "shell: stat testdata/checkers/base/bin/missing: no such file or directory",
+		},
+		{
+			name:    "user_duplicate_uid",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//accounts:duplicate_uid"}},
+			err:     "id 1000 is also used by \"same_uid\"",
+		},
+		{
+			name:    "group_bad_members",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//accounts:bad_members"}},
+			err:     "member \"nobody\" is not a user",
+		},
+		{
+			name:    "starlark_resource_good",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//starlark:good"}},
+		},
+		{
+			name:    "starlark_resource_returned_err",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//starlark:missing"}},
+			err:     "missing file: missing.json",
+		},
+		{
+			name:    "starlark_resource_fail",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//starlark:not_object"}},
+			err:     "fail: not a json object: somefile",
+		},
+		{
+			name:    "starlark_component_good",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//starlark:named_component"}},
+		},
+		{
+			name:    "starlark_component_bad",
+			base:    "testdata/checkers/base",
+			targets: []vts.TargetRef{{Path: "//starlark:misnamed_component"}},
+			err:     "unexpected name: misnamed_component",
+		},
 	}
 
 	for _, tc := range tcs {
@@ -529,6 +591,7 @@ func TestUniverseGenerate(t *testing.T) {
 		testManifest string
 		hasFiles     map[string]os.FileMode
 		hasContent   map[string]string
+		hasMeta      map[string]fsmeta.Entry
 		notFiles     []string
 		err          string
 	}{
@@ -686,6 +749,24 @@ Class: //basic:whelp
 			err:    "semver constraint was not met",
 			config: GenerateConfig{},
 		},
+		{
+			name:   "hostdep_constraint_semver_range_fail",
+			target: "//build_hostdep_constraint:failing_range_constraint",
+			err:    "semver constraint was not met",
+			config: GenerateConfig{},
+		},
+		{
+			name:   "hostdep_constraint_attr_eq_fail",
+			target: "//build_hostdep_constraint:failing_attr_constraint",
+			err:    "common://attrs:arch constraint was not met",
+			config: GenerateConfig{},
+		},
+		{
+			name:   "hostdep_constraint_attr_in_fail",
+			target: "//build_hostdep_constraint:failing_attr_in_constraint",
+			err:    "common://attrs:arch constraint was not met",
+			config: GenerateConfig{},
+		},
 		{
 			name:   "sieve_basic_filter_exclude",
 			target: "//basic_sieve:filter_exclude",
@@ -773,6 +854,65 @@ Class: //basic:whelp
 			config: GenerateConfig{},
 			err:    "bad magic number '[70 97 107 101]' in record at byte 0x0",
 		},
+		{
+			name:   "starlark_generator",
+			target: "//starlark_gen:index_component",
+			config: GenerateConfig{},
+			hasFiles: map[string]os.FileMode{
+				"etc/index.txt": os.FileMode(0640),
+			},
+			hasContent: map[string]string{
+				"etc/index.txt": "# generated for index\na\nb\n",
+			},
+		},
+		{
+			name:   "accounts",
+			target: "//accounts:system",
+			config: GenerateConfig{},
+			hasFiles: map[string]os.FileMode{
+				"etc/passwd":  os.FileMode(0644),
+				"etc/group":   os.FileMode(0644),
+				"etc/shadow":  os.FileMode(0600),
+				"etc/gshadow": os.FileMode(0640),
+			},
+			hasContent: map[string]string{
+				"etc/passwd":  "root:x:0:0::/root:/bin/sh\ndaemon:x:1:100::/:/sbin/nologin\nalice:x:879:879::/:/sbin/nologin\n",
+				"etc/group":   "root:x:0:\nusers:x:100:alice,daemon\nwheel:x:656:alice\nalice:x:879:\n",
+				"etc/shadow":  "root:!:::::::\ndaemon:!:::::::\nalice:!:::::::\n",
+				"etc/gshadow": "root:!::\nusers:!::alice,daemon\nwheel:!::alice\nalice:!::\n",
+			},
+		},
+		{
+			name:   "accounts_conflicting_ids",
+			target: "//accounts:conflicting_ids",
+			config: GenerateConfig{},
+			err:    "gid 100 is used by both \"staff\" and \"users\"",
+		},
+		{
+			name:   "special_files",
+			target: "//special:root",
+			config: GenerateConfig{},
+			hasContent: map[string]string{
+				"bin/thing2": "Fake contents!!\n",
+			},
+			hasMeta: map[string]fsmeta.Entry{
+				"bin/thing":   {Path: "/bin/thing", Mode: 0755 | os.ModeSetuid, UID: 1, GID: 1},
+				"run/initctl": {Path: "/run/initctl", Type: fsmeta.TypeFifo, Mode: 0600},
+				"dev/null":    {Path: "/dev/null", Type: fsmeta.TypeChar, Mode: 0666, Major: 1, Minor: 3},
+			},
+		},
+		{
+			name:   "special_files_bad_device",
+			target: "//special:bad_device_type",
+			config: GenerateConfig{},
+			err:    "cannot create special file of type \"pipe\"",
+		},
+		{
+			name:   "starlark_generator_fail",
+			target: "//starlark_gen:broken",
+			config: GenerateConfig{},
+			err:    "fail: nothing to write",
+		},
 	}
 
 	cd, err := ioutil.TempDir("", "")
@@ -852,6 +992,16 @@ Class: //basic:whelp
 					t.Errorf("incorrect file content for %s:\n%q\n!=\n%q", p, string(d), c)
 				}
 			}
+			for p, want := range tc.hasMeta {
+				got, err := fsmeta.Lookup(osfs.New(td), p)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("incorrect metadata for %s (+got, -want):\n%s", p, diff)
+				}
+			}
 			for _, p := range tc.notFiles {
 				_, err := os.Stat(filepath.Join(td, p))
 				if err == nil {
@@ -864,6 +1014,77 @@ Class: //basic:whelp
 	}
 }
 
+func TestUniverseExport(t *testing.T) {
+	cd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cd)
+	cache, err := cache.NewCache(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uv := NewUniverse(&log.Silent{}, cache)
+	dr := NewDirResolver("testdata/generators")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	target := vts.TargetRef{Path: "//special:root"}
+	if err := uv.Build([]vts.TargetRef{target}, &findOpts, cd); err != nil {
+		t.Fatalf("universe.Build(%q) failed: %v", target.Path, err)
+	}
+
+	var out bytes.Buffer
+	if err := uv.Export(GenerateConfig{}, target, &out, export.Options{Format: export.FormatTar}); err != nil {
+		t.Fatalf("universe.Export(%q) failed: %v", target.Path, err)
+	}
+
+	type file struct {
+		Type         byte
+		Mode         int64
+		UID, GID     int
+		Link         string
+		Major, Minor int64
+		Content      string
+	}
+	got := map[string]file{}
+	tr := tar.NewReader(&out)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !h.ModTime.Equal(time.Unix(0, 0)) {
+			t.Errorf("%s has modification time %v, want the unix epoch", h.Name, h.ModTime)
+		}
+		got[h.Name] = file{h.Typeflag, h.Mode, h.Uid, h.Gid, h.Linkname, h.Devmajor, h.Devminor, string(d)}
+	}
+
+	want := map[string]file{
+		"bin/":        {Type: tar.TypeDir, Mode: 0755},
+		"bin/thing":   {Type: tar.TypeReg, Mode: 04755, UID: 1, GID: 1, Content: "Fake contents!!\n"},
+		"bin/thing2":  {Type: tar.TypeLink, Mode: 04755, UID: 1, GID: 1, Link: "bin/thing"},
+		"dev/":        {Type: tar.TypeDir, Mode: 0755},
+		"dev/null":    {Type: tar.TypeChar, Mode: 0666, Major: 1, Minor: 3},
+		"run/":        {Type: tar.TypeDir, Mode: 0755},
+		"run/initctl": {Type: tar.TypeFifo, Mode: 0600},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("exported archive differs (+got, -want):\n%s", diff)
+	}
+}
+
 func TestSystemLibraryStuff(t *testing.T) {
 	cd, err := ioutil.TempDir("", "")
 	if err != nil {
@@ -1033,6 +1254,165 @@ func TestBuildFailsDuplicatePaths(t *testing.T) {
 	}
 }
 
+func TestUniverseBuildVirtuals(t *testing.T) {
+	tcs := []struct {
+		name         string
+		root         string
+		wantProvider string
+		err          string
+	}{
+		{
+			name:         "default",
+			root:         "//virtual:root_default",
+			wantProvider: "//virtual:dash",
+		},
+		{
+			name:         "selected",
+			root:         "//virtual:root_selected",
+			wantProvider: "//virtual:bash",
+		},
+		{
+			name:         "sole_provider",
+			root:         "//virtual:root_sole",
+			wantProvider: "//virtual:bash",
+		},
+		{
+			name: "ambiguous",
+			root: "//virtual:root_ambiguous",
+			err:  "virtual is ambiguous: provided by //virtual:bash, //virtual:dash",
+		},
+		{
+			name: "unsatisfied",
+			root: "//virtual:root_unsatisfied",
+			err:  "virtual is unsatisfied: no component provides it",
+		},
+		{
+			name: "conflict",
+			root: "//virtual:root_conflict",
+			err:  "conflicting components are both present: //virtual:busybox conflicts with //virtual:bash",
+		},
+		{
+			name: "virtual_conflict",
+			root: "//virtual:root_virtual_conflict",
+			err:  "conflicting components are both present: //virtual:toybox conflicts with //virtual:dash",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			uv := NewUniverse(&log.Silent{}, nil)
+			dr := NewDirResolver("testdata/virtual")
+			findOpts := FindOptions{
+				FallbackResolvers: []CCRResolver{dr.Resolve},
+				PrefixResolvers: map[string]CCRResolver{
+					"common": common.Resolve,
+				},
+			}
+			err := uv.Build([]vts.TargetRef{{Path: tc.root}}, &findOpts, "testdata/virtual")
+			if tc.err != "" {
+				if err == nil {
+					t.Fatal("universe.Build() succeeded, want error")
+				}
+				if we, ok := err.(vts.WrappedErr); !ok || we.Err.Error() != tc.err {
+					t.Fatalf("universe.Build() returned %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("universe.Build() failed: %v", err)
+			}
+
+			v, ok := uv.fqTargets["//virtual:sh"].(*vts.Virtual)
+			if !ok {
+				t.Fatalf("virtual //virtual:sh was not enumerated, got %T", uv.fqTargets["//virtual:sh"])
+			}
+			if v.Provider == nil {
+				t.Fatal("virtual //virtual:sh has no provider")
+			}
+			if got := v.Provider.Target.(vts.GlobalTarget).GlobalPath(); got != tc.wantProvider {
+				t.Errorf("provider = %q, want %q", got, tc.wantProvider)
+			}
+			if _, ok := uv.fqTargets[tc.wantProvider]; !ok {
+				t.Errorf("provider %q was not enumerated", tc.wantProvider)
+			}
+		})
+	}
+}
+
+func TestUniverseBuildClassInheritance(t *testing.T) {
+	uv := NewUniverse(&log.Silent{}, nil)
+	dr := NewDirResolver("testdata/inherit")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: "//inherit:root"}}, &findOpts, "testdata/inherit"); err != nil {
+		t.Fatalf("universe.Build() failed: %v", err)
+	}
+
+	for target, want := range map[string]starlark.Value{
+		"//inherit:motd":   starlark.String("0644"),
+		"//inherit:hosts":  starlark.String("0640"),
+		"//inherit:shadow": starlark.String("0600"),
+	} {
+		v, err := uv.QueryByClass("testdata/inherit", target, common.ModeClass.Path)
+		if err != nil {
+			t.Errorf("failed querying mode of %q: %v", target, err)
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Errorf("mode of %q = %v, want %v", target, v, want)
+		}
+	}
+
+	instances := func(class string) []string {
+		var out []string
+		for _, inst := range uv.classedTargets[uv.fqTargets[class]] {
+			out = append(out, inst.GlobalPath())
+		}
+		sort.Strings(out)
+		return out
+	}
+	if diff := cmp.Diff([]string{"//inherit:hosts", "//inherit:motd", "//inherit:shadow"}, instances("//inherit:config")); diff != "" {
+		t.Errorf("instances of //inherit:config differ (-want,+got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"//inherit:hosts", "//inherit:motd", "//inherit:shadow"}, instances("common://resources:file")); diff != "" {
+		t.Errorf("instances of common://resources:file differ (-want,+got):\n%s", diff)
+	}
+
+	secret := uv.fqTargets["//inherit:secret_config"].(*vts.ResourceClass)
+	var deps []string
+	for _, d := range secret.Dependencies() {
+		deps = append(deps, d.Target.(vts.GlobalTarget).GlobalPath())
+	}
+	if diff := cmp.Diff([]string{"//inherit:config_tools"}, deps); diff != "" {
+		t.Errorf("inherited deps differ (-want,+got):\n%s", diff)
+	}
+	if got, want := len(classCheckers(secret)), len(common.FileResourceClass.Checks); got != want {
+		t.Errorf("len(classCheckers(secret_config)) = %d, want %d", got, want)
+	}
+	if got, want := secret.PopulateStrategy(), vts.PopulateFileMatchPath; got != want {
+		t.Errorf("secret_config.PopulateStrategy() = %v, want %v", got, want)
+	}
+
+	t.Run("cycle", func(t *testing.T) {
+		uv := NewUniverse(&log.Silent{}, nil)
+		dr := NewDirResolver("testdata/inherit")
+		findOpts := FindOptions{
+			FallbackResolvers: []CCRResolver{dr.Resolve},
+			PrefixResolvers: map[string]CCRResolver{
+				"common": common.Resolve,
+			},
+		}
+		err := uv.Build([]vts.TargetRef{{Path: "//inherit:root_cycle"}}, &findOpts, "testdata/inherit")
+		want := `cyclic inheritance via "//inherit:loop_a"`
+		if we, ok := err.(vts.WrappedErr); !ok || we.Err.Error() != want {
+			t.Errorf("universe.Build() returned %v, want %q", err, want)
+		}
+	})
+}
+
 func TestUniverseCollectOrderedTargets(t *testing.T) {
 	tcs := []struct {
 		name   string
@@ -1113,3 +1493,692 @@ func TestUniverseCollectOrderedTargets(t *testing.T) {
 		})
 	}
 }
+
+func TestUniverseGraph(t *testing.T) {
+	tcs := []struct {
+		name  string
+		opts  GraphOptions
+		nodes []string
+		edges []string
+	}{
+		{
+			name: "all",
+			nodes: []string{
+				"//graph:root", "//graph:bin", "//graph:lib", "//graph:build_bin",
+				"//graph:lib2", "//graph:toolchain", "//graph:build_src",
+				"//graph:build_root", "//graph:gen_lib2", "//graph:headers",
+				"//graph:header",
+			},
+			edges: []string{
+				"//graph:root -> //graph:bin (dep)",
+				"//graph:root -> //graph:lib (dep)",
+				"//graph:bin -> //graph:build_bin (source)",
+				"//graph:lib -> //graph:lib2 (dep)",
+				"//graph:build_bin -> //graph:toolchain (host_dep)",
+				"//graph:build_bin -> //graph:lib2 (injection)",
+				"//graph:build_bin -> //graph:build_src (patch_input)",
+				"//graph:build_bin -> //graph:build_root (chroot)",
+				"//graph:lib2 -> //graph:gen_lib2 (source)",
+				"//graph:gen_lib2 -> //graph:headers (input)",
+				"//graph:headers -> //graph:header (class_instance)",
+			},
+		},
+		{
+			name: "collapse_classes",
+			opts: GraphOptions{CollapseClasses: true},
+			nodes: []string{
+				"//graph:root", "//graph:bin", "//graph:lib", "//graph:build_bin",
+				"//graph:lib2", "//graph:toolchain", "//graph:build_src",
+				"//graph:build_root", "//graph:gen_lib2", "//graph:headers",
+			},
+			edges: []string{
+				"//graph:root -> //graph:bin (dep)",
+				"//graph:root -> //graph:lib (dep)",
+				"//graph:bin -> //graph:build_bin (source)",
+				"//graph:lib -> //graph:lib2 (dep)",
+				"//graph:build_bin -> //graph:toolchain (host_dep)",
+				"//graph:build_bin -> //graph:lib2 (injection)",
+				"//graph:build_bin -> //graph:build_src (patch_input)",
+				"//graph:build_bin -> //graph:build_root (chroot)",
+				"//graph:lib2 -> //graph:gen_lib2 (source)",
+				"//graph:gen_lib2 -> //graph:headers (input)",
+			},
+		},
+		{
+			name:  "depth",
+			opts:  GraphOptions{MaxDepth: 2},
+			nodes: []string{"//graph:root", "//graph:bin", "//graph:lib", "//graph:build_bin", "//graph:lib2"},
+			edges: []string{
+				"//graph:root -> //graph:bin (dep)",
+				"//graph:root -> //graph:lib (dep)",
+				"//graph:bin -> //graph:build_bin (source)",
+				"//graph:lib -> //graph:lib2 (dep)",
+			},
+		},
+		{
+			name:  "types",
+			opts:  GraphOptions{Types: []vts.TargetType{vts.TargetBuild}},
+			nodes: []string{"//graph:root", "//graph:build_bin", "//graph:build_src", "//graph:build_root"},
+			edges: []string{
+				"//graph:root -> //graph:build_bin (dep)",
+				"//graph:build_bin -> //graph:build_src (patch_input)",
+				"//graph:build_bin -> //graph:build_root (chroot)",
+			},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			uv := NewUniverse(&log.Silent{}, nil)
+			dr := NewDirResolver("testdata/graph")
+			findOpts := FindOptions{
+				FallbackResolvers: []CCRResolver{dr.Resolve},
+				PrefixResolvers: map[string]CCRResolver{
+					"common": common.Resolve,
+				},
+			}
+			targets := []vts.TargetRef{{Path: "//graph:root"}, {Path: "//graph:header"}}
+			if err := uv.Build(targets, &findOpts, "testdata/graph"); err != nil {
+				t.Fatalf("universe.Build() failed: %v", err)
+			}
+
+			g, err := uv.Graph(vts.TargetRef{Path: "//graph:root"}, tc.opts)
+			if err != nil {
+				t.Fatalf("universe.Graph() failed: %v", err)
+			}
+			nodes := make([]string, len(g.Nodes))
+			for i, n := range g.Nodes {
+				nodes[i] = g.NodeID(n)
+			}
+			edges := make([]string, len(g.Edges))
+			for i, e := range g.Edges {
+				edges[i] = g.NodeID(e.From) + " -> " + g.NodeID(e.To) + " (" + string(e.Kind) + ")"
+			}
+
+			if diff := cmp.Diff(tc.nodes, nodes); diff != "" {
+				t.Errorf("nodes differ (-want,+got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.edges, edges); diff != "" {
+				t.Errorf("edges differ (-want,+got):\n%s", diff)
+			}
+
+			for _, format := range []string{"dot", "json", "graphml"} {
+				var out strings.Builder
+				if err := g.Write(&out, format); err != nil {
+					t.Errorf("Write(%q) failed: %v", format, err)
+				}
+				if !strings.Contains(out.String(), "//graph:build_bin") {
+					t.Errorf("Write(%q) output is missing targets:\n%s", format, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestUniverseWhy(t *testing.T) {
+	tcs := []struct {
+		name     string
+		from, to string
+		all      bool
+		want     []string
+	}{
+		{
+			name: "shortest",
+			from: "//graph:root",
+			to:   "//graph:lib2",
+			want: []string{"//graph:root -> //graph:lib -> //graph:lib2"},
+		},
+		{
+			name: "all",
+			from: "//graph:root",
+			to:   "//graph:lib2",
+			all:  true,
+			want: []string{
+				"//graph:root -> //graph:lib -> //graph:lib2",
+				"//graph:root -> //graph:bin -> //graph:build_bin -> //graph:lib2",
+			},
+		},
+		{
+			name: "not_dependent",
+			from: "//graph:lib2",
+			to:   "//graph:root",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			uv := NewUniverse(&log.Silent{}, nil)
+			dr := NewDirResolver("testdata/graph")
+			findOpts := FindOptions{
+				FallbackResolvers: []CCRResolver{dr.Resolve},
+				PrefixResolvers: map[string]CCRResolver{
+					"common": common.Resolve,
+				},
+			}
+			if err := uv.Build([]vts.TargetRef{{Path: "//graph:root"}}, &findOpts, "testdata/graph"); err != nil {
+				t.Fatalf("universe.Build() failed: %v", err)
+			}
+
+			paths, err := uv.Why(vts.TargetRef{Path: tc.from}, vts.TargetRef{Path: tc.to}, tc.all)
+			if err != nil {
+				t.Fatalf("universe.Why(%q, %q) failed: %v", tc.from, tc.to, err)
+			}
+			var got []string
+			for _, p := range paths {
+				got = append(got, p.String())
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("paths differ (-want,+got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUniverseReverseDeps(t *testing.T) {
+	uv := NewUniverse(&log.Silent{}, nil)
+	dr := NewDirResolver("testdata/graph")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: "//graph:root"}}, &findOpts, "testdata/graph"); err != nil {
+		t.Fatalf("universe.Build() failed: %v", err)
+	}
+
+	paths, err := uv.ReverseDeps(vts.TargetRef{Path: "//graph:lib2"})
+	if err != nil {
+		t.Fatalf("universe.ReverseDeps() failed: %v", err)
+	}
+	var got []string
+	for _, p := range paths {
+		got = append(got, p.StringWithKinds())
+	}
+	want := []string{
+		"//graph:lib -[dep]-> //graph:lib2",
+		"//graph:libs -[class_instance]-> //graph:lib2",
+		"//graph:build_bin -[injection]-> //graph:lib2",
+		"//graph:root -[dep]-> //graph:lib -[dep]-> //graph:lib2",
+		"//graph:bin -[source]-> //graph:build_bin -[injection]-> //graph:lib2",
+		"common://resources:file -[class_instance]-> //graph:bin -[source]-> //graph:build_bin -[injection]-> //graph:lib2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("paths differ (-want,+got):\n%s", diff)
+	}
+}
+
+func TestUniverseQuery(t *testing.T) {
+	tcs := []struct {
+		name  string
+		query string
+		want  []string
+		err   string
+	}{
+		{
+			name:  "class_and_attr",
+			query: `class(common://resources:sys_library) & attr(common://attrs:arch == "amd64")`,
+			want:  []string{"//query:libc"},
+		},
+		{
+			name:  "attr_not_equal",
+			query: `class(common://resources:sys_library) & attr(common://attrs:arch != "amd64")`,
+			want:  []string{"//query:libfoo"},
+		},
+		{
+			name:  "deps_difference",
+			query: `deps(//query:system) - deps(//query:minimal)`,
+			want:  []string{"//query:system", "//query:libfoo", "//query:tool", "//query:build_tool"},
+		},
+		{
+			name:  "source",
+			query: `source(build)`,
+			want:  []string{"//query:tool"},
+		},
+		{
+			name:  "path",
+			query: `path("/usr/lib/**")`,
+			want:  []string{"//query:libc", "//query:libfoo"},
+		},
+		{
+			name:  "path_single_segment",
+			query: `path("/usr/lib/*")`,
+			want:  []string{"//query:libc"},
+		},
+		{
+			name:  "precedence",
+			query: `type(component) | type(resource) & attr(common://attrs:arch)`,
+			want:  []string{"//query:system", "//query:minimal", "//query:libc", "//query:libfoo"},
+		},
+		{
+			name:  "rdeps",
+			query: `rdeps(//query:libc) & type(component)`,
+			want:  []string{"//query:system", "//query:minimal"},
+		},
+		{
+			name:  "unknown_function",
+			query: `bogus(//query:libc)`,
+			err:   `query: unknown function "bogus" at offset 0`,
+		},
+		{
+			name:  "unbalanced",
+			query: `(type(build)`,
+			err:   `query: expected ')' at offset 12, got end of query`,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := ParseQuery(tc.query)
+			if err != nil {
+				if tc.err == "" || err.Error() != tc.err {
+					t.Fatalf("ParseQuery(%q) failed: %v, want %q", tc.query, err, tc.err)
+				}
+				return
+			}
+
+			uv := NewUniverse(&log.Silent{}, nil)
+			dr := NewDirResolver("testdata/query")
+			findOpts := FindOptions{
+				FallbackResolvers: []CCRResolver{dr.Resolve},
+				PrefixResolvers: map[string]CCRResolver{
+					"common": common.Resolve,
+				},
+			}
+			targets := []vts.TargetRef{{Path: "//query:system"}}
+			for _, p := range q.TargetPaths() {
+				targets = append(targets, vts.TargetRef{Path: p})
+			}
+			if err := uv.Build(targets, &findOpts, "testdata/query"); err != nil {
+				t.Fatalf("universe.Build() failed: %v", err)
+			}
+
+			matches, err := uv.Query("testdata/query", q)
+			if err != nil {
+				t.Fatalf("universe.Query(%q) failed: %v", tc.query, err)
+			}
+			got := make([]string, len(matches))
+			for i, m := range matches {
+				got[i] = m.GlobalPath()
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("universe.Query(%q) differs (-want,+got):\n%s", tc.query, diff)
+			}
+		})
+	}
+}
+
+func TestUniverseQueryClassInheritance(t *testing.T) {
+	uv := NewUniverse(&log.Silent{}, nil)
+	dr := NewDirResolver("testdata/inherit")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: "//inherit:root"}}, &findOpts, "testdata/inherit"); err != nil {
+		t.Fatalf("universe.Build() failed: %v", err)
+	}
+
+	for query, want := range map[string][]string{
+		`class(//inherit:config)`:        {"//inherit:hosts", "//inherit:motd", "//inherit:shadow"},
+		`class(//inherit:secret_config)`: {"//inherit:shadow"},
+		`class(common://resources:file)`: {"//inherit:hosts", "//inherit:motd", "//inherit:shadow"},
+	} {
+		q, err := ParseQuery(query)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q) failed: %v", query, err)
+		}
+		matches, err := uv.Query("testdata/inherit", q)
+		if err != nil {
+			t.Fatalf("universe.Query(%q) failed: %v", query, err)
+		}
+		got := make([]string, len(matches))
+		for i, m := range matches {
+			got[i] = m.GlobalPath()
+		}
+		sort.Strings(got)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("universe.Query(%q) differs (-want,+got):\n%s", query, diff)
+		}
+	}
+}
+
+func TestUniverseQueryJSON(t *testing.T) {
+	uv := NewUniverse(&log.Silent{}, nil)
+	dr := NewDirResolver("testdata/query")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	if err := uv.Build([]vts.TargetRef{{Path: "//query:libc"}}, &findOpts, "testdata/query"); err != nil {
+		t.Fatalf("universe.Build() failed: %v", err)
+	}
+	q, err := ParseQuery("//query:libc")
+	if err != nil {
+		t.Fatalf("ParseQuery() failed: %v", err)
+	}
+	matches, err := uv.Query("testdata/query", q)
+	if err != nil {
+		t.Fatalf("universe.Query() failed: %v", err)
+	}
+
+	var out strings.Builder
+	if err := uv.WriteQueryJSON(&out, "testdata/query", matches); err != nil {
+		t.Fatalf("WriteQueryJSON() failed: %v", err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	want := []map[string]interface{}{
+		{
+			"path": "//query:libc",
+			"type": "resource",
+			"attrs": map[string]interface{}{
+				"common://attrs:arch": "amd64",
+				"common://attrs:path": "/usr/lib/libc.so.6",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("output differs (-want,+got):\n%s", diff)
+	}
+}
+
+func TestUniverseCheckKeepGoing(t *testing.T) {
+	uv := NewUniverse(&log.Silent{}, nil)
+	dr := NewDirResolver("testdata/checkers")
+	findOpts := FindOptions{
+		FallbackResolvers: []CCRResolver{dr.Resolve},
+		PrefixResolvers: map[string]CCRResolver{
+			"common": common.Resolve,
+		},
+	}
+	targets := []vts.TargetRef{
+		{Path: "//json:bad_json"},
+		{Path: "//json:good_json"},
+		{Path: "//path:bad_path"},
+	}
+	if err := uv.Build(targets, &findOpts, "testdata/checkers/base"); err != nil {
+		t.Fatalf("universe.Build() failed: %v", err)
+	}
+
+	report, err := uv.CheckWithOptions(targets, "testdata/checkers/base", CheckOptions{})
+	if err != nil {
+		t.Fatalf("universe.CheckWithOptions() failed: %v", err)
+	}
+	if len(report.Failures) != 1 {
+		t.Errorf("got %d failures without keep-going, want 1", len(report.Failures))
+	}
+
+	report, err = uv.CheckWithOptions(targets, "testdata/checkers/base", CheckOptions{KeepGoing: true, Workers: 4})
+	if err != nil {
+		t.Fatalf("universe.CheckWithOptions() failed: %v", err)
+	}
+	want := []CheckRecord{
+		{
+			Target:   "//json:bad_json_r",
+			Checker:  "common://checks/formats:json_valid",
+			Position: "testdata/checkers/json.ccr:21",
+			Path:     "invalid_json.json",
+			Chain:    []string{"//json:bad_json"},
+			Message:  "invalid character 'd' in literal false (expecting 'a')",
+		},
+		{
+			Target:   "//path:bad_path",
+			Position: "testdata/checkers/path.ccr:1",
+			Message:  "path contains illegal characters",
+		},
+		{
+			Target:   "//path:bad_path",
+			Checker:  "common://checks:file_present",
+			Position: "testdata/checkers/path.ccr:1",
+			Path:     "::eee",
+			Message:  "stat testdata/checkers/base/::eee: no such file or directory",
+		},
+	}
+	if diff := cmp.Diff(want, report.Records(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("failures differ (-want,+got):\n%s", diff)
+	}
+
+	var out strings.Builder
+	if err := report.WriteJUnit(&out); err != nil {
+		t.Fatalf("WriteJUnit() failed: %v", err)
+	}
+	if !strings.Contains(out.String(), `<testsuite name="ccr check" tests="5" failures="2">`) {
+		t.Errorf("unexpected JUnit output:\n%s", out.String())
+	}
+}
+
+func TestCheckRecordConstraint(t *testing.T) {
+	err := vts.WrapWithPath(vts.FailingConstraintInfo{
+		Kind: "semver",
+		Lhs:  "1.2.3",
+		Op:   ">=",
+		Rhs:  "2.0.0",
+	}, "/usr/bin/thing")
+
+	want := CheckRecord{
+		Path:       "/usr/bin/thing",
+		Message:    "semver constraint was not met",
+		Constraint: &ConstraintRecord{Kind: "semver", Lhs: "1.2.3", Op: ">=", Rhs: "2.0.0"},
+	}
+	if diff := cmp.Diff(want, NewCheckRecord(err)); diff != "" {
+		t.Errorf("record differs (-want,+got):\n%s", diff)
+	}
+}
+
+func TestUniverseCheckParallelDeterministic(t *testing.T) {
+	targets := []vts.TargetRef{
+		{Path: "//json:bad_json"},
+		{Path: "//json:good_json"},
+		{Path: "//path:bad_path"},
+		{Path: "//file_resource:empty_path"},
+		{Path: "//file_resource:filelist_missing_files"},
+	}
+
+	var first []CheckRecord
+	for i := 0; i < 10; i++ {
+		uv := NewUniverse(&log.Silent{}, nil)
+		dr := NewDirResolver("testdata/checkers")
+		findOpts := FindOptions{
+			FallbackResolvers: []CCRResolver{dr.Resolve},
+			PrefixResolvers: map[string]CCRResolver{
+				"common": common.Resolve,
+			},
+		}
+		if err := uv.Build(targets, &findOpts, "testdata/checkers/base"); err != nil {
+			t.Fatalf("universe.Build() failed: %v", err)
+		}
+
+		// Without keep-going, the failure reported must be the first
+		// in dependency order, as if checks ran serially.
+		if err := uv.Check(targets, "testdata/checkers/base"); err == nil || err.Error() != "invalid character 'd' in literal false (expecting 'a')" {
+			t.Errorf("universe.Check() returned %v, want the first failure", err)
+		}
+
+		report, err := uv.CheckWithOptions(targets, "testdata/checkers/base", CheckOptions{KeepGoing: true, Workers: 8})
+		if err != nil {
+			t.Fatalf("universe.CheckWithOptions() failed: %v", err)
+		}
+		if i == 0 {
+			first = report.Records()
+			continue
+		}
+		if diff := cmp.Diff(first, report.Records()); diff != "" {
+			t.Fatalf("run %d reported failures in a different order (-first,+got):\n%s", i, diff)
+		}
+	}
+}
+
+// readingPopulator reads a file while populating runtime information.
+type readingPopulator struct {
+	path string
+}
+
+func (p *readingPopulator) Name() string { return "reading" }
+
+func (p *readingPopulator) Run(t vts.Target, env *vts.RunnerEnv, info *vts.RuntimeInfo) error {
+	if _, err := env.FS.Stat(p.path); err != nil {
+		return err
+	}
+	info.Set(p, "read", true)
+	return nil
+}
+
+func TestCheckResultsPopulateEnv(t *testing.T) {
+	base := &vts.RunnerEnv{FS: memfs.New()}
+	pop := &readingPopulator{path: "/lib/libc.so.6"}
+	if err := util.WriteFile(base.FS, pop.path, []byte("elf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := newCheckResults(nil, base, false)
+
+	lib, script := &vts.Resource{}, &vts.Resource{}
+	libEnv, scriptEnv := r.envFor(lib, base), r.envFor(script, base)
+	// The library is populated by a check against another target, before
+	// the checks against the library itself use the populated information.
+	for _, env := range []*vts.RunnerEnv{scriptEnv, libEnv} {
+		if err := lib.RuntimeInfo().Populate(pop, lib, env); err != nil {
+			t.Fatalf("Populate() failed: %v", err)
+		}
+	}
+
+	for name, env := range map[string]*vts.RunnerEnv{"library": libEnv, "script": scriptEnv} {
+		if _, ok := env.FS.(*recordingFS).accessed()[pop.path]; !ok {
+			t.Errorf("%s: populator read of %q was not recorded", name, pop.path)
+		}
+	}
+}
+
+func TestUniverseCheckCacheUniverseDependent(t *testing.T) {
+	cd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cd)
+	c, err := cache.NewCache(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(targets []vts.TargetRef) *CheckReport {
+		t.Helper()
+		uv := NewUniverse(&log.Silent{}, c)
+		dr := NewDirResolver("testdata/checkers")
+		findOpts := FindOptions{
+			FallbackResolvers: []CCRResolver{dr.Resolve},
+			PrefixResolvers: map[string]CCRResolver{
+				"common": common.Resolve,
+			},
+		}
+		if err := uv.Build(targets, &findOpts, "testdata/checkers/base"); err != nil {
+			t.Fatalf("universe.Build() failed: %v", err)
+		}
+		report, err := uv.CheckWithOptions(targets, "testdata/checkers/base", CheckOptions{KeepGoing: true})
+		if err != nil {
+			t.Fatalf("universe.CheckWithOptions() failed: %v", err)
+		}
+		return report
+	}
+
+	if report := check([]vts.TargetRef{{Path: "//accounts:group_with_member"}}); len(report.Failures) != 0 {
+		t.Fatalf("initial check failed: %v", report.Failures)
+	}
+	// Without the member user in the universe, the group is no longer valid,
+	// even though the group itself is unchanged.
+	report := check([]vts.TargetRef{{Path: "//accounts:good_members"}})
+	if report.Cached != 0 {
+		t.Errorf("%d checks were cached, want 0", report.Cached)
+	}
+	if len(report.Failures) != 1 {
+		t.Errorf("got %d failures, want 1: %v", len(report.Failures), report.Failures)
+	}
+}
+
+func TestUniverseCheckCache(t *testing.T) {
+	cd, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cd)
+	c, err := cache.NewCache(cd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	jsonPath := filepath.Join(base, "valid_json.json")
+
+	targets := []vts.TargetRef{{Path: "//json:good_json"}}
+	check := func(opts CheckOptions) *CheckReport {
+		t.Helper()
+		uv := NewUniverse(&log.Silent{}, c)
+		dr := NewDirResolver("testdata/checkers")
+		findOpts := FindOptions{
+			FallbackResolvers: []CCRResolver{dr.Resolve},
+			PrefixResolvers: map[string]CCRResolver{
+				"common": common.Resolve,
+			},
+		}
+		if err := uv.Build(targets, &findOpts, base); err != nil {
+			t.Fatalf("universe.Build() failed: %v", err)
+		}
+		report, err := uv.CheckWithOptions(targets, base, opts)
+		if err != nil {
+			t.Fatalf("universe.CheckWithOptions() failed: %v", err)
+		}
+		return report
+	}
+
+	type step struct {
+		name     string
+		contents string
+		// owner, if non-zero, is the uid and gid the file is changed to.
+		owner    int
+		opts     CheckOptions
+		cached   int
+		failures int
+	}
+	steps := []step{
+		{name: "initial", contents: `{"a": 1}`},
+		{name: "unchanged", cached: 1},
+		{name: "ignore cache", opts: CheckOptions{IgnoreCache: true}},
+		{name: "invalid", contents: `{"a": tru}`, failures: 1},
+		{name: "failure not cached", failures: 1},
+		{name: "fixed", contents: `{"a": 2}`},
+		{name: "fixed unchanged", cached: 1},
+	}
+	if os.Geteuid() == 0 {
+		steps = append(steps,
+			step{name: "chowned", owner: 1},
+			step{name: "chowned unchanged", cached: 1},
+		)
+	}
+	for _, step := range steps {
+		if step.contents != "" {
+			if err := ioutil.WriteFile(jsonPath, []byte(step.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if step.owner != 0 {
+			if err := os.Chown(jsonPath, step.owner, step.owner); err != nil {
+				t.Fatal(err)
+			}
+		}
+		report := check(step.opts)
+		if report.Cached != step.cached {
+			t.Errorf("%s: %d checks were cached, want %d", step.name, report.Cached, step.cached)
+		}
+		if len(report.Failures) != step.failures {
+			t.Errorf("%s: got %d failures, want %d: %v", step.name, len(report.Failures), step.failures, report.Failures)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package ccr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/twitchylinux/ccr/log"
+	"github.com/twitchylinux/ccr/vts"
+)
+
+// requiredVirtuals returns the virtual targets which are required by
+// another target, but which do not yet have a provider.
+func (u *Universe) requiredVirtuals() []*vts.Virtual {
+	var (
+		out  []*vts.Virtual
+		seen = map[*vts.Virtual]bool{}
+	)
+	for _, t := range u.allTargets {
+		for _, e := range u.directEdges(t) {
+			if v, ok := e.To.(*vts.Virtual); ok && v.Provider == nil && !seen[v] {
+				seen[v] = true
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// providersOf returns the components in the universe which can provide v.
+func (u *Universe) providersOf(v *vts.Virtual) []*vts.Component {
+	var out []*vts.Component
+	for _, t := range u.allTargets {
+		if c, ok := t.(*vts.Component); ok && c.ProvidesVirtual(v) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func componentPaths(cs []*vts.Component) string {
+	paths := make([]string, len(cs))
+	for i, c := range cs {
+		paths[i] = c.Path
+	}
+	return strings.Join(paths, ", ")
+}
+
+// selectProvider determines the provider of a virtual. A provider selected
+// by a root component is preferred, then the only component in the universe
+// which provides the virtual, and finally the default provider.
+func (u *Universe) selectProvider(v *vts.Virtual, selections map[string]vts.TargetRef) (vts.TargetRef, error) {
+	if p, ok := selections[v.Path]; ok {
+		return p, nil
+	}
+	switch candidates := u.providersOf(v); {
+	case len(candidates) == 1:
+		return vts.TargetRef{Target: candidates[0]}, nil
+	case len(candidates) > 1:
+		return vts.TargetRef{}, fmt.Errorf("virtual is ambiguous: provided by %s", componentPaths(candidates))
+	case v.Default != nil:
+		return *v.Default, nil
+	}
+	return vts.TargetRef{}, fmt.Errorf("virtual is unsatisfied: no component provides it")
+}
+
+// resolveVirtuals selects a provider for every virtual target required by
+// the universe, resolving the providers. Providers may require further
+// virtuals, so selection repeats until every required virtual is provided.
+// Finally, the universe is checked for conflicting components.
+func (u *Universe) resolveVirtuals(findOpts *FindOptions, roots []vts.TargetRef) error {
+	var (
+		selections = map[string]vts.TargetRef{}
+		selectedBy = map[string]vts.Target{}
+	)
+	for _, r := range roots {
+		c, ok := u.fqTargets[r.Path].(*vts.Component)
+		if r.Target != nil {
+			c, ok = r.Target.(*vts.Component)
+		}
+		if !ok {
+			continue
+		}
+		for v, p := range c.Providers {
+			if prev, selected := selections[v]; selected && prev.Path != p.Path {
+				err := fmt.Errorf("conflicting providers selected for %s: %s and %s", v, prev.Path, p.Path)
+				return u.logger.Error(log.MsgBadDef, vts.WrapWithActionTarget(vts.WrapWithTarget(err, selectedBy[v]), c))
+			}
+			selections[v], selectedBy[v] = p, c
+		}
+	}
+
+	for pending := u.requiredVirtuals(); len(pending) > 0; pending = u.requiredVirtuals() {
+		for _, v := range pending {
+			ref, err := u.selectProvider(v, selections)
+			if err != nil {
+				return u.logger.Error(log.MsgBadDef, vts.WrapWithTarget(err, v))
+			}
+			if err := u.resolveRef(findOpts, ref); err != nil {
+				return err
+			}
+			if ref, err = u.makeTargetRef(ref); err != nil {
+				return u.logger.Error(log.MsgBadRef, vts.WrapWithTarget(err, v))
+			}
+			v.Provider = &ref
+			if err := v.Validate(); err != nil {
+				if by, selected := selectedBy[v.Path]; selected {
+					err = vts.WrapWithActionTarget(err, by)
+				}
+				return u.logger.Error(log.MsgBadDef, vts.WrapWithTarget(err, v))
+			}
+		}
+	}
+
+	// Selecting a provider may have brought other providers of an
+	// already-resolved virtual into the universe.
+	for _, t := range u.allTargets {
+		v, ok := t.(*vts.Virtual)
+		if !ok || v.Provider == nil {
+			continue
+		}
+		if _, selected := selections[v.Path]; selected {
+			continue
+		}
+		if candidates := u.providersOf(v); len(candidates) > 1 {
+			err := fmt.Errorf("virtual is ambiguous: provided by %s", componentPaths(candidates))
+			return u.logger.Error(log.MsgBadDef, vts.WrapWithTarget(err, v))
+		}
+	}
+
+	return u.checkConflicts()
+}
+
+// checkConflicts returns an error if the universe contains a component
+// and a target it conflicts with. Conflicting with a virtual target means
+// conflicting with every other component which provides it.
+func (u *Universe) checkConflicts() error {
+	for _, t := range u.allTargets {
+		c, ok := t.(*vts.Component)
+		if !ok {
+			continue
+		}
+		for _, ref := range c.Conflicts {
+			var conflicting []vts.Target
+			switch other := u.fqTargets[ref.Path].(type) {
+			case nil:
+			case *vts.Virtual:
+				for _, p := range u.providersOf(other) {
+					if p != c {
+						conflicting = append(conflicting, p)
+					}
+				}
+			default:
+				if other != vts.GlobalTarget(c) {
+					conflicting = append(conflicting, other)
+				}
+			}
+			if len(conflicting) > 0 {
+				err := fmt.Errorf("conflicting components are both present: %s conflicts with %s", c.Path, targetName(conflicting[0]))
+				return u.logger.Error(log.MsgBadDef, vts.WrapWithActionTarget(vts.WrapWithTarget(err, conflicting[0]), c))
+			}
+		}
+	}
+	return nil
+}
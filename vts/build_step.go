@@ -89,6 +89,17 @@ func (t *BuildStep) Validate() error {
 	return nil
 }
 
+// LocalInput returns the path of the local file consumed by the step,
+// relative to the directory of the contract. The empty string is returned
+// if the step does not read a local file.
+func (t *BuildStep) LocalInput() string {
+	switch t.Kind {
+	case StepUnpackGz, StepUnpackXz, StepUnpackBz2, StepPatch:
+		return t.Path
+	}
+	return ""
+}
+
 func (t *BuildStep) String() string {
 	return fmt.Sprintf("build_step<%s>", t.Kind)
 }
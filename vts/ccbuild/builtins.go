@@ -23,15 +23,58 @@ var builtinDeriveEnumRunner = starlark.NewBuiltin("valid_enum", func(_ *starlark
 	return runners.EnumCheckValid(vals), nil
 })
 
-func mkTargetConstraint(class *vts.AttrClass) *starlark.Builtin {
-	return starlark.NewBuiltin("semver", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+func mkTargetConstraint(name string, class *vts.AttrClass) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
 		if len(args) != 1 {
 			return nil, errors.New("expected 1 argument")
 		}
-		return &RefComparisonConstraint{AttrClass: common.SemverClass, CompareValue: args[0]}, nil
+		return newComparisonConstraint(class, args[0])
 	})
 }
 
+func attrConstraintClass(v starlark.Value) (string, error) {
+	if s, ok := v.(starlark.String); ok {
+		return string(s), nil
+	}
+	return "", fmt.Errorf("cannot reference attr class with starlark type %T (%s)", v, v.String())
+}
+
+var builtinAttrEqConstraint = starlark.NewBuiltin("attr_eq", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New("expected 2 arguments")
+	}
+	class, err := attrConstraintClass(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return &RefAttrConstraint{ClassPath: class, Values: []starlark.Value{args[1]}}, nil
+})
+
+var builtinAttrInConstraint = starlark.NewBuiltin("attr_in", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 2 {
+		return nil, errors.New("expected 2 arguments")
+	}
+	class, err := attrConstraintClass(args[0])
+	if err != nil {
+		return nil, err
+	}
+	vals, ok := args[1].(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("values must be iterable, got %s", args[1].Type())
+	}
+	out := &RefAttrConstraint{ClassPath: class, In: true}
+	it := vals.Iterate()
+	defer it.Done()
+	var v starlark.Value
+	for it.Next(&v) {
+		out.Values = append(out.Values, v)
+	}
+	if len(out.Values) == 0 {
+		return nil, errors.New("at least one value must be specified")
+	}
+	return out, nil
+})
+
 func mkStripPrefixOutputMapper(s *Script) *starlark.Builtin {
 	return starlark.NewBuiltin("strip_prefix", func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, _ []starlark.Tuple) (starlark.Value, error) {
 		if len(args) != 1 {
@@ -65,11 +108,14 @@ func (s *Script) makeBuiltins() (starlark.StringDict, error) {
 		"resource":       makeResource(s),
 		"resource_class": makeResourceClass(s),
 		"component":      makeComponent(s),
+		"virtual":        makeVirtual(s),
 		"checker":        makeChecker(s),
 		"generator":      makeGenerator(s),
 		"toolchain":      makeToolchain(s),
 		"build":          makeBuild(s),
 		"compute":        makeComputedValue(s),
+		"select":         makeSelect(s),
+		"config":         makeConfig(s),
 		"const": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 			"check": starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
 				"each_resource":  starlark.String(vts.ChkKindEachResource),
@@ -121,12 +167,15 @@ func (s *Script) makeBuiltins() (starlark.StringDict, error) {
 		"deb":          makePuesdotarget(s, vts.DebRef),
 		"sieve":        makeSieve(s),
 		"sieve_prefix": makeSievePrefix(s),
-		"semver":       mkTargetConstraint(common.SemverClass),
+		"semver":       mkTargetConstraint("semver", common.SemverClass),
+		"attr_eq":      builtinAttrEqConstraint,
+		"attr_in":      builtinAttrInConstraint,
 	}, nil
 }
 
 func makeBuildStep(s *Script, kind vts.StepKind) *starlark.Builtin {
 	return starlark.NewBuiltin(string(kind), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var (
 			to, path, sha256, url string
 			dir, content          string
@@ -215,10 +264,7 @@ func makeBuildStep(s *Script, kind vts.StepKind) *starlark.Builtin {
 			PatchLevel: patchLevel,
 			Content:    content,
 
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos: s.defPosition(thread),
 		}, nil
 	})
 }
@@ -2,7 +2,7 @@
 package ccbuild
 
 import (
-	"errors"
+	"crypto/sha256"
 	"fmt"
 	"strings"
 
@@ -10,11 +10,17 @@ import (
 	"go.starlark.net/starlark"
 )
 
-// ScriptLoader provides a means for arbitrary imports to be resolved.
+// ScriptLoader provides a means for modules referenced by load() to be
+// resolved.
 type ScriptLoader interface {
-	resolveImport(name string) ([]byte, error)
+	loadModule(thread *starlark.Thread, module string) (starlark.StringDict, error)
+	loadedModule(module string) (*module, bool)
 }
 
+// scriptLocal is the thread-local key under which the script being
+// executed is stored.
+const scriptLocal = "ccr.script"
+
 // Script represents a .ccr file execution.
 type Script struct {
 	thread  *starlark.Thread
@@ -22,6 +28,10 @@ type Script struct {
 
 	path    string
 	fPath   string
+	src     []byte
+	loads   []string
+	loader  ScriptLoader
+	config  map[string]string
 	targets []vts.Target
 }
 
@@ -36,44 +46,21 @@ func (s *Script) Targets() []vts.Target {
 }
 
 func (s *Script) loadScript(script []byte, fname string, loader ScriptLoader) (*starlark.Thread, starlark.StringDict, error) {
-	var moduleCache = map[string]starlark.StringDict{}
-	var load func(_ *starlark.Thread, module string) (starlark.StringDict, error)
-
 	builtins, err := s.makeBuiltins()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	load = func(_ *starlark.Thread, module string) (starlark.StringDict, error) {
-		m, ok := moduleCache[module]
-		if m == nil && ok {
-			return nil, errors.New("cycle in dependency graph when loading " + module)
-		}
-		if m != nil {
-			return m, nil
-		}
-
-		// loading in progress
-		moduleCache[module] = nil
-		d, err2 := loader.resolveImport(module)
-		if err2 != nil {
-			return nil, err2
-		}
-		thread := &starlark.Thread{
-			Load: load,
-		}
-
-		mod, err2 := starlark.ExecFile(thread, module, d, builtins)
-		if err2 != nil {
-			return nil, err2
-		}
-		moduleCache[module] = mod
-		return mod, nil
-	}
-
 	thread := &starlark.Thread{
-		Load: load,
+		Name: fname,
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			if loader == nil {
+				return nil, fmt.Errorf("cannot load %s: modules cannot be loaded here", module)
+			}
+			return s.load(loader, thread, module)
+		},
 	}
+	thread.SetLocal(scriptLocal, s)
 
 	globals, err := starlark.ExecFile(thread, fname, script, builtins)
 	if err != nil {
@@ -83,23 +70,110 @@ func (s *Script) loadScript(script []byte, fname string, loader ScriptLoader) (*
 	return thread, globals, nil
 }
 
+// caller returns the script on whose behalf a builtin is being invoked.
+// Builtins may be called by functions defined in a loaded module, in which
+// case the targets they construct belong to the calling script rather than
+// the module.
+func (s *Script) caller(thread *starlark.Thread) *Script {
+	if cs, ok := thread.Local(scriptLocal).(*Script); ok {
+		return cs
+	}
+	return s
+}
+
+// defPosition returns the position in the script at which a builtin was
+// invoked, along with the frames of any loaded modules in between.
+func (s *Script) defPosition(thread *starlark.Thread) *vts.DefPosition {
+	// The innermost frame is the builtin itself.
+	stack := thread.CallStack()
+	stack = stack[:len(stack)-1]
+
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].Pos.Filename() != s.path {
+			continue
+		}
+		pos := &vts.DefPosition{Path: s.fPath, Frame: stack[i]}
+		if i+1 < len(stack) {
+			pos.Via = append([]starlark.CallFrame(nil), stack[i+1:]...)
+		}
+		return pos
+	}
+	return &vts.DefPosition{Path: s.fPath, Frame: thread.CallFrame(1)}
+}
+
+// load loads a module on behalf of the script, recording that the script
+// depends on it.
+func (s *Script) load(loader ScriptLoader, thread *starlark.Thread, name string) (starlark.StringDict, error) {
+	globals, err := loader.loadModule(thread, name)
+	if err != nil {
+		return nil, err
+	}
+	s.loads = append(s.loads, name)
+	return globals, nil
+}
+
+// sourceOf returns the source of the script or module which defined fn,
+// followed by the hashes of the modules it transitively loads, as fn may
+// call into them.
+func (s *Script) sourceOf(fn *starlark.Function) []byte {
+	src, loads := s.src, s.loads
+	if name := fn.Position().Filename(); name != s.path && s.loader != nil {
+		if m, ok := s.loader.loadedModule(name); ok {
+			src, loads = m.src, m.loads
+		}
+	}
+	if len(loads) == 0 {
+		return src
+	}
+
+	out := append([]byte(nil), src...)
+	seen := make(map[string]bool, len(loads))
+	var fold func(loads []string)
+	fold = func(loads []string) {
+		for _, name := range loads {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			m, ok := s.loader.loadedModule(name)
+			if !ok {
+				continue
+			}
+			out = append(out, fmt.Sprintf("\n%s %x", name, sha256.Sum256(m.src))...)
+			fold(m.loads)
+		}
+	}
+	fold(loads)
+	return out
+}
+
 // NewScript initializes a new .ccr interpreter. The data parameter should
 // contain the contents of the ccr file, and the targetPath parameter should
-// represent the CCR path to the file.
+// represent the CCR path to the file. If loader is non-nil, it is used to
+// resolve load() statements.
 func NewScript(data []byte, targetPath, fPath string, loader ScriptLoader, printer func(string)) (*Script, error) {
-	return makeScript(data, targetPath, fPath, loader, nil, printer)
+	return makeScript(data, targetPath, fPath, loader, nil, nil, printer)
 }
 
-func makeScript(data []byte, targetPath, fPath string, loader ScriptLoader,
+// NewScriptWithConfig initializes a new .ccr interpreter, where the provided
+// configuration values are visible to the script through config and select().
+func NewScriptWithConfig(data []byte, targetPath, fPath string, loader ScriptLoader, config map[string]string) (*Script, error) {
+	return makeScript(data, targetPath, fPath, loader, config, nil, nil)
+}
+
+func makeScript(data []byte, targetPath, fPath string, loader ScriptLoader, config map[string]string,
 	testHook func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error),
 	printer func(string)) (*Script, error) {
 	out := &Script{
-		path:  targetPath,
-		fPath: fPath,
+		path:   targetPath,
+		fPath:  fPath,
+		src:    data,
+		loader: loader,
+		config: config,
 	}
 
 	var err error
-	out.thread, out.globals, err = out.loadScript(data, targetPath, out)
+	out.thread, out.globals, err = out.loadScript(data, targetPath, loader)
 	if err != nil {
 		return nil, err
 	}
@@ -107,10 +181,6 @@ func makeScript(data []byte, targetPath, fPath string, loader ScriptLoader,
 	return out, nil
 }
 
-func (s *Script) resolveImport(path string) ([]byte, error) {
-	return nil, errors.New("not implemented")
-}
-
 func (s *Script) makePath(targetName string) string {
 	if targetName == "" {
 		return ""
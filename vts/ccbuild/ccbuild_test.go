@@ -1,11 +1,15 @@
 package ccbuild
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/gobwas/glob"
@@ -15,6 +19,7 @@ import (
 	"github.com/twitchylinux/ccr/vts/common"
 	"github.com/twitchylinux/ccr/vts/match"
 	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
 )
 
 var (
@@ -116,6 +121,25 @@ var newScriptTestcases = []struct {
 			},
 		},
 	},
+	{
+		name:     "resource class with parent",
+		filename: "testdata/resourceclass_with_parent.ccr",
+		want: []vts.Target{
+			&vts.ResourceClass{
+				Path:   "//test:config",
+				Name:   "config",
+				Parent: &vts.TargetRef{Path: "common://resources:file"},
+				DefaultDetails: []vts.TargetRef{
+					{
+						Target: &vts.Attr{
+							Parent: vts.TargetRef{Path: "common://attrs:mode"},
+							Val:    starlark.String("0644"),
+						},
+					},
+				},
+			},
+		},
+	},
 	{
 		name:     "resource with helper attrs",
 		filename: "testdata/resource_with_helpers.ccr",
@@ -183,7 +207,7 @@ var newScriptTestcases = []struct {
 					Inputs:       []vts.TargetRef{{Path: "//test:something"}},
 					ExcludeGlobs: []string{"*.txt"},
 					Renames: &match.FilenameRules{
-						Rules: []match.MatchRule{{P: glob.MustCompile("cool.txt"), Out: match.LiteralOutputMapper("kek.txt")}},
+						Rules: []match.MatchRule{{P: glob.MustCompile("cool.txt"), Out: match.LiteralOutputMapper("kek.txt"), Pattern: "cool.txt"}},
 					},
 				},
 				},
@@ -204,8 +228,9 @@ var newScriptTestcases = []struct {
 					IncludeGlobs: []string{"usr/include/**"},
 					Renames: &match.FilenameRules{
 						Rules: []match.MatchRule{{
-							P:   glob.MustCompile("usr/include/**"),
-							Out: &match.StripPrefixOutputMapper{Prefix: "usr/include/"}}},
+							P:       glob.MustCompile("usr/include/**"),
+							Out:     &match.StripPrefixOutputMapper{Prefix: "usr/include/"},
+							Pattern: "usr/include/**"}},
 					},
 				},
 				},
@@ -287,6 +312,69 @@ var newScriptTestcases = []struct {
 				},
 				UsingRoot:      &vts.TargetRef{Path: "//test:blue"},
 				ProducesRootFS: true,
+				StrictOutputs:  true,
+				AllowNetwork:   true,
+			},
+		},
+	},
+	{
+		name:     "build_host_dep_constraints",
+		filename: "testdata/constrained_build.ccr",
+		want: []vts.Target{
+			&vts.Build{
+				Path:         "//test:constrained",
+				ContractPath: "testdata/constrained_build.ccr",
+				Name:         "constrained",
+				PatchIns:     map[string]vts.TargetRef{},
+				HostDeps: []vts.TargetRef{
+					{
+						Path: "//test:meow",
+						Constraints: []vts.RefConstraint{
+							{
+								Meta:   vts.TargetRef{Target: common.SemverClass},
+								Params: []starlark.Value{starlark.String(">>"), starlark.String(">=1.2 <2.0 || ^3.1")},
+							},
+						},
+					},
+					{
+						Path: "common://toolchains:gcc",
+						Constraints: []vts.RefConstraint{
+							{
+								Meta:   vts.TargetRef{Path: "common://attrs:arch"},
+								Params: []starlark.Value{starlark.String("=="), starlark.String("amd64")},
+							},
+						},
+					},
+					{
+						Path: "//test:woof",
+						Constraints: []vts.RefConstraint{
+							{
+								Meta:   vts.TargetRef{Path: "//test:flavour"},
+								Params: []starlark.Value{starlark.String("in"), starlark.String("a"), starlark.String("b")},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		name:     "component with provides",
+		filename: "testdata/component_with_provides.ccr",
+		want: []vts.Target{
+			&vts.Component{
+				Path:      "//test:bash",
+				Name:      "bash",
+				Provides:  []vts.TargetRef{{Path: "//virtuals:sh"}},
+				Conflicts: []vts.TargetRef{{Path: "//test:busybox"}},
+				Providers: map[string]vts.TargetRef{
+					"//virtuals:editor": {Path: "//editors:nano"},
+				},
+			},
+			&vts.Virtual{
+				Path:    "//test:pager",
+				Name:    "pager",
+				Default: &vts.TargetRef{Path: "//test:less"},
 			},
 		},
 	},
@@ -375,3 +463,372 @@ func TestMakeTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestStarlarkGeneratorRollupHash(t *testing.T) {
+	hash := func(src string) []byte {
+		t.Helper()
+		s, err := NewScript([]byte(src), "//test", "test.ccr", nil, nil)
+		if err != nil {
+			t.Fatalf("NewScript() failed: %v", err)
+		}
+		h, err := s.Targets()[0].(*vts.Generator).RollupHash(nil, nil)
+		if err != nil {
+			t.Fatalf("RollupHash() failed: %v", err)
+		}
+		return h
+	}
+	const script = "def gen(inputs, out):\n  out.write(%q)\n\ngenerator(name = \"g\", run = gen)\n"
+
+	first, again := hash(fmt.Sprintf(script, "a")), hash(fmt.Sprintf(script, "a"))
+	if !bytes.Equal(first, again) {
+		t.Errorf("hash of identical scripts differ: %X != %X", first, again)
+	}
+	if changed := hash(fmt.Sprintf(script, "b")); bytes.Equal(first, changed) {
+		t.Errorf("hash = %X after script changed, want different", changed)
+	}
+}
+
+func TestStarlarkGeneratorModuleHash(t *testing.T) {
+	hash := func(greeting string) []byte {
+		t.Helper()
+		d, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(d)
+		modules := map[string]string{
+			"gen.star":      "load(\"//helpers.star\", \"content\")\n\ndef gen(inputs, out):\n  out.write(content())\n",
+			"helpers.star":  "load(\"//greeting.star\", \"greeting\")\n\ndef content():\n  return greeting\n",
+			"greeting.star": fmt.Sprintf("greeting = %q\n", greeting),
+		}
+		for name, src := range modules {
+			if err := ioutil.WriteFile(filepath.Join(d, name), []byte(src), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		script := "load(\"//gen.star\", \"gen\")\n\ngenerator(name = \"g\", run = gen)\n"
+		s, err := NewScript([]byte(script), "//test", "test.ccr", NewModuleLoader(d, nil), nil)
+		if err != nil {
+			t.Fatalf("NewScript() failed: %v", err)
+		}
+		h, err := s.Targets()[0].(*vts.Generator).RollupHash(nil, nil)
+		if err != nil {
+			t.Fatalf("RollupHash() failed: %v", err)
+		}
+		return h
+	}
+
+	first, again := hash("hello"), hash("hello")
+	if !bytes.Equal(first, again) {
+		t.Errorf("hash of identical modules differ: %X != %X", first, again)
+	}
+	if changed := hash("goodbye"); bytes.Equal(first, changed) {
+		t.Errorf("hash = %X after transitively loaded module changed, want different", changed)
+	}
+}
+
+func TestLoadModule(t *testing.T) {
+	loader := NewModuleLoader("testdata", nil)
+
+	tcs := []struct {
+		name   string
+		script string
+		err    string
+		want   []string
+	}{
+		{
+			name:   "macro",
+			script: "load(\"//lib/macros.star\", \"make_component\")\n\nmake_component(\"a\")\nmake_component(\"b\")\n",
+			want:   []string{"//test:lib_a", "//test:lib_b"},
+		},
+		{
+			name:   "cached",
+			script: "load(\"//lib/macros.star\", \"make_component\")\n\nmake_component(\"c\")\n",
+			want:   []string{"//test:lib_c"},
+		},
+		{
+			name:   "cycle",
+			script: "load(\"//lib/cycle_a.star\", \"a\")\n",
+			err:    "cannot load //lib/cycle_a.star: cannot load //lib/cycle_b.star: cannot load //lib/cycle_a.star: cycle in load graph: //lib/cycle_a.star -> //lib/cycle_b.star -> //lib/cycle_a.star",
+		},
+		{
+			name:   "missing",
+			script: "load(\"//lib/missing.star\", \"a\")\n",
+			err:    "cannot load //lib/missing.star: module //lib/missing.star does not exist",
+		},
+		{
+			name:   "relative",
+			script: "load(\"lib/macros.star\", \"make_component\")\n",
+			err:    "cannot load lib/macros.star: module path \"lib/macros.star\" must begin with //",
+		},
+		{
+			name:   "toplevel_targets",
+			script: "load(\"//lib/toplevel.star\", \"a\")\n",
+			err:    "cannot load //lib/toplevel.star: targets cannot be declared at the top level of a loaded module",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewScript([]byte(tc.script), "//test", "testdata/test.ccr", loader, nil)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("NewScript() returned %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewScript() failed: %v", err)
+			}
+
+			var got []string
+			for _, target := range s.Targets() {
+				c := target.(*vts.Component)
+				got = append(got, c.Path)
+
+				// The definition should be attributed to the script, via
+				// the macro in the loaded module.
+				if c.Pos.Path != "testdata/test.ccr" {
+					t.Errorf("%s: Pos.Path = %q, want %q", c.Path, c.Pos.Path, "testdata/test.ccr")
+				}
+				if len(c.Pos.Via) != 1 || c.Pos.Via[0].Pos.Filename() != "//lib/macros.star" {
+					t.Errorf("%s: Pos.Via = %v, want frame in %s", c.Path, c.Pos.Via, "//lib/macros.star")
+				}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("unexpected targets (-want, +got):\n%s", diff)
+			}
+		})
+	}
+
+	if n := len(loader.modules); n != 2 {
+		t.Errorf("loader cached %d modules, want %d", n, 2)
+	}
+}
+
+func TestLoadModuleConcurrently(t *testing.T) {
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	// Executing the module takes long enough for loads to overlap.
+	slow := "def count():\n  n = 0\n  for i in range(100000):\n    n += 1\n  return n\n\nn = count()\n"
+	if err := ioutil.WriteFile(filepath.Join(d, "slow.star"), []byte(slow), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := NewModuleLoader(d, nil)
+
+	var (
+		wg      sync.WaitGroup
+		start   = make(chan struct{})
+		globals = make([]starlark.StringDict, 8)
+	)
+	for i := range globals {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			g, err := loader.loadModule(&starlark.Thread{}, "//slow.star")
+			if err != nil {
+				t.Errorf("loadModule() failed: %v", err)
+			}
+			globals[i] = g
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	// Every load should observe the globals of a single execution.
+	for i, g := range globals[1:] {
+		if reflect.ValueOf(g).Pointer() != reflect.ValueOf(globals[0]).Pointer() {
+			t.Errorf("load %d returned globals of a different execution of the module", i+1)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	d, err := ioutil.ReadFile("testdata/select_build.ccr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name   string
+		script string
+		config map[string]string
+		err    string
+		want   *vts.Build
+	}{
+		{
+			name:   "default",
+			script: string(d),
+			want: &vts.Build{
+				HostDeps: []vts.TargetRef{{Path: "//test:common"}, {Path: "//test:gcc"}},
+				Steps:    []*vts.BuildStep{{Kind: vts.StepShellCmd, Args: []string{"make"}}},
+				Env:      map[string]starlark.Value{"ARCH": starlark.String("x86_64")},
+				Config:   map[string]string{"arch": "", "profile": ""},
+			},
+		},
+		{
+			name:   "arm64_debug",
+			script: string(d),
+			config: map[string]string{"arch": "arm64", "profile": "debug", "unused": "yes"},
+			want: &vts.Build{
+				HostDeps: []vts.TargetRef{{Path: "//test:common"}, {Path: "//test:cross_gcc"}},
+				Steps:    []*vts.BuildStep{{Kind: vts.StepShellCmd, Args: []string{"make CFLAGS=-g"}}},
+				Env:      map[string]starlark.Value{"ARCH": starlark.String("aarch64")},
+				Config:   map[string]string{"arch": "arm64", "profile": "debug"},
+			},
+		},
+		{
+			name:   "config_struct",
+			script: "build(name = \"thingy\", steps = [step.shell_cmd(\"make ARCH=\" + config.arch)])\n",
+			config: map[string]string{"arch": "arm64"},
+			want: &vts.Build{
+				Steps: []*vts.BuildStep{{Kind: vts.StepShellCmd, Args: []string{"make ARCH=arm64"}}},
+			},
+		},
+		{
+			name:   "ambiguous",
+			script: "x = select({\"arch=arm64\": 1, \"os=linux\": 2})\n",
+			config: map[string]string{"arch": "arm64", "os": "linux"},
+			err:    "select is ambiguous: conditions \"arch=arm64\" and \"os=linux\" both match",
+		},
+		{
+			name:   "no_match",
+			script: "x = select({\"arch=arm64\": 1})\n",
+			err:    "no condition in select matches the configuration, and //conditions:default was not specified",
+		},
+		{
+			name:   "bad_condition",
+			script: "x = select({\"arm64\": 1})\n",
+			err:    "invalid condition \"arm64\": want key=value or //conditions:default",
+		},
+		{
+			name:   "wrong_type",
+			script: "build(name = \"thingy\", host_deps = select({\"//conditions:default\": \"meow\"}))\n",
+			err:    "host_deps: got string, want list",
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewScriptWithConfig([]byte(tc.script), "//test", "testdata/select_build.ccr", nil, tc.config)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("NewScriptWithConfig() returned %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewScriptWithConfig() failed: %v", err)
+			}
+
+			got := s.Targets()[0].(*vts.Build)
+			if diff := cmp.Diff(tc.want, got, filterPos, cmpopts.IgnoreUnexported(vts.Build{}),
+				cmpopts.IgnoreFields(vts.Build{}, "Path", "Name", "ContractDir", "ContractPath", "PatchIns")); diff != "" {
+				t.Errorf("unexpected build (+got, -want): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSelectRollupHash(t *testing.T) {
+	hash := func(config map[string]string) []byte {
+		t.Helper()
+		// Both branches select the same value, but the build must still be
+		// distinguished by the configuration which selected it.
+		const script = "build(name = \"b\", env = {\"A\": select({\"arch=arm64\": \"x\", \"//conditions:default\": \"x\"})})\n"
+		s, err := NewScriptWithConfig([]byte(script), "//test", "test.ccr", nil, config)
+		if err != nil {
+			t.Fatalf("NewScriptWithConfig() failed: %v", err)
+		}
+		h, err := s.Targets()[0].(*vts.Build).RollupHash(nil, nil)
+		if err != nil {
+			t.Fatalf("RollupHash() failed: %v", err)
+		}
+		return h
+	}
+
+	amd64, arm64 := hash(map[string]string{"arch": "amd64"}), hash(map[string]string{"arch": "arm64"})
+	if bytes.Equal(amd64, arm64) {
+		t.Errorf("hash = %X for both configurations, want different", amd64)
+	}
+	if unrelated := hash(map[string]string{"arch": "amd64", "profile": "debug"}); !bytes.Equal(amd64, unrelated) {
+		t.Errorf("hash = %X after setting an unused config value, want %X", unrelated, amd64)
+	}
+}
+
+func TestRefConstraintCheck(t *testing.T) {
+	tcs := []struct {
+		name string
+		op   syntax.Token
+		rhs  string
+		lhs  string
+		fail bool
+	}{
+		{name: "gt", op: syntax.GTGT, rhs: "1.2", lhs: "1.3"},
+		{name: "gt fail", op: syntax.GTGT, rhs: "1.2", lhs: "1.2", fail: true},
+		{name: "lt", op: syntax.LTLT, rhs: "1.2", lhs: "1.1.9"},
+		{name: "range", op: syntax.GTGT, rhs: ">=1.2 <2.0", lhs: "1.9.3"},
+		{name: "range upper", op: syntax.GTGT, rhs: ">=1.2 <2.0", lhs: "2.0.0", fail: true},
+		{name: "range spaced", op: syntax.GTGT, rhs: ">= 1.2 < 2", lhs: "1.2.0"},
+		{name: "not equal", op: syntax.GTGT, rhs: "!=1.5", lhs: "1.5.1"},
+		{name: "not equal fail", op: syntax.GTGT, rhs: "!=1.5", lhs: "1.5.0", fail: true},
+		{name: "exact", op: syntax.GTGT, rhs: "=1.5.2", lhs: "1.5.2"},
+		{name: "tilde", op: syntax.GTGT, rhs: "~1.2.3", lhs: "1.2.9"},
+		{name: "tilde minor", op: syntax.GTGT, rhs: "~1.2.3", lhs: "1.3.0", fail: true},
+		{name: "tilde major only", op: syntax.GTGT, rhs: "~1", lhs: "1.9.0"},
+		{name: "caret", op: syntax.GTGT, rhs: "^1.2.3", lhs: "1.9.0"},
+		{name: "caret major", op: syntax.GTGT, rhs: "^1.2.3", lhs: "2.0.0", fail: true},
+		{name: "caret below", op: syntax.GTGT, rhs: "^1.2.3", lhs: "1.2.2", fail: true},
+		{name: "caret zero major", op: syntax.GTGT, rhs: "^0.2.3", lhs: "0.3.0", fail: true},
+		{name: "caret zero minor", op: syntax.GTGT, rhs: "^0.0.3", lhs: "0.0.4", fail: true},
+		{name: "or first", op: syntax.GTGT, rhs: "<1 || >=3", lhs: "0.9"},
+		{name: "or second", op: syntax.GTGT, rhs: "<1 || >=3", lhs: "3.1"},
+		{name: "or neither", op: syntax.GTGT, rhs: "<1 || >=3", lhs: "2.0", fail: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := newComparisonConstraint(common.SemverClass, starlark.String(tc.rhs))
+			if err != nil {
+				t.Fatalf("newComparisonConstraint(%q) failed: %v", tc.rhs, err)
+			}
+			if _, err := c.Binary(tc.op, starlark.String("//test:thing"), starlark.Right); err != nil {
+				t.Fatalf("Binary() failed: %v", err)
+			}
+
+			err = c.Check(nil, starlark.String(tc.lhs))
+			if _, isConstraintErr := err.(vts.FailingConstraintInfo); tc.fail != isConstraintErr {
+				t.Errorf("Check(%q) = %v, want failing constraint = %v", tc.lhs, err, tc.fail)
+			}
+			if !tc.fail && err != nil {
+				t.Errorf("Check(%q) failed: %v", tc.lhs, err)
+			}
+		})
+	}
+}
+
+func TestRefAttrConstraintCheck(t *testing.T) {
+	c := &RefAttrConstraint{
+		ClassPath: "common://attrs:arch",
+		Values:    []starlark.Value{starlark.String("amd64"), starlark.String("arm64")},
+		In:        true,
+	}
+	if err := c.Check(nil, starlark.String("arm64")); err != nil {
+		t.Errorf("Check(%q) failed: %v", "arm64", err)
+	}
+
+	want := vts.FailingConstraintInfo{
+		Kind: "common://attrs:arch",
+		Lhs:  `"i386"`,
+		Op:   "in",
+		Rhs:  `["amd64", "arm64"]`,
+	}
+	if diff := cmp.Diff(want, c.Check(nil, starlark.String("i386"))); diff != "" {
+		t.Errorf("Check(%q) returned unexpected error (-want,+got):\n%s", "i386", diff)
+	}
+}
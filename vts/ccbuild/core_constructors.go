@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners"
 	"github.com/twitchylinux/ccr/vts/common"
 	"github.com/twitchylinux/ccr/vts/match"
 	"go.starlark.net/starlark"
@@ -16,6 +17,7 @@ func makeAttrClass(s *Script) *starlark.Builtin {
 	t := vts.TargetAttrClass
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name string
 		var checks *starlark.List
 		var repeatable bool
@@ -27,10 +29,7 @@ func makeAttrClass(s *Script) *starlark.Builtin {
 			Path:       s.makePath(name),
 			Name:       name,
 			Repeatable: repeatable,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:        s.defPosition(thread),
 		}
 		if checks != nil {
 			i := checks.Iterate()
@@ -54,6 +53,7 @@ func makeAttr(s *Script) *starlark.Builtin {
 	t := vts.TargetAttr
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name, parent string
 		var value starlark.Value
 		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name?", &name, "parent", &parent, "value", &value); err != nil {
@@ -70,10 +70,7 @@ func makeAttr(s *Script) *starlark.Builtin {
 			Name:   name,
 			Parent: parentClass,
 			Val:    value,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:    s.defPosition(thread),
 		}
 		// If theres no name, it must be an anonymous attr as part of another
 		// target. We don't add it to the targets list.
@@ -89,18 +86,28 @@ func makeResource(s *Script) *starlark.Builtin {
 	t := vts.TargetResource
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var (
-			name, parent, path string
-			mode, target       string
-			details, deps      *starlark.List
-			source             starlark.Value
+			name, parent, path  string
+			mode, target        string
+			detailsArg, depsArg starlark.Value
+			source              starlark.Value
+			owner, group        starlark.Value
 		)
 		if err := starlark.UnpackArgs(t.String(), args, kwargs,
 			// Core arguments.
-			"name", &name, "parent", &parent, "details?", &details, "deps?", &deps,
+			"name", &name, "parent", &parent, "details?", &detailsArg, "deps?", &depsArg,
 			"source?", &source,
 			// Helper arguments.
-			"path?", &path, "mode?", &mode, "target?", &target); err != nil {
+			"path?", &path, "mode?", &mode, "target?", &target, "owner?", &owner, "group?", &group); err != nil {
+			return starlark.None, err
+		}
+		details, err := listArg("details", detailsArg, nil)
+		if err != nil {
+			return starlark.None, err
+		}
+		deps, err := listArg("deps", depsArg, nil)
+		if err != nil {
 			return starlark.None, err
 		}
 
@@ -113,10 +120,7 @@ func makeResource(s *Script) *starlark.Builtin {
 			Path:   s.makePath(name),
 			Name:   name,
 			Parent: parentClass,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:    s.defPosition(thread),
 		}
 		if details != nil {
 			i := details.Iterate()
@@ -172,6 +176,20 @@ func makeResource(s *Script) *starlark.Builtin {
 				Pos:    r.Pos,
 			}})
 		}
+		if owner != nil {
+			r.Details = append(r.Details, vts.TargetRef{Target: &vts.Attr{
+				Parent: vts.TargetRef{Target: common.OwnerClass},
+				Val:    owner,
+				Pos:    r.Pos,
+			}})
+		}
+		if group != nil {
+			r.Details = append(r.Details, vts.TargetRef{Target: &vts.Attr{
+				Parent: vts.TargetRef{Target: common.OwnerGroupClass},
+				Val:    group,
+				Pos:    r.Pos,
+			}})
+		}
 
 		s.targets = append(s.targets, r)
 		return starlark.None, nil
@@ -182,24 +200,50 @@ func makeResourceClass(s *Script) *starlark.Builtin {
 	t := vts.TargetResourceClass
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-		var name string
+		s := s.caller(thread)
+		var name, parent string
 		var popStrategy starlark.Int
-		var chks, deps *starlark.List
-		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "chks?", &chks, "deps?", &deps,
-			"populate?", &popStrategy); err != nil {
+		var chks *starlark.List
+		var depsArg, detailsArg starlark.Value
+		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "chks?", &chks, "deps?", &depsArg,
+			"populate?", &popStrategy, "parent?", &parent, "default_details?", &detailsArg); err != nil {
+			return starlark.None, err
+		}
+		deps, err := listArg("deps", depsArg, nil)
+		if err != nil {
+			return starlark.None, err
+		}
+		details, err := listArg("default_details", detailsArg, nil)
+		if err != nil {
 			return starlark.None, err
 		}
 
 		ps, _ := popStrategy.Uint64()
 		r := &vts.ResourceClass{
-			Path: s.makePath(name),
-			Name: name,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Path:        s.makePath(name),
+			Name:        name,
+			Pos:         s.defPosition(thread),
 			PopStrategy: vts.PopulateStrategy(ps),
 		}
+		if parent != "" {
+			parentClass := vts.TargetRef{Path: parent}
+			if strings.HasPrefix(parent, ":") {
+				parentClass.Path = s.path + parent
+			}
+			r.Parent = &parentClass
+		}
+		if details != nil {
+			i := details.Iterate()
+			defer i.Done()
+			var x starlark.Value
+			for i.Next(&x) {
+				v, err := toDetailsTarget(s.path, x)
+				if err != nil {
+					return nil, fmt.Errorf("invalid default detail: %v", err)
+				}
+				r.DefaultDetails = append(r.DefaultDetails, v)
+			}
+		}
 		if chks != nil {
 			i := chks.Iterate()
 			defer i.Done()
@@ -234,19 +278,28 @@ func makeComponent(s *Script) *starlark.Builtin {
 	t := vts.TargetComponent
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name string
-		var details, deps, checks *starlark.List
-		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "details?", &details, "deps?", &deps, "chks?", &checks); err != nil {
+		var checks, provides, conflicts *starlark.List
+		var providers *starlark.Dict
+		var detailsArg, depsArg starlark.Value
+		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "details?", &detailsArg, "deps?", &depsArg, "chks?", &checks,
+			"provides?", &provides, "conflicts?", &conflicts, "providers?", &providers); err != nil {
+			return starlark.None, err
+		}
+		details, err := listArg("details", detailsArg, nil)
+		if err != nil {
+			return starlark.None, err
+		}
+		deps, err := listArg("deps", depsArg, nil)
+		if err != nil {
 			return starlark.None, err
 		}
 
 		r := &vts.Component{
 			Path: s.makePath(name),
 			Name: name,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:  s.defPosition(thread),
 		}
 		if details != nil {
 			i := details.Iterate()
@@ -284,6 +337,44 @@ func makeComponent(s *Script) *starlark.Builtin {
 				r.Checks = append(r.Checks, v)
 			}
 		}
+		if provides != nil {
+			i := provides.Iterate()
+			defer i.Done()
+			var x starlark.Value
+			for i.Next(&x) {
+				v, err := toPathTarget(s.path, x)
+				if err != nil {
+					return nil, fmt.Errorf("invalid provides: %v", err)
+				}
+				r.Provides = append(r.Provides, v)
+			}
+		}
+		if conflicts != nil {
+			i := conflicts.Iterate()
+			defer i.Done()
+			var x starlark.Value
+			for i.Next(&x) {
+				v, err := toPathTarget(s.path, x)
+				if err != nil {
+					return nil, fmt.Errorf("invalid conflicts: %v", err)
+				}
+				r.Conflicts = append(r.Conflicts, v)
+			}
+		}
+		if providers != nil {
+			r.Providers = make(map[string]vts.TargetRef, providers.Len())
+			for i, v := range providers.Items() {
+				k, err := toPathTarget(s.path, v[0])
+				if err != nil {
+					return nil, fmt.Errorf("providers[%d] invalid: %v", i, err)
+				}
+				p, err := toPathTarget(s.path, v[1])
+				if err != nil {
+					return nil, fmt.Errorf("providers[%d] invalid: %v", i, err)
+				}
+				r.Providers[k.Path] = p
+			}
+		}
 
 		s.targets = append(s.targets, r)
 		return starlark.None, nil
@@ -294,21 +385,27 @@ func makeChecker(s *Script) *starlark.Builtin {
 	t := vts.TargetChecker
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name, kind string
 		var run starlark.Value
 		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name?", &name, "kind", &kind, "run", &run); err != nil {
 			return starlark.None, err
 		}
+		// Checkers implemented in starlark are wrapped in a runner of the
+		// appropriate kind.
+		if fn, isFunc := run.(*starlark.Function); isFunc {
+			var err error
+			if run, err = runners.StarlarkChecker(vts.CheckerKind(kind), fn); err != nil {
+				return starlark.None, err
+			}
+		}
 
 		checker := &vts.Checker{
 			Path:   s.makePath(name),
 			Name:   name,
 			Kind:   vts.CheckerKind(kind),
 			Runner: run,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:    s.defPosition(thread),
 		}
 		// If theres no name, it must be an anonymous checker as part of another
 		// target. We don't add it to the targets list.
@@ -324,21 +421,24 @@ func makeGenerator(s *Script) *starlark.Builtin {
 	t := vts.TargetGenerator
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name string
 		var run starlark.Value
 		var inputs *starlark.List
 		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name?", &name, "inputs?", &inputs, "run?", &run); err != nil {
 			return starlark.None, err
 		}
+		// Generators implemented in starlark are wrapped in a runner, which
+		// hashes the script so it can be used in rollup hashes.
+		if fn, isFunc := run.(*starlark.Function); isFunc {
+			run = runners.StarlarkGenerator(fn, s.sourceOf(fn))
+		}
 
 		gen := &vts.Generator{
 			Path:   s.makePath(name),
 			Name:   name,
 			Runner: run,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:    s.defPosition(thread),
 		}
 
 		if inputs != nil {
@@ -368,37 +468,58 @@ func makeBuild(s *Script) *starlark.Builtin {
 	t := vts.TargetBuild
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var (
-			name                 string
-			deps, steps, inject  *starlark.List
-			outputs, inputs, env *starlark.Dict
-			rootFS               bool
-			chroot               starlark.Value
+			name                      string
+			inject                    *starlark.List
+			outputs, inputs           *starlark.Dict
+			depsArg, stepsArg, envArg starlark.Value
+			rootFS, strictOutputs     bool
+			allowNetwork              bool
+			chroot                    starlark.Value
 		)
 		if err := starlark.UnpackArgs(t.String(), args, kwargs,
-			"name?", &name, "host_deps?", &deps, "steps?", &steps,
+			"name?", &name, "host_deps?", &depsArg, "steps?", &stepsArg,
 			"patch_inputs?", &inputs, "output?", &outputs,
-			"inject?", &inject, "env?", &env,
-			"root_fs?", &rootFS, "using_chroot?", &chroot); err != nil {
+			"inject?", &inject, "env?", &envArg,
+			"root_fs?", &rootFS, "using_chroot?", &chroot,
+			"strict_outputs?", &strictOutputs, "allow_network?", &allowNetwork); err != nil {
+			return starlark.None, err
+		}
+		// Track the configuration values which selected any of the arguments,
+		// so builds in different configurations are cached separately.
+		conf := map[string]string{}
+		deps, err := listArg("host_deps", depsArg, conf)
+		if err != nil {
+			return starlark.None, err
+		}
+		steps, err := listArg("steps", stepsArg, conf)
+		if err != nil {
+			return starlark.None, err
+		}
+		env, err := dictArg("env", envArg, conf)
+		if err != nil {
 			return starlark.None, err
 		}
 
 		cd := filepath.Dir(s.fPath)
-		if filepath.IsAbs(cd) {
+		if !filepath.IsAbs(cd) {
 			wd, _ := os.Getwd()
 			cd = filepath.Join(wd, filepath.Dir(s.fPath))
 		}
 		b := &vts.Build{
-			ContractDir:  cd,
-			ContractPath: s.fPath,
-			Path:         s.makePath(name),
-			Name:         name,
-			PatchIns:     map[string]vts.TargetRef{},
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			ContractDir:    cd,
+			ContractPath:   s.fPath,
+			Path:           s.makePath(name),
+			Name:           name,
+			PatchIns:       map[string]vts.TargetRef{},
+			Pos:            s.defPosition(thread),
 			ProducesRootFS: rootFS,
+			StrictOutputs:  strictOutputs,
+			AllowNetwork:   allowNetwork,
+		}
+		if len(conf) > 0 {
+			b.Config = conf
 		}
 
 		if deps != nil {
@@ -12,7 +12,7 @@ import (
 var errNoAttr = errors.New("no relevant attribute")
 
 func resourcePath(r *vts.Resource, env *vts.RunnerEnv) (string, error) {
-	for _, attr := range r.Details {
+	for _, attr := range r.Attributes() {
 		if attr.Target == nil {
 			return "", fmt.Errorf("unresolved target reference: %q", attr.Path)
 		}
@@ -28,16 +28,15 @@ func toDepTarget(currentPath string, v starlark.Value) (vts.TargetRef, error) {
 		}
 		return vts.TargetRef{Path: string(s)}, nil
 	}
-	if constraint, isConstraint := v.(*RefComparisonConstraint); isConstraint {
-		base, err := toDepTarget(currentPath, constraint.Target)
+	if constraint, isConstraint := v.(targetConstraint); isConstraint {
+		if constraint.constrained() == nil {
+			return vts.TargetRef{}, fmt.Errorf("constraint %s was not applied to a target", constraint.Type())
+		}
+		base, err := toDepTarget(currentPath, constraint.constrained())
 		if err != nil {
 			return vts.TargetRef{}, fmt.Errorf("constraint target: %v", err)
 		}
-		base.Constraints = append(base.Constraints, vts.RefConstraint{
-			Meta:   vts.TargetRef{Target: constraint.AttrClass},
-			Params: []starlark.Value{starlark.String(constraint.Op.String()), constraint.CompareValue},
-			Eval:   constraint,
-		})
+		base.Constraints = append(base.Constraints, constraint.refConstraint(currentPath))
 		return base, nil
 	}
 	return vts.TargetRef{}, fmt.Errorf("cannot reference dep with starklark type %T (%s)", v, v.String())
@@ -90,3 +89,13 @@ func toBuildTarget(currentPath string, v starlark.Value) (vts.TargetRef, error)
 	}
 	return vts.TargetRef{}, fmt.Errorf("cannot reference generator with starklark type %T (%s)", v, v.String())
 }
+
+func toPathTarget(currentPath string, v starlark.Value) (vts.TargetRef, error) {
+	if s, ok := v.(starlark.String); ok {
+		if strings.HasPrefix(string(s), ":") {
+			return vts.TargetRef{Path: currentPath + string(s)}, nil
+		}
+		return vts.TargetRef{Path: string(s)}, nil
+	}
+	return vts.TargetRef{}, fmt.Errorf("cannot reference target with starklark type %T (%s)", v, v.String())
+}
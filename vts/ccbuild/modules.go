@@ -0,0 +1,131 @@
+package ccbuild
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// loadChainLocal is the thread-local key under which the chain of modules
+// currently being loaded is stored.
+const loadChainLocal = "ccr.load_chain"
+
+type module struct {
+	globals starlark.StringDict
+	src     []byte
+	// loads lists the modules loaded by the module.
+	loads []string
+}
+
+// ModuleLoader resolves modules referenced by load() statements, such as
+// load("//lib/autotools.star", "autotools_build"), against a directory of
+// contracts. Each module is executed once, so a single ModuleLoader should
+// be shared by all scripts in a universe.
+type ModuleLoader struct {
+	dir    string
+	config map[string]string
+
+	lock    sync.Mutex
+	modules map[string]*module
+	// execLock is held while a module and the modules it loads are
+	// executed, so concurrent loads of a module execute it only once.
+	// Holding a single lock rather than one per module means concurrent
+	// loads of a cycle report the cycle rather than deadlock.
+	execLock sync.Mutex
+}
+
+// NewModuleLoader returns a ModuleLoader which resolves modules in dir. The
+// provided configuration values are visible to modules through config.
+func NewModuleLoader(dir string, config map[string]string) *ModuleLoader {
+	return &ModuleLoader{
+		dir:     dir,
+		config:  config,
+		modules: make(map[string]*module, 8),
+	}
+}
+
+func (l *ModuleLoader) modulePath(name string) (string, error) {
+	if !strings.HasPrefix(name, "//") {
+		return "", fmt.Errorf("module path %q must begin with //", name)
+	}
+	p := filepath.Clean(strings.TrimPrefix(name, "//"))
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("module path %q is outside the contracts directory", name)
+	}
+	return filepath.Join(l.dir, p), nil
+}
+
+func (l *ModuleLoader) loadedModule(name string) (*module, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	m, ok := l.modules[name]
+	return m, ok
+}
+
+func (l *ModuleLoader) loadModule(thread *starlark.Thread, name string) (starlark.StringDict, error) {
+	chain, _ := thread.Local(loadChainLocal).([]string)
+	for _, c := range chain {
+		if c == name {
+			return nil, fmt.Errorf("cycle in load graph: %s -> %s", strings.Join(chain, " -> "), name)
+		}
+	}
+
+	if m, ok := l.loadedModule(name); ok {
+		return m.globals, nil
+	}
+	// Modules loaded by another module are executed while the outermost
+	// module holds execLock.
+	if len(chain) == 0 {
+		l.execLock.Lock()
+		defer l.execLock.Unlock()
+		if m, ok := l.loadedModule(name); ok {
+			return m.globals, nil
+		}
+	}
+
+	fPath, err := l.modulePath(name)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ioutil.ReadFile(fPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("module %s does not exist", name)
+		}
+		return nil, err
+	}
+
+	// Modules are executed as a script of their own, though the builtins
+	// they call will act on behalf of the script calling into the module.
+	s := &Script{path: name, fPath: fPath, src: d, loader: l, config: l.config}
+	builtins, err := s.makeBuiltins()
+	if err != nil {
+		return nil, err
+	}
+	modThread := &starlark.Thread{
+		Name: name,
+		Load: func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+			return s.load(l, thread, module)
+		},
+	}
+	modThread.SetLocal(loadChainLocal, append(append(make([]string, 0, len(chain)+1), chain...), name))
+
+	globals, err := starlark.ExecFile(modThread, name, d, builtins)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.targets) > 0 {
+		return nil, errors.New("targets cannot be declared at the top level of a loaded module")
+	}
+
+	l.lock.Lock()
+	l.modules[name] = &module{globals: globals, src: d, loads: s.loads}
+	l.lock.Unlock()
+	return globals, nil
+}
@@ -15,10 +15,19 @@ func makeToolchain(s *Script) *starlark.Builtin {
 	t := vts.TargetToolchain
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name string
-		var deps, details *starlark.List
+		var depsArg, detailsArg starlark.Value
 		var binaries *starlark.Dict
-		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "deps?", &deps, "details?", &details, "binaries?", &binaries); err != nil {
+		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "deps?", &depsArg, "details?", &detailsArg, "binaries?", &binaries); err != nil {
+			return starlark.None, err
+		}
+		deps, err := listArg("deps", depsArg, nil)
+		if err != nil {
+			return starlark.None, err
+		}
+		details, err := listArg("details", detailsArg, nil)
+		if err != nil {
 			return starlark.None, err
 		}
 
@@ -26,10 +35,7 @@ func makeToolchain(s *Script) *starlark.Builtin {
 			Path:           s.makePath(name),
 			Name:           name,
 			BinaryMappings: map[string]string{},
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:            s.defPosition(thread),
 		}
 		if deps != nil {
 			i := deps.Iterate()
@@ -82,6 +88,7 @@ func makeSieve(s *Script) *starlark.Builtin {
 	t := vts.TargetSieve
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var name, prefix string
 		var inputs, exGlobs, incGlobs *starlark.List
 		var renames *starlark.Dict
@@ -95,10 +102,7 @@ func makeSieve(s *Script) *starlark.Builtin {
 			TargetPath:   s.makePath(name),
 			ContractPath: s.fPath,
 			AddPrefix:    prefix,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:          s.defPosition(thread),
 		}
 
 		if inputs != nil {
@@ -162,6 +166,7 @@ func makeSieve(s *Script) *starlark.Builtin {
 
 func makeSievePrefix(s *Script) *starlark.Builtin {
 	return starlark.NewBuiltin("sieve_prefix", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var target, prefix string
 		if err := starlark.UnpackArgs("sieve_prefix", args, kwargs, "target?", &target, "prefix?", &prefix); err != nil {
 			return starlark.None, err
@@ -174,14 +179,11 @@ func makeSievePrefix(s *Script) *starlark.Builtin {
 
 		st := &vts.Sieve{
 			ContractPath: s.fPath,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:          s.defPosition(thread),
 			IncludeGlobs: []string{prefix + "**"},
 			Renames: &match.FilenameRules{
 				Rules: []match.MatchRule{
-					{P: m, Out: &match.StripPrefixOutputMapper{Prefix: prefix}},
+					{P: m, Out: &match.StripPrefixOutputMapper{Prefix: prefix}, Pattern: prefix + "**"},
 				},
 			},
 		}
@@ -196,8 +198,38 @@ func makeSievePrefix(s *Script) *starlark.Builtin {
 	})
 }
 
+func makeVirtual(s *Script) *starlark.Builtin {
+	t := vts.TargetVirtual
+
+	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
+		var name string
+		var def starlark.Value
+		if err := starlark.UnpackArgs(t.String(), args, kwargs, "name", &name, "default?", &def); err != nil {
+			return starlark.None, err
+		}
+
+		v := &vts.Virtual{
+			Path: s.makePath(name),
+			Name: name,
+			Pos:  s.defPosition(thread),
+		}
+		if def != nil {
+			ref, err := toPathTarget(s.path, def)
+			if err != nil {
+				return nil, fmt.Errorf("invalid default: %v", err)
+			}
+			v.Default = &ref
+		}
+
+		s.targets = append(s.targets, v)
+		return starlark.None, nil
+	})
+}
+
 func makeComputedValue(s *Script) *starlark.Builtin {
 	return starlark.NewBuiltin("compute", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var fname, fun, code string
 
 		if len(kwargs) == 0 && len(args) == 1 {
@@ -224,10 +256,7 @@ func makeComputedValue(s *Script) *starlark.Builtin {
 			Filename:     fname,
 			Func:         fun,
 			InlineScript: []byte(code),
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:          s.defPosition(thread),
 		}, nil
 	})
 }
@@ -236,6 +265,7 @@ func makePuesdotarget(s *Script, kind vts.PuesdoKind) *starlark.Builtin {
 	t := vts.TargetPuesdo
 
 	return starlark.NewBuiltin(t.String(), func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
 		var path, sha256, url string
 		var name string
 		var host bool
@@ -252,10 +282,7 @@ func makePuesdotarget(s *Script, kind vts.PuesdoKind) *starlark.Builtin {
 			Name:         name,
 			Host:         host,
 			ContractPath: s.fPath,
-			Pos: &vts.DefPosition{
-				Path:  s.fPath,
-				Frame: thread.CallFrame(1),
-			},
+			Pos:          s.defPosition(thread),
 
 			Path:   path,
 			SHA256: sha256,
@@ -3,6 +3,7 @@ package ccbuild
 import (
 	"crypto/sha256"
 	"fmt"
+	"strings"
 
 	semver "github.com/blang/semver/v4"
 	"github.com/twitchylinux/ccr/vts"
@@ -11,6 +12,16 @@ import (
 	"go.starlark.net/syntax"
 )
 
+// targetConstraint describes a constraint which can be applied to a target
+// reference, such as ":thing" >> semver("1.2").
+type targetConstraint interface {
+	starlark.Value
+	// constrained returns the reference the constraint was applied to.
+	constrained() starlark.Value
+	// refConstraint describes the constraint on the referenced target.
+	refConstraint(currentPath string) vts.RefConstraint
+}
+
 // RefComparisonConstraint implements a comparison constraint on a target
 // and one of its attributes.
 type RefComparisonConstraint struct {
@@ -18,6 +29,25 @@ type RefComparisonConstraint struct {
 	AttrClass    *vts.AttrClass
 	CompareValue starlark.Value
 	Op           syntax.Token
+	// Range is set if CompareValue is a semver range expression rather
+	// than a single version.
+	Range semver.Range
+}
+
+// newComparisonConstraint returns a constraint comparing the value of
+// attributes of the given class against v.
+func newComparisonConstraint(class *vts.AttrClass, v starlark.Value) (*RefComparisonConstraint, error) {
+	c := &RefComparisonConstraint{AttrClass: class, CompareValue: v}
+	if class == common.SemverClass {
+		if s, ok := v.(starlark.String); ok && isSemverRange(string(s)) {
+			r, err := parseSemverRange(string(s))
+			if err != nil {
+				return nil, err
+			}
+			c.Range = r
+		}
+	}
+	return c, nil
 }
 
 func (c *RefComparisonConstraint) String() string {
@@ -54,12 +84,25 @@ func (c *RefComparisonConstraint) Binary(op syntax.Token, y starlark.Value, side
 	if side != starlark.Right {
 		return nil, fmt.Errorf("invalid constraint: must be specified to the right")
 	}
+	if c.Range != nil && op != syntax.GTGT {
+		return nil, fmt.Errorf("range constraint %s must be applied with %q", c.CompareValue, syntax.GTGT.String())
+	}
 	c.Target = y
 	return c, nil
 }
 
 func (c *RefComparisonConstraint) Name() string { return c.Type() }
 
+func (c *RefComparisonConstraint) constrained() starlark.Value { return c.Target }
+
+func (c *RefComparisonConstraint) refConstraint(currentPath string) vts.RefConstraint {
+	return vts.RefConstraint{
+		Meta:   vts.TargetRef{Target: c.AttrClass},
+		Params: []starlark.Value{starlark.String(c.Op.String()), c.CompareValue},
+		Eval:   c,
+	}
+}
+
 func (c *RefComparisonConstraint) Check(env *vts.RunnerEnv, lhs starlark.Value) error {
 	l, ok := lhs.(starlark.String)
 	if !ok {
@@ -76,6 +119,17 @@ func (c *RefComparisonConstraint) Check(env *vts.RunnerEnv, lhs starlark.Value)
 		if err != nil {
 			return fmt.Errorf("lhs: %v", err)
 		}
+		if c.Range != nil {
+			if c.Range(lv) {
+				return nil
+			}
+			return vts.FailingConstraintInfo{
+				Lhs:  string(l),
+				Rhs:  fmt.Sprintf("semver(%q)", string(r)),
+				Op:   c.Op.String(),
+				Kind: "semver",
+			}
+		}
 		rv, err := semver.ParseTolerant(string(r))
 		if err != nil {
 			return fmt.Errorf("rhs: %v", err)
@@ -101,3 +155,99 @@ func (c *RefComparisonConstraint) Check(env *vts.RunnerEnv, lhs starlark.Value)
 
 	return fmt.Errorf("attr class %q not supported", c.AttrClass.GlobalPath())
 }
+
+// RefAttrConstraint implements a constraint that an attribute of a target
+// has one of a set of values.
+type RefAttrConstraint struct {
+	Target starlark.Value
+	// ClassPath is the path of the attribute class to constrain.
+	ClassPath string
+	Values    []starlark.Value
+	// In is true if the constraint was specified as a set of values rather
+	// than a single value.
+	In bool
+}
+
+func (c *RefAttrConstraint) String() string {
+	return c.Type()
+}
+
+// Type implements starlark.Value.
+func (c *RefAttrConstraint) Type() string {
+	return "target_constraint<attr>"
+}
+
+// Freeze implements starlark.Value.
+func (c *RefAttrConstraint) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (c *RefAttrConstraint) Truth() starlark.Bool {
+	return true
+}
+
+// Hash implements starlark.Value.
+func (c *RefAttrConstraint) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(c.String()))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (c *RefAttrConstraint) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op != syntax.GTGT {
+		return nil, fmt.Errorf("cannot handle constraint with op %q", op.String())
+	}
+	if side != starlark.Right {
+		return nil, fmt.Errorf("invalid constraint: must be specified to the right")
+	}
+	c.Target = y
+	return c, nil
+}
+
+func (c *RefAttrConstraint) Name() string { return c.Type() }
+
+func (c *RefAttrConstraint) op() string {
+	if c.In {
+		return "in"
+	}
+	return "=="
+}
+
+func (c *RefAttrConstraint) rhs() string {
+	if c.In {
+		return starlark.NewList(c.Values).String()
+	}
+	return c.Values[0].String()
+}
+
+func (c *RefAttrConstraint) constrained() starlark.Value { return c.Target }
+
+func (c *RefAttrConstraint) refConstraint(currentPath string) vts.RefConstraint {
+	classPath := c.ClassPath
+	if strings.HasPrefix(classPath, ":") {
+		classPath = currentPath + classPath
+	}
+	return vts.RefConstraint{
+		Meta:   vts.TargetRef{Path: classPath},
+		Params: append([]starlark.Value{starlark.String(c.op())}, c.Values...),
+		Eval:   c,
+	}
+}
+
+func (c *RefAttrConstraint) Check(env *vts.RunnerEnv, lhs starlark.Value) error {
+	for _, v := range c.Values {
+		eq, err := starlark.Equal(lhs, v)
+		if err != nil {
+			return err
+		}
+		if eq {
+			return nil
+		}
+	}
+
+	return vts.FailingConstraintInfo{
+		Lhs:  lhs.String(),
+		Rhs:  c.rhs(),
+		Op:   c.op(),
+		Kind: c.ClassPath,
+	}
+}
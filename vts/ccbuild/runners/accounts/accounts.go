@@ -0,0 +1,365 @@
+// Package accounts implements generation and checking of user and group
+// accounts.
+package accounts
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// Paths of the resource and attribute classes describing accounts.
+const (
+	UserClass  = "common://resources/accounts:user"
+	GroupClass = "common://resources/accounts:group"
+
+	NameClass    = "common://attrs/accounts:name"
+	UIDClass     = "common://attrs/accounts:uid"
+	GIDClass     = "common://attrs/accounts:gid"
+	HomeClass    = "common://attrs/accounts:home"
+	ShellClass   = "common://attrs/accounts:shell"
+	MembersClass = "common://attrs/accounts:members"
+)
+
+// Accounts which do not pin an id are allocated one from this range.
+const (
+	FirstAllocatedID = 100
+	LastAllocatedID  = 999
+)
+
+// Defaults for users which do not specify a home directory or shell.
+const (
+	DefaultHome  = "/"
+	DefaultShell = "/sbin/nologin"
+)
+
+// User describes a user account.
+type User struct {
+	Name  string
+	UID   int
+	GID   int
+	Home  string
+	Shell string
+
+	Resource *vts.Resource
+}
+
+// Group describes a group account.
+type Group struct {
+	Name    string
+	GID     int
+	Members []string
+
+	Resource *vts.Resource
+}
+
+// Accounts describes a consistent set of users and groups, each ordered by
+// id.
+type Accounts struct {
+	Users  []*User
+	Groups []*Group
+}
+
+// IsUser returns true if r describes a user account.
+func IsUser(r *vts.Resource) bool {
+	c, ok := r.Parent.Target.(*vts.ResourceClass)
+	return ok && c.IsA(UserClass)
+}
+
+// IsGroup returns true if r describes a group account.
+func IsGroup(r *vts.Resource) bool {
+	c, ok := r.Parent.Target.(*vts.ResourceClass)
+	return ok && c.IsA(GroupClass)
+}
+
+// attrValues returns the values of the attributes of r with the given class.
+func attrValues(r *vts.Resource, class string, env *vts.RunnerEnv) ([]starlark.Value, error) {
+	var out []starlark.Value
+	for _, attr := range r.Attributes() {
+		if attr.Target == nil {
+			return nil, fmt.Errorf("unresolved target reference: %q", attr.Path)
+		}
+		a := attr.Target.(*vts.Attr)
+		if a.Parent.Target == nil {
+			return nil, fmt.Errorf("unresolved target reference: %q", a.Parent.Path)
+		}
+		if a.Parent.Target.(*vts.AttrClass).GlobalPath() != class {
+			continue
+		}
+		v, err := a.Value(r, env, proc.EvalComputedAttribute)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// attrValue returns the value of the attribute of r with the given class,
+// or nil if r has no such attribute.
+func attrValue(r *vts.Resource, class string, env *vts.RunnerEnv) (starlark.Value, error) {
+	vals, err := attrValues(r, class, env)
+	if err != nil || len(vals) == 0 {
+		return nil, err
+	}
+	return vals[0], nil
+}
+
+func stringAttr(r *vts.Resource, class, def string, env *vts.RunnerEnv) (string, error) {
+	v, err := attrValue(r, class, env)
+	switch {
+	case err != nil:
+		return "", err
+	case v == nil:
+		return def, nil
+	}
+	s, ok := v.(starlark.String)
+	if !ok {
+		return "", fmt.Errorf("%s: want string, got %s", class, v.Type())
+	}
+	return string(s), nil
+}
+
+// Name returns the name of the account described by r, which defaults to
+// the name of the resource.
+func Name(r *vts.Resource, env *vts.RunnerEnv) (string, error) {
+	return stringAttr(r, NameClass, r.Name, env)
+}
+
+// idAttr returns the id pinned by the attribute of r with the given class,
+// or -1 if none is pinned.
+func idAttr(r *vts.Resource, class string, env *vts.RunnerEnv) (int, error) {
+	v, err := attrValue(r, class, env)
+	switch {
+	case err != nil:
+		return 0, err
+	case v == nil:
+		return -1, nil
+	}
+	i, ok := v.(starlark.Int)
+	if !ok {
+		return 0, fmt.Errorf("%s: want int, got %s", class, v.Type())
+	}
+	id, ok := i.Int64()
+	if !ok || id < 0 || id > 1<<32-2 {
+		return 0, fmt.Errorf("%s: id %v is out of range", class, i)
+	}
+	return int(id), nil
+}
+
+// allocator assigns ids to accounts. Accounts which do not pin an id are
+// assigned one based on the hash of their name, so adding or removing an
+// account rarely changes the id of another.
+type allocator struct {
+	kind string
+	used map[int]string
+}
+
+func (a *allocator) pin(name string, id int) error {
+	if other, used := a.used[id]; used {
+		return fmt.Errorf("%s %d is used by both %q and %q", a.kind, id, other, name)
+	}
+	a.used[id] = name
+	return nil
+}
+
+func (a *allocator) allocate(name string) (int, error) {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	span := LastAllocatedID - FirstAllocatedID + 1
+	start := int(h.Sum32() % uint32(span))
+	for i := 0; i < span; i++ {
+		id := FirstAllocatedID + (start+i)%span
+		if _, used := a.used[id]; !used {
+			a.used[id] = name
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("cannot allocate %s for %q: no ids are free", a.kind, name)
+}
+
+// Collect computes the accounts described by the given user and group
+// resources.
+func Collect(users, groups []*vts.Resource, env *vts.RunnerEnv) (*Accounts, error) {
+	out := &Accounts{}
+
+	// Groups are allocated first, so users can reference them.
+	var (
+		gids       = allocator{kind: "gid", used: map[int]string{}}
+		groupNames = make(map[string]*Group, len(groups))
+		unpinned   []*Group
+	)
+	for _, r := range groups {
+		name, err := Name(r, env)
+		if err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		if _, dupe := groupNames[name]; dupe {
+			return nil, vts.WrapWithTarget(fmt.Errorf("multiple groups are named %q", name), r)
+		}
+		g := &Group{Name: name, Resource: r}
+		if g.GID, err = idAttr(r, GIDClass, env); err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		members, err := attrValues(r, MembersClass, env)
+		if err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		for _, m := range members {
+			s, ok := m.(starlark.String)
+			if !ok {
+				return nil, vts.WrapWithTarget(fmt.Errorf("%s: want string, got %s", MembersClass, m.Type()), r)
+			}
+			g.Members = append(g.Members, string(s))
+		}
+		sort.Strings(g.Members)
+
+		if g.GID >= 0 {
+			if err := gids.pin(g.Name, g.GID); err != nil {
+				return nil, vts.WrapWithTarget(err, r)
+			}
+		} else {
+			unpinned = append(unpinned, g)
+		}
+		groupNames[g.Name] = g
+		out.Groups = append(out.Groups, g)
+	}
+	sort.Slice(unpinned, func(i, j int) bool { return unpinned[i].Name < unpinned[j].Name })
+	for _, g := range unpinned {
+		var err error
+		if g.GID, err = gids.allocate(g.Name); err != nil {
+			return nil, vts.WrapWithTarget(err, g.Resource)
+		}
+	}
+
+	var (
+		uids          = allocator{kind: "uid", used: map[int]string{}}
+		userNames     = make(map[string]*User, len(users))
+		unpinnedUsers []*User
+	)
+	for _, r := range users {
+		name, err := Name(r, env)
+		if err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		if _, dupe := userNames[name]; dupe {
+			return nil, vts.WrapWithTarget(fmt.Errorf("multiple users are named %q", name), r)
+		}
+		u := &User{Name: name, Resource: r}
+		if u.UID, err = idAttr(r, UIDClass, env); err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		if u.Home, err = stringAttr(r, HomeClass, DefaultHome, env); err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		if u.Shell, err = stringAttr(r, ShellClass, DefaultShell, env); err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+		if u.GID, err = primaryGroup(r, name, groupNames, env); err != nil {
+			return nil, vts.WrapWithTarget(err, r)
+		}
+
+		if u.UID >= 0 {
+			if err := uids.pin(u.Name, u.UID); err != nil {
+				return nil, vts.WrapWithTarget(err, r)
+			}
+		} else {
+			unpinnedUsers = append(unpinnedUsers, u)
+		}
+		userNames[u.Name] = u
+		out.Users = append(out.Users, u)
+	}
+	sort.Slice(unpinnedUsers, func(i, j int) bool { return unpinnedUsers[i].Name < unpinnedUsers[j].Name })
+	for _, u := range unpinnedUsers {
+		var err error
+		if u.UID, err = uids.allocate(u.Name); err != nil {
+			return nil, vts.WrapWithTarget(err, u.Resource)
+		}
+	}
+
+	for _, g := range out.Groups {
+		for _, m := range g.Members {
+			if _, ok := userNames[m]; !ok {
+				return nil, vts.WrapWithTarget(fmt.Errorf("member %q is not a user", m), g.Resource)
+			}
+		}
+	}
+
+	sort.Slice(out.Users, func(i, j int) bool { return out.Users[i].UID < out.Users[j].UID })
+	sort.Slice(out.Groups, func(i, j int) bool { return out.Groups[i].GID < out.Groups[j].GID })
+	return out, nil
+}
+
+// primaryGroup returns the gid of the primary group of a user. The group
+// may be specified by gid or by name, and defaults to the group with the
+// same name as the user.
+func primaryGroup(r *vts.Resource, name string, groups map[string]*Group, env *vts.RunnerEnv) (int, error) {
+	v, err := attrValue(r, GIDClass, env)
+	if err != nil {
+		return 0, err
+	}
+	switch v := v.(type) {
+	case nil:
+		if g, ok := groups[name]; ok {
+			return g.GID, nil
+		}
+		return 0, fmt.Errorf("no primary group specified, and there is no group named %q", name)
+	case starlark.String:
+		if g, ok := groups[string(v)]; ok {
+			return g.GID, nil
+		}
+		return 0, fmt.Errorf("primary group %q does not exist", string(v))
+	case starlark.Int:
+		gid, ok := v.Int64()
+		if ok {
+			for _, g := range groups {
+				if g.GID == int(gid) {
+					return g.GID, nil
+				}
+			}
+		}
+		return 0, fmt.Errorf("primary group %v does not exist", v)
+	}
+	return 0, fmt.Errorf("%s: want int or string, got %s", GIDClass, v.Type())
+}
+
+// Passwd returns the contents of /etc/passwd.
+func (a *Accounts) Passwd() string {
+	var out strings.Builder
+	for _, u := range a.Users {
+		fmt.Fprintf(&out, "%s:x:%d:%d::%s:%s\n", u.Name, u.UID, u.GID, u.Home, u.Shell)
+	}
+	return out.String()
+}
+
+// Shadow returns the contents of /etc/shadow. Passwords are locked.
+func (a *Accounts) Shadow() string {
+	var out strings.Builder
+	for _, u := range a.Users {
+		fmt.Fprintf(&out, "%s:!:::::::\n", u.Name)
+	}
+	return out.String()
+}
+
+// Group returns the contents of /etc/group.
+func (a *Accounts) Group() string {
+	var out strings.Builder
+	for _, g := range a.Groups {
+		fmt.Fprintf(&out, "%s:x:%d:%s\n", g.Name, g.GID, strings.Join(g.Members, ","))
+	}
+	return out.String()
+}
+
+// GShadow returns the contents of /etc/gshadow. Passwords are locked.
+func (a *Accounts) GShadow() string {
+	var out strings.Builder
+	for _, g := range a.Groups {
+		fmt.Fprintf(&out, "%s:!::%s\n", g.Name, strings.Join(g.Members, ","))
+	}
+	return out.String()
+}
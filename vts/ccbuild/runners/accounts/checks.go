@@ -0,0 +1,225 @@
+package accounts
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// UserCheckValid returns a runner that checks a user account is unique
+// within the universe, and that its shell and home directory exist, if
+// specified.
+func UserCheckValid() *userChecker {
+	return &userChecker{}
+}
+
+type userChecker struct{}
+
+func (*userChecker) Kind() vts.CheckerKind { return vts.ChkKindEachResource }
+
+func (*userChecker) String() string { return "accounts.user_valid" }
+
+func (*userChecker) Freeze() {}
+
+func (*userChecker) Truth() starlark.Bool { return true }
+
+func (*userChecker) Type() string { return "runner" }
+
+func (t *userChecker) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*userChecker) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	if err := checkUnique(r, IsUser, UIDClass, opts); err != nil {
+		return err
+	}
+
+	shell, err := stringAttr(r, ShellClass, "", opts)
+	if err != nil {
+		return err
+	}
+	if shell != "" {
+		st, err := opts.FS.Stat(shell)
+		if err != nil {
+			return vts.WrapWithPath(fmt.Errorf("shell: %v", err), shell)
+		}
+		if st.IsDir() {
+			return vts.WrapWithPath(errors.New("shell is a directory"), shell)
+		}
+	}
+
+	home, err := stringAttr(r, HomeClass, "", opts)
+	if err != nil {
+		return err
+	}
+	if home != "" {
+		st, err := opts.FS.Stat(home)
+		if err != nil {
+			return vts.WrapWithPath(fmt.Errorf("home: %v", err), home)
+		}
+		if !st.IsDir() {
+			return vts.WrapWithPath(errors.New("home is not a directory"), home)
+		}
+	}
+	return nil
+}
+
+func (*userChecker) PopulatorsNeeded() []vts.InfoPopulator {
+	return nil
+}
+
+// UniverseDependent returns true, as accounts are checked against every
+// other account in the universe.
+func (*userChecker) UniverseDependent() bool {
+	return true
+}
+
+// GroupCheckValid returns a runner that checks a group account is unique
+// within the universe, and that its members are users in the universe.
+func GroupCheckValid() *groupChecker {
+	return &groupChecker{}
+}
+
+type groupChecker struct{}
+
+func (*groupChecker) Kind() vts.CheckerKind { return vts.ChkKindEachResource }
+
+func (*groupChecker) String() string { return "accounts.group_valid" }
+
+func (*groupChecker) Freeze() {}
+
+func (*groupChecker) Truth() starlark.Bool { return true }
+
+func (*groupChecker) Type() string { return "runner" }
+
+func (t *groupChecker) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*groupChecker) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	if err := checkUnique(r, IsGroup, GIDClass, opts); err != nil {
+		return err
+	}
+
+	members, err := attrValues(r, MembersClass, opts)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]bool, 32)
+	for _, t := range opts.Universe.AllTargets() {
+		if u, ok := t.(*vts.Resource); ok && IsUser(u) {
+			name, err := Name(u, opts)
+			if err != nil {
+				return vts.WrapWithTarget(err, u)
+			}
+			users[name] = true
+		}
+	}
+	for _, m := range members {
+		s, ok := m.(starlark.String)
+		if !ok {
+			return fmt.Errorf("%s: want string, got %s", MembersClass, m.Type())
+		}
+		if !users[string(s)] {
+			return fmt.Errorf("member %q is not a user", string(s))
+		}
+	}
+	return nil
+}
+
+func (*groupChecker) PopulatorsNeeded() []vts.InfoPopulator {
+	return nil
+}
+
+// UniverseDependent returns true, as accounts are checked against every
+// other account in the universe.
+func (*groupChecker) UniverseDependent() bool {
+	return true
+}
+
+// checkUnique returns an error if another account of the same kind as r
+// has the same name, or pins the same id.
+func checkUnique(r *vts.Resource, sameKind func(*vts.Resource) bool, idClass string, opts *vts.RunnerEnv) error {
+	name, err := Name(r, opts)
+	if err != nil {
+		return err
+	}
+	id, err := idAttr(r, idClass, opts)
+	if err != nil {
+		return err
+	}
+	for _, t := range opts.Universe.AllTargets() {
+		other, ok := t.(*vts.Resource)
+		if !ok || other == r || !sameKind(other) {
+			continue
+		}
+		otherName, err := Name(other, opts)
+		if err != nil {
+			return vts.WrapWithTarget(err, other)
+		}
+		if otherName == name {
+			return vts.WrapWithActionTarget(fmt.Errorf("account %q is declared more than once", name), other)
+		}
+		if id < 0 {
+			continue
+		}
+		otherID, err := idAttr(other, idClass, opts)
+		if err != nil {
+			return vts.WrapWithTarget(err, other)
+		}
+		if otherID == id {
+			return vts.WrapWithActionTarget(fmt.Errorf("id %d is also used by %q", id, otherName), other)
+		}
+	}
+	return nil
+}
+
+// IDCheckValid returns a runner that checks attrs are valid account ids.
+// If names are allowed, attrs may instead name an account.
+func IDCheckValid(allowNames bool) *idValidRunner {
+	return &idValidRunner{allowNames: allowNames}
+}
+
+type idValidRunner struct {
+	allowNames bool
+}
+
+func (*idValidRunner) Kind() vts.CheckerKind { return vts.ChkKindEachAttr }
+
+func (*idValidRunner) String() string { return "accounts.id_valid" }
+
+func (*idValidRunner) Freeze() {}
+
+func (*idValidRunner) Truth() starlark.Bool { return true }
+
+func (*idValidRunner) Type() string { return "runner" }
+
+func (t *idValidRunner) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (t *idValidRunner) Run(attr *vts.Attr, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	v, err := attr.Value(chkr, opts, proc.EvalComputedAttribute)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case starlark.Int:
+		if id, ok := v.Int64(); !ok || id < 0 || id > 1<<32-2 {
+			return fmt.Errorf("id %v is out of range", v)
+		}
+		return nil
+	case starlark.String:
+		if t.allowNames && v != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid account id: %s", v.String())
+}
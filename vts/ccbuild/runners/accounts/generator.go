@@ -0,0 +1,119 @@
+package accounts
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/twitchylinux/ccr/fsmeta"
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// Generate returns a generator runner that generates the account database
+// file at the path of the resource being generated, from every user and
+// group resource in the inputs to the generator. The file generated is
+// determined by the base name of the path: passwd, shadow, group or
+// gshadow.
+func Generate() *generator {
+	return &generator{}
+}
+
+type generator struct{}
+
+func (*generator) String() string { return "accounts.generator" }
+
+func (*generator) Freeze() {}
+
+func (*generator) Truth() starlark.Bool { return true }
+
+func (*generator) Type() string { return "runner" }
+
+func (t *generator) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// classedAccounts returns the user and group resources in the inputs,
+// ordered by path.
+func classedAccounts(inputs *vts.InputSet) (users, groups []*vts.Resource) {
+	seen := make(map[*vts.Resource]bool, 64)
+	for _, resources := range inputs.ClassedResources {
+		for _, r := range resources {
+			if seen[r] {
+				continue
+			}
+			seen[r] = true
+			switch {
+			case IsUser(r):
+				users = append(users, r)
+			case IsGroup(r):
+				groups = append(groups, r)
+			}
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Path < users[j].Path })
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Path < groups[j].Path })
+	return users, groups
+}
+
+func (*generator) Run(g *vts.Generator, inputs *vts.InputSet, opts *vts.RunnerEnv) error {
+	p, err := stringAttr(inputs.Resource, "common://attrs:path", "", opts)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return errors.New("cannot generate accounts when no path was specified")
+	}
+
+	users, groups := classedAccounts(inputs)
+	accts, err := Collect(users, groups, opts)
+	if err != nil {
+		return vts.WrapWithActionTarget(err, g)
+	}
+
+	var (
+		content string
+		mode    os.FileMode = 0644
+	)
+	switch base := filepath.Base(p); base {
+	case "passwd":
+		content = accts.Passwd()
+	case "group":
+		content = accts.Group()
+	case "shadow":
+		content, mode = accts.Shadow(), 0600
+	case "gshadow":
+		content, mode = accts.GShadow(), 0600
+	default:
+		return vts.WrapWithPath(fmt.Errorf("cannot generate unknown account database %q", base), p)
+	}
+	m, err := stringAttr(inputs.Resource, "common://attrs:mode", "", opts)
+	if err != nil {
+		return err
+	}
+	if m != "" {
+		pm, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return err
+		}
+		mode = fsmeta.FileMode(uint32(pm))
+	}
+
+	if err := opts.FS.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return vts.WrapWithPath(err, filepath.Dir(p))
+	}
+	f, err := opts.FS.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return vts.WrapWithPath(err, p)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return vts.WrapWithPath(err, p)
+	}
+	return f.Close()
+}
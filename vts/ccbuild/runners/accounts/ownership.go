@@ -0,0 +1,117 @@
+package accounts
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// Paths of the attribute classes describing the ownership of a file.
+const (
+	OwnerClass      = "common://attrs:owner"
+	OwnerGroupClass = "common://attrs:group"
+)
+
+// Key against which the accounts of the universe are stored.
+const universeAccountsKey = "accounts-universe"
+
+// universeAccounts computes the accounts described by every user and group
+// resource in the universe. The accounts are computed once for each
+// environment, and stored in the universe.
+func universeAccounts(env *vts.RunnerEnv) (*Accounts, error) {
+	if env.Universe == nil {
+		return nil, fmt.Errorf("accounts cannot be resolved outside of a universe")
+	}
+	if d, ok := env.Universe.GetData(universeAccountsKey); ok {
+		return d.(*Accounts), nil
+	}
+
+	var users, groups []*vts.Resource
+	for _, t := range env.Universe.AllTargets() {
+		if r, ok := t.(*vts.Resource); ok {
+			switch {
+			case IsUser(r):
+				users = append(users, r)
+			case IsGroup(r):
+				groups = append(groups, r)
+			}
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Path < users[j].Path })
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Path < groups[j].Path })
+	accts, err := Collect(users, groups, env)
+	if err != nil {
+		return nil, err
+	}
+	env.Universe.SetData(universeAccountsKey, accts)
+	return accts, nil
+}
+
+// resolveID returns the id described by an ownership attribute, which is
+// either an id or the name of an account. The root account need not be
+// declared.
+func resolveID(v starlark.Value, class string, byName func(*Accounts, string) (int, bool), env *vts.RunnerEnv) (int, error) {
+	switch v := v.(type) {
+	case nil:
+		return 0, nil
+	case starlark.Int:
+		id, ok := v.Int64()
+		if !ok || id < 0 || id > 1<<32-2 {
+			return 0, fmt.Errorf("%s: id %v is out of range", class, v)
+		}
+		return int(id), nil
+	case starlark.String:
+		accts, err := universeAccounts(env)
+		if err != nil {
+			return 0, err
+		}
+		if id, ok := byName(accts, string(v)); ok {
+			return id, nil
+		}
+		if v == "root" {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%s: account %q does not exist", class, string(v))
+	}
+	return 0, fmt.Errorf("%s: want int or string, got %s", class, v.Type())
+}
+
+func uidByName(a *Accounts, name string) (int, bool) {
+	for _, u := range a.Users {
+		if u.Name == name {
+			return u.UID, true
+		}
+	}
+	return 0, false
+}
+
+func gidByName(a *Accounts, name string) (int, bool) {
+	for _, g := range a.Groups {
+		if g.Name == name {
+			return g.GID, true
+		}
+	}
+	return 0, false
+}
+
+// Ownership returns the uid and gid which should own the file described by
+// r. Files are owned by root unless an owner or group is specified.
+func Ownership(r *vts.Resource, env *vts.RunnerEnv) (uid, gid int, err error) {
+	owner, err := attrValue(r, OwnerClass, env)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = resolveID(owner, OwnerClass, uidByName, env); err != nil {
+		return 0, 0, err
+	}
+	group, err := attrValue(r, OwnerGroupClass, env)
+	if err != nil {
+		return 0, 0, err
+	}
+	if gid, err = resolveID(group, OwnerGroupClass, gidByName, env); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
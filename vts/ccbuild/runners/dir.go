@@ -47,17 +47,14 @@ func (*dirCheckPresent) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.Runner
 		return vts.WrapWithPath(fmt.Errorf("resource %q is not a directory", stat.Path), stat.Path)
 	}
 
-	m, err := resourceMode(r, opts)
-	if err == errNoAttr {
-		return nil
-	}
-	if err != nil {
+	switch m, err := resourceMode(r, opts); {
+	case err == errNoAttr:
+	case err != nil:
 		return err
-	}
-	if stat.Mode()&os.ModePerm != m&os.ModePerm {
+	case stat.Mode()&os.ModePerm != m&os.ModePerm:
 		return fmt.Errorf("permissions mismatch: %#o was specified but directory is %#o", m, stat.Mode()&os.ModePerm)
 	}
-	return nil
+	return checkOwnership(r, stat.Path, opts)
 }
 
 func (*dirCheckPresent) PopulatorsNeeded() []vts.InfoPopulator {
@@ -65,10 +65,7 @@ func (*unionLinkerscriptGenerator) Run(g *vts.Generator, inputs *vts.InputSet, o
 			}
 
 			ri := libRes.RuntimeInfo()
-			if ri.HasRun(info.ELFPopulator) {
-				continue
-			}
-			if err := info.ELFPopulator.Run(libRes, opts, ri); err != nil {
+			if err := ri.Populate(info.ELFPopulator, libRes, opts); err != nil {
 				err = vts.WrapWithTarget(err, libRes)
 				err = vts.WrapWithActionTarget(err, g)
 				return err
@@ -106,7 +103,7 @@ func (*unionLinkerscriptGenerator) Run(g *vts.Generator, inputs *vts.InputSet, o
 
 func resourceLdInputs(r *vts.Resource, env *vts.RunnerEnv) ([]string, error) {
 	var out []string
-	for _, attr := range r.Details {
+	for _, attr := range r.Attributes() {
 		if attr.Target == nil {
 			return nil, fmt.Errorf("unresolved target reference: %q", attr.Path)
 		}
@@ -80,7 +80,7 @@ func (*fileCheckPresent) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.Runne
 	if stat.IsDir() {
 		return vts.WrapWithPath(fmt.Errorf("resource %q is a directory", path), path)
 	}
-	return nil
+	return checkOwnership(r, path, opts)
 }
 
 func (*fileCheckPresent) PopulatorsNeeded() []vts.InfoPopulator {
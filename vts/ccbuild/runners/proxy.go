@@ -0,0 +1,236 @@
+package runners
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// targetProxy provides read-only access to a target from starlark.
+type targetProxy struct {
+	t   vts.Target
+	env *vts.RunnerEnv
+}
+
+func proxyTarget(t vts.Target, env *vts.RunnerEnv) starlark.Value {
+	if t == nil {
+		return starlark.None
+	}
+	return &targetProxy{t: t, env: env}
+}
+
+func (p *targetProxy) String() string {
+	if gt, ok := p.t.(vts.GlobalTarget); ok && gt.GlobalPath() != "" {
+		return fmt.Sprintf("%s<%s>", p.t.TargetType(), gt.GlobalPath())
+	}
+	return p.t.TargetType().String()
+}
+
+// Type implements starlark.Value.
+func (p *targetProxy) Type() string {
+	return p.t.TargetType().String()
+}
+
+// Freeze implements starlark.Value.
+func (p *targetProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *targetProxy) Truth() starlark.Bool {
+	return true
+}
+
+// Hash implements starlark.Value.
+func (p *targetProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", p.t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.HasAttrs.
+func (p *targetProxy) AttrNames() []string {
+	out := []string{"type", "name", "path"}
+	if _, ok := p.t.(vts.ClassedTarget); ok {
+		out = append(out, "class")
+	}
+	if _, ok := p.t.(vts.DetailedTarget); ok {
+		out = append(out, "attrs")
+	}
+	if _, ok := p.t.(*vts.Attr); ok {
+		out = append(out, "value")
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Attr implements starlark.HasAttrs.
+func (p *targetProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "type":
+		return starlark.String(p.t.TargetType().String()), nil
+	case "name":
+		if gt, ok := p.t.(vts.GlobalTarget); ok {
+			return starlark.String(gt.TargetName()), nil
+		}
+		return starlark.None, nil
+	case "path":
+		if gt, ok := p.t.(vts.GlobalTarget); ok {
+			return starlark.String(gt.GlobalPath()), nil
+		}
+		return starlark.None, nil
+	case "class":
+		if ct, ok := p.t.(vts.ClassedTarget); ok {
+			return proxyTarget(ct.Class().Target, p.env), nil
+		}
+	case "attrs":
+		if dt, ok := p.t.(vts.DetailedTarget); ok {
+			return p.attrs(dt)
+		}
+	case "value":
+		if a, ok := p.t.(*vts.Attr); ok {
+			return a.Value(a, p.env, proc.EvalComputedAttribute)
+		}
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+// attrs returns a dictionary mapping the name of each attribute class on
+// the target to the value of the attribute. Attributes of a repeatable class
+// are collected into a list.
+func (p *targetProxy) attrs(dt vts.DetailedTarget) (starlark.Value, error) {
+	out := starlark.NewDict(len(dt.Attributes()))
+	for _, ref := range dt.Attributes() {
+		a, ok := ref.Target.(*vts.Attr)
+		if !ok {
+			return nil, fmt.Errorf("unresolved target reference: %q", ref.Path)
+		}
+		if a.Parent.Target == nil {
+			return nil, fmt.Errorf("unresolved target reference: %q", a.Parent.Path)
+		}
+		v, err := a.Value(p.t, p.env, proc.EvalComputedAttribute)
+		if err != nil {
+			return nil, err
+		}
+		class := a.Parent.Target.(*vts.AttrClass)
+		if !class.Repeatable {
+			out.SetKey(starlark.String(class.Name), v)
+			continue
+		}
+		existing, found, _ := out.Get(starlark.String(class.Name))
+		if !found {
+			existing = starlark.NewList(nil)
+			out.SetKey(starlark.String(class.Name), existing)
+		}
+		existing.(*starlark.List).Append(v)
+	}
+	out.Freeze()
+	return out, nil
+}
+
+// fsProxy provides read-only access to a filesystem from starlark.
+type fsProxy struct {
+	fs billy.Filesystem
+}
+
+func (p *fsProxy) String() string {
+	return fmt.Sprintf("fs<%s>", p.fs.Root())
+}
+
+// Type implements starlark.Value.
+func (p *fsProxy) Type() string {
+	return "fs"
+}
+
+// Freeze implements starlark.Value.
+func (p *fsProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *fsProxy) Truth() starlark.Bool {
+	return true
+}
+
+// Hash implements starlark.Value.
+func (p *fsProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", p)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.HasAttrs.
+func (p *fsProxy) AttrNames() []string {
+	return []string{"exists", "listdir", "read", "stat"}
+}
+
+// Attr implements starlark.HasAttrs.
+func (p *fsProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "exists":
+		return p.pathBuiltin(name, func(path string) (starlark.Value, error) {
+			_, err := p.fs.Lstat(path)
+			return starlark.Bool(err == nil), nil
+		}), nil
+
+	case "read":
+		return p.pathBuiltin(name, func(path string) (starlark.Value, error) {
+			f, err := p.fs.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			d, err := ioutil.ReadAll(f)
+			if err != nil {
+				return nil, err
+			}
+			return starlark.String(d), nil
+		}), nil
+
+	case "stat":
+		return p.pathBuiltin(name, func(path string) (starlark.Value, error) {
+			s, err := p.fs.Lstat(path)
+			if err != nil {
+				return nil, err
+			}
+			return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+				"size":       starlark.MakeInt64(s.Size()),
+				"mode":       starlark.MakeUint(uint(s.Mode().Perm())),
+				"is_dir":     starlark.Bool(s.IsDir()),
+				"is_symlink": starlark.Bool(s.Mode()&os.ModeSymlink != 0),
+			}), nil
+		}), nil
+
+	case "listdir":
+		return p.pathBuiltin(name, func(path string) (starlark.Value, error) {
+			entries, err := p.fs.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			out := make([]starlark.Value, len(entries))
+			for i, e := range entries {
+				out[i] = starlark.String(e.Name())
+			}
+			return starlark.NewList(out), nil
+		}), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+func (p *fsProxy) pathBuiltin(name string, fn func(path string) (starlark.Value, error)) *starlark.Builtin {
+	return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var path string
+		if err := starlark.UnpackArgs(name, args, kwargs, "path", &path); err != nil {
+			return starlark.None, err
+		}
+		return fn(path)
+	})
+}
@@ -69,11 +69,11 @@ func (*scriptValidRunner) Run(resource *vts.Resource, chkr *vts.Checker, opts *v
 	if !ok {
 		return vts.WrapWithPath(fmt.Errorf("target representing script interpreter is %v, not a resource", t.TargetType()), interp)
 	}
-	switch c := interpR.Parent.Target.(*vts.ResourceClass).GlobalPath(); c {
-	case "common://resources:binary", "common://resources:binary_symlink", "common://resources:script":
+	switch c := interpR.Parent.Target.(*vts.ResourceClass); {
+	case c.IsA("common://resources:binary"), c.IsA("common://resources:binary_symlink"), c.IsA("common://resources:script"):
 		// Sweet, it exists, and will be validated as an executable.
 	default:
-		return vts.WrapWithPath(fmt.Errorf("script intepreter is of non-executable class %s", c), interp)
+		return vts.WrapWithPath(fmt.Errorf("script intepreter is of non-executable class %s", c.GlobalPath()), interp)
 	}
 
 	return nil
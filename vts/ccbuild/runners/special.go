@@ -0,0 +1,281 @@
+package runners
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/twitchylinux/ccr/fsmeta"
+	"github.com/twitchylinux/ccr/proc"
+	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners/accounts"
+	"go.starlark.net/starlark"
+)
+
+func resourceAttr(r *vts.Resource, class string, env *vts.RunnerEnv) (starlark.Value, error) {
+	for _, attr := range r.Attributes() {
+		if attr.Target == nil {
+			return nil, fmt.Errorf("unresolved target reference: %q", attr.Path)
+		}
+		a := attr.Target.(*vts.Attr)
+		if a.Parent.Target == nil {
+			return nil, fmt.Errorf("unresolved target reference: %q", a.Parent.Path)
+		}
+		if a.Parent.Target.(*vts.AttrClass).GlobalPath() == class {
+			return a.Value(r, env, proc.EvalComputedAttribute)
+		}
+	}
+	return nil, errNoAttr
+}
+
+// resourceSpecialFile returns the special file described by a device_node,
+// fifo or hardlink resource.
+func resourceSpecialFile(r *vts.Resource, env *vts.RunnerEnv) (fsmeta.Entry, error) {
+	p, err := resourcePath(r, env)
+	if err != nil {
+		if err == errNoAttr {
+			return fsmeta.Entry{}, errors.New("no path specified")
+		}
+		return fsmeta.Entry{}, err
+	}
+	e := fsmeta.Entry{Path: p}
+
+	class := r.Parent.Target.(*vts.ResourceClass)
+	switch {
+	case class.IsA("common://resources:hardlink"):
+		e.Type = fsmeta.TypeHardlink
+		if e.Link, err = resourceTarget(r, env); err != nil {
+			if err == errNoAttr {
+				return fsmeta.Entry{}, errors.New("no target specified")
+			}
+			return fsmeta.Entry{}, err
+		}
+		return e, nil
+
+	case class.IsA("common://resources:fifo"):
+		e.Type = fsmeta.TypeFifo
+
+	case class.IsA("common://resources:device_node"):
+		v, err := resourceAttr(r, "common://attrs/device:type", env)
+		if err != nil {
+			if err == errNoAttr {
+				return fsmeta.Entry{}, errors.New("no device type specified")
+			}
+			return fsmeta.Entry{}, err
+		}
+		s, _ := v.(starlark.String)
+		e.Type = string(s)
+		if e.Major, err = deviceNumber(r, "common://attrs/device:major", env); err != nil {
+			return fsmeta.Entry{}, err
+		}
+		if e.Minor, err = deviceNumber(r, "common://attrs/device:minor", env); err != nil {
+			return fsmeta.Entry{}, err
+		}
+
+	default:
+		return fsmeta.Entry{}, fmt.Errorf("resource of class %s is not a special file", class.Path)
+	}
+
+	switch e.Mode, err = resourceMode(r, env); {
+	case err == errNoAttr:
+		e.Mode = 0644
+	case err != nil:
+		return fsmeta.Entry{}, err
+	}
+	return e, nil
+}
+
+func deviceNumber(r *vts.Resource, class string, env *vts.RunnerEnv) (uint32, error) {
+	v, err := resourceAttr(r, class, env)
+	if err != nil {
+		if err == errNoAttr {
+			return 0, fmt.Errorf("no %s specified", class)
+		}
+		return 0, err
+	}
+	i, ok := v.(starlark.Int)
+	if !ok {
+		return 0, fmt.Errorf("bad type for device number: want int, got %T", v)
+	}
+	n, ok := i.Uint64()
+	if !ok || n > 1<<32-1 {
+		return 0, fmt.Errorf("device number %v is out of range", i)
+	}
+	return uint32(n), nil
+}
+
+// checkOwnership returns an error if the file at path is not owned by the
+// owner and group specified on the resource. Ownership is not checked if
+// neither is specified.
+func checkOwnership(r *vts.Resource, path string, opts *vts.RunnerEnv) error {
+	_, err := resourceAttr(r, accounts.OwnerClass, opts)
+	if err == errNoAttr {
+		_, err = resourceAttr(r, accounts.OwnerGroupClass, opts)
+	}
+	if err == errNoAttr {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	uid, gid, err := accounts.Ownership(r, opts)
+	if err != nil {
+		return err
+	}
+	e, err := fsmeta.Lookup(opts.FS, path)
+	if err != nil {
+		return vts.WrapWithPath(err, path)
+	}
+	if e.UID != uid || e.GID != gid {
+		return vts.WrapWithPath(fmt.Errorf("ownership mismatch: %d:%d was specified but file is owned by %d:%d", uid, gid, e.UID, e.GID), path)
+	}
+	return nil
+}
+
+// SpecialFileCheckPresent returns a runner that checks the device node,
+// FIFO or hardlink described by a resource is present. Special files which
+// could not be created are recorded in the metadata manifest instead.
+func SpecialFileCheckPresent() *specialFileCheckPresent {
+	return &specialFileCheckPresent{}
+}
+
+type specialFileCheckPresent struct{}
+
+func (*specialFileCheckPresent) Kind() vts.CheckerKind { return vts.ChkKindEachResource }
+
+func (*specialFileCheckPresent) String() string { return "special_file.present" }
+
+func (*specialFileCheckPresent) Freeze() {}
+
+func (*specialFileCheckPresent) Truth() starlark.Bool { return true }
+
+func (*specialFileCheckPresent) Type() string { return "runner" }
+
+func (t *specialFileCheckPresent) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*specialFileCheckPresent) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	want, err := resourceSpecialFile(r, opts)
+	if err != nil {
+		return err
+	}
+
+	if want.Type == fsmeta.TypeHardlink {
+		linked, err := fsmeta.Linked(opts.FS, want.Path, want.Link)
+		if err != nil {
+			return vts.WrapWithPath(err, want.Path)
+		}
+		if !linked {
+			return vts.WrapWithPath(fmt.Errorf("resource %q is not a hardlink to %q", want.Path, want.Link), want.Path)
+		}
+		return checkOwnership(r, want.Path, opts)
+	}
+
+	got, err := fsmeta.Lookup(opts.FS, want.Path)
+	if err != nil {
+		return vts.WrapWithPath(err, want.Path)
+	}
+	if got.Type != want.Type {
+		return vts.WrapWithPath(fmt.Errorf("resource %q is not a %s", want.Path, want.Type), want.Path)
+	}
+	if got.Major != want.Major || got.Minor != want.Minor {
+		return vts.WrapWithPath(fmt.Errorf("device mismatch: %d:%d was specified but device is %d:%d", want.Major, want.Minor, got.Major, got.Minor), want.Path)
+	}
+	if got.Mode != want.Mode {
+		return vts.WrapWithPath(fmt.Errorf("permissions mismatch: %#o was specified but file is %#o", want.Mode, got.Mode), want.Path)
+	}
+	return checkOwnership(r, want.Path, opts)
+}
+
+func (*specialFileCheckPresent) PopulatorsNeeded() []vts.InfoPopulator {
+	return nil
+}
+
+// GenerateSpecialFile returns a generator runner that generates device
+// nodes, FIFOs and hardlinks.
+func GenerateSpecialFile() *specialFileGenerator {
+	return &specialFileGenerator{}
+}
+
+type specialFileGenerator struct{}
+
+func (*specialFileGenerator) String() string { return "special_file.generator" }
+
+func (*specialFileGenerator) Freeze() {}
+
+func (*specialFileGenerator) Truth() starlark.Bool { return true }
+
+func (*specialFileGenerator) Type() string { return "runner" }
+
+func (t *specialFileGenerator) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*specialFileGenerator) OutputScoped() bool { return true }
+
+func (*specialFileGenerator) Run(g *vts.Generator, inputs *vts.InputSet, opts *vts.RunnerEnv) error {
+	e, err := resourceSpecialFile(inputs.Resource, opts)
+	if err != nil {
+		return err
+	}
+	if err := opts.FS.MkdirAll(filepath.Dir(e.Path), 0755); err != nil {
+		return vts.WrapWithPath(err, filepath.Dir(e.Path))
+	}
+	if e.Type == fsmeta.TypeHardlink {
+		err = fsmeta.Link(opts.FS, e.Path, e.Link)
+	} else {
+		err = fsmeta.Mknod(opts.FS, e)
+	}
+	if err != nil {
+		return vts.WrapWithPath(err, e.Path)
+	}
+	return nil
+}
+
+// DeviceAttrCheckValid returns a runner that checks attrs describing a
+// device node are valid.
+func DeviceAttrCheckValid() *deviceAttrValidRunner {
+	return &deviceAttrValidRunner{}
+}
+
+type deviceAttrValidRunner struct{}
+
+func (*deviceAttrValidRunner) Kind() vts.CheckerKind { return vts.ChkKindEachAttr }
+
+func (*deviceAttrValidRunner) String() string { return "attr.device_valid" }
+
+func (*deviceAttrValidRunner) Freeze() {}
+
+func (*deviceAttrValidRunner) Truth() starlark.Bool { return true }
+
+func (*deviceAttrValidRunner) Type() string { return "runner" }
+
+func (t *deviceAttrValidRunner) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", t)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*deviceAttrValidRunner) Run(attr *vts.Attr, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	v, err := attr.Value(chkr, opts, proc.EvalComputedAttribute)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case starlark.String:
+		if v == fsmeta.TypeChar || v == fsmeta.TypeBlock {
+			return nil
+		}
+		return fmt.Errorf("invalid device type %q: must be %q or %q", string(v), fsmeta.TypeChar, fsmeta.TypeBlock)
+	case starlark.Int:
+		if n, ok := v.Uint64(); !ok || n > 1<<32-1 {
+			return fmt.Errorf("device number %v is out of range", v)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid device attribute: %s", v.String())
+}
@@ -0,0 +1,115 @@
+package runners
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+)
+
+// StarlarkChecker returns a runner of the given kind which invokes a
+// starlark function to perform the check. The function is called with a
+// read-only proxy of the target being checked (or None for global checks),
+// and a read-only view of the filesystem. The check fails if the function
+// calls fail(), or returns a non-empty string describing the problem.
+func StarlarkChecker(kind vts.CheckerKind, fn *starlark.Function) (starlark.Value, error) {
+	base := starlarkChecker{kind: kind, fn: fn}
+	switch kind {
+	case vts.ChkKindEachResource:
+		return &starlarkResourceChecker{base}, nil
+	case vts.ChkKindEachAttr:
+		return &starlarkAttrChecker{base}, nil
+	case vts.ChkKindEachComponent:
+		return &starlarkComponentChecker{base}, nil
+	case vts.ChkKindGlobal:
+		return &starlarkGlobalChecker{base}, nil
+	}
+	return nil, fmt.Errorf("invalid checker kind: %q", kind)
+}
+
+type starlarkChecker struct {
+	kind vts.CheckerKind
+	fn   *starlark.Function
+}
+
+func (c *starlarkChecker) Kind() vts.CheckerKind { return c.kind }
+
+func (c *starlarkChecker) String() string { return fmt.Sprintf("starlark.check<%s>", c.fn.Name()) }
+
+func (*starlarkChecker) Freeze() {}
+
+func (*starlarkChecker) Truth() starlark.Bool { return true }
+
+func (*starlarkChecker) Type() string { return "runner" }
+
+func (c *starlarkChecker) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", c)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+func (*starlarkChecker) PopulatorsNeeded() []vts.InfoPopulator {
+	return nil
+}
+
+func (c *starlarkChecker) run(t vts.Target, opts *vts.RunnerEnv) error {
+	return callStarlarkRunner(c.String(), c.fn, starlark.Tuple{proxyTarget(t, opts), &fsProxy{fs: opts.FS}})
+}
+
+// callStarlarkRunner invokes a starlark function implementing a runner. An
+// error is returned if the function calls fail() or returns a non-empty
+// string.
+func callStarlarkRunner(name string, fn *starlark.Function, args starlark.Tuple) error {
+	thread := &starlark.Thread{Name: name}
+	ret, err := starlark.Call(thread, fn, args, nil)
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			return errors.New(evalErr.Msg)
+		}
+		return err
+	}
+
+	switch r := ret.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.String:
+		if r == "" {
+			return nil
+		}
+		return errors.New(string(r))
+	}
+	return fmt.Errorf("%s returned %s, want string or None", fn.Name(), ret.Type())
+}
+
+type starlarkResourceChecker struct {
+	starlarkChecker
+}
+
+func (c *starlarkResourceChecker) Run(r *vts.Resource, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	return c.run(r, opts)
+}
+
+type starlarkAttrChecker struct {
+	starlarkChecker
+}
+
+func (c *starlarkAttrChecker) Run(a *vts.Attr, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	return c.run(a, opts)
+}
+
+type starlarkComponentChecker struct {
+	starlarkChecker
+}
+
+func (c *starlarkComponentChecker) Run(comp *vts.Component, chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	return c.run(comp, opts)
+}
+
+type starlarkGlobalChecker struct {
+	starlarkChecker
+}
+
+func (c *starlarkGlobalChecker) Run(chkr *vts.Checker, opts *vts.RunnerEnv) error {
+	return c.run(nil, opts)
+}
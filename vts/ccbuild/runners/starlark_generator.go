@@ -0,0 +1,190 @@
+package runners
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/twitchylinux/ccr/vts"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	billy "gopkg.in/src-d/go-billy.v4"
+)
+
+// StarlarkGenerator returns a generator runner which invokes a starlark
+// function to generate a resource. The function is called with a struct
+// describing the inputs to the generator, and a handle which can write
+// to the output path of the resource. The source of the script defining
+// the function is hashed, so changes to it invalidate generated resources.
+func StarlarkGenerator(fn *starlark.Function, src []byte) *starlarkGenerator {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", fn.Name())
+	h.Write(src)
+	return &starlarkGenerator{fn: fn, srcHash: h.Sum(nil)}
+}
+
+type starlarkGenerator struct {
+	fn      *starlark.Function
+	srcHash []byte
+}
+
+func (g *starlarkGenerator) String() string {
+	return fmt.Sprintf("starlark.generator<%s>", g.fn.Name())
+}
+
+func (*starlarkGenerator) Freeze() {}
+
+func (*starlarkGenerator) Truth() starlark.Bool { return true }
+
+func (*starlarkGenerator) Type() string { return "runner" }
+
+func (g *starlarkGenerator) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", g)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// SourceHash returns a hash of the script which defines the generator.
+func (g *starlarkGenerator) SourceHash() []byte {
+	return g.srcHash
+}
+
+// OutputScoped returns true, as starlark generators can only write to the
+// output path of the resource they generate.
+func (g *starlarkGenerator) OutputScoped() bool {
+	return true
+}
+
+func (g *starlarkGenerator) Run(gen *vts.Generator, inputs *vts.InputSet, opts *vts.RunnerEnv) error {
+	if inputs == nil || inputs.Resource == nil {
+		return errors.New("starlark generators can only be used to generate resources")
+	}
+	p, err := resourcePath(inputs.Resource, opts)
+	if err != nil {
+		if err == errNoAttr {
+			return errors.New("cannot generate resource when no path was specified")
+		}
+		return err
+	}
+	m, err := resourceMode(inputs.Resource, opts)
+	switch {
+	case err == errNoAttr:
+		m = 0644
+	case err != nil:
+		return err
+	}
+
+	out := &outputProxy{fs: opts.FS, path: p, mode: m}
+	return callStarlarkRunner(g.String(), g.fn, starlark.Tuple{proxyInputSet(inputs, opts), out})
+}
+
+func proxyInputSet(inputs *vts.InputSet, env *vts.RunnerEnv) starlark.Value {
+	directs := make([]starlark.Value, len(inputs.Directs))
+	for i, d := range inputs.Directs {
+		directs[i] = proxyTarget(d, env)
+	}
+	classes := make([]*vts.ResourceClass, 0, len(inputs.ClassedResources))
+	for class := range inputs.ClassedResources {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i].GlobalPath() < classes[j].GlobalPath()
+	})
+	classed := starlark.NewDict(len(classes))
+	for _, class := range classes {
+		resources := inputs.ClassedResources[class]
+		rs := make([]starlark.Value, len(resources))
+		for i, r := range resources {
+			rs[i] = proxyTarget(r, env)
+		}
+		classed.SetKey(starlark.String(class.GlobalPath()), starlark.NewList(rs))
+	}
+
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"resource": proxyTarget(inputs.Resource, env),
+		"directs":  starlark.NewList(directs),
+		"classed":  classed,
+	})
+}
+
+// outputProxy provides starlark generators the means to write the
+// resource they are generating.
+type outputProxy struct {
+	fs   billy.Filesystem
+	path string
+	mode os.FileMode
+}
+
+func (p *outputProxy) String() string {
+	return fmt.Sprintf("output<%s>", p.path)
+}
+
+// Type implements starlark.Value.
+func (p *outputProxy) Type() string {
+	return "output"
+}
+
+// Freeze implements starlark.Value.
+func (p *outputProxy) Freeze() {
+}
+
+// Truth implements starlark.Value.
+func (p *outputProxy) Truth() starlark.Bool {
+	return true
+}
+
+// Hash implements starlark.Value.
+func (p *outputProxy) Hash() (uint32, error) {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%p", p)))
+	return uint32(uint32(h[0]) + uint32(h[1])<<8 + uint32(h[2])<<16 + uint32(h[3])<<24), nil
+}
+
+// AttrNames implements starlark.HasAttrs.
+func (p *outputProxy) AttrNames() []string {
+	return []string{"mode", "path", "write"}
+}
+
+// Attr implements starlark.HasAttrs.
+func (p *outputProxy) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "path":
+		return starlark.String(p.path), nil
+	case "mode":
+		return starlark.MakeUint(uint(p.mode)), nil
+	case "write":
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var content string
+			if err := starlark.UnpackArgs(name, args, kwargs, "content", &content); err != nil {
+				return starlark.None, err
+			}
+			return starlark.None, p.write(content)
+		}), nil
+	}
+
+	return nil, starlark.NoSuchAttrError(
+		fmt.Sprintf("%s has no .%s attribute", p.Type(), name))
+}
+
+func (p *outputProxy) write(content string) error {
+	if err := p.fs.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return vts.WrapWithPath(err, p.path)
+	}
+	f, err := p.fs.OpenFile(p.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, p.mode)
+	if err != nil {
+		return vts.WrapWithPath(err, p.path)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		f.Close()
+		return vts.WrapWithPath(err, p.path)
+	}
+	if err := f.Close(); err != nil {
+		return vts.WrapWithPath(err, p.path)
+	}
+	// The requested mode may have been masked by the umask.
+	if c, canChmod := p.fs.(billy.Change); canChmod {
+		return c.Chmod(p.path, p.mode)
+	}
+	return nil
+}
@@ -28,7 +28,7 @@ func getPathResourceCollection(key, classPath string, opts *vts.RunnerEnv) (map[
 	pathResources := make(map[string]*vts.Resource, 64)
 	for _, target := range opts.Universe.AllTargets() {
 		if r, isResource := target.(*vts.Resource); isResource {
-			if parent := r.Parent.Target.(*vts.ResourceClass); parent.GlobalPath() == classPath {
+			if parent := r.Parent.Target.(*vts.ResourceClass); parent.IsA(classPath) {
 				path, err := resourcePath(r, opts)
 				if err != nil {
 					return nil, vts.WrapWithTarget(err, r)
@@ -72,10 +72,8 @@ func (c *globalChecker) Run(chkr *vts.Checker, opts *vts.RunnerEnv) error {
 
 func (*globalChecker) elfInfo(r *vts.Resource, opts *vts.RunnerEnv) (elf.FileHeader, info.ELFLinkDeps,
 	[]info.ELFSym, string, error) {
-	if !r.RuntimeInfo().HasRun(info.ELFPopulator) {
-		if err := info.ELFPopulator.Run(r, opts, r.RuntimeInfo()); err != nil {
-			return elf.FileHeader{}, info.ELFLinkDeps{}, nil, "", err
-		}
+	if err := r.RuntimeInfo().Populate(info.ELFPopulator, r, opts); err != nil {
+		return elf.FileHeader{}, info.ELFLinkDeps{}, nil, "", err
 	}
 	d, err := r.RuntimeInfo().Get(info.ELFPopulator, info.ELFHeader)
 	if err != nil {
@@ -110,8 +108,8 @@ func (c *globalChecker) checkInterp(interp string, opts *vts.RunnerEnv) error {
 	if !ok {
 		return vts.WrapWithTarget(fmt.Errorf("interpreter %q is a %s, not a resource", interp, t.TargetType().String()), t)
 	}
-	if p := r.Parent.Target.(*vts.ResourceClass).Path; p != "common://resources:sys_library" && p != "common://resources:sys_library_symlink" {
-		return vts.WrapWithTarget(fmt.Errorf("interpreter %q is of class %q, need sys_library*", interp, p), t)
+	if c := r.Parent.Target.(*vts.ResourceClass); !c.IsA("common://resources:sys_library") && !c.IsA("common://resources:sys_library_symlink") {
+		return vts.WrapWithTarget(fmt.Errorf("interpreter %q is of class %q, need sys_library*", interp, c.Path), t)
 	}
 	// Because it was of class sys_library, the ELF checkers on sys_library would
 	// have validated the correctness of the ELF markup. As such we are done.
@@ -200,8 +198,8 @@ func (c *globalChecker) libsInDir(dir string, opts *vts.RunnerEnv) (map[string]*
 	for _, target := range opts.Universe.AllTargets() {
 		if r, isResource := target.(*vts.Resource); isResource {
 			parent := r.Parent.Target.(*vts.ResourceClass)
-			switch parent.GlobalPath() {
-			case "common://resources:support_files":
+			switch {
+			case parent.IsA("common://resources:support_files"):
 				path, err := resourcePath(r, opts)
 				if err != nil {
 					return nil, vts.WrapWithTarget(err, r)
@@ -234,7 +232,7 @@ func (c *globalChecker) libsInDir(dir string, opts *vts.RunnerEnv) (map[string]*
 						}
 					}
 				}
-			case "common://resources:sys_library", "common://resources:sys_library_symlink":
+			case parent.IsA("common://resources:sys_library"), parent.IsA("common://resources:sys_library_symlink"):
 				path, err := resourcePath(r, opts)
 				if err != nil {
 					return nil, vts.WrapWithTarget(err, r)
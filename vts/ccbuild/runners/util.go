@@ -6,6 +6,7 @@ import (
 	"os"
 	"strconv"
 
+	"github.com/twitchylinux/ccr/fsmeta"
 	"github.com/twitchylinux/ccr/proc"
 	"github.com/twitchylinux/ccr/vts"
 	"go.starlark.net/starlark"
@@ -14,7 +15,7 @@ import (
 var errNoAttr = errors.New("no relevant attribute")
 
 func resourcePath(r *vts.Resource, env *vts.RunnerEnv) (string, error) {
-	for _, attr := range r.Details {
+	for _, attr := range r.Attributes() {
 		if attr.Target == nil {
 			return "", fmt.Errorf("unresolved target reference: %q", attr.Path)
 		}
@@ -38,7 +39,7 @@ func resourcePath(r *vts.Resource, env *vts.RunnerEnv) (string, error) {
 }
 
 func resourceMode(r *vts.Resource, env *vts.RunnerEnv) (os.FileMode, error) {
-	for _, attr := range r.Details {
+	for _, attr := range r.Attributes() {
 		if attr.Target == nil {
 			return 0, fmt.Errorf("unresolved target reference: %q", attr.Path)
 		}
@@ -52,8 +53,8 @@ func resourceMode(r *vts.Resource, env *vts.RunnerEnv) (os.FileMode, error) {
 				return 0, err
 			}
 			if s, ok := v.(starlark.String); ok {
-				m, err := strconv.ParseInt(string(s), 8, 64)
-				return os.FileMode(m), err
+				m, err := strconv.ParseUint(string(s), 8, 32)
+				return fsmeta.FileMode(uint32(m)), err
 			}
 			return 0, fmt.Errorf("bad type for path: want string, got %T", v)
 		}
@@ -61,7 +62,7 @@ func resourceMode(r *vts.Resource, env *vts.RunnerEnv) (os.FileMode, error) {
 
 	// Special case: system library directories may omit the mode parameter.
 	// TODO: Unspecial-case this, perhaps with a new default_mode attribute / attribute-class?
-	if r.Parent.Target.(*vts.ResourceClass).GlobalPath() == "common://resources:library_dir" {
+	if r.Parent.Target.(*vts.ResourceClass).IsA("common://resources:library_dir") {
 		return 0755, nil
 	}
 
@@ -69,7 +70,7 @@ func resourceMode(r *vts.Resource, env *vts.RunnerEnv) (os.FileMode, error) {
 }
 
 func resourceTarget(r *vts.Resource, env *vts.RunnerEnv) (string, error) {
-	for _, attr := range r.Details {
+	for _, attr := range r.Attributes() {
 		if attr.Target == nil {
 			return "", fmt.Errorf("unresolved target reference: %q", attr.Path)
 		}
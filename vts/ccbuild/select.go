@@ -0,0 +1,185 @@
+package ccbuild
+
+import (
+	"fmt"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// defaultCondition is the select() condition which matches when no other
+// condition does.
+const defaultCondition = "//conditions:default"
+
+// selection is the result of a select() expression. It holds the value
+// chosen by the configuration, along with the configuration values which
+// were consulted to choose it.
+type selection struct {
+	value starlark.Value
+	keys  map[string]string
+}
+
+func (s *selection) String() string {
+	return fmt.Sprintf("select<%s>", s.value.String())
+}
+
+// Type implements starlark.Value.
+func (s *selection) Type() string {
+	return "select"
+}
+
+// Freeze implements starlark.Value.
+func (s *selection) Freeze() {
+	s.value.Freeze()
+}
+
+// Truth implements starlark.Value.
+func (s *selection) Truth() starlark.Bool {
+	return s.value.Truth()
+}
+
+// Hash implements starlark.Value.
+func (s *selection) Hash() (uint32, error) {
+	return 0, fmt.Errorf("unhashable type: %s", s.Type())
+}
+
+// Binary implements starlark.HasBinary, so selections can be concatenated
+// with other values, such as deps = [":a"] + select({...}).
+func (s *selection) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	if op != syntax.PLUS {
+		return nil, nil
+	}
+	keys := make(map[string]string, len(s.keys))
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	if other, ok := y.(*selection); ok {
+		for k, v := range other.keys {
+			keys[k] = v
+		}
+		y = other.value
+	}
+
+	l, r := s.value, y
+	if side == starlark.Right {
+		l, r = y, s.value
+	}
+	v, err := starlark.Binary(op, l, r)
+	if err != nil {
+		return nil, err
+	}
+	return &selection{value: v, keys: keys}, nil
+}
+
+// unwrapSelect returns the value chosen by a select() expression, recording
+// the configuration values which determined it in conf if non-nil. Values
+// which are not the result of select() are returned as-is.
+func unwrapSelect(v starlark.Value, conf map[string]string) starlark.Value {
+	s, ok := v.(*selection)
+	if !ok {
+		return v
+	}
+	if conf != nil {
+		for k, v := range s.keys {
+			conf[k] = v
+		}
+	}
+	return s.value
+}
+
+// listArg unwraps a list argument which may be, or contain, the result of
+// select() expressions.
+func listArg(argName string, v starlark.Value, conf map[string]string) (*starlark.List, error) {
+	if v == nil {
+		return nil, nil
+	}
+	l, ok := unwrapSelect(v, conf).(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want list", argName, unwrapSelect(v, nil).Type())
+	}
+
+	out := make([]starlark.Value, l.Len())
+	for i := range out {
+		out[i] = unwrapSelect(l.Index(i), conf)
+	}
+	return starlark.NewList(out), nil
+}
+
+// dictArg unwraps a dict argument whose values may be the result of
+// select() expressions.
+func dictArg(argName string, v starlark.Value, conf map[string]string) (*starlark.Dict, error) {
+	if v == nil {
+		return nil, nil
+	}
+	d, ok := unwrapSelect(v, conf).(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want dict", argName, unwrapSelect(v, nil).Type())
+	}
+
+	out := starlark.NewDict(d.Len())
+	for _, kv := range d.Items() {
+		if err := out.SetKey(kv[0], unwrapSelect(kv[1], conf)); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func makeSelect(s *Script) *starlark.Builtin {
+	return starlark.NewBuiltin("select", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		s := s.caller(thread)
+		var conditions *starlark.Dict
+		if err := starlark.UnpackArgs("select", args, kwargs, "conditions", &conditions); err != nil {
+			return starlark.None, err
+		}
+
+		var (
+			out          = &selection{keys: make(map[string]string, conditions.Len())}
+			matched      string
+			defaultValue starlark.Value
+		)
+		for _, kv := range conditions.Items() {
+			cond, ok := kv[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("invalid condition: cannot use type %T as condition", kv[0])
+			}
+			if cond == defaultCondition {
+				defaultValue = kv[1]
+				continue
+			}
+			spl := strings.SplitN(string(cond), "=", 2)
+			if len(spl) != 2 || spl[0] == "" {
+				return nil, fmt.Errorf("invalid condition %q: want key=value or %s", string(cond), defaultCondition)
+			}
+
+			val := s.config[spl[0]]
+			out.keys[spl[0]] = val
+			if val != spl[1] {
+				continue
+			}
+			if matched != "" {
+				return nil, fmt.Errorf("select is ambiguous: conditions %q and %q both match", matched, string(cond))
+			}
+			matched, out.value = string(cond), kv[1]
+		}
+
+		if out.value == nil {
+			if defaultValue == nil {
+				return nil, fmt.Errorf("no condition in select matches the configuration, and %s was not specified", defaultCondition)
+			}
+			out.value = defaultValue
+		}
+		return out, nil
+	})
+}
+
+// makeConfig returns a struct exposing the configuration values to scripts.
+func makeConfig(s *Script) starlark.Value {
+	d := make(starlark.StringDict, len(s.config))
+	for k, v := range s.config {
+		d[k] = starlark.String(v)
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, d)
+}
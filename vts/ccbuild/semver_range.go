@@ -0,0 +1,126 @@
+package ccbuild
+
+import (
+	"fmt"
+	"strings"
+
+	semver "github.com/blang/semver/v4"
+)
+
+// rangeOps lists the operators which may prefix a version in a range
+// expression. Longer operators are listed before their prefixes.
+var rangeOps = []string{">=", "<=", "!=", "==", ">", "<", "=", "!", "~", "^"}
+
+// isSemverRange returns true if s is a range expression, rather than a
+// single version.
+func isSemverRange(s string) bool {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "||") || strings.ContainsAny(s, " \t") {
+		return true
+	}
+	for _, op := range rangeOps {
+		if strings.HasPrefix(s, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSemverRange parses a range expression, such as ">=1.2 <2.0 || ^3.1".
+// Comparisons separated by whitespace must all be satisfied, and groups of
+// comparisons separated by || are alternatives. Versions are parsed
+// tolerantly, so may omit their minor or patch numbers.
+//
+// In addition to the usual comparison operators, ~1.2.3 matches versions
+// with the same major and minor numbers which are at least 1.2.3, and ^1.2.3
+// matches versions with the same leftmost non-zero number which are at
+// least 1.2.3. A version with no operator must match exactly.
+func parseSemverRange(s string) (semver.Range, error) {
+	var out semver.Range
+	for _, group := range strings.Split(s, "||") {
+		fields := strings.Fields(group)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid semver range %q: empty alternative", s)
+		}
+
+		var groupRange semver.Range
+		for i := 0; i < len(fields); i++ {
+			cmp := fields[i]
+			// Allow whitespace between an operator and its version.
+			if isRangeOp(cmp) && i+1 < len(fields) {
+				i++
+				cmp += fields[i]
+			}
+			r, err := parseSemverComparison(cmp)
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver range %q: %v", s, err)
+			}
+			if groupRange == nil {
+				groupRange = r
+			} else {
+				groupRange = groupRange.AND(r)
+			}
+		}
+
+		if out == nil {
+			out = groupRange
+		} else {
+			out = out.OR(groupRange)
+		}
+	}
+	return out, nil
+}
+
+func isRangeOp(s string) bool {
+	for _, op := range rangeOps {
+		if s == op {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSemverComparison parses a single version, prefixed by an operator.
+func parseSemverComparison(s string) (semver.Range, error) {
+	op := ""
+	for _, o := range rangeOps {
+		if strings.HasPrefix(s, o) {
+			op = o
+			break
+		}
+	}
+	vs := strings.TrimPrefix(s, op)
+	v, err := semver.ParseTolerant(vs)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %v", s, err)
+	}
+
+	switch op {
+	case "", "=", "==":
+		return func(x semver.Version) bool { return x.EQ(v) }, nil
+	case "!", "!=":
+		return func(x semver.Version) bool { return x.NE(v) }, nil
+	case ">":
+		return func(x semver.Version) bool { return x.GT(v) }, nil
+	case ">=":
+		return func(x semver.Version) bool { return x.GTE(v) }, nil
+	case "<":
+		return func(x semver.Version) bool { return x.LT(v) }, nil
+	case "<=":
+		return func(x semver.Version) bool { return x.LTE(v) }, nil
+	}
+
+	// Tilde and caret ranges depend on how many numbers were specified.
+	numbers := len(strings.Split(strings.SplitN(strings.SplitN(strings.TrimPrefix(vs, "v"), "-", 2)[0], "+", 2)[0], "."))
+	upper := semver.Version{Major: v.Major + 1}
+	switch {
+	case op == "~" && numbers > 1:
+		upper = semver.Version{Major: v.Major, Minor: v.Minor + 1}
+	case op == "^" && v.Major == 0 && numbers > 1:
+		upper = semver.Version{Minor: v.Minor + 1}
+		if v.Minor == 0 && numbers > 2 {
+			upper = semver.Version{Patch: v.Patch + 1}
+		}
+	}
+	return func(x semver.Version) bool { return x.GTE(v) && x.LT(upper) }, nil
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"github.com/twitchylinux/ccr/vts"
 	"github.com/twitchylinux/ccr/vts/ccbuild/runners"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners/accounts"
 )
 
 var ArchClass = &vts.AttrClass{
@@ -130,3 +131,67 @@ var InputLibraryClass = &vts.AttrClass{
 		}},
 	},
 }
+
+// OwnerClass is the class for the user which owns a file, specified by
+// uid or by name. Files are owned by root if no owner is specified.
+var OwnerClass = &vts.AttrClass{
+	Path: accounts.OwnerClass,
+	Name: "owner",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: accounts.IDCheckValid(true),
+		}},
+	},
+}
+
+// OwnerGroupClass is the class for the group which owns a file, specified
+// by gid or by name. Files are owned by the root group if no group is
+// specified.
+var OwnerGroupClass = &vts.AttrClass{
+	Path: accounts.OwnerGroupClass,
+	Name: "group",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: accounts.IDCheckValid(true),
+		}},
+	},
+}
+
+// DeviceTypeClass is the class for the type of a device node, either
+// "char" or "block".
+var DeviceTypeClass = &vts.AttrClass{
+	Path: "common://attrs/device:type",
+	Name: "type",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: runners.DeviceAttrCheckValid(),
+		}},
+	},
+}
+
+// DeviceMajorClass is the class for the major number of a device node.
+var DeviceMajorClass = &vts.AttrClass{
+	Path: "common://attrs/device:major",
+	Name: "major",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: runners.DeviceAttrCheckValid(),
+		}},
+	},
+}
+
+// DeviceMinorClass is the class for the minor number of a device node.
+var DeviceMinorClass = &vts.AttrClass{
+	Path: "common://attrs/device:minor",
+	Name: "minor",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: runners.DeviceAttrCheckValid(),
+		}},
+	},
+}
@@ -48,6 +48,13 @@ var SymlinkPresentChecker = &vts.Checker{
 	Runner: runners.SymlinkCheckPresent(),
 }
 
+var SpecialFilePresentChecker = &vts.Checker{
+	Path:   "common://checks:special_file_present",
+	Name:   "special_file_present",
+	Kind:   vts.ChkKindEachResource,
+	Runner: runners.SpecialFileCheckPresent(),
+}
+
 var NoopComponentChecker = &vts.Checker{
 	Path:   "common://checks:noop",
 	Name:   "noop",
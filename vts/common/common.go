@@ -35,10 +35,18 @@ var commonTargets = map[string]vts.Target{
 	"common://attrs/arch:arm":               archDir["arm"],
 	"common://attrs/arch:arm64":             archDir["arm64"],
 	"common://attrs:ldscript_input_library": InputLibraryClass,
+	"common://attrs:owner":                  OwnerClass,
+	"common://attrs:group":                  OwnerGroupClass,
+	"common://attrs/device:type":            DeviceTypeClass,
+	"common://attrs/device:major":           DeviceMajorClass,
+	"common://attrs/device:minor":           DeviceMinorClass,
 
 	"common://resources:dir":                      DirResourceClass,
 	"common://resources:file":                     FileResourceClass,
 	"common://resources:symlink":                  SymlinkResourceClass,
+	"common://resources:hardlink":                 HardlinkResourceClass,
+	"common://resources:fifo":                     FifoResourceClass,
+	"common://resources:device_node":              DeviceNodeResourceClass,
 	"common://resources:virtual":                  VirtualResourceClass,
 	"common://resources:binary":                   BinResourceClass,
 	"common://resources:binary_symlink":           BinLinkResourceClass,
@@ -57,11 +65,21 @@ var commonTargets = map[string]vts.Target{
 
 	"common://resources/accounts:user":  UserResourceClass,
 	"common://resources/accounts:group": GroupResourceClass,
+	"common://attrs/accounts:name":      AccountNameClass,
+	"common://attrs/accounts:uid":       UIDClass,
+	"common://attrs/accounts:gid":       GIDClass,
+	"common://attrs/accounts:home":      HomeClass,
+	"common://attrs/accounts:shell":     ShellClass,
+	"common://attrs/accounts:members":   MembersClass,
+	"common://checks/accounts:user":     UserChecker,
+	"common://checks/accounts:group":    GroupChecker,
+	"common://generators:accounts":      AccountsGenerator,
 
 	"common://checks:noop":                    NoopComponentChecker,
 	"common://checks:file_present":            FilePresentChecker,
 	"common://checks:dir_present":             DirPresentChecker,
 	"common://checks:symlink_present":         SymlinkPresentChecker,
+	"common://checks:special_file_present":    SpecialFilePresentChecker,
 	"common://checks/formats:json_valid":      JSONResourceChecker,
 	"common://checks/executable:binary":       BinaryResourceChecker,
 	"common://checks/executable:script":       ScriptResourceChecker,
@@ -76,6 +94,9 @@ var commonTargets = map[string]vts.Target{
 
 	"common://generators:dir":                       DirGenerator,
 	"common://generators:symlink":                   SymlinkGenerator,
+	"common://generators:hardlink":                  HardlinkGenerator,
+	"common://generators:fifo":                      FifoGenerator,
+	"common://generators:device_node":               DeviceNodeGenerator,
 	"common://generators:syslib_union_linkerscript": SysLibUnionLinkerscript,
 
 	"common://toolchains:go":                GoToolchain,
@@ -1,12 +1,113 @@
 package common
 
-import "github.com/twitchylinux/ccr/vts"
+import (
+	"github.com/twitchylinux/ccr/vts"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners"
+	"github.com/twitchylinux/ccr/vts/ccbuild/runners/accounts"
+)
 
 var UserResourceClass = &vts.ResourceClass{
-	Path: "common://resources/accounts:user",
+	Path: accounts.UserClass,
 	Name: "user",
+	Checks: []vts.TargetRef{
+		{Target: UserChecker},
+	},
 }
 var GroupResourceClass = &vts.ResourceClass{
-	Path: "common://resources/accounts:group",
+	Path: accounts.GroupClass,
 	Name: "group",
+	Checks: []vts.TargetRef{
+		{Target: GroupChecker},
+	},
+}
+
+// AccountNameClass is the class for the name of a user or group, if it
+// differs from the name of the resource.
+var AccountNameClass = &vts.AttrClass{
+	Path: accounts.NameClass,
+	Name: "name",
+}
+
+// UIDClass is the class for the uid of a user. Users which do not specify
+// a uid are allocated one.
+var UIDClass = &vts.AttrClass{
+	Path: accounts.UIDClass,
+	Name: "uid",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: accounts.IDCheckValid(false),
+		}},
+	},
+}
+
+// GIDClass is the class for the gid of a group, or the primary group of a
+// user. Users may instead name their primary group.
+var GIDClass = &vts.AttrClass{
+	Path: accounts.GIDClass,
+	Name: "gid",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: accounts.IDCheckValid(true),
+		}},
+	},
+}
+
+// HomeClass is the class for the home directory of a user.
+var HomeClass = &vts.AttrClass{
+	Path: accounts.HomeClass,
+	Name: "home",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: runners.PathCheckValid(),
+		}},
+	},
+}
+
+// ShellClass is the class for the login shell of a user.
+var ShellClass = &vts.AttrClass{
+	Path: accounts.ShellClass,
+	Name: "shell",
+	Checks: []vts.TargetRef{
+		{Target: &vts.Checker{
+			Kind:   vts.ChkKindEachAttr,
+			Runner: runners.PathCheckValid(),
+		}},
+	},
+}
+
+// MembersClass is the class for the name of a user which is a member of a
+// group.
+var MembersClass = &vts.AttrClass{
+	Path:       accounts.MembersClass,
+	Name:       "members",
+	Repeatable: true,
+}
+
+var UserChecker = &vts.Checker{
+	Path:   "common://checks/accounts:user",
+	Name:   "user",
+	Kind:   vts.ChkKindEachResource,
+	Runner: accounts.UserCheckValid(),
+}
+
+var GroupChecker = &vts.Checker{
+	Path:   "common://checks/accounts:group",
+	Name:   "group",
+	Kind:   vts.ChkKindEachResource,
+	Runner: accounts.GroupCheckValid(),
+}
+
+// AccountsGenerator generates passwd, shadow, group and gshadow files from
+// every user and group in the universe.
+var AccountsGenerator = &vts.Generator{
+	Path: "common://generators:accounts",
+	Name: "accounts",
+	Inputs: []vts.TargetRef{
+		{Target: UserResourceClass},
+		{Target: GroupResourceClass},
+	},
+	Runner: accounts.Generate(),
 }
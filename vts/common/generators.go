@@ -17,6 +17,24 @@ var SymlinkGenerator = &vts.Generator{
 	Runner: runners.GenerateSymlink(),
 }
 
+var DeviceNodeGenerator = &vts.Generator{
+	Path:   "common://generators:device_node",
+	Name:   "device_node",
+	Runner: runners.GenerateSpecialFile(),
+}
+
+var FifoGenerator = &vts.Generator{
+	Path:   "common://generators:fifo",
+	Name:   "fifo",
+	Runner: runners.GenerateSpecialFile(),
+}
+
+var HardlinkGenerator = &vts.Generator{
+	Path:   "common://generators:hardlink",
+	Name:   "hardlink",
+	Runner: runners.GenerateSpecialFile(),
+}
+
 var SysLibUnionLinkerscript = &vts.Generator{
 	Path:   "common://generators:syslib_union_linkerscript",
 	Name:   "syslib_union_linkerscript",
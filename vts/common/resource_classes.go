@@ -35,6 +35,28 @@ var SymlinkResourceClass = &vts.ResourceClass{
 		{Target: SymlinkPresentChecker},
 	},
 }
+
+var DeviceNodeResourceClass = &vts.ResourceClass{
+	Path: "common://resources:device_node",
+	Name: "device_node",
+	Checks: []vts.TargetRef{
+		{Target: SpecialFilePresentChecker},
+	},
+}
+var FifoResourceClass = &vts.ResourceClass{
+	Path: "common://resources:fifo",
+	Name: "fifo",
+	Checks: []vts.TargetRef{
+		{Target: SpecialFilePresentChecker},
+	},
+}
+var HardlinkResourceClass = &vts.ResourceClass{
+	Path: "common://resources:hardlink",
+	Name: "hardlink",
+	Checks: []vts.TargetRef{
+		{Target: SpecialFilePresentChecker},
+	},
+}
 var BinResourceClass = &vts.ResourceClass{
 	Path: "common://resources:binary",
 	Name: "binary",
@@ -0,0 +1,71 @@
+package vts
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// localFileDigest is a memoised content hash of a local file, along with
+// the stat information used to determine if the memoised value is stale.
+type localFileDigest struct {
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	sum     []byte
+}
+
+var (
+	localDigestsLock sync.Mutex
+	localDigests     = make(map[string]localFileDigest, 64)
+)
+
+// hashLocalFile returns a hash covering the contents and executable bits of
+// the file at path. Only the executable bits are considered, as other
+// permission bits vary with the umask of whoever checked out the tree.
+// Digests are memoised for the lifetime of the process, so large inputs
+// referenced by many targets are only read once.
+func hashLocalFile(path string) ([]byte, error) {
+	path = filepath.Clean(path)
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsDir() {
+		return nil, fmt.Errorf("%s: expected file, got directory", path)
+	}
+
+	localDigestsLock.Lock()
+	d, ok := localDigests[path]
+	localDigestsLock.Unlock()
+	if ok && d.size == s.Size() && d.modTime.Equal(s.ModTime()) && d.mode == s.Mode() {
+		return d.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "exec: %#o\n", s.Mode()&0111)
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	d = localFileDigest{
+		size:    s.Size(),
+		modTime: s.ModTime(),
+		mode:    s.Mode(),
+		sum:     hash.Sum(nil),
+	}
+
+	localDigestsLock.Lock()
+	localDigests[path] = d
+	localDigestsLock.Unlock()
+	return d.sum, nil
+}
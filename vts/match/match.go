@@ -15,6 +15,15 @@ import (
 type MatchRule struct {
 	P   glob.Glob
 	Out OutputMapper
+	// Pattern is the glob P was compiled from, if known.
+	Pattern string
+}
+
+func (r MatchRule) String() string {
+	if r.Pattern != "" {
+		return r.Pattern
+	}
+	return fmt.Sprint(r.P)
 }
 
 // FilenameRules contains a set of filename matching/rewriting rules.
@@ -34,12 +43,19 @@ func (m *FilenameRules) RollupHash() []byte {
 // Match returns the new filename, or the empty string if no match
 // is found.
 func (m *FilenameRules) Match(artifactPath string) string {
-	for _, r := range m.Rules {
+	out, _ := m.Matching(artifactPath)
+	return out
+}
+
+// Matching returns the new filename and the index of the rule which
+// matched, or the empty string and -1 if no match is found.
+func (m *FilenameRules) Matching(artifactPath string) (string, int) {
+	for i, r := range m.Rules {
 		if r.P.Match(artifactPath) {
-			return r.Out.Map(artifactPath)
+			return r.Out.Map(artifactPath), i
 		}
 	}
-	return ""
+	return "", -1
 }
 
 func BuildFilenameMappers(output *starlark.Dict) (*FilenameRules, error) {
@@ -69,7 +85,8 @@ func BuildFilenameMappers(output *starlark.Dict) (*FilenameRules, error) {
 		default:
 			return nil, fmt.Errorf("key %q: value is %T, need string or mapper", k, v)
 		}
-		out.Rules[i] = MatchRule{P: glob.MustCompile(strings.TrimPrefix(k, "/")), Out: mapper}
+		pattern := strings.TrimPrefix(k, "/")
+		out.Rules[i] = MatchRule{P: glob.MustCompile(pattern), Out: mapper, Pattern: pattern}
 	}
 	return out, nil
 }
@@ -3,6 +3,9 @@ package vts
 import (
 	"bytes"
 	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/gobwas/glob"
@@ -87,8 +90,8 @@ func TestRollupHash(t *testing.T) {
 		},
 		{
 			"puesdo",
-			&Puesdo{Name: "users", Path: "//systems:users_list", Kind: FileRef, SHA256: "EDA1AF8391DAAE70543512FBEE98185454B26FE136479CA5CEDFA5AD13FB4F2F"},
-			mustDecodeHex(t, "1D1DB3BC7625A100018B4C58803C16B528D5650878C85BCDB6BECF6BEF20E05D"),
+			&Puesdo{Name: "users", Path: "testdata/users.txt", Kind: FileRef, SHA256: "EDA1AF8391DAAE70543512FBEE98185454B26FE136479CA5CEDFA5AD13FB4F2F"},
+			mustDecodeHex(t, "80DB46E4F8C2005EA70D312C5168841550D3D2E3A9267678BA4EC2F5A0763A49"),
 			"",
 		},
 		{
@@ -120,9 +123,9 @@ func TestRollupHash(t *testing.T) {
 		},
 		{
 			"build",
-			&Build{Name: "users", Path: "//systems:users_list",
+			&Build{Name: "users", Path: "//systems:users_list", ContractDir: "testdata",
 				Steps: []*BuildStep{
-					{Kind: StepUnpackGz, Path: "go1.11.4.tar.gz", ToPath: "src"},
+					{Kind: StepUnpackGz, Path: "src.tar.gz", ToPath: "src"},
 					{Kind: StepConfigure, Dir: "/tmp/aaa", NamedArgs: map[string]string{
 						"with-prefix": "/usr",
 						"something":   "else",
@@ -136,14 +139,20 @@ func TestRollupHash(t *testing.T) {
 						{P: glob.MustCompile("*.go"), Out: &match.StripPrefixOutputMapper{Prefix: "/usr/local/go/src"}},
 					},
 				},
-				PatchIns: map[string]TargetRef{"/cool.txt": TargetRef{Target: &Puesdo{Kind: FileRef, Path: "cool.txt"}}},
+				PatchIns: map[string]TargetRef{"/cool.txt": TargetRef{Target: &Puesdo{Kind: FileRef, Path: "cool.txt", ContractPath: "testdata/BUILD.ccr"}}},
 				Env: map[string]starlark.Value{
 					"yeet": starlark.String("123"),
 					"noot": starlark.String(":)"),
 				},
 				ProducesRootFS: true,
 			},
-			mustDecodeHex(t, "9BC1CCB739FBF1CE36284EEB41FB912A2799A85CE4C2D3520323499E671BBFAE"),
+			mustDecodeHex(t, "F7FFC98F902D2DB03EBE2DD61038F484269A330F8555854D6EEEAF0BB88D8681"),
+			"",
+		},
+		{
+			"build with network",
+			&Build{Name: "fetch", Path: "//bootstrap:fetch", AllowNetwork: true},
+			mustDecodeHex(t, "5CC6A6D4176E674F8DA425892CDA7D2BD6C693156D6C6E2D648A96A6FD3F1BB4"),
 			"",
 		},
 	}
@@ -163,3 +172,49 @@ func TestRollupHash(t *testing.T) {
 		})
 	}
 }
+
+func TestRollupHashLocalFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fPath := filepath.Join(tmp, "input.txt")
+
+	target := &Puesdo{Name: "input", Path: "input.txt", Kind: FileRef, ContractPath: filepath.Join(tmp, "BUILD.ccr")}
+	hash := func() []byte {
+		t.Helper()
+		h, err := target.RollupHash(nil, nil)
+		if err != nil {
+			t.Fatalf("RollupHash() failed: %v", err)
+		}
+		return h
+	}
+
+	if _, err := target.RollupHash(nil, nil); err == nil {
+		t.Error("RollupHash() on missing file succeeded, want error")
+	}
+
+	if err := ioutil.WriteFile(fPath, []byte("first"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	first := hash()
+	if again := hash(); !bytes.Equal(first, again) {
+		t.Errorf("hash changed without modification: %X != %X", again, first)
+	}
+
+	if err := ioutil.WriteFile(fPath, []byte("second"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	second := hash()
+	if bytes.Equal(first, second) {
+		t.Errorf("hash = %X after content change, want different", second)
+	}
+
+	if err := os.Chmod(fPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if h := hash(); bytes.Equal(h, second) {
+		t.Errorf("hash = %X after mode change, want different", h)
+	}
+}
@@ -11,6 +11,9 @@ type RunnerEnv struct {
 	Dir      string
 	FS       billy.Filesystem
 	Universe UniverseResolver
+	// PopulateEnv, if set, returns the environment populators should use to
+	// gather information about the given target, in place of this one.
+	PopulateEnv func(Target) *RunnerEnv
 }
 
 type Console interface {
@@ -59,6 +62,20 @@ type generateRunner interface {
 	Run(*Generator, *InputSet, *RunnerEnv) error
 }
 
+// sourcedRunner is implemented by runners whose behavior is defined by
+// a script, rather than by ccr itself.
+type sourcedRunner interface {
+	SourceHash() []byte
+}
+
+// UniverseDependentRunner is implemented by checker runners whose outcome
+// depends on targets other than the one checked, such as runners which
+// compare against every target in the universe. Their results are never
+// cached, as the cache only tracks changes to the checked target.
+type UniverseDependentRunner interface {
+	UniverseDependent() bool
+}
+
 // InputSet describes the inputs to a generator.
 type InputSet struct {
 	Resource *Resource
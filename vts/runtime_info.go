@@ -1,6 +1,9 @@
 package vts
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 // InfoPopulator describes something that gathers information about
 // a target, for later use in checkers or generators.
@@ -10,13 +13,34 @@ type InfoPopulator interface {
 }
 
 // RuntimeInfo tracks information about a target which is generated at runtime,
-// and consumed by runners.
+// and consumed by runners. It is safe for concurrent use.
 type RuntimeInfo struct {
 	Data map[InfoPopulator]map[string]interface{}
 }
 
+// infoMu guards the Data of every RuntimeInfo, and inflight. It is held
+// only briefly, so is shared rather than embedded in each RuntimeInfo,
+// which are compared and copied as plain values.
+var (
+	infoMu   sync.Mutex
+	inflight = map[inflightKey]*populateCall{}
+)
+
+type inflightKey struct {
+	info *RuntimeInfo
+	ip   InfoPopulator
+}
+
+// populateCall tracks a run of a populator which is in progress.
+type populateCall struct {
+	done chan struct{}
+	err  error
+}
+
 // Get returns the data populated from the populator with the given key.
 func (i *RuntimeInfo) Get(ip InfoPopulator, key string) (interface{}, error) {
+	infoMu.Lock()
+	defer infoMu.Unlock()
 	if i.Data == nil {
 		return nil, fmt.Errorf("runtime info %q.%s is not present", ip.Name(), key)
 	}
@@ -32,6 +56,8 @@ func (i *RuntimeInfo) Get(ip InfoPopulator, key string) (interface{}, error) {
 
 // Set is called by populators to provide information about a target.
 func (i *RuntimeInfo) Set(ip InfoPopulator, key string, data interface{}) {
+	infoMu.Lock()
+	defer infoMu.Unlock()
 	if i.Data == nil {
 		i.Data = make(map[InfoPopulator]map[string]interface{})
 	}
@@ -42,9 +68,42 @@ func (i *RuntimeInfo) Set(ip InfoPopulator, key string, data interface{}) {
 }
 
 func (i *RuntimeInfo) HasRun(ip InfoPopulator) bool {
+	infoMu.Lock()
+	defer infoMu.Unlock()
 	if i.Data == nil {
 		return false
 	}
 	_, run := i.Data[ip]
 	return run
 }
+
+// Populate runs the populator against the target, unless it has already
+// run. Concurrent callers wait for a single run of the populator, and all
+// observe its error. A populator which failed is run again by later callers.
+func (i *RuntimeInfo) Populate(ip InfoPopulator, t Target, env *RunnerEnv) error {
+	if env != nil && env.PopulateEnv != nil {
+		env = env.PopulateEnv(t)
+	}
+	k := inflightKey{i, ip}
+	infoMu.Lock()
+	if _, populated := i.Data[ip]; populated {
+		infoMu.Unlock()
+		return nil
+	}
+	if c, running := inflight[k]; running {
+		infoMu.Unlock()
+		<-c.done
+		return c.err
+	}
+	c := &populateCall{done: make(chan struct{})}
+	inflight[k] = c
+	infoMu.Unlock()
+
+	c.err = ip.Run(t, env, i)
+
+	infoMu.Lock()
+	delete(inflight, k)
+	infoMu.Unlock()
+	close(c.done)
+	return c.err
+}
@@ -0,0 +1,73 @@
+package vts
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type countingPopulator struct {
+	runs int32
+	err  error
+}
+
+func (p *countingPopulator) Name() string { return "counting" }
+
+func (p *countingPopulator) Run(t Target, env *RunnerEnv, info *RuntimeInfo) error {
+	atomic.AddInt32(&p.runs, 1)
+	if p.err != nil {
+		return p.err
+	}
+	info.Set(p, "key", "value")
+	return nil
+}
+
+func TestRuntimeInfoPopulate(t *testing.T) {
+	tcs := []struct {
+		name string
+		err  error
+	}{
+		{name: "success"},
+		{name: "failure", err: errors.New("populator failed")},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				r   Resource
+				pop = &countingPopulator{err: tc.err}
+				wg  sync.WaitGroup
+			)
+			for i := 0; i < 16; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := r.RuntimeInfo().Populate(pop, &r, nil); err != tc.err {
+						t.Errorf("Populate() returned %v, want %v", err, tc.err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if tc.err != nil {
+				// Failures are not memoized, so the populator is run again.
+				runs := pop.runs
+				if err := r.RuntimeInfo().Populate(pop, &r, nil); err != tc.err {
+					t.Errorf("Populate() returned %v, want %v", err, tc.err)
+				}
+				if pop.runs != runs+1 {
+					t.Errorf("populator ran %d times after failing, want %d", pop.runs, runs+1)
+				}
+				return
+			}
+
+			if pop.runs != 1 {
+				t.Errorf("populator ran %d times, want 1", pop.runs)
+			}
+			if v, err := r.RuntimeInfo().Get(pop, "key"); err != nil || v != "value" {
+				t.Errorf("Get() = %v, %v, want %q", v, err, "value")
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"sync"
 
 	"go.starlark.net/starlark"
 )
@@ -16,6 +17,7 @@ type Attr struct {
 	Pos    *DefPosition
 
 	Val       starlark.Value
+	cacheMu   sync.Mutex
 	cachedVal attrCachedVal
 }
 
@@ -97,6 +99,8 @@ type computeEval func(attr *Attr, target Target, runInfo *ComputedValue, env *Ru
 func (t *Attr) Value(parent Target, env *RunnerEnv, eval computeEval) (starlark.Value, error) {
 	if cv, isComputed := t.Val.(*ComputedValue); isComputed {
 		// attempt to use cached value.
+		t.cacheMu.Lock()
+		defer t.cacheMu.Unlock()
 		if t.cachedVal.parent == parent && t.cachedVal.val != nil {
 			return t.cachedVal.val, nil
 		}
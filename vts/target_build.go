@@ -4,13 +4,14 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"sort"
 
 	"github.com/twitchylinux/ccr/vts/match"
 	"go.starlark.net/starlark"
 )
 
-const buildOutputHashCacheBuster = 3
+const buildOutputHashCacheBuster = 4
 
 // Build is a target representing a build.
 type Build struct {
@@ -28,6 +29,14 @@ type Build struct {
 	Env            map[string]starlark.Value
 	UsingRoot      *TargetRef
 	ProducesRootFS bool
+	// StrictOutputs fails the build if any output rule matches no files.
+	StrictOutputs bool
+	// AllowNetwork permits build steps to access the network of the host,
+	// which is otherwise isolated.
+	AllowNetwork bool
+	// Config holds the configuration values which determined the build,
+	// by way of select() expressions in its definition.
+	Config map[string]string
 
 	cachedRollupHash []byte
 }
@@ -135,6 +144,14 @@ func (t *Build) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error) {
 			return nil, err
 		}
 		hash.Write(h)
+
+		if p := step.LocalInput(); p != "" {
+			h, err := hashLocalFile(filepath.Join(t.ContractDir, p))
+			if err != nil {
+				return nil, WrapWithPosition(WrapWithPath(WrapWithTarget(err, t), p), step.Pos)
+			}
+			hash.Write(h)
+		}
 	}
 
 	if t.PatchIns != nil {
@@ -182,9 +199,26 @@ func (t *Build) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error) {
 		}
 	}
 
+	if len(t.Config) > 0 {
+		ordered := make([]string, 0, len(t.Config))
+		for k := range t.Config {
+			ordered = append(ordered, k)
+		}
+		sort.Strings(ordered)
+		for _, k := range ordered {
+			fmt.Fprintf(hash, "Config[%s] = %q\n", k, t.Config[k])
+		}
+	}
+
 	if t.ProducesRootFS {
 		fmt.Fprintln(hash, "RootFS = true")
 	}
+	if t.StrictOutputs {
+		fmt.Fprintln(hash, "StrictOutputs = true")
+	}
+	if t.AllowNetwork {
+		fmt.Fprintln(hash, "AllowNetwork = true")
+	}
 	if t.UsingRoot != nil {
 		rt, isHashable := t.UsingRoot.Target.(ReproducibleTarget)
 		if !isHashable {
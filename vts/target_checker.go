@@ -122,11 +122,7 @@ func (t *Checker) RunResource(r *Resource, opts *RunnerEnv) error {
 	}
 
 	for _, pop := range ac.PopulatorsNeeded() {
-		ri := r.RuntimeInfo()
-		if ri.HasRun(pop) {
-			continue
-		}
-		if err := pop.Run(r, opts, ri); err != nil {
+		if err := r.RuntimeInfo().Populate(pop, r, opts); err != nil {
 			err = WrapWithTarget(err, r)
 			err = WrapWithActionTarget(err, t)
 			return err
@@ -164,10 +160,7 @@ func (t *Checker) RunCheckedTarget(tgt CheckedTarget, opts *RunnerEnv) error {
 		r := t.Runner.(eachComponentRunner)
 
 		for _, pop := range r.PopulatorsNeeded() {
-			if c.RuntimeInfo().HasRun(pop) {
-				continue
-			}
-			if err := pop.Run(c, opts, c.RuntimeInfo()); err != nil {
+			if err := c.RuntimeInfo().Populate(pop, c, opts); err != nil {
 				err = WrapWithTarget(err, tgt)
 				return err
 			}
@@ -15,6 +15,17 @@ type Component struct {
 	Deps    []TargetRef
 	Checks  []TargetRef
 
+	// Provides lists the virtual targets this component can provide.
+	Provides []TargetRef
+	// Conflicts lists the targets which must not be present in the same
+	// system as this component. Conflicts are referenced by path, and are
+	// only resolved if something else requires them.
+	Conflicts []TargetRef
+	// Providers selects the component which should provide each virtual
+	// target, keyed by the path of the virtual. Selections only apply if
+	// the component is the root of the universe.
+	Providers map[string]TargetRef
+
 	Info RuntimeInfo
 }
 
@@ -50,6 +61,16 @@ func (t *Component) Attributes() []TargetRef {
 	return t.Details
 }
 
+// ProvidesVirtual returns true if the component can provide v.
+func (t *Component) ProvidesVirtual(v *Virtual) bool {
+	for _, p := range t.Provides {
+		if p.Target == v || (p.Target == nil && p.Path == v.Path) {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Component) RuntimeInfo() *RuntimeInfo {
 	return &t.Info
 }
@@ -66,6 +87,24 @@ func (t *Component) Validate() error {
 			return fmt.Errorf("chks[%d]: cannot specify constraints here", i)
 		}
 	}
+	for i, p := range t.Provides {
+		if _, ok := p.Target.(*Virtual); !ok {
+			return fmt.Errorf("provides[%d] is type %T, but must be virtual", i, p.Target)
+		}
+		if len(p.Constraints) > 0 {
+			return fmt.Errorf("provides[%d]: cannot specify constraints here", i)
+		}
+	}
+	for i, c := range t.Conflicts {
+		if len(c.Constraints) > 0 {
+			return fmt.Errorf("conflicts[%d]: cannot specify constraints here", i)
+		}
+	}
+	for v, p := range t.Providers {
+		if len(p.Constraints) > 0 {
+			return fmt.Errorf("providers[%q]: cannot specify constraints here", v)
+		}
+	}
 	return nil
 }
 
@@ -86,6 +125,9 @@ func (t *Component) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error)
 		}
 		fmt.Fprint(hash, v)
 	}
+	for _, p := range t.Provides {
+		fmt.Fprintf(hash, "provides %q\n", p.Target.(*Virtual).Path)
+	}
 	for _, dep := range t.Deps {
 		rt, isHashable := dep.Target.(ReproducibleTarget)
 		if !isHashable {
@@ -91,6 +91,9 @@ func (t *Generator) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error)
 	if t.Runner != nil {
 		fmt.Fprintf(hash, "%v\n", t.Runner.String())
 	}
+	if sr, isSourced := t.Runner.(sourcedRunner); isSourced {
+		hash.Write(sr.SourceHash())
+	}
 
 	for _, dep := range t.Inputs {
 		rt, isHashable := dep.Target.(ReproducibleTarget)
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"path/filepath"
 
 	"go.starlark.net/starlark"
 )
@@ -61,6 +62,12 @@ func (t *Puesdo) Attributes() []TargetRef {
 	return t.Details
 }
 
+// LocalPath returns the path of the referenced file on the local filesystem,
+// resolved relative to the directory containing the contract.
+func (t *Puesdo) LocalPath() string {
+	return filepath.Join(filepath.Dir(t.ContractPath), t.Path)
+}
+
 func (t *Puesdo) Validate() error {
 	if err := validateDetails(t.Details); err != nil {
 		return err
@@ -114,6 +121,15 @@ func (t *Puesdo) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error) {
 	fmt.Fprintf(hash, "%q\n%q\n%q\n", t.Kind, t.Name, t.TargetPath)
 	fmt.Fprintf(hash, "%q\n%q\n%q\n", t.Path, t.URL, t.SHA256)
 	fmt.Fprintf(hash, "%v\n", t.Host)
+	// The contents of local files are hashed, so edits to the file
+	// invalidate anything built from it.
+	if t.Kind == FileRef {
+		h, err := hashLocalFile(t.LocalPath())
+		if err != nil {
+			return nil, WrapWithPath(WrapWithTarget(err, t), t.Path)
+		}
+		hash.Write(h)
+	}
 
 	for _, attr := range t.Details {
 		a := attr.Target.(*Attr)
@@ -54,8 +54,29 @@ func (t *Resource) Checkers() []TargetRef {
 	return t.Checks
 }
 
+// Attributes returns the details of the resource, followed by any default
+// details of its class which it does not override.
 func (t *Resource) Attributes() []TargetRef {
-	return t.Details
+	class, ok := t.Parent.Target.(*ResourceClass)
+	if !ok {
+		return t.Details
+	}
+	defaults := class.InheritedDetails()
+	if len(defaults) == 0 {
+		return t.Details
+	}
+
+	overridden := make(map[string]bool, len(t.Details))
+	for _, d := range t.Details {
+		overridden[detailClassPath(d)] = true
+	}
+	out := append(make([]TargetRef, 0, len(t.Details)+len(defaults)), t.Details...)
+	for _, d := range defaults {
+		if !overridden[detailClassPath(d)] {
+			out = append(out, d)
+		}
+	}
+	return out
 }
 
 func (t *Resource) Src() *TargetRef {
@@ -78,7 +99,7 @@ func (t *Resource) Validate() error {
 		return errors.New("cannot specify constraints on a parent target")
 	}
 
-	if err := validateDetails(t.Details); err != nil {
+	if err := validateDetails(t.Attributes()); err != nil {
 		return err
 	}
 	if err := validateDeps(t.Deps, false); err != nil {
@@ -96,7 +117,7 @@ func (t *Resource) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error)
 	hash := sha256.New()
 	fmt.Fprintf(hash, "%q\n%q\n%q\n", t.Path, t.Name, t.Parent.Target.(*ResourceClass).GlobalPath())
 
-	for _, attr := range t.Details {
+	for _, attr := range t.Attributes() {
 		a := attr.Target.(*Attr)
 		fmt.Fprintf(hash, "%q\n%q\n%q\n", a.Name, a.Path, a.Parent.Target.(*AttrClass).GlobalPath())
 		// TODO: Hash attribute class.
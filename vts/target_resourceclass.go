@@ -1,6 +1,9 @@
 package vts
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 // PopulateStrategy describes how files should be read from the source
 // and written into the output filesystem, when a resource is being
@@ -40,9 +43,17 @@ type ResourceClass struct {
 	Name string
 	Pos  *DefPosition
 
+	// Parent is the class this class extends, if any. A class inherits
+	// the dependencies, checks, populate strategy and default details of
+	// its ancestors.
+	Parent *TargetRef
+
 	PopStrategy PopulateStrategy
 	Deps        []TargetRef
 	Checks      []TargetRef
+	// DefaultDetails are attributes inherited by instances of the class,
+	// unless the instance specifies an attribute of the same class.
+	DefaultDetails []TargetRef
 }
 
 func (t *ResourceClass) DefinedAt() *DefPosition {
@@ -65,29 +76,137 @@ func (t *ResourceClass) TargetName() string {
 	return t.Name
 }
 
+// Superclass returns the class this class extends, or nil if it does not
+// extend a class or the parent is not resolved.
+func (t *ResourceClass) Superclass() *ResourceClass {
+	if t.Parent == nil {
+		return nil
+	}
+	p, _ := t.Parent.Target.(*ResourceClass)
+	return p
+}
+
+// Lineage returns the class followed by each of its ancestors, nearest
+// first.
+func (t *ResourceClass) Lineage() []*ResourceClass {
+	out := []*ResourceClass{t}
+	for c := t.Superclass(); c != nil; c = c.Superclass() {
+		for _, seen := range out {
+			if seen == c {
+				return out // Cycles are reported by Validate.
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// IsA returns true if the class or any of its ancestors has the given path.
+func (t *ResourceClass) IsA(path string) bool {
+	for _, c := range t.Lineage() {
+		if c.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Dependencies returns the dependencies of the class, including those
+// inherited from its ancestors.
 func (t *ResourceClass) Dependencies() []TargetRef {
-	return t.Deps
+	lineage := t.Lineage()
+	if len(lineage) == 1 {
+		return t.Deps
+	}
+	var out []TargetRef
+	for i := len(lineage) - 1; i >= 0; i-- {
+		out = append(out, lineage[i].Deps...)
+	}
+	return out
 }
 
 func (t *ResourceClass) Checkers() []TargetRef {
 	return t.Checks
 }
 
+// InheritedCheckers returns the checks which apply to instances of the
+// class, starting with those of the most distant ancestor.
+func (t *ResourceClass) InheritedCheckers() []TargetRef {
+	lineage := t.Lineage()
+	if len(lineage) == 1 {
+		return t.Checks
+	}
+	var out []TargetRef
+	for i := len(lineage) - 1; i >= 0; i-- {
+		out = append(out, lineage[i].Checks...)
+	}
+	return out
+}
+
+// InheritedDetails returns the default details which apply to instances of
+// the class. Defaults of the nearest class take precedence over those of
+// an ancestor with the same attribute class.
+func (t *ResourceClass) InheritedDetails() []TargetRef {
+	var (
+		out  []TargetRef
+		seen = map[string]bool{}
+	)
+	for _, c := range t.Lineage() {
+		var classes []string
+		for _, d := range c.DefaultDetails {
+			ac := detailClassPath(d)
+			if ac != "" && seen[ac] {
+				continue
+			}
+			out = append(out, d)
+			classes = append(classes, ac)
+		}
+		for _, ac := range classes {
+			seen[ac] = true
+		}
+	}
+	return out
+}
+
 func (t *ResourceClass) Validate() error {
+	if t.Parent != nil {
+		if t.Parent.Target != nil {
+			if _, ok := t.Parent.Target.(*ResourceClass); !ok {
+				return fmt.Errorf("parent is type %T, but must be resource_class", t.Parent.Target)
+			}
+		}
+		if len(t.Parent.Constraints) > 0 {
+			return errors.New("cannot specify constraints on a parent target")
+		}
+		lineage := t.Lineage()
+		if last := lineage[len(lineage)-1]; last.Superclass() != nil {
+			return fmt.Errorf("cyclic inheritance via %q", last.Superclass().Path)
+		}
+	}
 	if err := validateDeps(t.Deps, false); err != nil {
 		return err
 	}
+	if err := validateDetails(t.DefaultDetails); err != nil {
+		return fmt.Errorf("default details: %v", err)
+	}
 	return nil
 }
 
+// PopulateStrategy returns the populate strategy of the class, or that of
+// its nearest ancestor which declares one.
 func (t *ResourceClass) PopulateStrategy() PopulateStrategy {
-	return t.PopStrategy
+	for _, c := range t.Lineage() {
+		if c.PopStrategy != 0 {
+			return c.PopStrategy
+		}
+	}
+	return 0
 }
 
 // RunCheckers runs checkers on a resource, in the context of this
-// resource class.
+// resource class and its ancestors.
 func (t *ResourceClass) RunCheckers(r *Resource, opts *RunnerEnv) error {
-	for i, c := range t.Checks {
+	for i, c := range t.InheritedCheckers() {
 		if c.Target == nil {
 			return fmt.Errorf("check[%d] is not resolved: %q", i, c.Path)
 		}
@@ -0,0 +1,87 @@
+package vts
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Virtual is a target representing a capability, such as a shell at
+// /bin/sh, which may be provided by any of several components. A virtual
+// depends on the single component selected to provide it when the
+// universe is built.
+type Virtual struct {
+	Path string
+	Name string
+	Pos  *DefPosition
+
+	// Default is the component which provides the virtual if no provider
+	// is otherwise selected.
+	Default *TargetRef
+	// Provider is the component selected to provide the virtual. It is
+	// nil until the virtual is resolved.
+	Provider *TargetRef
+}
+
+func (t *Virtual) DefinedAt() *DefPosition {
+	return t.Pos
+}
+
+func (t *Virtual) IsClassTarget() bool {
+	return false
+}
+
+func (t *Virtual) TargetType() TargetType {
+	return TargetVirtual
+}
+
+func (t *Virtual) GlobalPath() string {
+	return t.Path
+}
+
+func (t *Virtual) TargetName() string {
+	return t.Name
+}
+
+// Dependencies returns the selected provider, if the virtual is resolved.
+func (t *Virtual) Dependencies() []TargetRef {
+	if t.Provider == nil {
+		return nil
+	}
+	return []TargetRef{*t.Provider}
+}
+
+func (t *Virtual) Validate() error {
+	if t.Default != nil && len(t.Default.Constraints) > 0 {
+		return errors.New("default: constraints are not valid here")
+	}
+	if t.Provider != nil {
+		c, ok := t.Provider.Target.(*Component)
+		if !ok {
+			return fmt.Errorf("provider is type %T, but must be component", t.Provider.Target)
+		}
+		if !c.ProvidesVirtual(t) {
+			return fmt.Errorf("provider %q does not provide %q", c.Path, t.Path)
+		}
+	}
+	return nil
+}
+
+func (t *Virtual) RollupHash(env *RunnerEnv, eval computeEval) ([]byte, error) {
+	if t.Provider == nil {
+		return nil, WrapWithTarget(errors.New("cannot compute rollup hash of unresolved virtual"), t)
+	}
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%q\n%q\n", t.Path, t.Name)
+
+	rt, isHashable := t.Provider.Target.(ReproducibleTarget)
+	if !isHashable {
+		return nil, WrapWithTarget(fmt.Errorf("cannot compute rollup hash on non-reproducible target of type %T", t.Provider.Target), t.Provider.Target)
+	}
+	h, err := rt.RollupHash(env, eval)
+	if err != nil {
+		return nil, err
+	}
+	hash.Write(h)
+	return hash.Sum(nil), nil
+}
@@ -36,6 +36,9 @@ const (
 	TargetBuild
 	// TargetSieve represents a union/filter of other generator targets.
 	TargetSieve
+	// TargetVirtual represents a capability which may be provided by
+	// one of several components.
+	TargetVirtual
 )
 
 func (t TargetType) String() string {
@@ -62,11 +65,24 @@ func (t TargetType) String() string {
 		return "build"
 	case TargetSieve:
 		return "sieve"
+	case TargetVirtual:
+		return "virtual"
 	default:
 		return fmt.Sprintf("TargetType<%d>", int(t))
 	}
 }
 
+// ParseTargetType returns the TargetType with the given name, as returned
+// by TargetType.String().
+func ParseTargetType(name string) (TargetType, error) {
+	for t := TargetComponent; t <= TargetVirtual; t++ {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return TargetEmpty, fmt.Errorf("unknown target type %q", name)
+}
+
 // Target describes a node, such as a resource or component, that
 // participates in the the web of nodes declaring a system.
 type Target interface {
@@ -168,7 +184,8 @@ func validateDeps(deps []TargetRef, allowConstraints bool) error {
 		_, component := dep.Target.(*Component)
 		_, resource := dep.Target.(*Resource)
 		_, toolchain := dep.Target.(*Toolchain)
-		if !component && !resource && !toolchain {
+		_, virtual := dep.Target.(*Virtual)
+		if !component && !resource && !toolchain && !virtual {
 			return fmt.Errorf("deps[%d] is type %T, but must be resource or component", i, dep.Target)
 		}
 
@@ -199,6 +216,21 @@ func validateDetails(details []TargetRef) error {
 	return nil
 }
 
+// detailClassPath returns the path of the class of an attribute, or the
+// empty string if it is not known.
+func detailClassPath(deet TargetRef) string {
+	a, ok := deet.Target.(*Attr)
+	if !ok {
+		return ""
+	}
+	if a.Parent.Target != nil {
+		if gt, ok := a.Parent.Target.(GlobalTarget); ok {
+			return gt.GlobalPath()
+		}
+	}
+	return a.Parent.Path
+}
+
 func validateSource(src TargetRef, parent Target) error {
 	if src.Path == "" && src.Target == nil {
 		return errors.New("source defined but no target or path present in reference")
@@ -229,4 +261,8 @@ func validateSource(src TargetRef, parent Target) error {
 type DefPosition struct {
 	Path  string
 	Frame starlark.CallFrame
+	// Via lists the frames within loaded modules through which the target
+	// was defined, outermost first. It is empty when the target was
+	// defined directly by the file at Path.
+	Via []starlark.CallFrame
 }